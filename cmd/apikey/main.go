@@ -2,30 +2,77 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/passionde/user-segmentation-service/config"
+	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/repo"
 	"github.com/passionde/user-segmentation-service/internal/service"
+	"github.com/passionde/user-segmentation-service/pkg/jwtauth"
 	"github.com/passionde/user-segmentation-service/pkg/postgres"
 	"github.com/passionde/user-segmentation-service/pkg/secure"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const configPath = "config/config.yaml"
 
+const usage = `Usage:
+  cli generate [-tenant <id>] [-label <name>] [-expires <duration>] [-read <namespace,...>] [-write <namespace,...>]
+               [-rate <requests per minute>] [-burst <requests>] [scope,...]
+  cli exist <KeyApi>
+  cli list
+  cli describe <id>
+  cli revoke <id>
+  cli rotate [-grace <duration>] [-expires <duration>] <id>
+  cli tenants
+  cli create-tenant <name>
+  cli jwks [-kid <id>] <public-key.pem>`
+
 func main() {
 	// Args
 	if len(os.Args) < 2 {
-		log.Fatal("Usage: cli exist <KeyApi>|generate")
+		log.Fatal(usage)
 	}
 
 	cmd := os.Args[1]
-	if cmd != "exist" && cmd != "generate" {
-		log.Fatal("Usage: cli exist <KeyApi>|generate")
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	tenant := flags.Int("tenant", entity.DefaultTenantID, "tenant whose data the key accesses")
+	label := flags.String("label", "", "human readable name of the key")
+	expires := flags.Duration("expires", 0, "lifetime of the key, 0 for a key that does not expire")
+	read := flags.String("read", entity.NamespaceAll, "segment namespaces the key may read")
+	write := flags.String("write", entity.NamespaceAll, "segment namespaces the key may change")
+	grace := flags.Duration("grace", 24*time.Hour, "time the old key keeps working after rotation")
+	kid := flags.String("kid", "local", "key id written to the JWKS")
+	rate := flags.Int("rate", 0, "requests per minute, 0 for the limit of the key scopes")
+	burst := flags.Int("burst", 0, "requests allowed at once, 0 for the rate of the key or the limit of its scopes")
+
+	switch cmd {
+	case "generate", "exist", "list", "describe", "revoke", "rotate", "tenants", "create-tenant", "jwks":
+	default:
+		log.Fatal(usage)
+	}
+	_ = flags.Parse(os.Args[2:])
+	args := flags.Args()
+
+	switch {
+	case cmd == "generate" && len(args) > 1,
+		(cmd == "list" || cmd == "tenants") && len(args) != 0,
+		(cmd == "exist" || cmd == "describe" || cmd == "revoke" || cmd == "rotate" || cmd == "create-tenant" || cmd == "jwks") && len(args) != 1:
+		log.Fatal(usage)
 	}
-	if cmd == "exist" && len(os.Args) != 3 {
-		log.Fatal("Usage: cli exist <KeyApi>")
+
+	// the JWKS is built from a local key pair and does not need the database
+	if cmd == "jwks" {
+		jwksCommand(args[0], *kid)
+		return
 	}
 
 	// Config
@@ -46,32 +93,220 @@ func main() {
 	// Services
 	deps := service.ServicesDependencies{
 		Repos:     repositories,
-		APISecure: secure.NewSecure(cfg.Secure.Salt),
+		APISecure: secure.NewSecure(cfg.Secure.Salt, cfg.Secure.Secret),
 	}
 	services := service.NewServices(deps)
 
 	// Handlers
 	switch cmd {
 	case "exist":
-		existCommand(services, os.Args[2])
+		existCommand(services, args[0])
 	case "generate":
-		generateCommand(services)
+		// a key without explicit scopes has full access, as keys had before scopes existed
+		scopes := []string{entity.ScopeAdmin}
+		if len(args) == 1 {
+			scopes = strings.Split(args[0], ",")
+		}
+		generateCommand(services, service.GenerateTokenInput{
+			TenantID:        *tenant,
+			Label:           *label,
+			Scopes:          scopes,
+			ReadNamespaces:  splitList(*read),
+			WriteNamespaces: splitList(*write),
+			ExpiresIn:       *expires,
+			RateLimit:       optionalInt(*rate),
+			RateBurst:       optionalInt(*burst),
+		})
+	case "list":
+		listCommand(services)
+	case "describe":
+		describeCommand(services, parseID(args[0]))
+	case "revoke":
+		revokeCommand(services, parseID(args[0]))
+	case "rotate":
+		rotateCommand(services, service.RotateTokenInput{ID: parseID(args[0]), Grace: *grace, ExpiresIn: *expires})
+	case "tenants":
+		tenantsCommand(services)
+	case "create-tenant":
+		createTenantCommand(services, args[0])
+	}
+}
+
+func splitList(arg string) []string {
+	if arg == "" {
+		return []string{}
 	}
+	return strings.Split(arg, ",")
+}
+
+// optionalInt treats the zero value of a flag as not set
+func optionalInt(value int) *int {
+	if value == 0 {
+		return nil
+	}
+	return &value
+}
+
+func parseID(arg string) int {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		log.Fatalf("Invalid key ID <%s>", arg)
+	}
+	return id
 }
 
 func existCommand(services *service.Services, token string) {
-	id, err := services.Auth.TokenExist(context.TODO(), token)
+	key, err := services.Auth.TokenExist(context.TODO(), token)
 	if err != nil {
-		fmt.Printf("ApiKey <%s> - does not exist\n", token)
+		if errors.Is(err, service.ErrKeyNotFound) {
+			fmt.Printf("ApiKey <%s> - does not exist\n", token)
+			return
+		}
+		fmt.Printf("ApiKey <%s> - %s\n", token, err)
 		return
 	}
-	fmt.Printf("ApiKey <%s> - exist, ID = %d\n", token, id)
+	fmt.Printf("ApiKey <%s> - exist, ID = %d, tenant = %d, scopes = %s\n", token, key.ID, key.TenantID, strings.Join(key.Scopes, ","))
+}
+
+func generateCommand(services *service.Services, input service.GenerateTokenInput) {
+	_, key, err := services.Auth.GenerateToken(context.TODO(), input)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidScope) {
+			log.Fatalf("%s, available scopes: %s", err, strings.Join(entity.Scopes, ","))
+		}
+		log.Fatal(err)
+	}
+	fmt.Printf("Api key: Bearer %s\n", key)
+}
+
+func listCommand(services *service.Services) {
+	keys, err := services.Auth.ListTokens(context.TODO())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, key := range keys {
+		fmt.Printf("%d\t%d\t%s\t%s\t%s\t%s\n", key.ID, key.TenantID, keyStatus(key), formatPrefix(key), key.Label, strings.Join(key.Scopes, ","))
+	}
+}
+
+func describeCommand(services *service.Services, id int) {
+	key, err := services.Auth.GetToken(context.TODO(), service.TokenInput{ID: id})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("ID:         %d\n", key.ID)
+	fmt.Printf("Tenant:     %d\n", key.TenantID)
+	fmt.Printf("Prefix:     %s\n", formatPrefix(key))
+	fmt.Printf("Hash:       v%d\n", key.HashVersion)
+	fmt.Printf("Label:      %s\n", key.Label)
+	fmt.Printf("Status:     %s\n", keyStatus(key))
+	fmt.Printf("Scopes:     %s\n", strings.Join(key.Scopes, ","))
+	fmt.Printf("Read:       %s\n", strings.Join(key.ReadNamespaces, ","))
+	fmt.Printf("Write:      %s\n", strings.Join(key.WriteNamespaces, ","))
+	fmt.Printf("Rate limit: %s\n", formatRateLimit(key))
+	fmt.Printf("Created:    %s\n", key.CreatedAt.Format(time.RFC3339))
+	fmt.Printf("Expires:    %s\n", formatTime(key.ExpiresAt))
+	fmt.Printf("Revoked:    %s\n", formatTime(key.RevokedAt))
+	fmt.Printf("Last used:  %s\n", formatTime(key.LastUsedAt))
+}
+
+func revokeCommand(services *service.Services, id int) {
+	if err := services.Auth.RevokeToken(context.TODO(), service.TokenInput{ID: id}); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("ApiKey ID = %d - revoked\n", id)
 }
 
-func generateCommand(services *service.Services) {
-	_, key, err := services.Auth.GenerateToken(context.TODO())
+func rotateCommand(services *service.Services, input service.RotateTokenInput) {
+	id, key, err := services.Auth.RotateToken(context.TODO(), input)
 	if err != nil {
 		log.Fatal(err)
 	}
 	fmt.Printf("Api key: Bearer %s\n", key)
+	fmt.Printf("New ID = %d, ApiKey ID = %d expires in %s\n", id, input.ID, input.Grace)
+}
+
+func tenantsCommand(services *service.Services) {
+	tenants, err := services.Tenant.ListTenants(context.TODO())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, tenant := range tenants {
+		fmt.Printf("%d\t%s\t%s\n", tenant.TenantID, tenant.Name, tenant.CreatedAt.Format(time.RFC3339))
+	}
+}
+
+func createTenantCommand(services *service.Services, name string) {
+	id, err := services.Tenant.CreateTenant(context.TODO(), service.CreateTenantInput{Name: name})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Tenant <%s> - created, ID = %d\n", name, id)
+}
+
+// jwksCommand prints the JWKS with the public key, so tokens signed with a locally generated key pair are accepted
+func jwksCommand(path, kid string) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		log.Fatalf("No PEM data in <%s>", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	jwk, err := jwtauth.NewJWK(key, kid)
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, _ := json.MarshalIndent(jwtauth.JWKS{Keys: []jwtauth.JWK{jwk}}, "", "  ")
+	fmt.Println(string(out))
+}
+
+func keyStatus(key entity.APIKey) string {
+	switch {
+	case key.RevokedAt != nil:
+		return "revoked"
+	case key.ExpiresAt != nil && !time.Now().UTC().Before(*key.ExpiresAt):
+		return "expired"
+	default:
+		return "active"
+	}
+}
+
+// formatPrefix shows the start of the key, it is known only after the key was generated or used with the current hashing
+func formatPrefix(key entity.APIKey) string {
+	if key.KeyPrefix == "" {
+		return "-"
+	}
+	return key.KeyPrefix + "..."
+}
+
+// formatRateLimit shows the limit of the key itself, keys without it are limited by their scopes
+func formatRateLimit(key entity.APIKey) string {
+	if key.RateLimit == nil && key.RateBurst == nil {
+		return "by scopes"
+	}
+	rate := "by scopes"
+	if key.RateLimit != nil {
+		rate = fmt.Sprintf("%d/min", *key.RateLimit)
+	}
+	burst := rate
+	if key.RateBurst != nil {
+		burst = strconv.Itoa(*key.RateBurst)
+	} else if key.RateLimit != nil {
+		burst = strconv.Itoa(*key.RateLimit)
+	}
+	return fmt.Sprintf("%s, burst %s", rate, burst)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
 }
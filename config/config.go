@@ -4,15 +4,26 @@ import (
 	"fmt"
 	"github.com/ilyakaznacheev/cleanenv"
 	"path"
+	"time"
 )
 
+// minSecretLength is the shortest HASHER_SECRET accepted, 32 characters of hex are 128 bits
+const minSecretLength = 32
+
 type (
 	Config struct {
-		App    `yaml:"app"`
-		HTTP   `yaml:"http"`
-		Log    `yaml:"log"`
-		PG     `yaml:"postgres"`
-		Secure `yaml:"secure"`
+		App         `yaml:"app"`
+		HTTP        `yaml:"http"`
+		Log         `yaml:"log"`
+		PG          `yaml:"postgres"`
+		Secure      `yaml:"secure"`
+		AuthCache   `yaml:"auth_cache"`
+		Segments    `yaml:"segments"`
+		Users       `yaml:"users"`
+		Idempotency `yaml:"idempotency"`
+		JWT         `yaml:"jwt"`
+		RateLimit   `yaml:"rate_limit"`
+		Webhooks    `yaml:"webhooks"`
 	}
 
 	App struct {
@@ -33,8 +44,69 @@ type (
 		URL         string `env-required:"true"                      env:"PG_URL"`
 	}
 
+	// Secure.Secret keys the HMAC of API keys, it is generated for every deployment and never committed
 	Secure struct {
-		Salt string `env-required:"true" env:"HASHER_SALT"`
+		Salt   string `env-required:"true" env:"HASHER_SALT"`
+		Secret string `env-required:"true" env:"HASHER_SECRET"`
+	}
+
+	// AuthCache keeps verified and rejected API keys, so repeated requests do not look keys up in the database.
+	// A zero size disables the cache.
+	AuthCache struct {
+		Size         int           `                    yaml:"size"          env:"AUTH_CACHE_SIZE"`
+		TTL          time.Duration `env-required:"true" yaml:"ttl"           env:"AUTH_CACHE_TTL"`
+		RejectedSize int           `                    yaml:"rejected_size" env:"AUTH_CACHE_REJECTED_SIZE"`
+		RejectedTTL  time.Duration `env-required:"true" yaml:"rejected_ttl"  env:"AUTH_CACHE_REJECTED_TTL"`
+	}
+
+	Segments struct {
+		ArchiveRetention time.Duration `env-required:"true" yaml:"archive_retention" env:"SEGMENTS_ARCHIVE_RETENTION"`
+		AliasTTL         time.Duration `env-required:"true" yaml:"alias_ttl"         env:"SEGMENTS_ALIAS_TTL"`
+	}
+
+	// Users.HistoryPolicy is keep or delete, see service.HistoryPolicyKeep
+	Users struct {
+		HistoryPolicy string `env-required:"true" yaml:"history_policy" env:"USERS_HISTORY_POLICY"`
+	}
+
+	// Idempotency.LockTimeout frees a key held by a request that never completed, it has to outlast the slowest request
+	Idempotency struct {
+		Retention   time.Duration `env-required:"true" yaml:"retention"    env:"IDEMPOTENCY_RETENTION"`
+		LockTimeout time.Duration `env-required:"true" yaml:"lock_timeout" env:"IDEMPOTENCY_LOCK_TIMEOUT"`
+	}
+
+	// JWT authentication is enabled when JWKS holds a file path or a URL
+	JWT struct {
+		JWKS        string        `                    yaml:"jwks"         env:"JWT_JWKS"`
+		Issuer      string        `                    yaml:"issuer"       env:"JWT_ISSUER"`
+		Audience    string        `                    yaml:"audience"     env:"JWT_AUDIENCE"`
+		ClockSkew   time.Duration `env-required:"true" yaml:"clock_skew"   env:"JWT_CLOCK_SKEW"`
+		ActorClaim  string        `env-required:"true" yaml:"actor_claim"  env:"JWT_ACTOR_CLAIM"`
+		ScopesClaim string        `env-required:"true" yaml:"scopes_claim" env:"JWT_SCOPES_CLAIM"`
+		ScopePrefix string        `                    yaml:"scope_prefix" env:"JWT_SCOPE_PREFIX"`
+		TenantClaim string        `                    yaml:"tenant_claim" env:"JWT_TENANT_CLAIM"`
+		Tenant      int           `env-required:"true" yaml:"tenant"       env:"JWT_TENANT"`
+	}
+
+	// RateLimit is the token bucket of a key: Burst requests at once, refilled at Rate requests per minute.
+	// Scopes override the limit for keys with the scope, a key gets the most generous limit of its scopes.
+	RateLimit struct {
+		Rate   int                       `env-required:"true" yaml:"rate"  env:"RATE_LIMIT_RATE"`
+		Burst  int                       `env-required:"true" yaml:"burst" env:"RATE_LIMIT_BURST"`
+		Scopes map[string]ScopeRateLimit `                    yaml:"scopes"`
+	}
+
+	ScopeRateLimit struct {
+		Rate  int `yaml:"rate"`
+		Burst int `yaml:"burst"`
+	}
+
+	// Webhooks retry a failed delivery after Backoff, doubled with every attempt, until MaxAttempts are made
+	Webhooks struct {
+		Timeout     time.Duration `env-required:"true" yaml:"timeout"      env:"WEBHOOKS_TIMEOUT"`
+		MaxAttempts int           `env-required:"true" yaml:"max_attempts" env:"WEBHOOKS_MAX_ATTEMPTS"`
+		Backoff     time.Duration `env-required:"true" yaml:"backoff"      env:"WEBHOOKS_BACKOFF"`
+		Retention   time.Duration `env-required:"true" yaml:"retention"    env:"WEBHOOKS_RETENTION"`
 	}
 )
 
@@ -51,5 +123,24 @@ func NewConfig(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("error updating env: %w", err)
 	}
 
+	err = cfg.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
 	return cfg, nil
 }
+
+// validate checks values that cleanenv cannot, a mistyped value must not silently fall back to a default behaviour
+func (c *Config) validate() error {
+	if len(c.Secure.Secret) < minSecretLength {
+		return fmt.Errorf("HASHER_SECRET must be at least %d characters, generate it with openssl rand -hex 32", minSecretLength)
+	}
+	if c.Users.HistoryPolicy != "keep" && c.Users.HistoryPolicy != "delete" {
+		return fmt.Errorf("users.history_policy must be keep or delete, got %q", c.Users.HistoryPolicy)
+	}
+	if c.Idempotency.LockTimeout <= 0 {
+		return fmt.Errorf("idempotency.lock_timeout must be positive, got %s", c.Idempotency.LockTimeout)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+var testIdempotency = Idempotency{Retention: time.Hour, LockTimeout: time.Minute}
+
+func TestValidateHistoryPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		wantErr bool
+	}{
+		{"keep", false},
+		{"delete", false},
+		{"delet", true},
+		{"Delete", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			cfg := &Config{Secure: Secure{Secret: testSecret}, Users: Users{HistoryPolicy: tt.policy}, Idempotency: testIdempotency}
+			if err := cfg.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr bool
+	}{
+		{"generated", testSecret, false},
+		{"empty", "", true},
+		{"short", testSecret[:minSecretLength-1], true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Secure: Secure{Secret: tt.secret}, Users: Users{HistoryPolicy: "keep"}, Idempotency: testIdempotency}
+			if err := cfg.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateIdempotencyLockTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		lockTimeout time.Duration
+		wantErr     bool
+	}{
+		{"minute", time.Minute, false},
+		{"zero", 0, true},
+		{"negative", -time.Second, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Secure:      Secure{Secret: testSecret},
+				Users:       Users{HistoryPolicy: "keep"},
+				Idempotency: Idempotency{Retention: time.Hour, LockTimeout: tt.lockTimeout},
+			}
+			if err := cfg.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+#!/bin/sh
+# Runs once when the data volume is initialized and creates the login of the service.
+# Privileges of the role are granted by migrations.
+set -e
+
+psql -v ON_ERROR_STOP=1 -v password="$APP_DB_PASSWORD" --username "$POSTGRES_USER" --dbname "$POSTGRES_DB" <<-'EOSQL'
+	CREATE ROLE uss_app LOGIN NOSUPERUSER NOBYPASSRLS PASSWORD :'password';
+EOSQL
@@ -73,9 +73,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/segments/create": {
-            "post": {
-                "description": "Этот эндпоинт позволяет создать новый сегмент",
+        "/api/v1/schedule/cancel": {
+            "delete": {
+                "description": "Этот эндпоинт позволяет отменить еще не выполненную запланированную операцию.",
                 "consumes": [
                     "application/json"
                 ],
@@ -83,10 +83,10 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "Segments"
+                    "Schedule"
                 ],
-                "summary": "Создание сегмента",
-                "operationId": "createSegment",
+                "summary": "Отмена запланированной операции",
+                "operationId": "cancelTask",
                 "parameters": [
                     {
                         "type": "string",
@@ -96,21 +96,18 @@ const docTemplate = `{
                         "required": true
                     },
                     {
-                        "description": "Данные для создания сегмента",
+                        "description": "Идентификатор операции",
                         "name": "input",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.createSegmentInput"
+                            "$ref": "#/definitions/internal_controller_http_v1.cancelTaskInput"
                         }
                     }
                 ],
                 "responses": {
-                    "201": {
-                        "description": "Успешное выполнение",
-                        "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.createSegmentResponse"
-                        }
+                    "204": {
+                        "description": "Успешная отмена"
                     },
                     "400": {
                         "description": "Некорректный запрос или данные",
@@ -118,6 +115,18 @@ const docTemplate = `{
                             "$ref": "#/definitions/echo.HTTPError"
                         }
                     },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Операция не найдена",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
                     "500": {
                         "description": "Внутренняя ошибка сервера",
                         "schema": {
@@ -127,9 +136,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/segments/delete": {
-            "delete": {
-                "description": "Этот эндпоинт позволяет удалить существующий сегмент.",
+        "/api/v1/schedule/create": {
+            "post": {
+                "description": "Этот эндпоинт позволяет запланировать добавление или удаление пользователей из сегментов на указанное время.",
                 "consumes": [
                     "application/json"
                 ],
@@ -137,10 +146,10 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "Segments"
+                    "Schedule"
                 ],
-                "summary": "Удаление сегмента",
-                "operationId": "deleteSegment",
+                "summary": "Планирование изменения сегментов",
+                "operationId": "scheduleTasks",
                 "parameters": [
                     {
                         "type": "string",
@@ -150,18 +159,21 @@ const docTemplate = `{
                         "required": true
                     },
                     {
-                        "description": "Данные для удаления сегмента",
+                        "description": "Пользователи, сегменты, операция (add или delete) и время выполнения",
                         "name": "input",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.deleteSegmentInput"
+                            "$ref": "#/definitions/internal_controller_http_v1.scheduleTasksInput"
                         }
                     }
                 ],
                 "responses": {
-                    "204": {
-                        "description": "Успешное удаление"
+                    "201": {
+                        "description": "Успешное выполнение",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.tasksResponse"
+                        }
                     },
                     "400": {
                         "description": "Некорректный запрос или данные",
@@ -169,6 +181,12 @@ const docTemplate = `{
                             "$ref": "#/definitions/echo.HTTPError"
                         }
                     },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
                     "404": {
                         "description": "Сегмент не найден",
                         "schema": {
@@ -184,9 +202,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/users/active-segments": {
+        "/api/v1/schedule/user-tasks": {
             "get": {
-                "description": "Этот эндпоинт позволяет получить список сегментов, к которым принадлежит пользователь.",
+                "description": "Этот эндпоинт позволяет получить список невыполненных запланированных операций пользователя, включая удаление по TTL.",
                 "consumes": [
                     "application/json"
                 ],
@@ -194,10 +212,10 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "Users"
+                    "Schedule"
                 ],
-                "summary": "Получение активных сегментов пользователя",
-                "operationId": "getSegments",
+                "summary": "Получение запланированных операций пользователя",
+                "operationId": "getUserTasks",
                 "parameters": [
                     {
                         "type": "string",
@@ -218,8 +236,59 @@ const docTemplate = `{
                     "200": {
                         "description": "Успешное выполнение",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.getSegmentsUserResponse"
+                            "$ref": "#/definitions/internal_controller_http_v1.tasksResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/segments/active-window": {
+            "put": {
+                "description": "Этот эндпоинт позволяет задать период, в который сегмент активен. Вне периода сегмент не возвращается пользователям, но их членство сохраняется. Пустое значение границы снимает ограничение.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "Изменение окна активности сегмента",
+                "operationId": "setActiveWindow",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Сегмент и границы периода активности",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.setActiveWindowInput"
                         }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Успешное выполнение"
                     },
                     "400": {
                         "description": "Некорректный запрос или данные",
@@ -227,8 +296,14 @@ const docTemplate = `{
                             "$ref": "#/definitions/echo.HTTPError"
                         }
                     },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
                     "404": {
-                        "description": "Пользователь не найден",
+                        "description": "Сегмент не найден",
                         "schema": {
                             "$ref": "#/definitions/echo.HTTPError"
                         }
@@ -242,9 +317,9 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/users/segments": {
-            "post": {
-                "description": "Этот эндпоинт позволяет обновить сегменты, к которым принадлежит пользователь.",
+        "/api/v1/segments/auto-enroll": {
+            "put": {
+                "description": "Этот эндпоинт позволяет задать долю новых пользователей, автоматически добавляемых в сегмент при их создании. 10000 соответствует 100%, пустое значение отключает добавление.",
                 "consumes": [
                     "application/json"
                 ],
@@ -252,10 +327,10 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "Users"
+                    "Segments"
                 ],
-                "summary": "Обновление сегментов пользователя",
-                "operationId": "setSegments",
+                "summary": "Изменение автоматического добавления новых пользователей",
+                "operationId": "setAutoEnroll",
                 "parameters": [
                     {
                         "type": "string",
@@ -265,18 +340,18 @@ const docTemplate = `{
                         "required": true
                     },
                     {
-                        "description": "Данные для обновления сегментов пользователя",
+                        "description": "Сегмент и доля новых пользователей",
                         "name": "input",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.setSegmentsUserInput"
+                            "$ref": "#/definitions/internal_controller_http_v1.setAutoEnrollInput"
                         }
                     }
                 ],
                 "responses": {
-                    "200": {
-                        "description": "Успешная операция"
+                    "204": {
+                        "description": "Успешное выполнение"
                     },
                     "400": {
                         "description": "Некорректный запрос или данные",
@@ -284,6 +359,12 @@ const docTemplate = `{
                             "$ref": "#/definitions/echo.HTTPError"
                         }
                     },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
                     "404": {
                         "description": "Сегмент не найден",
                         "schema": {
@@ -298,76 +379,1902 @@ const docTemplate = `{
                     }
                 }
             }
-        }
-    },
-    "definitions": {
-        "echo.HTTPError": {
-            "type": "object",
-            "properties": {
-                "message": {}
-            }
-        },
-        "internal_controller_http_v1.createSegmentInput": {
-            "type": "object",
-            "required": [
-                "slug"
-            ],
-            "properties": {
-                "percentageUsers": {
-                    "type": "integer",
-                    "maximum": 10000,
-                    "minimum": 1
-                },
-                "slug": {
-                    "type": "string",
-                    "maxLength": 256
-                }
-            }
         },
-        "internal_controller_http_v1.createSegmentResponse": {
-            "type": "object",
-            "properties": {
-                "slug": {
-                    "type": "string"
+        "/api/v1/segments/capacity": {
+            "put": {
+                "description": "Этот эндпоинт позволяет задать максимальное количество пользователей в сегменте. Пустое значение снимает ограничение. Уже состоящие в сегменте пользователи не удаляются.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "Изменение ограничения размера сегмента",
+                "operationId": "setCapacity",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Сегмент и ограничение",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.setCapacityInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Успешное выполнение"
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Сегмент не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
                 }
             }
         },
-        "internal_controller_http_v1.deleteSegmentInput": {
-            "type": "object",
-            "required": [
-                "slug"
-            ],
-            "properties": {
-                "slug": {
-                    "type": "string",
-                    "maxLength": 256
+        "/api/v1/segments/create": {
+            "post": {
+                "description": "Этот эндпоинт позволяет создать новый сегмент. При dry_run=true сегмент не создается, а возвращается история, которая была бы записана.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "Создание сегмента",
+                "operationId": "createSegment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Данные для создания сегмента",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.createSegmentInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Результат предварительного просмотра",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.previewResponse"
+                        }
+                    },
+                    "201": {
+                        "description": "Успешное выполнение",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.createSegmentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/segments/delete": {
+            "delete": {
+                "description": "Этот эндпоинт позволяет удалить существующий сегмент. Сегмент переносится в архив и окончательно удаляется по истечении срока хранения. При dry_run=true сегмент не удаляется, а возвращается история, которая была бы записана.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "Удаление сегмента",
+                "operationId": "deleteSegment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Данные для удаления сегмента",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.deleteSegmentInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Результат предварительного просмотра",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.previewResponse"
+                        }
+                    },
+                    "204": {
+                        "description": "Успешное удаление"
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Сегмент не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/segments/derive": {
+            "post": {
+                "description": "Этот эндпоинт позволяет создать сегмент из выражения над существующими сегментами (union, intersection, difference). В режиме materialized пользователи копируются в новый обычный сегмент, в режиме live состав сегмента вычисляется при каждом запросе.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "Создание производного сегмента",
+                "operationId": "deriveSegment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Данные для создания производного сегмента",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.deriveSegmentInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Успешное выполнение",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.createSegmentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Некорректный запрос, выражение или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Сегмент из выражения не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/segments/hierarchy/link": {
+            "post": {
+                "description": "Этот эндпоинт позволяет сделать один сегмент дочерним для другого. При наследовании down пользователи родителя считаются состоящими в дочернем сегменте, при наследовании up - наоборот. Связь, образующая цикл, отклоняется.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "Связывание сегментов в иерархию",
+                "operationId": "linkSegments",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Родительский и дочерний сегменты, тип наследования",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.linkSegmentsInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Успешное выполнение"
+                    },
+                    "400": {
+                        "description": "Некорректный запрос, связь уже существует или образует цикл",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Сегмент не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/segments/hierarchy/unlink": {
+            "delete": {
+                "description": "Этот эндпоинт позволяет удалить связь между родительским и дочерним сегментом.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "Удаление связи сегментов",
+                "operationId": "unlinkSegments",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Родительский и дочерний сегменты",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.unlinkSegmentsInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Успешное удаление"
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Связь не найдена",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/segments/list": {
+            "get": {
+                "description": "Этот эндпоинт позволяет получить список сегментов с количеством участников и оставшимся местом в сегментах с ограничением max_members.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "Получение списка сегментов",
+                "operationId": "listSegments",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Успешное выполнение",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.listSegmentsResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/segments/prerequisites": {
+            "put": {
+                "description": "Этот эндпоинт позволяет задать сегменты, в которых пользователь должен состоять, чтобы его можно было добавить в сегмент. Пустой список снимает требования.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "Изменение обязательных сегментов",
+                "operationId": "setPrerequisites",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Сегмент и обязательные сегменты",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.setPrerequisitesInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Успешное выполнение"
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Сегмент не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "409": {
+                        "description": "Требования образуют цикл",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/segments/rename": {
+            "put": {
+                "description": "Этот эндпоинт позволяет переименовать сегмент. Членство пользователей и запланированные операции переносятся на новый slug, старый slug продолжает работать как псевдоним в запросах изменения сегментов пользователя в течение срока segments.alias_ttl.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "Переименование сегмента",
+                "operationId": "renameSegment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Текущий и новый slug сегмента",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.renameSegmentInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Успешное выполнение",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.renameSegmentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или новый slug уже занят",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Сегмент не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/segments/restore": {
+            "post": {
+                "description": "Этот эндпоинт позволяет восстановить удаленный сегмент из архива вместе с членством пользователей.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Segments"
+                ],
+                "summary": "Восстановление сегмента",
+                "operationId": "restoreSegment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Данные для восстановления сегмента",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.restoreSegmentInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Успешное восстановление"
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Сегмент не найден в архиве",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/users/active-segments": {
+            "get": {
+                "description": "Этот эндпоинт позволяет получить список сегментов, к которым принадлежит пользователь, включая унаследованные по иерархии сегментов. Заголовок ETag содержит версию сегментов пользователя для If-Match при их изменении.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Users"
+                ],
+                "summary": "Получение активных сегментов пользователя",
+                "operationId": "getSegments",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Идентификатор пользователя",
+                        "name": "user_id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Успешное выполнение",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.getSegmentsUserResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Пользователь не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/users/create": {
+            "post": {
+                "description": "Этот эндпоинт позволяет явно создать пользователя. Пользователь добавляется в сегменты с опцией auto_enroll.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Users"
+                ],
+                "summary": "Создание пользователя",
+                "operationId": "createUser",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Идентификатор пользователя",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.userInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Успешное выполнение",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.createUserResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "409": {
+                        "description": "Пользователь уже существует",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/users/delete": {
+            "delete": {
+                "description": "Этот эндпоинт позволяет удалить пользователя вместе с его сегментами и запланированными операциями. История сохраняется или удаляется в зависимости от users.history_policy.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Users"
+                ],
+                "summary": "Удаление пользователя",
+                "operationId": "deleteUser",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Идентификатор пользователя",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.userInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Успешное выполнение"
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нужна область admin",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Пользователь не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/users/erase": {
+            "post": {
+                "description": "Этот эндпоинт позволяет удалить (mode=delete) или необратимо псевдонимизировать (mode=pseudonymize) user_id во всех данных сервиса. В журнал стирания записываются только режим и количество затронутых записей.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Users"
+                ],
+                "summary": "Стирание данных пользователя",
+                "operationId": "eraseUser",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Идентификатор пользователя и режим стирания",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.eraseUserInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Успешное выполнение",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.eraseUserResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нужна область admin",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Пользователь не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/users/export": {
+            "get": {
+                "description": "Этот эндпоинт позволяет выгрузить все хранимые данные пользователя: сегменты, запланированные операции и полную историю. История удаленного пользователя также выгружается.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Users"
+                ],
+                "summary": "Выгрузка данных пользователя",
+                "operationId": "exportUser",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Идентификатор пользователя",
+                        "name": "user_id",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Успешное выполнение",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.exportUserResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нужна область history:read",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Пользователь не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/users/list": {
+            "get": {
+                "description": "Этот эндпоинт позволяет получить список пользователей по дате создания с постраничным выводом. По умолчанию возвращается 100 пользователей.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Users"
+                ],
+                "summary": "Получение списка пользователей",
+                "operationId": "listUsers",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Начало периода создания (RFC 3339)",
+                        "name": "created_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Конец периода создания (RFC 3339), не включается",
+                        "name": "created_to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Только пользователи, состоящие в сегменте",
+                        "name": "segment",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Количество пользователей на странице (до 1000)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Смещение от начала списка",
+                        "name": "offset",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Успешное выполнение",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.listUsersResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/users/merge": {
+            "post": {
+                "description": "Этот эндпоинт позволяет объединить двух пользователей: сегменты объединяются, запланированные операции и история переносятся на target_user_id, а source_user_id становится его псевдонимом.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Users"
+                ],
+                "summary": "Объединение пользователей",
+                "operationId": "mergeUsers",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Объединяемый и итоговый пользователи",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.mergeUsersInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Успешное выполнение"
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нужна область admin",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Пользователь не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "409": {
+                        "description": "Достигнуто ограничение размера сегмента или нарушены обязательные сегменты",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/users/segments": {
+            "post": {
+                "description": "Этот эндпоинт позволяет обновить сегменты, к которым принадлежит пользователь. При cascade=true удаление обязательного сегмента удаляет и зависящие от него сегменты. При dry_run=true изменения не сохраняются, а возвращаются история, которая была бы записана, и конфликты.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Users"
+                ],
+                "summary": "Обновление сегментов пользователя",
+                "operationId": "setSegments",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Версия сегментов пользователя из ETag активных сегментов или * для любой версии существующего пользователя",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Данные для обновления сегментов пользователя",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.setSegmentsUserInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Успешная операция. Тело возвращается только при dry_run=true",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.previewResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Сегмент не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "409": {
+                        "description": "Достигнуто ограничение размера сегмента или нарушены обязательные сегменты",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "412": {
+                        "description": "Сегменты пользователя изменились после получения версии, пользователя нет или передан слабый ETag",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/webhooks/create": {
+            "post": {
+                "description": "Этот эндпоинт позволяет подписаться на изменения членства в сегментах. События отправляются POST запросом, подписанным HMAC-SHA256 с секретом вебхука. Пустые списки сегментов и событий означают все сегменты и все события.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Webhooks"
+                ],
+                "summary": "Создание вебхука",
+                "operationId": "createWebhook",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Адрес, секрет для подписи, сегменты или пространства имен и типы событий",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.createWebhookInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Успешное создание",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.createWebhookResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/webhooks/delete": {
+            "delete": {
+                "description": "Этот эндпоинт позволяет удалить вебхук вместе с журналом доставок. Неотправленные события не доставляются.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Webhooks"
+                ],
+                "summary": "Удаление вебхука",
+                "operationId": "deleteWebhook",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Идентификатор вебхука",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.webhookInput"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Успешное удаление"
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Вебхук не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/webhooks/deliveries": {
+            "get": {
+                "description": "Этот эндпоинт позволяет получить доставки вебхука, начиная с последних: статус (pending, delivered или failed), число попыток, ответ получателя и время следующей попытки. По умолчанию возвращается 100 доставок.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Webhooks"
+                ],
+                "summary": "Журнал доставок вебхука",
+                "operationId": "getWebhookDeliveries",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Идентификатор вебхука",
+                        "name": "webhook_id",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Количество доставок на странице (до 1000)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Смещение от начала списка",
+                        "name": "offset",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Успешное выполнение",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.deliveriesResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Некорректный запрос или данные",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "403": {
+                        "description": "Нет доступа к пространству имен сегмента",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "404": {
+                        "description": "Вебхук не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/webhooks/list": {
+            "get": {
+                "description": "Этот эндпоинт позволяет получить вебхуки, события которых доступны ключу. Секреты не возвращаются.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Webhooks"
+                ],
+                "summary": "Получение списка вебхуков",
+                "operationId": "listWebhooks",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Успешное выполнение",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.listWebhooksResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        },
+        "/reports/{reportID}": {
+            "get": {
+                "description": "Этот эндпоинт позволяет скачать отчет по ссылке из report-link. Отчет доступен только ключам арендатора, для которого он создан.",
+                "produces": [
+                    "text/csv"
+                ],
+                "tags": [
+                    "History"
+                ],
+                "summary": "Скачивание CSV отчета",
+                "operationId": "downloadReport",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "API KEY для аутентификации",
+                        "name": "Authorization",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Идентификатор отчета",
+                        "name": "reportID",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "CSV отчет",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "404": {
+                        "description": "Отчет не найден",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    },
+                    "500": {
+                        "description": "Внутренняя ошибка сервера",
+                        "schema": {
+                            "$ref": "#/definitions/echo.HTTPError"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "echo.HTTPError": {
+            "type": "object",
+            "properties": {
+                "message": {}
+            }
+        },
+        "internal_controller_http_v1.activeSegmentResponse": {
+            "type": "object",
+            "properties": {
+                "inherited": {
+                    "type": "boolean"
+                },
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.cancelTaskInput": {
+            "type": "object",
+            "required": [
+                "task_id"
+            ],
+            "properties": {
+                "task_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "internal_controller_http_v1.createSegmentInput": {
+            "type": "object",
+            "required": [
+                "slug"
+            ],
+            "properties": {
+                "active_from": {
+                    "type": "string"
+                },
+                "active_until": {
+                    "type": "string"
+                },
+                "auto_enroll": {
+                    "type": "integer",
+                    "maximum": 10000,
+                    "minimum": 1
+                },
+                "dry_run": {
+                    "type": "boolean"
+                },
+                "max_members": {
+                    "type": "integer",
+                    "minimum": 0
+                },
+                "percentageUsers": {
+                    "type": "integer",
+                    "maximum": 10000,
+                    "minimum": 1
+                },
+                "slug": {
+                    "type": "string",
+                    "maxLength": 256
+                }
+            }
+        },
+        "internal_controller_http_v1.createSegmentResponse": {
+            "type": "object",
+            "properties": {
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.createUserResponse": {
+            "type": "object",
+            "properties": {
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.createWebhookInput": {
+            "type": "object",
+            "required": [
+                "events",
+                "secret",
+                "segments",
+                "url"
+            ],
+            "properties": {
+                "events": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "secret": {
+                    "type": "string",
+                    "maxLength": 255,
+                    "minLength": 16
+                },
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "url": {
+                    "type": "string",
+                    "maxLength": 2048
+                }
+            }
+        },
+        "internal_controller_http_v1.createWebhookResponse": {
+            "type": "object",
+            "properties": {
+                "webhook_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "internal_controller_http_v1.deleteSegmentInput": {
+            "type": "object",
+            "required": [
+                "slug"
+            ],
+            "properties": {
+                "dry_run": {
+                    "type": "boolean"
+                },
+                "slug": {
+                    "type": "string",
+                    "maxLength": 256
+                }
+            }
+        },
+        "internal_controller_http_v1.deliveriesResponse": {
+            "type": "object",
+            "properties": {
+                "deliveries": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controller_http_v1.deliveryResponse"
+                    }
+                }
+            }
+        },
+        "internal_controller_http_v1.deliveryResponse": {
+            "type": "object",
+            "properties": {
+                "attempts": {
+                    "type": "integer"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "delivery_id": {
+                    "type": "integer"
+                },
+                "event": {
+                    "type": "string"
+                },
+                "last_attempt_at": {
+                    "type": "string"
+                },
+                "last_error": {
+                    "type": "string"
+                },
+                "next_attempt_at": {
+                    "type": "string"
+                },
+                "response_status": {
+                    "type": "integer"
+                },
+                "segment": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.deriveSegmentInput": {
+            "type": "object",
+            "required": [
+                "mode",
+                "slug"
+            ],
+            "properties": {
+                "active_from": {
+                    "type": "string"
+                },
+                "active_until": {
+                    "type": "string"
+                },
+                "expression": {
+                    "$ref": "#/definitions/internal_controller_http_v1.segmentExpression"
+                },
+                "mode": {
+                    "type": "string",
+                    "enum": [
+                        "materialized",
+                        "live"
+                    ]
+                },
+                "slug": {
+                    "type": "string",
+                    "maxLength": 256
+                }
+            }
+        },
+        "internal_controller_http_v1.eraseUserInput": {
+            "type": "object",
+            "required": [
+                "mode",
+                "user_id"
+            ],
+            "properties": {
+                "mode": {
+                    "type": "string",
+                    "enum": [
+                        "delete",
+                        "pseudonymize"
+                    ]
+                },
+                "user_id": {
+                    "type": "string",
+                    "maxLength": 40
+                }
+            }
+        },
+        "internal_controller_http_v1.eraseUserResponse": {
+            "type": "object",
+            "properties": {
+                "audit_id": {
+                    "type": "integer"
+                },
+                "erased_at": {
+                    "type": "string"
+                },
+                "history_records": {
+                    "type": "integer"
+                },
+                "memberships": {
+                    "type": "integer"
+                },
+                "mode": {
+                    "type": "string"
+                },
+                "tasks": {
+                    "type": "integer"
+                }
+            }
+        },
+        "internal_controller_http_v1.exportUserResponse": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "history": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controller_http_v1.historyRecordResponse"
+                    }
+                },
+                "pending_tasks": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controller_http_v1.taskResponse"
+                    }
+                },
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "user_id": {
+                    "type": "string"
                 }
             }
         },
         "internal_controller_http_v1.getHistoryInput": {
             "type": "object",
             "required": [
-                "month",
-                "user_id",
-                "year"
+                "month",
+                "user_id",
+                "year"
+            ],
+            "properties": {
+                "month": {
+                    "type": "integer"
+                },
+                "user_id": {
+                    "type": "string",
+                    "maxLength": 40
+                },
+                "year": {
+                    "type": "integer"
+                }
+            }
+        },
+        "internal_controller_http_v1.getHistoryResponse": {
+            "type": "object",
+            "properties": {
+                "report_link": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.getSegmentsUserResponse": {
+            "type": "object",
+            "properties": {
+                "details": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controller_http_v1.activeSegmentResponse"
+                    }
+                },
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "user_id": {
+                    "type": "string"
+                },
+                "version": {
+                    "type": "integer"
+                }
+            }
+        },
+        "internal_controller_http_v1.historyRecordResponse": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "segment_slug": {
+                    "type": "string"
+                },
+                "type": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.linkSegmentsInput": {
+            "type": "object",
+            "required": [
+                "child",
+                "inheritance",
+                "parent"
+            ],
+            "properties": {
+                "child": {
+                    "type": "string",
+                    "maxLength": 256
+                },
+                "inheritance": {
+                    "type": "string",
+                    "enum": [
+                        "down",
+                        "up"
+                    ]
+                },
+                "parent": {
+                    "type": "string",
+                    "maxLength": 256
+                }
+            }
+        },
+        "internal_controller_http_v1.listSegmentsResponse": {
+            "type": "object",
+            "properties": {
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controller_http_v1.segmentResponse"
+                    }
+                }
+            }
+        },
+        "internal_controller_http_v1.listUsersResponse": {
+            "type": "object",
+            "properties": {
+                "users": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controller_http_v1.userResponse"
+                    }
+                }
+            }
+        },
+        "internal_controller_http_v1.listWebhooksResponse": {
+            "type": "object",
+            "properties": {
+                "webhooks": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controller_http_v1.webhookResponse"
+                    }
+                }
+            }
+        },
+        "internal_controller_http_v1.mergeUsersInput": {
+            "type": "object",
+            "required": [
+                "source_user_id",
+                "target_user_id"
             ],
             "properties": {
-                "month": {
-                    "type": "integer"
-                },
-                "user_id": {
+                "source_user_id": {
                     "type": "string",
                     "maxLength": 40
                 },
-                "year": {
-                    "type": "integer"
+                "target_user_id": {
+                    "type": "string",
+                    "maxLength": 40
                 }
             }
         },
-        "internal_controller_http_v1.getHistoryResponse": {
+        "internal_controller_http_v1.previewNoteResponse": {
             "type": "object",
             "properties": {
-                "report_link": {
+                "segment_slug": {
+                    "type": "string"
+                },
+                "type": {
                     "type": "string"
                 },
                 "user_id": {
@@ -375,17 +2282,216 @@ const docTemplate = `{
                 }
             }
         },
-        "internal_controller_http_v1.getSegmentsUserResponse": {
+        "internal_controller_http_v1.previewResponse": {
+            "type": "object",
+            "properties": {
+                "conflicts": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "history": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controller_http_v1.previewNoteResponse"
+                    }
+                }
+            }
+        },
+        "internal_controller_http_v1.renameSegmentInput": {
+            "type": "object",
+            "required": [
+                "new_slug",
+                "slug"
+            ],
+            "properties": {
+                "new_slug": {
+                    "type": "string",
+                    "maxLength": 256
+                },
+                "slug": {
+                    "type": "string",
+                    "maxLength": 256
+                }
+            }
+        },
+        "internal_controller_http_v1.renameSegmentResponse": {
+            "type": "object",
+            "properties": {
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.restoreSegmentInput": {
+            "type": "object",
+            "required": [
+                "slug"
+            ],
+            "properties": {
+                "slug": {
+                    "type": "string",
+                    "maxLength": 256
+                }
+            }
+        },
+        "internal_controller_http_v1.scheduleTasksInput": {
             "type": "object",
+            "required": [
+                "operation",
+                "run_at",
+                "segments",
+                "users_id"
+            ],
             "properties": {
+                "operation": {
+                    "type": "string",
+                    "enum": [
+                        "add",
+                        "delete"
+                    ]
+                },
+                "run_at": {
+                    "type": "string"
+                },
                 "segments": {
                     "type": "array",
+                    "minItems": 1,
                     "items": {
                         "type": "string"
                     }
                 },
-                "user_id": {
+                "users_id": {
+                    "type": "array",
+                    "minItems": 1,
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "internal_controller_http_v1.segmentExpression": {
+            "type": "object",
+            "properties": {
+                "args": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controller_http_v1.segmentExpression"
+                    }
+                },
+                "op": {
+                    "type": "string",
+                    "enum": [
+                        "union",
+                        "intersection",
+                        "difference"
+                    ]
+                },
+                "segment": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.segmentResponse": {
+            "type": "object",
+            "properties": {
+                "active_from": {
+                    "type": "string"
+                },
+                "active_until": {
+                    "type": "string"
+                },
+                "auto_enroll": {
+                    "type": "integer"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "derived": {
+                    "type": "boolean"
+                },
+                "max_members": {
+                    "type": "integer"
+                },
+                "members": {
+                    "type": "integer"
+                },
+                "remaining": {
+                    "type": "integer"
+                },
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.setActiveWindowInput": {
+            "type": "object",
+            "required": [
+                "slug"
+            ],
+            "properties": {
+                "active_from": {
                     "type": "string"
+                },
+                "active_until": {
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string",
+                    "maxLength": 256
+                }
+            }
+        },
+        "internal_controller_http_v1.setAutoEnrollInput": {
+            "type": "object",
+            "required": [
+                "slug"
+            ],
+            "properties": {
+                "auto_enroll": {
+                    "type": "integer",
+                    "maximum": 10000,
+                    "minimum": 1
+                },
+                "slug": {
+                    "type": "string",
+                    "maxLength": 256
+                }
+            }
+        },
+        "internal_controller_http_v1.setCapacityInput": {
+            "type": "object",
+            "required": [
+                "slug"
+            ],
+            "properties": {
+                "max_members": {
+                    "type": "integer",
+                    "minimum": 0
+                },
+                "slug": {
+                    "type": "string",
+                    "maxLength": 256
+                }
+            }
+        },
+        "internal_controller_http_v1.setPrerequisitesInput": {
+            "type": "object",
+            "required": [
+                "prerequisites",
+                "slug"
+            ],
+            "properties": {
+                "prerequisites": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "slug": {
+                    "type": "string",
+                    "maxLength": 256
                 }
             }
         },
@@ -397,6 +2503,12 @@ const docTemplate = `{
                 "user_id"
             ],
             "properties": {
+                "cascade": {
+                    "type": "boolean"
+                },
+                "dry_run": {
+                    "type": "boolean"
+                },
                 "segments_add": {
                     "type": "array",
                     "items": {
@@ -419,11 +2531,119 @@ const docTemplate = `{
                     "maxLength": 40
                 }
             }
+        },
+        "internal_controller_http_v1.taskResponse": {
+            "type": "object",
+            "properties": {
+                "operation": {
+                    "type": "string"
+                },
+                "run_at": {
+                    "type": "string"
+                },
+                "segment_slug": {
+                    "type": "string"
+                },
+                "task_id": {
+                    "type": "integer"
+                },
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.tasksResponse": {
+            "type": "object",
+            "properties": {
+                "tasks": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controller_http_v1.taskResponse"
+                    }
+                }
+            }
+        },
+        "internal_controller_http_v1.unlinkSegmentsInput": {
+            "type": "object",
+            "required": [
+                "child",
+                "parent"
+            ],
+            "properties": {
+                "child": {
+                    "type": "string",
+                    "maxLength": 256
+                },
+                "parent": {
+                    "type": "string",
+                    "maxLength": 256
+                }
+            }
+        },
+        "internal_controller_http_v1.userInput": {
+            "type": "object",
+            "required": [
+                "user_id"
+            ],
+            "properties": {
+                "user_id": {
+                    "type": "string",
+                    "maxLength": 40
+                }
+            }
+        },
+        "internal_controller_http_v1.userResponse": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.webhookInput": {
+            "type": "object",
+            "required": [
+                "webhook_id"
+            ],
+            "properties": {
+                "webhook_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "internal_controller_http_v1.webhookResponse": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "events": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "url": {
+                    "type": "string"
+                },
+                "webhook_id": {
+                    "type": "integer"
+                }
+            }
         }
     },
     "securityDefinitions": {
         "APIKey": {
-            "description": "API KEY for authentication",
+            "description": "API key or JWT of the identity provider for authentication",
             "type": "apiKey",
             "name": "Authorization",
             "in": "header"
@@ -9,9 +9,12 @@ import (
 	"github.com/passionde/user-segmentation-service/internal/service"
 	"github.com/passionde/user-segmentation-service/pkg/csvwriter"
 	"github.com/passionde/user-segmentation-service/pkg/httpserver"
+	"github.com/passionde/user-segmentation-service/pkg/jwtauth"
 	"github.com/passionde/user-segmentation-service/pkg/postgres"
+	"github.com/passionde/user-segmentation-service/pkg/ratelimit"
 	"github.com/passionde/user-segmentation-service/pkg/secure"
 	"github.com/passionde/user-segmentation-service/pkg/validator"
+	"github.com/passionde/user-segmentation-service/pkg/webhook"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"os/signal"
@@ -31,7 +34,7 @@ import (
 // @securityDefinitions.apikey  APIKey
 // @in                          header
 // @name                        Authorization
-// @description                 API KEY for authentication
+// @description                 API key or JWT of the identity provider for authentication
 
 func Run(configPath string) {
 	// Config
@@ -50,17 +53,67 @@ func Run(configPath string) {
 		log.Fatal(fmt.Errorf("app - Run - postgres.New: %w", err))
 	}
 	defer pg.Close()
+	if err = checkDatabaseRole(pg); err != nil {
+		log.Fatal(fmt.Errorf("app - Run - checkDatabaseRole: %w", err))
+	}
 
 	// Repositories
 	log.Info("Initializing repositories...")
 	repositories := repo.NewRepositories(pg)
 
+	// JWT
+	var jwtVerifier jwtauth.Verifier
+	if cfg.JWT.JWKS != "" {
+		log.Info("Initializing JWT verifier...")
+		verifier, err := jwtauth.NewVerifier(cfg.JWT.JWKS, cfg.JWT.Issuer, cfg.JWT.Audience, cfg.JWT.ClockSkew)
+		if err != nil {
+			log.Fatal(fmt.Errorf("app - Run - jwtauth.NewVerifier: %w", err))
+		}
+		jwtVerifier = verifier
+	}
+
 	// Services
 	log.Info("Initializing services...")
+	jwtClaims := service.JWTClaims{
+		ActorClaim:  cfg.JWT.ActorClaim,
+		ScopesClaim: cfg.JWT.ScopesClaim,
+		ScopePrefix: cfg.JWT.ScopePrefix,
+		TenantClaim: cfg.JWT.TenantClaim,
+		Tenant:      cfg.JWT.Tenant,
+	}
+	keyCache := service.KeyCache{
+		Size:         cfg.AuthCache.Size,
+		TTL:          cfg.AuthCache.TTL,
+		RejectedSize: cfg.AuthCache.RejectedSize,
+		RejectedTTL:  cfg.AuthCache.RejectedTTL,
+	}
+	rateLimits := service.RateLimits{
+		Default: ratelimit.Limit{Rate: cfg.RateLimit.Rate, Burst: cfg.RateLimit.Burst},
+		Scopes:  make(map[string]ratelimit.Limit, len(cfg.RateLimit.Scopes)),
+	}
+	for scope, limit := range cfg.RateLimit.Scopes {
+		rateLimits.Scopes[scope] = ratelimit.Limit{Rate: limit.Rate, Burst: limit.Burst}
+	}
+	webhookOptions := service.WebhookOptions{
+		Timeout:     cfg.Webhooks.Timeout,
+		MaxAttempts: cfg.Webhooks.MaxAttempts,
+		Backoff:     cfg.Webhooks.Backoff,
+	}
 	deps := service.ServicesDependencies{
-		Repos:     repositories,
-		APISecure: secure.NewSecure(cfg.Secure.Salt),
-		CSVWrite:  csvwriter.NewCsvWriter("reports"),
+		Repos:             repositories,
+		APISecure:         secure.NewSecure(cfg.Secure.Salt, cfg.Secure.Secret),
+		JWTVerifier:       jwtVerifier,
+		JWTClaims:         jwtClaims,
+		KeyCache:          keyCache,
+		CSVWrite:          csvwriter.NewCsvWriter("reports"),
+		SegmentAliasTTL:   cfg.Segments.AliasTTL,
+		UserHistoryPolicy: cfg.Users.HistoryPolicy,
+		IdempotencyTTL:    cfg.Idempotency.Retention,
+		IdempotencyLock:   cfg.Idempotency.LockTimeout,
+		RateLimiter:       ratelimit.NewMemoryLimiter(),
+		RateLimits:        rateLimits,
+		WebhookSender:     webhook.NewHTTPSender(cfg.Webhooks.Timeout),
+		WebhookOptions:    webhookOptions,
 	}
 	services := service.NewServices(deps)
 
@@ -78,6 +131,12 @@ func Run(configPath string) {
 	// Background worker
 	log.Info("Starting a worker...")
 	go RunWorker(services)
+	go RunArchivePurger(services, cfg.Segments.ArchiveRetention)
+	go RunIdempotencyPurger(services)
+	go RunWebhookDispatcher(services, cfg.Webhooks.Retention)
+	if cfg.AuthCache.Size > 0 {
+		go RunKeyCacheInvalidator(services)
+	}
 
 	// Waiting signal
 	log.Info("Configuring graceful shutdown...")
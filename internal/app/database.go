@@ -0,0 +1,25 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/passionde/user-segmentation-service/pkg/postgres"
+)
+
+// checkDatabaseRole makes sure the service connects as a role that row-level security applies to.
+// Pools connect lazily, so without the check a role that can not log in would only show up in failing requests.
+func checkDatabaseRole(pg *postgres.Postgres) error {
+	var role string
+	var bypassRLS bool
+	err := pg.Pool.QueryRow(context.Background(),
+		"SELECT rolname, rolsuper OR rolbypassrls FROM pg_roles WHERE rolname = current_user").
+		Scan(&role, &bypassRLS)
+	if err != nil {
+		return fmt.Errorf("can not connect with PG_URL, a data volume initialized before uss_app was introduced "+
+			"needs ALTER ROLE uss_app LOGIN PASSWORD '<APP_DB_PASSWORD>', see README: %w", err)
+	}
+	if bypassRLS {
+		return fmt.Errorf("PG_URL connects as %s, which bypasses row-level security, connect as uss_app", role)
+	}
+	return nil
+}
@@ -20,9 +20,10 @@ const (
 )
 
 func init() {
-	databaseURL, ok := os.LookupEnv("PG_URL")
+	// migrations run as the owner of the tables, the service itself connects as a role without these rights
+	databaseURL, ok := os.LookupEnv("PG_MIGRATE_URL")
 	if !ok || len(databaseURL) == 0 {
-		log.Fatalf("migrate: environment variable not declared: PG_URL")
+		log.Fatalf("migrate: environment variable not declared: PG_MIGRATE_URL")
 	}
 
 	databaseURL += "?sslmode=disable"
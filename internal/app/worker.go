@@ -2,57 +2,323 @@ package app
 
 import (
 	"context"
+	"errors"
 	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/service"
 	log "github.com/sirupsen/logrus"
 	"time"
 )
 
+const (
+	pollInterval  = 45 * time.Second
+	listenRetry   = 5 * time.Second
+	purgeInterval = time.Hour
+	// minWait is the shortest pause between rounds of the worker, it doubles after every failed round
+	minWait = time.Second
+	// webhookInterval is the pause between delivery rounds, a round with a full batch is followed at once
+	webhookInterval = 5 * time.Second
+)
+
 func RunWorker(services *service.Services) {
 	// TODO: Реализовать graceful shutdown
+	ctx := context.Background()
+
+	wakeup := make(chan struct{}, 1)
+	go listenNewTasks(ctx, services.TaskDelete, wakeup)
+
+	failures := 0
 	for {
-		time.Sleep(45 * time.Second)
+		var wait time.Duration
+		wait, failures = workerRound(ctx, services, failures)
+
+		// new tasks do not cut the pause after a failed round short
+		newTasks := wakeup
+		if failures > 0 {
+			newTasks = nil
+		}
 
-		ctx := context.Background()
-		tasks, err := services.TaskDelete.GetExpiredTasks(ctx)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-newTasks:
+			timer.Stop()
+		}
+	}
+}
+
+// workerRound completes the expired tasks of every tenant and returns the pause before the next round with
+// the number of failed rounds in a row. A task that is past due and keeps failing would otherwise be retried
+// without a pause, so the pause is at least minWait and doubles after every failed round up to pollInterval.
+func workerRound(ctx context.Context, services *service.Services, failures int) (time.Duration, int) {
+	wait := pollInterval
+	failed := false
+	for _, tenantCtx := range tenantContexts(ctx, services.Tenant) {
+		if !completeExpiredTasks(tenantCtx, services) {
+			failed = true
+		}
+		if next := nextWakeup(tenantCtx, services.TaskDelete); next < wait {
+			wait = next
+		}
+	}
+
+	if !failed {
+		return max(wait, minWait), 0
+	}
+	failures++
+	backoff := pollInterval
+	if failures < 8 {
+		backoff = min(minWait<<failures, pollInterval)
+	}
+	return max(wait, backoff), failures
+}
+
+// completeExpiredTasks reports whether the expired tasks of the tenant were completed
+func completeExpiredTasks(ctx context.Context, services *service.Services) bool {
+	tasks, err := services.TaskDelete.GetExpiredTasks(ctx)
+	if err != nil {
+		log.Errorf("App - completeExpiredTasks - services.TaskDelete.GetExpiredTasks: %v", err)
+		return false
+	}
+
+	if len(tasks) > 0 {
+		err = services.TaskDelete.CompleteTasks(ctx, tasks, handler(ctx, services.User))
 		if err != nil {
-			log.Errorf("App - RunWorker - services.TaskDelete.GetExpiredTasks: %v", err)
+			log.Errorf("App - completeExpiredTasks - services.TaskDelete.CompleteTasks: %v", err)
+			return false
+		}
+	}
+	return true
+}
+
+func RunArchivePurger(services *service.Services, retention time.Duration) {
+	ctx := context.Background()
+	for {
+		for _, tenantCtx := range tenantContexts(ctx, services.Tenant) {
+			count, err := services.Segment.PurgeArchived(tenantCtx, retention)
+			if err != nil {
+				log.Errorf("App - RunArchivePurger - services.Segment.PurgeArchived: %v", err)
+			} else if count > 0 {
+				log.Infof("App - RunArchivePurger - purged archived segments: %d", count)
+			}
+		}
+		time.Sleep(purgeInterval)
+	}
+}
+
+// tenantContexts returns a context for each tenant, background jobs see the data of one tenant at a time
+func tenantContexts(ctx context.Context, tenantService service.Tenant) []context.Context {
+	tenants, err := tenantService.ListTenants(ctx)
+	if err != nil {
+		log.Errorf("App - tenantContexts - tenantService.ListTenants: %v", err)
+		return nil
+	}
+
+	contexts := make([]context.Context, 0, len(tenants))
+	for _, tenant := range tenants {
+		contexts = append(contexts, service.WithTenant(ctx, tenant.TenantID))
+	}
+	return contexts
+}
+
+func RunIdempotencyPurger(services *service.Services) {
+	ctx := context.Background()
+	for {
+		count, err := services.Idempotency.PurgeExpired(ctx)
+		if err != nil {
+			log.Errorf("App - RunIdempotencyPurger - services.Idempotency.PurgeExpired: %v", err)
+		} else if count > 0 {
+			log.Infof("App - RunIdempotencyPurger - purged idempotency keys: %d", count)
+		}
+		time.Sleep(purgeInterval)
+	}
+}
+
+// nextWakeup returns the time until the earliest pending deadline, polling is kept as a fallback
+func nextWakeup(ctx context.Context, taskService service.TaskDelete) time.Duration {
+	wait, err := taskService.GetNextDeadline(ctx)
+	if err != nil {
+		if !errors.Is(err, service.ErrNoPendingTasks) {
+			log.Errorf("App - nextWakeup - taskService.GetNextDeadline: %v", err)
+		}
+		return pollInterval
+	}
+	if wait > pollInterval {
+		return pollInterval
+	}
+	return wait
+}
+
+func listenNewTasks(ctx context.Context, taskService service.TaskDelete, wakeup chan<- struct{}) {
+	notify := func() {
+		select {
+		case wakeup <- struct{}{}:
+		default:
+		}
+	}
+
+	for {
+		err := taskService.ListenNewTasks(ctx, notify)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Errorf("App - listenNewTasks - taskService.ListenNewTasks: %v", err)
+		time.Sleep(listenRetry)
+	}
+}
+
+// RunWebhookDispatcher sends due webhook deliveries of every tenant and purges old delivery logs
+func RunWebhookDispatcher(services *service.Services, retention time.Duration) {
+	ctx := context.Background()
+	lastPurge := time.Time{}
+	for {
+		purge := time.Since(lastPurge) >= purgeInterval
+		if purge {
+			lastPurge = time.Now()
 		}
 
-		err = services.TaskDelete.CompleteTasks(ctx, tasks, handler(services.User))
+		busy := false
+		for _, tenantCtx := range tenantContexts(ctx, services.Tenant) {
+			if sendDeliveries(tenantCtx, services.Webhook) {
+				busy = true
+			}
+			if purge {
+				purgeDeliveries(tenantCtx, services.Webhook, retention)
+			}
+		}
+
+		if !busy {
+			time.Sleep(webhookInterval)
+		}
+	}
+}
+
+// sendDeliveries sends due deliveries until none are left or the time is up, it reports whether deliveries remain
+func sendDeliveries(ctx context.Context, webhookService service.Webhook) bool {
+	deadline := time.Now().Add(webhookInterval)
+	for time.Now().Before(deadline) {
+		count, err := webhookService.SendDeliveries(ctx)
 		if err != nil {
-			log.Errorf("App - RunWorker - services.TaskDelete.CompleteTasks: %v", err)
+			log.Errorf("App - sendDeliveries - webhookService.SendDeliveries: %v", err)
+			return false
+		}
+		if count == 0 {
+			return false
 		}
 	}
+	return true
+}
+
+func purgeDeliveries(ctx context.Context, webhookService service.Webhook, retention time.Duration) {
+	count, err := webhookService.PurgeDeliveries(ctx, retention)
+	if err != nil {
+		log.Errorf("App - purgeDeliveries - webhookService.PurgeDeliveries: %v", err)
+	} else if count > 0 {
+		log.Infof("App - purgeDeliveries - purged webhook deliveries: %d", count)
+	}
 }
 
-func handler(userService service.User) func([]entity.Task) error {
+// RunKeyCacheInvalidator drops cached API keys revoked or rotated by cmd/apikey or another instance
+func RunKeyCacheInvalidator(services *service.Services) {
+	ctx := context.Background()
+	for {
+		err := services.Auth.ListenKeyChanges(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Errorf("App - RunKeyCacheInvalidator - services.Auth.ListenKeyChanges: %v", err)
+		time.Sleep(listenRetry)
+	}
+}
+
+func handler(ctx context.Context, userService service.User) func([]entity.Task) error {
 	return func(tasks []entity.Task) error {
-		ctx := context.Background()
 		for _, setSegmentsInput := range getSegmentsInput(tasks) {
 			log.Debug(setSegmentsInput) // todo
-			if err := userService.SetSegments(ctx, setSegmentsInput); err != nil {
+			err := userService.SetSegments(ctx, setSegmentsInput)
+			if err == nil {
+				continue
+			}
+			if !unappliable(err) {
 				return err
 			}
+
+			// one operation cannot be applied, the others of the user are applied one by one so they are not lost
+			log.Warnf("App - handler - userService.SetSegments: %v, user %s, applying tasks one by one", err, setSegmentsInput.UserID)
+			for _, singleInput := range splitSegmentsInput(setSegmentsInput) {
+				if err = userService.SetSegments(ctx, singleInput); err != nil {
+					if !unappliable(err) {
+						return err
+					}
+					log.Warnf("App - handler - userService.SetSegments: %v, user %s", err, singleInput.UserID)
+				}
+			}
 		}
 		return nil
 	}
 }
 
+// unappliable reports whether a task cannot be applied and is done anyway: the segment was deleted, filled up
+// or lost its prerequisite after the task had been scheduled
+func unappliable(err error) bool {
+	return errors.Is(err, service.ErrSegmentNotFound) || errors.Is(err, service.ErrSegmentCapacity) ||
+		errors.Is(err, service.ErrPrerequisiteMissing)
+}
+
+// getSegmentsInput groups tasks by user, tasks are sorted by deadline so the latest operation on a segment wins.
+// Segments keep the order of their tasks.
 func getSegmentsInput(tasks []entity.Task) []service.SetSegmentsUserInput {
-	usersMap := make(map[string][]string)
+	usersOrder := make([]string, 0, len(tasks))
+	segmentsOrder := make(map[string][]string)
+	usersMap := make(map[string]map[string]string)
 	for _, task := range tasks {
-		usersMap[task.UserID] = append(usersMap[task.UserID], task.SegmentSlug)
+		if _, ok := usersMap[task.UserID]; !ok {
+			usersMap[task.UserID] = make(map[string]string)
+			usersOrder = append(usersOrder, task.UserID)
+		}
+		if _, ok := usersMap[task.UserID][task.SegmentSlug]; !ok {
+			segmentsOrder[task.UserID] = append(segmentsOrder[task.UserID], task.SegmentSlug)
+		}
+		usersMap[task.UserID][task.SegmentSlug] = task.Operation
 	}
 
 	result := make([]service.SetSegmentsUserInput, 0, len(usersMap))
-	for userID, segmentsDel := range usersMap {
-		result = append(result, service.SetSegmentsUserInput{
-			UserID:      userID,
-			SegmentsAdd: make([]string, 0, 1),
-			SegmentsDel: segmentsDel,
-			TTL:         0,
-		})
+	for _, userID := range usersOrder {
+		input := newTaskInput(userID)
+		for _, segment := range segmentsOrder[userID] {
+			if usersMap[userID][segment] == entity.OperationTypeAdd {
+				input.SegmentsAdd = append(input.SegmentsAdd, segment)
+			} else {
+				input.SegmentsDel = append(input.SegmentsDel, segment)
+			}
+		}
+		result = append(result, input)
 	}
 	return result
 }
+
+// splitSegmentsInput returns an input for every operation of the user, removals first
+func splitSegmentsInput(input service.SetSegmentsUserInput) []service.SetSegmentsUserInput {
+	result := make([]service.SetSegmentsUserInput, 0, len(input.SegmentsAdd)+len(input.SegmentsDel))
+	for _, segment := range input.SegmentsDel {
+		single := newTaskInput(input.UserID)
+		single.SegmentsDel = append(single.SegmentsDel, segment)
+		result = append(result, single)
+	}
+	for _, segment := range input.SegmentsAdd {
+		single := newTaskInput(input.UserID)
+		single.SegmentsAdd = append(single.SegmentsAdd, segment)
+		result = append(result, single)
+	}
+	return result
+}
+
+func newTaskInput(userID string) service.SetSegmentsUserInput {
+	return service.SetSegmentsUserInput{
+		UserID:      userID,
+		SegmentsAdd: make([]string, 0, 1),
+		SegmentsDel: make([]string, 0, 1),
+		TTL:         0,
+		// expired prerequisites take their dependent segments with them
+		Cascade: true,
+	}
+}
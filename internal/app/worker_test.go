@@ -0,0 +1,195 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/service"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeUserService applies inputs that do not touch a failing segment and records them
+type fakeUserService struct {
+	service.User
+	failing map[string]error
+	applied []service.SetSegmentsUserInput
+}
+
+func (f *fakeUserService) SetSegments(_ context.Context, input service.SetSegmentsUserInput) error {
+	for _, segment := range append(append([]string{}, input.SegmentsAdd...), input.SegmentsDel...) {
+		if err, ok := f.failing[segment]; ok {
+			return err
+		}
+	}
+	f.applied = append(f.applied, input)
+	return nil
+}
+
+func task(userID, segment, operation string) entity.Task {
+	return entity.Task{UserID: userID, SegmentSlug: segment, Operation: operation, Deadline: time.Now()}
+}
+
+func TestGetSegmentsInput(t *testing.T) {
+	tasks := []entity.Task{
+		task("1", "B", entity.OperationTypeDelete),
+		task("2", "A", entity.OperationTypeAdd),
+		task("1", "A", entity.OperationTypeAdd),
+		task("1", "C", entity.OperationTypeDelete),
+		task("1", "B", entity.OperationTypeAdd),
+	}
+
+	got := getSegmentsInput(tasks)
+
+	want := []service.SetSegmentsUserInput{
+		{UserID: "1", SegmentsAdd: []string{"B", "A"}, SegmentsDel: []string{"C"}, Cascade: true},
+		{UserID: "2", SegmentsAdd: []string{"A"}, SegmentsDel: []string{}, Cascade: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("getSegmentsInput() = %+v, want %+v", got, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tasks := []entity.Task{
+		task("1", "TTL_1", entity.OperationTypeDelete),
+		task("1", "FULL", entity.OperationTypeAdd),
+		task("1", "TTL_2", entity.OperationTypeDelete),
+		task("1", "NEW", entity.OperationTypeAdd),
+		task("2", "TTL_1", entity.OperationTypeDelete),
+	}
+
+	tests := []struct {
+		name    string
+		failing map[string]error
+		want    []service.SetSegmentsUserInput
+		wantErr error
+	}{
+		{
+			name: "applied at once",
+			want: []service.SetSegmentsUserInput{
+				{UserID: "1", SegmentsAdd: []string{"FULL", "NEW"}, SegmentsDel: []string{"TTL_1", "TTL_2"}, Cascade: true},
+				{UserID: "2", SegmentsAdd: []string{}, SegmentsDel: []string{"TTL_1"}, Cascade: true},
+			},
+		},
+		{
+			name:    "unappliable task is skipped alone",
+			failing: map[string]error{"FULL": &service.SegmentCapacityError{Slug: "FULL"}},
+			want: []service.SetSegmentsUserInput{
+				{UserID: "1", SegmentsAdd: []string{}, SegmentsDel: []string{"TTL_1"}, Cascade: true},
+				{UserID: "1", SegmentsAdd: []string{}, SegmentsDel: []string{"TTL_2"}, Cascade: true},
+				{UserID: "1", SegmentsAdd: []string{"NEW"}, SegmentsDel: []string{}, Cascade: true},
+				{UserID: "2", SegmentsAdd: []string{}, SegmentsDel: []string{"TTL_1"}, Cascade: true},
+			},
+		},
+		{
+			name: "every unappliable task is skipped",
+			failing: map[string]error{
+				"FULL":  &service.PrerequisiteError{Slug: "FULL", Prerequisite: "BASE"},
+				"TTL_2": service.ErrSegmentNotFound,
+			},
+			want: []service.SetSegmentsUserInput{
+				{UserID: "1", SegmentsAdd: []string{}, SegmentsDel: []string{"TTL_1"}, Cascade: true},
+				{UserID: "1", SegmentsAdd: []string{"NEW"}, SegmentsDel: []string{}, Cascade: true},
+				{UserID: "2", SegmentsAdd: []string{}, SegmentsDel: []string{"TTL_1"}, Cascade: true},
+			},
+		},
+		{
+			name:    "other errors stop the batch",
+			failing: map[string]error{"NEW": errors.New("connection refused")},
+			wantErr: errors.New("connection refused"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userService := &fakeUserService{failing: tt.failing}
+
+			err := handler(context.Background(), userService)(tasks)
+
+			if (err == nil) != (tt.wantErr == nil) || (err != nil && err.Error() != tt.wantErr.Error()) {
+				t.Fatalf("handler() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(userService.applied, tt.want) {
+				t.Fatalf("applied = %+v, want %+v", userService.applied, tt.want)
+			}
+		})
+	}
+}
+
+type fakeTenantService struct {
+	service.Tenant
+}
+
+func (fakeTenantService) ListTenants(context.Context) ([]entity.Tenant, error) {
+	return []entity.Tenant{{TenantID: entity.DefaultTenantID}}, nil
+}
+
+// fakeTaskService always has an expired task, completing it fails with completeErr
+type fakeTaskService struct {
+	service.TaskDelete
+	completeErr error
+	completions int
+}
+
+func (f *fakeTaskService) GetExpiredTasks(context.Context) ([]entity.Task, error) {
+	return []entity.Task{task("1", "TTL", entity.OperationTypeDelete)}, nil
+}
+
+func (f *fakeTaskService) GetNextDeadline(context.Context) (time.Duration, error) {
+	return 0, nil
+}
+
+func (f *fakeTaskService) CompleteTasks(_ context.Context, _ []entity.Task, _ func([]entity.Task) error) error {
+	f.completions++
+	return f.completeErr
+}
+
+func TestWorkerRound(t *testing.T) {
+	tests := []struct {
+		name        string
+		completeErr error
+		want        []time.Duration
+	}{
+		{
+			name: "past due task is completed",
+			want: []time.Duration{minWait, minWait, minWait},
+		},
+		{
+			name:        "past due task keeps failing",
+			completeErr: errors.New("connection refused"),
+			want: []time.Duration{
+				2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second,
+				pollInterval, pollInterval, pollInterval, pollInterval, pollInterval, pollInterval,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskService := &fakeTaskService{completeErr: tt.completeErr}
+			services := &service.Services{Tenant: fakeTenantService{}, TaskDelete: taskService}
+
+			failures := 0
+			for i, want := range tt.want {
+				var wait time.Duration
+				wait, failures = workerRound(context.Background(), services, failures)
+				if wait != want {
+					t.Fatalf("round %d: wait = %v, want %v", i, wait, want)
+				}
+			}
+			if taskService.completions != len(tt.want) {
+				t.Errorf("completions = %d, want %d", taskService.completions, len(tt.want))
+			}
+		})
+	}
+
+	t.Run("success after failures resets the pause", func(t *testing.T) {
+		services := &service.Services{Tenant: fakeTenantService{}, TaskDelete: &fakeTaskService{}}
+		wait, failures := workerRound(context.Background(), services, 5)
+		if wait != minWait || failures != 0 {
+			t.Fatalf("workerRound() = %v, %d, want %v, 0", wait, failures, minWait)
+		}
+	})
+}
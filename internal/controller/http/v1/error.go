@@ -7,8 +7,13 @@ import (
 )
 
 var (
-	ErrInvalidAuthHeader = fmt.Errorf("invalid auth header")
-	ErrCannotParseToken  = fmt.Errorf("cannot parse API key")
+	ErrInvalidAuthHeader     = fmt.Errorf("invalid auth header")
+	ErrCannotParseToken      = fmt.Errorf("cannot parse API key")
+	ErrInvalidIfMatch        = fmt.Errorf("If-Match must contain a version from ETag or *")
+	ErrWeakIfMatch           = fmt.Errorf("If-Match does not match weak entity tags")
+	ErrInvalidIdempotencyKey = fmt.Errorf("idempotency key is too long")
+	ErrMissingScope          = fmt.Errorf("API key does not have the required scope")
+	ErrRateLimited           = fmt.Errorf("rate limit exceeded")
 )
 
 func newErrorResponse(c echo.Context, errStatus int, message string) {
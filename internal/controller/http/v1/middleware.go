@@ -1,14 +1,33 @@
 package v1
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/labstack/echo/v4"
+	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/service"
+	"github.com/passionde/user-segmentation-service/pkg/jwtauth"
+	log "github.com/sirupsen/logrus"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
 const (
 	userIdCtx = "keyId"
+	apiKeyCtx = "apiKey"
+
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+
+	rateLimitLimitHeader     = "RateLimit-Limit"
+	rateLimitRemainingHeader = "RateLimit-Remaining"
+	rateLimitResetHeader     = "RateLimit-Reset"
 )
 
 type AuthMiddleware struct {
@@ -23,18 +42,52 @@ func (h *AuthMiddleware) UserIdentity(next echo.HandlerFunc) echo.HandlerFunc {
 			return nil
 		}
 
-		userId, err := h.authService.TokenExist(c.Request().Context(), token)
+		// a JWT of the identity provider is accepted in place of an API key
+		var key entity.APIKey
+		var err error
+		if jwtauth.IsJWT(token) {
+			key, err = h.authService.VerifyJWT(c.Request().Context(), token)
+		} else {
+			key, err = h.authService.TokenExist(c.Request().Context(), token)
+		}
 		if err != nil {
+			if errors.Is(err, service.ErrKeyExpired) || errors.Is(err, service.ErrKeyRevoked) || errors.Is(err, service.ErrTokenExpired) {
+				newErrorResponse(c, http.StatusUnauthorized, err.Error())
+				return err
+			}
 			newErrorResponse(c, http.StatusUnauthorized, ErrCannotParseToken.Error())
 			return err
 		}
 
-		c.Set(userIdCtx, userId)
+		c.Set(userIdCtx, key.ID)
+		c.Set(apiKeyCtx, key)
+		ctx := service.WithTenant(service.WithAccess(c.Request().Context(), key), key.TenantID)
+		c.SetRequest(c.Request().WithContext(ctx))
 
 		return next(c)
 	}
 }
 
+// RequireScope allows GET requests to keys with readScope and other requests to keys with writeScope
+func RequireScope(readScope, writeScope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			scope := writeScope
+			if c.Request().Method == http.MethodGet || c.Request().Method == http.MethodHead {
+				scope = readScope
+			}
+
+			key, _ := c.Get(apiKeyCtx).(entity.APIKey)
+			if !key.HasScope(scope) {
+				newErrorResponse(c, http.StatusForbidden, fmt.Sprintf("%s: %s", ErrMissingScope, scope))
+				return nil
+			}
+
+			return next(c)
+		}
+	}
+}
+
 func bearerToken(r *http.Request) (string, bool) {
 	const prefix = "Bearer "
 
@@ -49,3 +102,131 @@ func bearerToken(r *http.Request) (string, bool) {
 
 	return "", false
 }
+
+type RateLimitMiddleware struct {
+	rateLimitService service.RateLimit
+}
+
+// Limit rejects requests of a key that has used up its bucket with 429 and tells when to retry.
+// Requests are let through when the limiter is unavailable.
+func (h *RateLimitMiddleware) Limit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key, _ := c.Get(apiKeyCtx).(entity.APIKey)
+		result, err := h.rateLimitService.Allow(c.Request().Context(), key)
+		if err != nil {
+			log.Errorf("RateLimitMiddleware.Limit - h.rateLimitService.Allow: %v", err)
+			return next(c)
+		}
+
+		header := c.Response().Header()
+		header.Set(rateLimitLimitHeader, strconv.Itoa(result.Limit))
+		header.Set(rateLimitRemainingHeader, strconv.Itoa(result.Remaining))
+		header.Set(rateLimitResetHeader, strconv.Itoa(int(result.Reset.Seconds())))
+		if !result.Allowed {
+			header.Set(echo.HeaderRetryAfter, strconv.Itoa(int(result.RetryAfter.Seconds())))
+			newErrorResponse(c, http.StatusTooManyRequests, ErrRateLimited.Error())
+			return nil
+		}
+
+		return next(c)
+	}
+}
+
+type IdempotencyMiddleware struct {
+	idempotencyService service.Idempotency
+}
+
+// Idempotent stores the response of a mutating request sent with the Idempotency-Key header
+// and replays it for retries with the same key and payload
+func (h *IdempotencyMiddleware) Idempotent(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		method := c.Request().Method
+		key := c.Request().Header.Get(idempotencyKeyHeader)
+		if key == "" || method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions {
+			return next(c)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			newErrorResponse(c, http.StatusBadRequest, ErrInvalidIdempotencyKey.Error())
+			return nil
+		}
+
+		// stored responses belong to the API key or to the subject of the JWT
+		apiKey, _ := c.Get(apiKeyCtx).(entity.APIKey)
+		principal := apiKey.Principal()
+
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+			return err
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+		input := service.BeginIdempotentInput{
+			Principal:      principal,
+			IdempotencyKey: key,
+			RequestHash:    requestHash(method, c.Request().URL.RequestURI(), body),
+		}
+
+		stored, err := h.idempotencyService.Begin(c.Request().Context(), input)
+		if err != nil {
+			if errors.Is(err, service.ErrIdempotencyKeyReused) {
+				newErrorResponse(c, http.StatusUnprocessableEntity, err.Error())
+				return err
+			}
+			if errors.Is(err, service.ErrIdempotencyInProgress) {
+				newErrorResponse(c, http.StatusConflict, err.Error())
+				return err
+			}
+			newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+			return err
+		}
+		if stored != nil {
+			c.Response().Header().Set(idempotentReplayedHeader, "true")
+			if len(stored.Body) == 0 {
+				return c.NoContent(*stored.Status)
+			}
+			return c.Blob(*stored.Status, stored.ContentType, stored.Body)
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = recorder
+		err = next(c)
+
+		// server errors are not stored, the retry has to be processed again
+		status := c.Response().Status
+		if !c.Response().Committed || status >= http.StatusInternalServerError {
+			_ = h.idempotencyService.Release(c.Request().Context(), input)
+			return err
+		}
+
+		completeErr := h.idempotencyService.Complete(c.Request().Context(), entity.IdempotentRequest{
+			Principal:      principal,
+			IdempotencyKey: key,
+			Status:         &status,
+			ContentType:    c.Response().Header().Get(echo.HeaderContentType),
+			Body:           recorder.body.Bytes(),
+		})
+		if completeErr != nil {
+			_ = h.idempotencyService.Release(c.Request().Context(), input)
+		}
+		return err
+	}
+}
+
+func requestHash(method, uri string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(method + " " + uri + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder keeps a copy of the response body written to the client
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
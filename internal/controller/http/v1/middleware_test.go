@@ -0,0 +1,69 @@
+package v1
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeIdempotencyService reserves every key and records the callers it was asked for
+type fakeIdempotencyService struct {
+	service.Idempotency
+	principals []string
+	completed  []entity.IdempotentRequest
+}
+
+func (f *fakeIdempotencyService) Begin(_ context.Context, input service.BeginIdempotentInput) (*entity.IdempotentRequest, error) {
+	f.principals = append(f.principals, input.Principal)
+	return nil, nil
+}
+
+func (f *fakeIdempotencyService) Complete(_ context.Context, request entity.IdempotentRequest) error {
+	f.completed = append(f.completed, request)
+	return nil
+}
+
+func TestIdempotentPrincipal(t *testing.T) {
+	tests := []struct {
+		name string
+		key  entity.APIKey
+		want string
+	}{
+		{"api key", entity.APIKey{ID: 7, TenantID: entity.DefaultTenantID}, "key:7"},
+		{"jwt", entity.APIKey{Actor: "billing", TenantID: entity.DefaultTenantID}, "jwt:billing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idempotencyService := &fakeIdempotencyService{}
+			middleware := &IdempotencyMiddleware{idempotencyService}
+			handler := middleware.Idempotent(func(c echo.Context) error {
+				return c.NoContent(http.StatusCreated)
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/users/create", strings.NewReader(`{"user_id":"1000"}`))
+			req.Header.Set(idempotencyKeyHeader, "key")
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			c.Set(apiKeyCtx, tt.key)
+
+			if err := handler(c); err != nil {
+				t.Fatalf("Idempotent() error = %v", err)
+			}
+			if rec.Code != http.StatusCreated {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusCreated)
+			}
+			if len(idempotencyService.principals) != 1 || idempotencyService.principals[0] != tt.want {
+				t.Errorf("Begin() principals = %v, want [%s]", idempotencyService.principals, tt.want)
+			}
+			if len(idempotencyService.completed) != 1 || idempotencyService.completed[0].Principal != tt.want {
+				t.Errorf("Complete() = %+v, want the response stored for %s", idempotencyService.completed, tt.want)
+			}
+		})
+	}
+}
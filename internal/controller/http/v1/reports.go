@@ -1,12 +1,10 @@
 package v1
 
 import (
-	"fmt"
+	"errors"
 	"github.com/labstack/echo/v4"
 	"github.com/passionde/user-segmentation-service/internal/service"
 	"net/http"
-	"os"
-	"path"
 )
 
 type reportsRoutes struct {
@@ -17,15 +15,29 @@ func newReportsRoutes(g *echo.Group, historyService service.History) {
 	r := reportsRoutes{
 		historyService: historyService,
 	}
-	g.GET("/:fileName", r.downloadFile)
+	g.GET("/:reportID", r.downloadFile)
 }
 
+// @Summary Скачивание CSV отчета
+// @Description Этот эндпоинт позволяет скачать отчет по ссылке из report-link. Отчет доступен только ключам арендатора, для которого он создан.
+// @Tags History
+// @ID downloadReport
+// @Produce text/csv
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param reportID path string true "Идентификатор отчета"
+// @Success 200 {file} file "CSV отчет"
+// @Failure 404 {object} echo.HTTPError "Отчет не найден"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /reports/{reportID} [get]
 func (r *reportsRoutes) downloadFile(c echo.Context) error {
-	fileName := path.Clean(c.Param("fileName"))
-	filePath := fmt.Sprintf("reports/%s", fileName)
-	file, err := os.Open(filePath)
+	file, err := r.historyService.GetReport(c.Request().Context(), c.Param("reportID"))
 	if err != nil {
-		return c.String(http.StatusNotFound, "File not found")
+		if errors.Is(err, service.ErrReportNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
 	}
 	defer file.Close()
 	return c.Stream(http.StatusOK, "text/csv", file)
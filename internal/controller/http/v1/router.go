@@ -4,6 +4,7 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	_ "github.com/passionde/user-segmentation-service/docs"
+	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/service"
 	log "github.com/sirupsen/logrus"
 	echoSwagger "github.com/swaggo/echo-swagger"
@@ -20,17 +21,40 @@ func NewRouter(handler *echo.Echo, services *service.Services) {
 	handler.GET("/health", func(c echo.Context) error { return c.NoContent(200) })
 	handler.GET("/swagger/*", echoSwagger.WrapHandler)
 
-	reportsGroup := handler.Group("/reports")
-	{
-		newReportsRoutes(reportsGroup, services.History)
-	}
+	newAPIRoutes(handler, services)
+}
 
+// newAPIRoutes registers the routes that require authentication
+func newAPIRoutes(handler *echo.Echo, services *service.Services) {
 	authMiddleware := &AuthMiddleware{services.Auth}
-	v1 := handler.Group("/api/v1", authMiddleware.UserIdentity)
+	rateLimitMiddleware := &RateLimitMiddleware{services.RateLimit}
+	// reports hold the history of a tenant, they are served to its keys only
+	newReportsRoutes(handler.Group("/reports", authMiddleware.UserIdentity, rateLimitMiddleware.Limit,
+		RequireScope(entity.ScopeHistoryRead, entity.ScopeHistoryRead)),
+		services.History)
+
+	idempotencyMiddleware := &IdempotencyMiddleware{services.Idempotency}
+	// scopes are checked before idempotency, so a stored response is not replayed to a key without access
+	v1 := handler.Group("/api/v1", authMiddleware.UserIdentity, rateLimitMiddleware.Limit)
 	{
-		newUserRoutes(v1.Group("/users"), services.User)
-		newSegmentRoutes(v1.Group("/segments"), services.Segment)
-		newHistoryRoutes(v1.Group("/history"), services.History)
+		// the export discloses the history of the user, erasing, merging and deleting users can not be undone
+		newUserRoutes(
+			v1.Group("/users", RequireScope(entity.ScopeSegmentsRead, entity.ScopeUsersWrite), idempotencyMiddleware.Idempotent),
+			v1.Group("/users", RequireScope(entity.ScopeHistoryRead, entity.ScopeHistoryRead), idempotencyMiddleware.Idempotent),
+			v1.Group("/users", RequireScope(entity.ScopeAdmin, entity.ScopeAdmin), idempotencyMiddleware.Idempotent),
+			services.User)
+		newSegmentRoutes(v1.Group("/segments",
+			RequireScope(entity.ScopeSegmentsRead, entity.ScopeSegmentsWrite), idempotencyMiddleware.Idempotent),
+			services.Segment)
+		newHistoryRoutes(v1.Group("/history",
+			RequireScope(entity.ScopeHistoryRead, entity.ScopeHistoryRead), idempotencyMiddleware.Idempotent),
+			services.History)
+		newScheduleRoutes(v1.Group("/schedule",
+			RequireScope(entity.ScopeSegmentsRead, entity.ScopeUsersWrite), idempotencyMiddleware.Idempotent),
+			services.TaskDelete)
+		newWebhookRoutes(v1.Group("/webhooks",
+			RequireScope(entity.ScopeWebhooks, entity.ScopeWebhooks), idempotencyMiddleware.Idempotent),
+			services.Webhook)
 	}
 }
 
@@ -0,0 +1,70 @@
+package v1
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/service"
+	"github.com/passionde/user-segmentation-service/pkg/ratelimit"
+	"github.com/passionde/user-segmentation-service/pkg/validator"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeAuthService grants the scopes listed in the token, separated by commas
+type fakeAuthService struct {
+	service.Auth
+}
+
+func (fakeAuthService) TokenExist(_ context.Context, token string) (entity.APIKey, error) {
+	return entity.APIKey{ID: 1, TenantID: entity.DefaultTenantID, Scopes: strings.Split(token, ",")}, nil
+}
+
+type fakeRateLimitService struct{}
+
+func (fakeRateLimitService) Allow(context.Context, entity.APIKey) (ratelimit.Result, error) {
+	return ratelimit.Result{Allowed: true}, nil
+}
+
+func TestUserRoutesScopes(t *testing.T) {
+	tests := []struct {
+		method    string
+		path      string
+		scopes    string
+		forbidden bool
+	}{
+		{http.MethodGet, "/api/v1/users/export", "segments:read,users:write", true},
+		{http.MethodGet, "/api/v1/users/export", "history:read", false},
+		{http.MethodPost, "/api/v1/users/erase", "users:write", true},
+		{http.MethodPost, "/api/v1/users/erase", "admin", false},
+		{http.MethodPost, "/api/v1/users/merge", "users:write", true},
+		{http.MethodPost, "/api/v1/users/merge", "admin", false},
+		{http.MethodDelete, "/api/v1/users/delete", "users:write", true},
+		{http.MethodDelete, "/api/v1/users/delete", "admin", false},
+		{http.MethodPost, "/api/v1/users/create", "history:read", true},
+		{http.MethodPost, "/api/v1/users/create", "users:write", false},
+	}
+
+	handler := echo.New()
+	handler.Validator = validator.NewCustomValidator()
+	newAPIRoutes(handler, &service.Services{Auth: fakeAuthService{}, RateLimit: fakeRateLimitService{}})
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path+" "+tt.scopes, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("{"))
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+tt.scopes)
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if forbidden := rec.Code == http.StatusForbidden; forbidden != tt.forbidden {
+				t.Errorf("status = %d, forbidden = %v, want %v", rec.Code, forbidden, tt.forbidden)
+			}
+			if rec.Code == http.StatusNotFound {
+				t.Errorf("route is not registered")
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package v1
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/service"
+	"net/http"
+	"time"
+)
+
+type scheduleRoutes struct {
+	taskService service.TaskDelete
+}
+
+func newScheduleRoutes(g *echo.Group, taskService service.TaskDelete) {
+	r := &scheduleRoutes{
+		taskService: taskService,
+	}
+	g.POST("/create", r.create)
+	g.GET("/user-tasks", r.getUserTasks)
+	g.DELETE("/cancel", r.cancel)
+}
+
+type scheduleTasksInput struct {
+	UsersID   []string  `json:"users_id" validate:"required,min=1,dive,required,max=40"`
+	Segments  []string  `json:"segments" validate:"required,min=1,dive,required,max=256"`
+	Operation string    `json:"operation" validate:"required,oneof=add delete"`
+	RunAt     time.Time `json:"run_at" validate:"required"`
+}
+
+type taskResponse struct {
+	TaskID      int       `json:"task_id"`
+	UserID      string    `json:"user_id"`
+	SegmentSlug string    `json:"segment_slug"`
+	Operation   string    `json:"operation"`
+	RunAt       time.Time `json:"run_at"`
+}
+
+type tasksResponse struct {
+	Tasks []taskResponse `json:"tasks"`
+}
+
+// @Summary Планирование изменения сегментов
+// @Description Этот эндпоинт позволяет запланировать добавление или удаление пользователей из сегментов на указанное время.
+// @Tags Schedule
+// @ID scheduleTasks
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body scheduleTasksInput true "Пользователи, сегменты, операция (add или delete) и время выполнения"
+// @Success 201 {object} tasksResponse "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 404 {object} echo.HTTPError "Сегмент не найден"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/schedule/create [post]
+func (s *scheduleRoutes) create(c echo.Context) error {
+	var input scheduleTasksInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	tasks, err := s.taskService.ScheduleTasks(c.Request().Context(), service.ScheduleTasksInput{
+		UsersID:   input.UsersID,
+		Segments:  input.Segments,
+		Operation: input.Operation,
+		RunAt:     input.RunAt,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrScheduleInPast) {
+			newErrorResponse(c, http.StatusBadRequest, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrSegmentNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, newTasksResponse(tasks))
+}
+
+type getUserTasksInput struct {
+	UserID string `json:"user_id" validate:"required,max=40"`
+}
+
+// @Summary Получение запланированных операций пользователя
+// @Description Этот эндпоинт позволяет получить список невыполненных запланированных операций пользователя, включая удаление по TTL.
+// @Tags Schedule
+// @ID getUserTasks
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param user_id query string true "Идентификатор пользователя"
+// @Success 200 {object} tasksResponse "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/schedule/user-tasks [get]
+func (s *scheduleRoutes) getUserTasks(c echo.Context) error {
+	input := getUserTasksInput{
+		UserID: c.QueryParams().Get("user_id"),
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	tasks, err := s.taskService.GetPendingTasks(c.Request().Context(), service.GetTasksUserInput{
+		UserID: input.UserID,
+	})
+	if err != nil {
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+
+	return c.JSON(http.StatusOK, newTasksResponse(tasks))
+}
+
+type cancelTaskInput struct {
+	TaskID int `json:"task_id" validate:"required"`
+}
+
+// @Summary Отмена запланированной операции
+// @Description Этот эндпоинт позволяет отменить еще не выполненную запланированную операцию.
+// @Tags Schedule
+// @ID cancelTask
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body cancelTaskInput true "Идентификатор операции"
+// @Success 204 "Успешная отмена"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 404 {object} echo.HTTPError "Операция не найдена"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/schedule/cancel [delete]
+func (s *scheduleRoutes) cancel(c echo.Context) error {
+	var input cancelTaskInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err := s.taskService.CancelTask(c.Request().Context(), service.CancelTaskInput{
+		TaskID: input.TaskID,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrTaskNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+	return c.NoContent(204)
+}
+
+func newTasksResponse(tasks []entity.Task) tasksResponse {
+	response := tasksResponse{Tasks: make([]taskResponse, 0, len(tasks))}
+	for _, task := range tasks {
+		response.Tasks = append(response.Tasks, taskResponse{
+			TaskID:      task.TaskID,
+			UserID:      task.UserID,
+			SegmentSlug: task.SegmentSlug,
+			Operation:   task.Operation,
+			RunAt:       task.Deadline,
+		})
+	}
+	return response
+}
@@ -3,8 +3,10 @@ package v1
 import (
 	"errors"
 	"github.com/labstack/echo/v4"
+	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/service"
 	"net/http"
+	"time"
 )
 
 type segmentRoutes struct {
@@ -16,20 +18,61 @@ func newSegmentRoutes(g *echo.Group, segmentService service.Segment) {
 		segmentService: segmentService,
 	}
 	g.POST("/create", r.create)
+	g.POST("/derive", r.derive)
 	g.DELETE("/delete", r.delete)
+	g.GET("/list", r.list)
+	g.PUT("/capacity", r.setCapacity)
+	g.PUT("/auto-enroll", r.setAutoEnroll)
+	g.PUT("/prerequisites", r.setPrerequisites)
+	g.PUT("/active-window", r.setActiveWindow)
+	g.POST("/restore", r.restore)
+	g.PUT("/rename", r.rename)
+	g.POST("/hierarchy/link", r.link)
+	g.DELETE("/hierarchy/unlink", r.unlink)
 }
 
 type createSegmentInput struct {
-	Slug            string `json:"slug" validate:"required,max=256"`
-	PercentageUsers int    `json:"percentageUsers" validate:"omitempty,min=1,max=10000"`
+	Slug            string     `json:"slug" validate:"required,max=256"`
+	PercentageUsers int        `json:"percentageUsers" validate:"omitempty,min=1,max=10000"`
+	ActiveFrom      *time.Time `json:"active_from"`
+	ActiveUntil     *time.Time `json:"active_until"`
+	MaxMembers      *int       `json:"max_members" validate:"omitempty,min=0"`
+	AutoEnroll      *int       `json:"auto_enroll" validate:"omitempty,min=1,max=10000"`
+	DryRun          bool       `json:"dry_run"`
 }
 
 type createSegmentResponse struct {
 	Slug string `json:"slug"`
 }
 
+type previewNoteResponse struct {
+	UserID      string `json:"user_id"`
+	SegmentSlug string `json:"segment_slug"`
+	Type        string `json:"type"`
+}
+
+type previewResponse struct {
+	History   []previewNoteResponse `json:"history"`
+	Conflicts []string              `json:"conflicts"`
+}
+
+func newPreviewResponse(preview entity.ChangePreview) previewResponse {
+	resp := previewResponse{
+		History:   make([]previewNoteResponse, 0, len(preview.History)),
+		Conflicts: preview.Conflicts,
+	}
+	for _, note := range preview.History {
+		resp.History = append(resp.History, previewNoteResponse{
+			UserID:      note.UserID,
+			SegmentSlug: note.SegmentSlug,
+			Type:        note.Type,
+		})
+	}
+	return resp
+}
+
 // @Summary Создание сегмента
-// @Description Этот эндпоинт позволяет создать новый сегмент
+// @Description Этот эндпоинт позволяет создать новый сегмент. При dry_run=true сегмент не создается, а возвращается история, которая была бы записана.
 // @Tags Segments
 // @ID createSegment
 // @Accept json
@@ -37,7 +80,9 @@ type createSegmentResponse struct {
 // @Param Authorization header string true "API KEY для аутентификации"
 // @Param input body createSegmentInput true "Данные для создания сегмента"
 // @Success 201 {object} createSegmentResponse "Успешное выполнение"
+// @Success 200 {object} previewResponse "Результат предварительного просмотра"
 // @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
 // @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
 // @Router /api/v1/segments/create [post]
 func (s *segmentRoutes) create(c echo.Context) error {
@@ -53,13 +98,29 @@ func (s *segmentRoutes) create(c echo.Context) error {
 		return err
 	}
 
-	err := s.segmentService.CreateSegment(c.Request().Context(), service.CreateSegmentInput{
+	createInput := service.CreateSegmentInput{
 		Slug:            input.Slug,
 		PercentageUsers: input.PercentageUsers,
-	})
+		ActiveFrom:      input.ActiveFrom,
+		ActiveUntil:     input.ActiveUntil,
+		MaxMembers:      input.MaxMembers,
+		AutoEnroll:      input.AutoEnroll,
+	}
+
+	var preview entity.ChangePreview
+	var err error
+	if input.DryRun {
+		preview, err = s.segmentService.PreviewCreateSegment(c.Request().Context(), createInput)
+	} else {
+		err = s.segmentService.CreateSegment(c.Request().Context(), createInput)
+	}
 
 	if err != nil {
-		if errors.Is(err, service.ErrSegmentAlreadyExists) {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrSegmentAlreadyExists) || errors.Is(err, service.ErrInvalidActiveWindow) {
 			newErrorResponse(c, http.StatusBadRequest, err.Error())
 			return err
 		}
@@ -67,17 +128,21 @@ func (s *segmentRoutes) create(c echo.Context) error {
 		return err
 	}
 
+	if input.DryRun {
+		return c.JSON(http.StatusOK, newPreviewResponse(preview))
+	}
 	return c.JSON(http.StatusCreated, createSegmentResponse{
 		Slug: input.Slug,
 	})
 }
 
 type deleteSegmentInput struct {
-	Slug string `json:"slug" validate:"required,max=256"`
+	Slug   string `json:"slug" validate:"required,max=256"`
+	DryRun bool   `json:"dry_run"`
 }
 
 // @Summary Удаление сегмента
-// @Description Этот эндпоинт позволяет удалить существующий сегмент.
+// @Description Этот эндпоинт позволяет удалить существующий сегмент. Сегмент переносится в архив и окончательно удаляется по истечении срока хранения. При dry_run=true сегмент не удаляется, а возвращается история, которая была бы записана.
 // @Tags Segments
 // @ID deleteSegment
 // @Accept json
@@ -85,7 +150,9 @@ type deleteSegmentInput struct {
 // @Param Authorization header string true "API KEY для аутентификации"
 // @Param input body deleteSegmentInput true "Данные для удаления сегмента"
 // @Success 204 "Успешное удаление"
+// @Success 200 {object} previewResponse "Результат предварительного просмотра"
 // @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
 // @Failure 404 {object} echo.HTTPError "Сегмент не найден"
 // @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
 // @Router /api/v1/segments/delete [delete]
@@ -102,10 +169,333 @@ func (s *segmentRoutes) delete(c echo.Context) error {
 		return err
 	}
 
-	err := s.segmentService.DeleteSegment(c.Request().Context(), service.SegmentInput{
+	segmentInput := service.SegmentInput{
 		Slug: input.Slug,
+	}
+
+	var preview entity.ChangePreview
+	var err error
+	if input.DryRun {
+		preview, err = s.segmentService.PreviewDeleteSegment(c.Request().Context(), segmentInput)
+	} else {
+		err = s.segmentService.DeleteSegment(c.Request().Context(), segmentInput)
+	}
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrSegmentNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+	if input.DryRun {
+		return c.JSON(http.StatusOK, newPreviewResponse(preview))
+	}
+	return c.NoContent(204)
+}
+
+type setActiveWindowInput struct {
+	Slug        string     `json:"slug" validate:"required,max=256"`
+	ActiveFrom  *time.Time `json:"active_from"`
+	ActiveUntil *time.Time `json:"active_until"`
+}
+
+// @Summary Изменение окна активности сегмента
+// @Description Этот эндпоинт позволяет задать период, в который сегмент активен. Вне периода сегмент не возвращается пользователям, но их членство сохраняется. Пустое значение границы снимает ограничение.
+// @Tags Segments
+// @ID setActiveWindow
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body setActiveWindowInput true "Сегмент и границы периода активности"
+// @Success 204 "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 404 {object} echo.HTTPError "Сегмент не найден"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/segments/active-window [put]
+func (s *segmentRoutes) setActiveWindow(c echo.Context) error {
+	var input setActiveWindowInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err := s.segmentService.SetActiveWindow(c.Request().Context(), service.SetActiveWindowInput{
+		Slug:        input.Slug,
+		ActiveFrom:  input.ActiveFrom,
+		ActiveUntil: input.ActiveUntil,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrInvalidActiveWindow) {
+			newErrorResponse(c, http.StatusBadRequest, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrSegmentNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+	return c.NoContent(204)
+}
+
+type restoreSegmentInput struct {
+	Slug string `json:"slug" validate:"required,max=256"`
+}
+
+// @Summary Восстановление сегмента
+// @Description Этот эндпоинт позволяет восстановить удаленный сегмент из архива вместе с членством пользователей.
+// @Tags Segments
+// @ID restoreSegment
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body restoreSegmentInput true "Данные для восстановления сегмента"
+// @Success 204 "Успешное восстановление"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 404 {object} echo.HTTPError "Сегмент не найден в архиве"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/segments/restore [post]
+func (s *segmentRoutes) restore(c echo.Context) error {
+	var input restoreSegmentInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err := s.segmentService.RestoreSegment(c.Request().Context(), service.SegmentInput{
+		Slug: input.Slug,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrArchivedNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+	return c.NoContent(204)
+}
+
+type renameSegmentInput struct {
+	Slug    string `json:"slug" validate:"required,max=256"`
+	NewSlug string `json:"new_slug" validate:"required,max=256"`
+}
+
+type renameSegmentResponse struct {
+	Slug string `json:"slug"`
+}
+
+// @Summary Переименование сегмента
+// @Description Этот эндпоинт позволяет переименовать сегмент. Членство пользователей и запланированные операции переносятся на новый slug, старый slug продолжает работать как псевдоним в запросах изменения сегментов пользователя в течение срока segments.alias_ttl.
+// @Tags Segments
+// @ID renameSegment
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body renameSegmentInput true "Текущий и новый slug сегмента"
+// @Success 200 {object} renameSegmentResponse "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или новый slug уже занят"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 404 {object} echo.HTTPError "Сегмент не найден"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/segments/rename [put]
+func (s *segmentRoutes) rename(c echo.Context) error {
+	var input renameSegmentInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err := s.segmentService.RenameSegment(c.Request().Context(), service.RenameSegmentInput{
+		Slug:    input.Slug,
+		NewSlug: input.NewSlug,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrSegmentAlreadyExists) {
+			newErrorResponse(c, http.StatusBadRequest, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrSegmentNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+
+	return c.JSON(http.StatusOK, renameSegmentResponse{
+		Slug: input.NewSlug,
+	})
+}
+
+type segmentExpression struct {
+	Op      string              `json:"op,omitempty" enums:"union,intersection,difference"`
+	Segment string              `json:"segment,omitempty"`
+	Args    []segmentExpression `json:"args,omitempty"`
+}
+
+type deriveSegmentInput struct {
+	Slug        string            `json:"slug" validate:"required,max=256"`
+	Expression  segmentExpression `json:"expression"`
+	Mode        string            `json:"mode" validate:"required,oneof=materialized live"`
+	ActiveFrom  *time.Time        `json:"active_from"`
+	ActiveUntil *time.Time        `json:"active_until"`
+}
+
+// @Summary Создание производного сегмента
+// @Description Этот эндпоинт позволяет создать сегмент из выражения над существующими сегментами (union, intersection, difference). В режиме materialized пользователи копируются в новый обычный сегмент, в режиме live состав сегмента вычисляется при каждом запросе.
+// @Tags Segments
+// @ID deriveSegment
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body deriveSegmentInput true "Данные для создания производного сегмента"
+// @Success 201 {object} createSegmentResponse "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос, выражение или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 404 {object} echo.HTTPError "Сегмент из выражения не найден"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/segments/derive [post]
+func (s *segmentRoutes) derive(c echo.Context) error {
+	var input deriveSegmentInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err := s.segmentService.CreateDerivedSegment(c.Request().Context(), service.CreateDerivedSegmentInput{
+		Slug:        input.Slug,
+		Expression:  toEntityExpression(input.Expression),
+		Materialize: input.Mode == "materialized",
+		ActiveFrom:  input.ActiveFrom,
+		ActiveUntil: input.ActiveUntil,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrSegmentAlreadyExists) ||
+			errors.Is(err, service.ErrInvalidExpression) ||
+			errors.Is(err, service.ErrInvalidActiveWindow) {
+			newErrorResponse(c, http.StatusBadRequest, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrSegmentNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, createSegmentResponse{
+		Slug: input.Slug,
+	})
+}
+
+func toEntityExpression(expr segmentExpression) entity.SegmentExpression {
+	result := entity.SegmentExpression{
+		Op:      expr.Op,
+		Segment: expr.Segment,
+	}
+	for _, arg := range expr.Args {
+		result.Args = append(result.Args, toEntityExpression(arg))
+	}
+	return result
+}
+
+type linkSegmentsInput struct {
+	Parent      string `json:"parent" validate:"required,max=256"`
+	Child       string `json:"child" validate:"required,max=256"`
+	Inheritance string `json:"inheritance" validate:"required,oneof=down up"`
+}
+
+// @Summary Связывание сегментов в иерархию
+// @Description Этот эндпоинт позволяет сделать один сегмент дочерним для другого. При наследовании down пользователи родителя считаются состоящими в дочернем сегменте, при наследовании up - наоборот. Связь, образующая цикл, отклоняется.
+// @Tags Segments
+// @ID linkSegments
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body linkSegmentsInput true "Родительский и дочерний сегменты, тип наследования"
+// @Success 201 "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос, связь уже существует или образует цикл"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 404 {object} echo.HTTPError "Сегмент не найден"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/segments/hierarchy/link [post]
+func (s *segmentRoutes) link(c echo.Context) error {
+	var input linkSegmentsInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err := s.segmentService.LinkSegments(c.Request().Context(), service.LinkSegmentsInput{
+		Parent:      input.Parent,
+		Child:       input.Child,
+		Inheritance: input.Inheritance,
 	})
 	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrHierarchyCycle) || errors.Is(err, service.ErrLinkAlreadyExists) {
+			newErrorResponse(c, http.StatusBadRequest, err.Error())
+			return err
+		}
 		if errors.Is(err, service.ErrSegmentNotFound) {
 			newErrorResponse(c, http.StatusNotFound, err.Error())
 			return err
@@ -113,5 +503,271 @@ func (s *segmentRoutes) delete(c echo.Context) error {
 		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
 		return err
 	}
+	return c.NoContent(http.StatusCreated)
+}
+
+type unlinkSegmentsInput struct {
+	Parent string `json:"parent" validate:"required,max=256"`
+	Child  string `json:"child" validate:"required,max=256"`
+}
+
+// @Summary Удаление связи сегментов
+// @Description Этот эндпоинт позволяет удалить связь между родительским и дочерним сегментом.
+// @Tags Segments
+// @ID unlinkSegments
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body unlinkSegmentsInput true "Родительский и дочерний сегменты"
+// @Success 204 "Успешное удаление"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 404 {object} echo.HTTPError "Связь не найдена"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/segments/hierarchy/unlink [delete]
+func (s *segmentRoutes) unlink(c echo.Context) error {
+	var input unlinkSegmentsInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err := s.segmentService.UnlinkSegments(c.Request().Context(), service.LinkSegmentsInput{
+		Parent: input.Parent,
+		Child:  input.Child,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrLinkNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+	return c.NoContent(204)
+}
+
+type segmentResponse struct {
+	Slug        string     `json:"slug"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ActiveFrom  *time.Time `json:"active_from,omitempty"`
+	ActiveUntil *time.Time `json:"active_until,omitempty"`
+	Derived     bool       `json:"derived"`
+	Members     int        `json:"members"`
+	MaxMembers  *int       `json:"max_members,omitempty"`
+	Remaining   *int       `json:"remaining,omitempty"`
+	AutoEnroll  *int       `json:"auto_enroll,omitempty"`
+}
+
+type listSegmentsResponse struct {
+	Segments []segmentResponse `json:"segments"`
+}
+
+// @Summary Получение списка сегментов
+// @Description Этот эндпоинт позволяет получить список сегментов с количеством участников и оставшимся местом в сегментах с ограничением max_members.
+// @Tags Segments
+// @ID listSegments
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Success 200 {object} listSegmentsResponse "Успешное выполнение"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/segments/list [get]
+func (s *segmentRoutes) list(c echo.Context) error {
+	segments, err := s.segmentService.ListSegments(c.Request().Context())
+	if err != nil {
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+
+	response := listSegmentsResponse{Segments: make([]segmentResponse, 0, len(segments))}
+	for _, segment := range segments {
+		item := segmentResponse{
+			Slug:        segment.Slug,
+			CreatedAt:   segment.CreatedAt,
+			ActiveFrom:  segment.ActiveFrom,
+			ActiveUntil: segment.ActiveUntil,
+			Derived:     segment.Expression != nil,
+			Members:     segment.Members,
+			MaxMembers:  segment.MaxMembers,
+			AutoEnroll:  segment.AutoEnroll,
+		}
+		if segment.MaxMembers != nil {
+			remaining := *segment.MaxMembers - segment.Members
+			if remaining < 0 {
+				remaining = 0
+			}
+			item.Remaining = &remaining
+		}
+		response.Segments = append(response.Segments, item)
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+type setCapacityInput struct {
+	Slug       string `json:"slug" validate:"required,max=256"`
+	MaxMembers *int   `json:"max_members" validate:"omitempty,min=0"`
+}
+
+// @Summary Изменение ограничения размера сегмента
+// @Description Этот эндпоинт позволяет задать максимальное количество пользователей в сегменте. Пустое значение снимает ограничение. Уже состоящие в сегменте пользователи не удаляются.
+// @Tags Segments
+// @ID setCapacity
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body setCapacityInput true "Сегмент и ограничение"
+// @Success 204 "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 404 {object} echo.HTTPError "Сегмент не найден"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/segments/capacity [put]
+func (s *segmentRoutes) setCapacity(c echo.Context) error {
+	var input setCapacityInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err := s.segmentService.SetCapacity(c.Request().Context(), service.SetCapacityInput{
+		Slug:       input.Slug,
+		MaxMembers: input.MaxMembers,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrSegmentNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+	return c.NoContent(204)
+}
+
+type setAutoEnrollInput struct {
+	Slug       string `json:"slug" validate:"required,max=256"`
+	AutoEnroll *int   `json:"auto_enroll" validate:"omitempty,min=1,max=10000"`
+}
+
+// @Summary Изменение автоматического добавления новых пользователей
+// @Description Этот эндпоинт позволяет задать долю новых пользователей, автоматически добавляемых в сегмент при их создании. 10000 соответствует 100%, пустое значение отключает добавление.
+// @Tags Segments
+// @ID setAutoEnroll
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body setAutoEnrollInput true "Сегмент и доля новых пользователей"
+// @Success 204 "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 404 {object} echo.HTTPError "Сегмент не найден"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/segments/auto-enroll [put]
+func (s *segmentRoutes) setAutoEnroll(c echo.Context) error {
+	var input setAutoEnrollInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err := s.segmentService.SetAutoEnroll(c.Request().Context(), service.SetAutoEnrollInput{
+		Slug:    input.Slug,
+		Percent: input.AutoEnroll,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrSegmentNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+	return c.NoContent(204)
+}
+
+type setPrerequisitesInput struct {
+	Slug          string   `json:"slug" validate:"required,max=256"`
+	Prerequisites []string `json:"prerequisites" validate:"required"`
+}
+
+// @Summary Изменение обязательных сегментов
+// @Description Этот эндпоинт позволяет задать сегменты, в которых пользователь должен состоять, чтобы его можно было добавить в сегмент. Пустой список снимает требования.
+// @Tags Segments
+// @ID setPrerequisites
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body setPrerequisitesInput true "Сегмент и обязательные сегменты"
+// @Success 204 "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 404 {object} echo.HTTPError "Сегмент не найден"
+// @Failure 409 {object} echo.HTTPError "Требования образуют цикл"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/segments/prerequisites [put]
+func (s *segmentRoutes) setPrerequisites(c echo.Context) error {
+	var input setPrerequisitesInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err := s.segmentService.SetPrerequisites(c.Request().Context(), service.SetPrerequisitesInput{
+		Slug:          input.Slug,
+		Prerequisites: input.Prerequisites,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrSegmentNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrPrerequisiteCycle) {
+			newErrorResponse(c, http.StatusConflict, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
 	return c.NoContent(204)
 }
@@ -2,21 +2,36 @@ package v1
 
 import (
 	"errors"
+	"fmt"
 	"github.com/labstack/echo/v4"
+	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/service"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const defaultUsersLimit = 100
+
 type userRoutes struct {
 	userService service.User
 }
 
-func newUserRoutes(g *echo.Group, userService service.User) {
+// newUserRoutes registers the export on historyGroup and irreversible changes on adminGroup,
+// the groups share the prefix of g and differ in the required scopes
+func newUserRoutes(g, historyGroup, adminGroup *echo.Group, userService service.User) {
 	r := &userRoutes{
 		userService: userService,
 	}
 	g.POST("/segments", r.setSegments)
 	g.GET("/active-segments", r.getSegments)
+	g.POST("/create", r.create)
+	g.GET("/list", r.list)
+	historyGroup.GET("/export", r.export)
+	adminGroup.DELETE("/delete", r.delete)
+	adminGroup.POST("/erase", r.erase)
+	adminGroup.POST("/merge", r.merge)
 }
 
 type setSegmentsUserInput struct {
@@ -24,19 +39,25 @@ type setSegmentsUserInput struct {
 	SegmentsAdd []string `json:"segments_add" validate:"required"`
 	SegmentsDel []string `json:"segments_del" validate:"required"`
 	TTL         uint64   `json:"ttl" validate:"omitempty,min=1,max=18446744073709551615"`
+	Cascade     bool     `json:"cascade"`
+	DryRun      bool     `json:"dry_run"`
 }
 
 // @Summary Обновление сегментов пользователя
-// @Description Этот эндпоинт позволяет обновить сегменты, к которым принадлежит пользователь.
+// @Description Этот эндпоинт позволяет обновить сегменты, к которым принадлежит пользователь. При cascade=true удаление обязательного сегмента удаляет и зависящие от него сегменты. При dry_run=true изменения не сохраняются, а возвращаются история, которая была бы записана, и конфликты.
 // @Tags Users
 // @ID setSegments
 // @Accept json
 // @Produce json
 // @Param Authorization header string true "API KEY для аутентификации"
+// @Param If-Match header string false "Версия сегментов пользователя из ETag активных сегментов или * для любой версии существующего пользователя"
 // @Param input body setSegmentsUserInput true "Данные для обновления сегментов пользователя"
-// @Success 200 "Успешная операция"
+// @Success 200 {object} previewResponse "Успешная операция. Тело возвращается только при dry_run=true"
 // @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
 // @Failure 404 {object} echo.HTTPError "Сегмент не найден"
+// @Failure 409 {object} echo.HTTPError "Достигнуто ограничение размера сегмента или нарушены обязательные сегменты"
+// @Failure 412 {object} echo.HTTPError "Сегменты пользователя изменились после получения версии, пользователя нет или передан слабый ETag"
 // @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
 // @Router /api/v1/users/segments [post]
 func (u *userRoutes) setSegments(c echo.Context) error {
@@ -51,17 +72,62 @@ func (u *userRoutes) setSegments(c echo.Context) error {
 		newErrorResponse(c, http.StatusBadRequest, err.Error())
 		return err
 	}
-	err := u.userService.SetSegments(c.Request().Context(), service.SetSegmentsUserInput{
+
+	ifVersion, err := parseETag(c.Request().Header.Get("If-Match"))
+	if err != nil {
+		if errors.Is(err, ErrWeakIfMatch) {
+			newErrorResponse(c, http.StatusPreconditionFailed, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	setInput := service.SetSegmentsUserInput{
 		UserID:      input.UserID,
 		SegmentsAdd: input.SegmentsAdd,
 		SegmentsDel: input.SegmentsDel,
 		TTL:         input.TTL,
-	})
+		Cascade:     input.Cascade,
+		IfVersion:   ifVersion,
+	}
+
+	if input.DryRun {
+		preview, err := u.userService.PreviewSetSegments(c.Request().Context(), setInput)
+		if err != nil {
+			if errors.Is(err, service.ErrNamespaceForbidden) {
+				newErrorResponse(c, http.StatusForbidden, err.Error())
+				return err
+			}
+			if errors.Is(err, service.ErrSegmentNotFound) {
+				newErrorResponse(c, http.StatusNotFound, err.Error())
+				return err
+			}
+			newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+			return err
+		}
+		return c.JSON(http.StatusOK, newPreviewResponse(preview))
+	}
+
+	err = u.userService.SetSegments(c.Request().Context(), setInput)
 	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrVersionMismatch) {
+			newErrorResponse(c, http.StatusPreconditionFailed, err.Error())
+			return err
+		}
 		if errors.Is(err, service.ErrSegmentNotFound) {
 			newErrorResponse(c, http.StatusNotFound, err.Error())
 			return err
 		}
+		if errors.Is(err, service.ErrSegmentCapacity) || errors.Is(err, service.ErrPrerequisiteMissing) ||
+			errors.Is(err, service.ErrPrerequisiteRequired) {
+			newErrorResponse(c, http.StatusConflict, err.Error())
+			return err
+		}
 		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
 		return err
 	}
@@ -72,13 +138,20 @@ type getSegmentsUserInput struct {
 	UserID string `json:"user_id" validate:"required,max=40"`
 }
 
+type activeSegmentResponse struct {
+	Slug      string `json:"slug"`
+	Inherited bool   `json:"inherited"`
+}
+
 type getSegmentsUserResponse struct {
-	UserID   string   `json:"user_id"`
-	Segments []string `json:"segments"`
+	UserID   string                  `json:"user_id"`
+	Version  int64                   `json:"version"`
+	Segments []string                `json:"segments"`
+	Details  []activeSegmentResponse `json:"details"`
 }
 
 // @Summary Получение активных сегментов пользователя
-// @Description Этот эндпоинт позволяет получить список сегментов, к которым принадлежит пользователь.
+// @Description Этот эндпоинт позволяет получить список сегментов, к которым принадлежит пользователь, включая унаследованные по иерархии сегментов. Заголовок ETag содержит версию сегментов пользователя для If-Match при их изменении.
 // @Tags Users
 // @ID getSegments
 // @Accept json
@@ -100,7 +173,7 @@ func (u *userRoutes) getSegments(c echo.Context) error {
 		return err
 	}
 
-	segments, err := u.userService.GetSegments(
+	segments, version, err := u.userService.GetSegments(
 		c.Request().Context(),
 		service.GetSegmentsUserInput{UserID: input.UserID},
 	)
@@ -114,8 +187,402 @@ func (u *userRoutes) getSegments(c echo.Context) error {
 		return err
 	}
 
-	return c.JSON(http.StatusOK, getSegmentsUserResponse{
+	response := getSegmentsUserResponse{
 		UserID:   input.UserID,
-		Segments: segments,
+		Version:  version,
+		Segments: make([]string, 0, len(segments)),
+		Details:  make([]activeSegmentResponse, 0, len(segments)),
+	}
+	for _, segment := range segments {
+		response.Segments = append(response.Segments, segment.Slug)
+		response.Details = append(response.Details, activeSegmentResponse{
+			Slug:      segment.Slug,
+			Inherited: segment.Inherited,
+		})
+	}
+	c.Response().Header().Set("ETag", formatETag(version))
+	return c.JSON(http.StatusOK, response)
+}
+
+func formatETag(version int64) string {
+	return fmt.Sprintf("%q", strconv.FormatInt(version, 10))
+}
+
+// parseETag returns the version from the If-Match header, nil when the header is absent.
+// "*" is entity.AnyVersion. If-Match uses the strong comparison, so weak tags are refused with ErrWeakIfMatch,
+// they would never match (RFC 9110, section 13.1.1).
+func parseETag(header string) (*int64, error) {
+	header = strings.TrimSpace(header)
+	switch {
+	case header == "":
+		return nil, nil
+	case header == "*":
+		version := entity.AnyVersion
+		return &version, nil
+	case strings.HasPrefix(header, "W/"):
+		return nil, ErrWeakIfMatch
+	}
+
+	version, err := strconv.ParseInt(strings.Trim(header, `"`), 10, 64)
+	if err != nil || version < 0 {
+		return nil, ErrInvalidIfMatch
+	}
+	return &version, nil
+}
+
+type userInput struct {
+	UserID string `json:"user_id" validate:"required,max=40"`
+}
+
+type createUserResponse struct {
+	UserID string `json:"user_id"`
+}
+
+// @Summary Создание пользователя
+// @Description Этот эндпоинт позволяет явно создать пользователя. Пользователь добавляется в сегменты с опцией auto_enroll.
+// @Tags Users
+// @ID createUser
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body userInput true "Идентификатор пользователя"
+// @Success 201 {object} createUserResponse "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 409 {object} echo.HTTPError "Пользователь уже существует"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/users/create [post]
+func (u *userRoutes) create(c echo.Context) error {
+	var input userInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err := u.userService.CreateUser(c.Request().Context(), service.UserInput{UserID: input.UserID})
+	if err != nil {
+		if errors.Is(err, service.ErrUserAlreadyExists) {
+			newErrorResponse(c, http.StatusConflict, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+	return c.JSON(http.StatusCreated, createUserResponse{UserID: input.UserID})
+}
+
+type listUsersInput struct {
+	CreatedFrom *time.Time `query:"created_from"`
+	CreatedTo   *time.Time `query:"created_to"`
+	Segment     string     `query:"segment" validate:"max=256"`
+	Limit       uint64     `query:"limit" validate:"omitempty,min=1,max=1000"`
+	Offset      uint64     `query:"offset"`
+}
+
+type userResponse struct {
+	UserID    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type listUsersResponse struct {
+	Users []userResponse `json:"users"`
+}
+
+// @Summary Получение списка пользователей
+// @Description Этот эндпоинт позволяет получить список пользователей по дате создания с постраничным выводом. По умолчанию возвращается 100 пользователей.
+// @Tags Users
+// @ID listUsers
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param created_from query string false "Начало периода создания (RFC 3339)"
+// @Param created_to query string false "Конец периода создания (RFC 3339), не включается"
+// @Param segment query string false "Только пользователи, состоящие в сегменте"
+// @Param limit query int false "Количество пользователей на странице (до 1000)"
+// @Param offset query int false "Смещение от начала списка"
+// @Success 200 {object} listUsersResponse "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/users/list [get]
+func (u *userRoutes) list(c echo.Context) error {
+	var input listUsersInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid query parameters")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+	if input.Limit == 0 {
+		input.Limit = defaultUsersLimit
+	}
+
+	users, err := u.userService.ListUsers(c.Request().Context(), service.ListUsersInput{
+		CreatedFrom: input.CreatedFrom,
+		CreatedTo:   input.CreatedTo,
+		Segment:     input.Segment,
+		Limit:       input.Limit,
+		Offset:      input.Offset,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+
+	response := listUsersResponse{Users: make([]userResponse, 0, len(users))}
+	for _, user := range users {
+		response.Users = append(response.Users, userResponse{
+			UserID:    user.UserID,
+			CreatedAt: user.CreatedAt,
+		})
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// @Summary Удаление пользователя
+// @Description Этот эндпоинт позволяет удалить пользователя вместе с его сегментами и запланированными операциями. История сохраняется или удаляется в зависимости от users.history_policy.
+// @Tags Users
+// @ID deleteUser
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body userInput true "Идентификатор пользователя"
+// @Success 204 "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нужна область admin"
+// @Failure 404 {object} echo.HTTPError "Пользователь не найден"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/users/delete [delete]
+func (u *userRoutes) delete(c echo.Context) error {
+	var input userInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err := u.userService.DeleteUser(c.Request().Context(), service.UserInput{UserID: input.UserID})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrUserNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+	return c.NoContent(204)
+}
+
+type historyRecordResponse struct {
+	SegmentSlug string    `json:"segment_slug"`
+	Type        string    `json:"type"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type exportUserResponse struct {
+	UserID       string                  `json:"user_id"`
+	CreatedAt    *time.Time              `json:"created_at,omitempty"`
+	Segments     []string                `json:"segments"`
+	PendingTasks []taskResponse          `json:"pending_tasks"`
+	History      []historyRecordResponse `json:"history"`
+}
+
+// @Summary Выгрузка данных пользователя
+// @Description Этот эндпоинт позволяет выгрузить все хранимые данные пользователя: сегменты, запланированные операции и полную историю. История удаленного пользователя также выгружается.
+// @Tags Users
+// @ID exportUser
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param user_id query string true "Идентификатор пользователя"
+// @Success 200 {object} exportUserResponse "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нужна область history:read"
+// @Failure 404 {object} echo.HTTPError "Пользователь не найден"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/users/export [get]
+func (u *userRoutes) export(c echo.Context) error {
+	input := userInput{
+		UserID: c.QueryParams().Get("user_id"),
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	export, err := u.userService.ExportUser(c.Request().Context(), service.UserInput{UserID: input.UserID})
+	if err != nil {
+		if errors.Is(err, service.ErrUserNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+
+	response := exportUserResponse{
+		UserID:       export.UserID,
+		CreatedAt:    export.CreatedAt,
+		Segments:     export.Segments,
+		PendingTasks: newTasksResponse(export.PendingTasks).Tasks,
+		History:      make([]historyRecordResponse, 0, len(export.History)),
+	}
+	for _, note := range export.History {
+		response.History = append(response.History, historyRecordResponse{
+			SegmentSlug: note.SegmentSlug,
+			Type:        note.Type,
+			CreatedAt:   note.CreatedAt,
+		})
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+type eraseUserInput struct {
+	UserID string `json:"user_id" validate:"required,max=40"`
+	Mode   string `json:"mode" validate:"required,oneof=delete pseudonymize"`
+}
+
+type eraseUserResponse struct {
+	AuditID        int       `json:"audit_id"`
+	Mode           string    `json:"mode"`
+	Memberships    int       `json:"memberships"`
+	Tasks          int       `json:"tasks"`
+	HistoryRecords int       `json:"history_records"`
+	ErasedAt       time.Time `json:"erased_at"`
+}
+
+// @Summary Стирание данных пользователя
+// @Description Этот эндпоинт позволяет удалить (mode=delete) или необратимо псевдонимизировать (mode=pseudonymize) user_id во всех данных сервиса. В журнал стирания записываются только режим и количество затронутых записей.
+// @Tags Users
+// @ID eraseUser
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body eraseUserInput true "Идентификатор пользователя и режим стирания"
+// @Success 200 {object} eraseUserResponse "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нужна область admin"
+// @Failure 404 {object} echo.HTTPError "Пользователь не найден"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/users/erase [post]
+func (u *userRoutes) erase(c echo.Context) error {
+	var input eraseUserInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	audit, err := u.userService.EraseUser(c.Request().Context(), service.EraseUserInput{
+		UserID: input.UserID,
+		Mode:   input.Mode,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrUserNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+	return c.JSON(http.StatusOK, eraseUserResponse{
+		AuditID:        audit.AuditID,
+		Mode:           audit.Mode,
+		Memberships:    audit.Memberships,
+		Tasks:          audit.Tasks,
+		HistoryRecords: audit.HistoryRecords,
+		ErasedAt:       audit.CreatedAt,
+	})
+}
+
+type mergeUsersInput struct {
+	SourceUserID string `json:"source_user_id" validate:"required,max=40"`
+	TargetUserID string `json:"target_user_id" validate:"required,max=40"`
+}
+
+// @Summary Объединение пользователей
+// @Description Этот эндпоинт позволяет объединить двух пользователей: сегменты объединяются, запланированные операции и история переносятся на target_user_id, а source_user_id становится его псевдонимом.
+// @Tags Users
+// @ID mergeUsers
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body mergeUsersInput true "Объединяемый и итоговый пользователи"
+// @Success 204 "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нужна область admin"
+// @Failure 404 {object} echo.HTTPError "Пользователь не найден"
+// @Failure 409 {object} echo.HTTPError "Достигнуто ограничение размера сегмента или нарушены обязательные сегменты"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/users/merge [post]
+func (u *userRoutes) merge(c echo.Context) error {
+	var input mergeUsersInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err := u.userService.MergeUsers(c.Request().Context(), service.MergeUsersInput{
+		SourceID: input.SourceUserID,
+		TargetID: input.TargetUserID,
 	})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrMergeSameUser) {
+			newErrorResponse(c, http.StatusBadRequest, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrUserNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrSegmentCapacity) || errors.Is(err, service.ErrPrerequisiteMissing) {
+			newErrorResponse(c, http.StatusConflict, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+	return c.NoContent(204)
 }
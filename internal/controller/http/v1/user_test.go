@@ -0,0 +1,46 @@
+package v1
+
+import (
+	"errors"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"testing"
+)
+
+func TestParseETag(t *testing.T) {
+	version := func(v int64) *int64 { return &v }
+
+	tests := []struct {
+		header  string
+		want    *int64
+		wantErr error
+	}{
+		{header: "", want: nil},
+		{header: `"4"`, want: version(4)},
+		{header: `4`, want: version(4)},
+		{header: ` "0" `, want: version(0)},
+		{header: `*`, want: version(entity.AnyVersion)},
+		{header: `W/"4"`, wantErr: ErrWeakIfMatch},
+		{header: `"-1"`, wantErr: ErrInvalidIfMatch},
+		{header: `"abc"`, wantErr: ErrInvalidIfMatch},
+		{header: `"4", "5"`, wantErr: ErrInvalidIfMatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got, err := parseETag(tt.header)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseETag() error = %v, want %v", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("parseETag() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatETagRoundTrip(t *testing.T) {
+	got, err := parseETag(formatETag(42))
+	if err != nil || got == nil || *got != 42 {
+		t.Errorf("parseETag(formatETag(42)) = %v, %v", got, err)
+	}
+}
@@ -0,0 +1,270 @@
+package v1
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/service"
+	"net/http"
+	"time"
+)
+
+const defaultDeliveriesLimit = 100
+
+type webhookRoutes struct {
+	webhookService service.Webhook
+}
+
+func newWebhookRoutes(g *echo.Group, webhookService service.Webhook) {
+	r := &webhookRoutes{
+		webhookService: webhookService,
+	}
+	g.POST("/create", r.create)
+	g.GET("/list", r.list)
+	g.DELETE("/delete", r.delete)
+	g.GET("/deliveries", r.deliveries)
+}
+
+type createWebhookInput struct {
+	URL      string   `json:"url" validate:"required,http_url,max=2048"`
+	Secret   string   `json:"secret" validate:"required,min=16,max=255"`
+	Segments []string `json:"segments" validate:"dive,required,max=256"`
+	Events   []string `json:"events" validate:"dive,required,max=15"`
+}
+
+type createWebhookResponse struct {
+	WebhookID int `json:"webhook_id"`
+}
+
+// @Summary Создание вебхука
+// @Description Этот эндпоинт позволяет подписаться на изменения членства в сегментах. События отправляются POST запросом, подписанным HMAC-SHA256 с секретом вебхука. Пустые списки сегментов и событий означают все сегменты и все события.
+// @Tags Webhooks
+// @ID createWebhook
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body createWebhookInput true "Адрес, секрет для подписи, сегменты или пространства имен и типы событий"
+// @Success 201 {object} createWebhookResponse "Успешное создание"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/webhooks/create [post]
+func (r *webhookRoutes) create(c echo.Context) error {
+	var input createWebhookInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	webhookID, err := r.webhookService.CreateWebhook(c.Request().Context(), service.CreateWebhookInput{
+		URL:      input.URL,
+		Secret:   input.Secret,
+		Segments: input.Segments,
+		Events:   input.Events,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidWebhookEvent) {
+			newErrorResponse(c, http.StatusBadRequest, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, createWebhookResponse{WebhookID: webhookID})
+}
+
+type webhookResponse struct {
+	WebhookID int       `json:"webhook_id"`
+	URL       string    `json:"url"`
+	Segments  []string  `json:"segments"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type listWebhooksResponse struct {
+	Webhooks []webhookResponse `json:"webhooks"`
+}
+
+// @Summary Получение списка вебхуков
+// @Description Этот эндпоинт позволяет получить вебхуки, события которых доступны ключу. Секреты не возвращаются.
+// @Tags Webhooks
+// @ID listWebhooks
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Success 200 {object} listWebhooksResponse "Успешное выполнение"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/webhooks/list [get]
+func (r *webhookRoutes) list(c echo.Context) error {
+	webhooks, err := r.webhookService.ListWebhooks(c.Request().Context())
+	if err != nil {
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+
+	response := listWebhooksResponse{Webhooks: make([]webhookResponse, 0, len(webhooks))}
+	for _, webhook := range webhooks {
+		response.Webhooks = append(response.Webhooks, webhookResponse{
+			WebhookID: webhook.WebhookID,
+			URL:       webhook.URL,
+			Segments:  webhook.Segments,
+			Events:    webhook.Events,
+			CreatedAt: webhook.CreatedAt,
+		})
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+type webhookInput struct {
+	WebhookID int `json:"webhook_id" validate:"required"`
+}
+
+// @Summary Удаление вебхука
+// @Description Этот эндпоинт позволяет удалить вебхук вместе с журналом доставок. Неотправленные события не доставляются.
+// @Tags Webhooks
+// @ID deleteWebhook
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param input body webhookInput true "Идентификатор вебхука"
+// @Success 204 "Успешное удаление"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 404 {object} echo.HTTPError "Вебхук не найден"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/webhooks/delete [delete]
+func (r *webhookRoutes) delete(c echo.Context) error {
+	var input webhookInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid request body")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	err := r.webhookService.DeleteWebhook(c.Request().Context(), service.WebhookInput{WebhookID: input.WebhookID})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrWebhookNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+type getDeliveriesInput struct {
+	WebhookID int    `query:"webhook_id" validate:"required"`
+	Limit     uint64 `query:"limit" validate:"omitempty,min=1,max=1000"`
+	Offset    uint64 `query:"offset"`
+}
+
+type deliveryResponse struct {
+	DeliveryID     int64      `json:"delivery_id"`
+	Event          string     `json:"event"`
+	UserID         string     `json:"user_id"`
+	Segment        string     `json:"segment"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	ResponseStatus *int       `json:"response_status,omitempty"`
+	LastError      *string    `json:"last_error,omitempty"`
+}
+
+type deliveriesResponse struct {
+	Deliveries []deliveryResponse `json:"deliveries"`
+}
+
+// @Summary Журнал доставок вебхука
+// @Description Этот эндпоинт позволяет получить доставки вебхука, начиная с последних: статус (pending, delivered или failed), число попыток, ответ получателя и время следующей попытки. По умолчанию возвращается 100 доставок.
+// @Tags Webhooks
+// @ID getWebhookDeliveries
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "API KEY для аутентификации"
+// @Param webhook_id query int true "Идентификатор вебхука"
+// @Param limit query int false "Количество доставок на странице (до 1000)"
+// @Param offset query int false "Смещение от начала списка"
+// @Success 200 {object} deliveriesResponse "Успешное выполнение"
+// @Failure 400 {object} echo.HTTPError "Некорректный запрос или данные"
+// @Failure 403 {object} echo.HTTPError "Нет доступа к пространству имен сегмента"
+// @Failure 404 {object} echo.HTTPError "Вебхук не найден"
+// @Failure 500 {object} echo.HTTPError "Внутренняя ошибка сервера"
+// @Router /api/v1/webhooks/deliveries [get]
+func (r *webhookRoutes) deliveries(c echo.Context) error {
+	var input getDeliveriesInput
+
+	if err := c.Bind(&input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, "invalid query parameters")
+		return err
+	}
+
+	if err := c.Validate(input); err != nil {
+		newErrorResponse(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+	if input.Limit == 0 {
+		input.Limit = defaultDeliveriesLimit
+	}
+
+	deliveries, err := r.webhookService.GetDeliveries(c.Request().Context(), service.GetDeliveriesInput{
+		WebhookID: input.WebhookID,
+		Limit:     input.Limit,
+		Offset:    input.Offset,
+	})
+	if err != nil {
+		if errors.Is(err, service.ErrNamespaceForbidden) {
+			newErrorResponse(c, http.StatusForbidden, err.Error())
+			return err
+		}
+		if errors.Is(err, service.ErrWebhookNotFound) {
+			newErrorResponse(c, http.StatusNotFound, err.Error())
+			return err
+		}
+		newErrorResponse(c, http.StatusInternalServerError, "internal server error")
+		return err
+	}
+
+	response := deliveriesResponse{Deliveries: make([]deliveryResponse, 0, len(deliveries))}
+	for _, delivery := range deliveries {
+		item := deliveryResponse{
+			DeliveryID:     delivery.DeliveryID,
+			Event:          delivery.Event,
+			UserID:         delivery.UserID,
+			Segment:        delivery.SegmentSlug,
+			CreatedAt:      delivery.CreatedAt,
+			Status:         delivery.Status,
+			Attempts:       delivery.Attempts,
+			LastAttemptAt:  delivery.LastAttemptAt,
+			ResponseStatus: delivery.ResponseStatus,
+			LastError:      delivery.LastError,
+		}
+		if delivery.Status == entity.DeliveryStatusPending {
+			item.NextAttemptAt = &delivery.NextAttemptAt
+		}
+		response.Deliveries = append(response.Deliveries, item)
+	}
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,107 @@
+package entity
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scopes of API keys. ScopeAdmin grants every other scope.
+const (
+	ScopeSegmentsRead  = "segments:read"
+	ScopeSegmentsWrite = "segments:write"
+	ScopeUsersWrite    = "users:write"
+	ScopeHistoryRead   = "history:read"
+	ScopeWebhooks      = "webhooks"
+	ScopeAdmin         = "admin"
+)
+
+var Scopes = []string{ScopeSegmentsRead, ScopeSegmentsWrite, ScopeUsersWrite, ScopeHistoryRead, ScopeWebhooks, ScopeAdmin}
+
+// APIKey is a stored key of a tenant. ReadNamespaces and WriteNamespaces limit the segments it can access, see SegmentNamespace.
+// A key with zero ID is not stored, it is built from the claims of a JWT whose subject is kept in Actor.
+// RateLimit (requests per minute) and RateBurst override the limits of the key scopes when set.
+type APIKey struct {
+	ID              int        `db:"id"`
+	Actor           string     `db:"-"`
+	TenantID        int        `db:"tenant_id"`
+	HashVersion     int        `db:"hash_version"`
+	KeyPrefix       string     `db:"key_prefix"`
+	Label           string     `db:"label"`
+	Scopes          []string   `db:"scopes"`
+	ReadNamespaces  []string   `db:"read_namespaces"`
+	WriteNamespaces []string   `db:"write_namespaces"`
+	CreatedAt       time.Time  `db:"created_at"`
+	ExpiresAt       *time.Time `db:"expires_at"`
+	RevokedAt       *time.Time `db:"revoked_at"`
+	LastUsedAt      *time.Time `db:"last_used_at"`
+	RateLimit       *int       `db:"rate_limit"`
+	RateBurst       *int       `db:"rate_burst"`
+}
+
+// KeyHash is the hash of a key computed with one of the hashing versions
+type KeyHash struct {
+	Version int
+	Hash    string
+}
+
+// Principal identifies the caller within its tenant: the stored key or the subject of a JWT
+func (k APIKey) Principal() string {
+	if k.ID == 0 {
+		return "jwt:" + k.Actor
+	}
+	return "key:" + strconv.Itoa(k.ID)
+}
+
+// HasScope reports whether the key was granted the scope directly or through ScopeAdmin
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// NamespaceAll in a namespace list of a key grants access to every namespace
+const NamespaceAll = "*"
+
+// SegmentNamespace returns the namespace of the segment: the slug prefix up to and including the first "/".
+// Segments without a namespace return "".
+func SegmentNamespace(slug string) string {
+	i := strings.Index(slug, "/")
+	if i < 0 {
+		return ""
+	}
+	return slug[:i+1]
+}
+
+// Unrestricted reports whether the key may change segments of every namespace
+func (k APIKey) Unrestricted() bool {
+	return k.HasScope(ScopeAdmin) || containsNamespace(k.WriteNamespaces, NamespaceAll)
+}
+
+// CanWrite reports whether the key may change the segment and its memberships
+func (k APIKey) CanWrite(slug string) bool {
+	return k.Unrestricted() || containsNamespace(k.WriteNamespaces, SegmentNamespace(slug))
+}
+
+// CanRead reports whether the key may see the segment and its memberships, write access includes read access
+func (k APIKey) CanRead(slug string) bool {
+	return k.CanWrite(slug) || k.CanReadAll() || containsNamespace(k.ReadNamespaces, SegmentNamespace(slug))
+}
+
+// CanReadAll reports whether the key may see every segment
+func (k APIKey) CanReadAll() bool {
+	return k.Unrestricted() || containsNamespace(k.ReadNamespaces, NamespaceAll)
+}
+
+// containsNamespace does not match segments without a namespace, only NamespaceAll grants access to them
+func containsNamespace(namespaces []string, namespace string) bool {
+	for _, ns := range namespaces {
+		if ns == namespace && ns != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,15 @@
+package entity
+
+import "time"
+
+// IdempotentRequest is a mutating request identified by the Idempotency-Key header of a caller, see APIKey.Principal.
+// Status is nil while the first request is still being processed.
+type IdempotentRequest struct {
+	Principal      string    `db:"principal"`
+	IdempotencyKey string    `db:"idempotency_key"`
+	RequestHash    string    `db:"request_hash"`
+	Status         *int      `db:"status"`
+	ContentType    string    `db:"content_type"`
+	Body           []byte    `db:"body"`
+	CreatedAt      time.Time `db:"created_at"`
+}
@@ -0,0 +1,8 @@
+package entity
+
+// ChangePreview is the effect of a change computed in a rolled-back transaction:
+// history that would be written and conflicts that would prevent a part of the change
+type ChangePreview struct {
+	History   []History
+	Conflicts []string
+}
@@ -3,13 +3,60 @@ package entity
 import "time"
 
 type Segment struct {
-	Slug      string    `db:"slug"`
-	CreatedAt time.Time `db:"created_at"`
+	Slug        string             `db:"slug"`
+	CreatedAt   time.Time          `db:"created_at"`
+	ActiveFrom  *time.Time         `db:"active_from"`
+	ActiveUntil *time.Time         `db:"active_until"`
+	ArchivedAt  *time.Time         `db:"archived_at"`
+	Expression  *SegmentExpression `db:"expression"`
+	MaxMembers  *int               `db:"max_members"`
+	// AutoEnroll is the share of new users in hundredths of a percent that join the segment on creation
+	AutoEnroll *int `db:"auto_enroll"`
 }
 
+type SegmentWithMembers struct {
+	Segment
+	Members int `db:"members"`
+}
+
+// SegmentExpression describes a derived segment: either a single segment or a set operation over nested expressions
+type SegmentExpression struct {
+	Op      string              `json:"op,omitempty"`
+	Segment string              `json:"segment,omitempty"`
+	Args    []SegmentExpression `json:"args,omitempty"`
+}
+
+// Segments returns slugs of all segments used in the expression
+func (e SegmentExpression) Segments() []string {
+	if e.Op == "" {
+		return []string{e.Segment}
+	}
+	segments := make([]string, 0, len(e.Args))
+	for _, arg := range e.Args {
+		segments = append(segments, arg.Segments()...)
+	}
+	return segments
+}
+
+// InheritanceDown means members of the parent are members of its children, InheritanceUp is the opposite
+const (
+	InheritanceDown = "down"
+	InheritanceUp   = "up"
+)
+
+const (
+	ExpressionUnion        = "union"
+	ExpressionIntersection = "intersection"
+	ExpressionDifference   = "difference"
+)
+
 const (
-	OperationTypeAdd           = "add"
-	OperationTypeDelete        = "delete"
-	OperationTypeAutoAdd       = "auto_add"
-	OperationTypeSegmentDelete = "delete_segment"
+	OperationTypeAdd            = "add"
+	OperationTypeDelete         = "delete"
+	OperationTypeDeleteCascade  = "delete_cascade"
+	OperationTypeAutoAdd        = "auto_add"
+	OperationTypeSegmentDelete  = "delete_segment"
+	OperationTypeSegmentRestore = "restore_segment"
+	OperationTypeRenameFrom     = "rename_from"
+	OperationTypeRenameTo       = "rename_to"
 )
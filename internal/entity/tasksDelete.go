@@ -1,7 +1,11 @@
 package entity
 
+import "time"
+
 type Task struct {
-	TaskID      int
-	UserID      string
-	SegmentSlug string
+	TaskID      int       `db:"task_id"`
+	UserID      string    `db:"user_id"`
+	SegmentSlug string    `db:"segment_slug"`
+	Operation   string    `db:"operation"`
+	Deadline    time.Time `db:"deadline"`
 }
@@ -0,0 +1,14 @@
+package entity
+
+import "time"
+
+// Tenant is a product hosted by the service. Users, segments and their history belong to a tenant
+// and are visible only to API keys of the same tenant.
+type Tenant struct {
+	TenantID  int       `db:"tenant_id"`
+	Name      string    `db:"name"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// DefaultTenantID owns the data created before tenants existed
+const DefaultTenantID = 1
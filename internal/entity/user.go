@@ -5,4 +5,43 @@ import "time"
 type User struct {
 	UserID    string    `db:"user_id"`
 	CreatedAt time.Time `db:"created_at"`
+	// Version is bumped on every change of the user's memberships
+	Version int64 `db:"version"`
+}
+
+// AnyVersion is a precondition met by any version of an existing user, as If-Match: *
+const AnyVersion int64 = -1
+
+// UserFilter narrows the list of users, zero values are not applied
+type UserFilter struct {
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	Segment     string
+	Limit       uint64
+	Offset      uint64
+}
+
+// UserExport contains everything stored about a user
+type UserExport struct {
+	UserID       string
+	CreatedAt    *time.Time
+	Segments     []string
+	PendingTasks []Task
+	History      []History
+}
+
+// Erasure modes: rows of the user are either removed or moved to an irreversible pseudonym
+const (
+	ErasureModeDelete       = "delete"
+	ErasureModePseudonymize = "pseudonymize"
+)
+
+// ErasureAudit records an erasure without identifying the user
+type ErasureAudit struct {
+	AuditID        int       `db:"audit_id"`
+	Mode           string    `db:"mode"`
+	Memberships    int       `db:"memberships"`
+	Tasks          int       `db:"tasks"`
+	HistoryRecords int       `db:"history_records"`
+	CreatedAt      time.Time `db:"created_at"`
 }
@@ -4,3 +4,8 @@ type UserSegments struct {
 	UserID      string `db:"user_id"`
 	SegmentSlug string `db:"segment_slug"`
 }
+
+type ActiveSegment struct {
+	Slug      string `db:"slug"`
+	Inherited bool   `db:"inherited"`
+}
@@ -0,0 +1,48 @@
+package entity
+
+import "time"
+
+// Webhook is a subscription to membership changes. Segments holds slugs and namespaces ending with "/",
+// Events holds history operation types. Empty lists match every segment and every event.
+type Webhook struct {
+	WebhookID int       `db:"webhook_id"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	Segments  []string  `db:"segments"`
+	Events    []string  `db:"events"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// WebhookEvents are the history operation types a webhook can subscribe to
+var WebhookEvents = []string{OperationTypeAdd, OperationTypeDelete, OperationTypeDeleteCascade, OperationTypeAutoAdd,
+	OperationTypeSegmentDelete, OperationTypeSegmentRestore, OperationTypeRenameFrom, OperationTypeRenameTo}
+
+const (
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusDelivered = "delivered"
+	DeliveryStatusFailed    = "failed"
+)
+
+// WebhookDelivery is a history record sent to a webhook. A pending delivery is retried at NextAttemptAt
+// until it is delivered or runs out of attempts.
+type WebhookDelivery struct {
+	DeliveryID     int64      `db:"delivery_id"`
+	WebhookID      int        `db:"webhook_id"`
+	Event          string     `db:"event"`
+	UserID         string     `db:"user_id"`
+	SegmentSlug    string     `db:"segment_slug"`
+	CreatedAt      time.Time  `db:"created_at"`
+	Status         string     `db:"status"`
+	Attempts       int        `db:"attempts"`
+	NextAttemptAt  time.Time  `db:"next_attempt_at"`
+	LastAttemptAt  *time.Time `db:"last_attempt_at"`
+	ResponseStatus *int       `db:"response_status"`
+	LastError      *string    `db:"last_error"`
+}
+
+// OutgoingDelivery is a delivery claimed for sending with the address and the secret of its webhook
+type OutgoingDelivery struct {
+	WebhookDelivery
+	URL    string
+	Secret string
+}
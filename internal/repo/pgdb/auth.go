@@ -2,10 +2,24 @@ package pgdb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
 	"github.com/passionde/user-segmentation-service/pkg/postgres"
+	"strconv"
+	"time"
 )
 
+// apiKeysChannel receives the id of a key whose access changed, see the api_keys_notify_changed trigger
+const apiKeysChannel = "api_keys_changed"
+
+var apiKeyColumns = []string{"id", "tenant_id", "hash_version", "key_prefix", "label", "scopes",
+	"read_namespaces", "write_namespaces", "created_at", "expires_at", "revoked_at", "last_used_at", "rate_limit", "rate_burst"}
+
 type AuthRepo struct {
 	*postgres.Postgres
 }
@@ -14,33 +28,218 @@ func NewAuthRepo(pg *postgres.Postgres) *AuthRepo {
 	return &AuthRepo{pg}
 }
 
-func (a *AuthRepo) WriteToken(ctx context.Context, token string) (int, error) {
+func (a *AuthRepo) WriteToken(ctx context.Context, token string, key entity.APIKey) (int, error) {
 	sql, args, _ := a.Builder.
 		Insert("api_keys").
-		Columns("hash_key").
-		Values(token).
+		Columns("tenant_id", "hash_key", "hash_version", "key_prefix", "label", "scopes", "read_namespaces", "write_namespaces", "expires_at",
+			"rate_limit", "rate_burst").
+		Values(key.TenantID, token, key.HashVersion, key.KeyPrefix, key.Label, key.Scopes, key.ReadNamespaces, key.WriteNamespaces,
+			key.ExpiresAt, key.RateLimit, key.RateBurst).
 		Suffix("RETURNING id").
 		ToSql()
 
 	var tokenID int
 	err := a.Pool.QueryRow(ctx, sql, args...).Scan(&tokenID)
 	if err != nil {
+		var pgErr *pgconn.PgError
+		if ok := errors.As(err, &pgErr); ok && pgErr.Code == "23503" {
+			return 0, repoerrs.ErrNotFound
+		}
 		return 0, fmt.Errorf("AuthRepo.WriteToken - u.Pool.QueryRow: %v", err)
 	}
 	return tokenID, nil
 }
 
-func (a *AuthRepo) TokenExist(ctx context.Context, token string) (int, error) {
+// TokenExist finds the key by any of its hashes, each matched only against keys of the same version
+func (a *AuthRepo) TokenExist(ctx context.Context, hashes []entity.KeyHash) (entity.APIKey, error) {
+	match := squirrel.Or{}
+	for _, hash := range hashes {
+		match = append(match, squirrel.Eq{"hash_version": hash.Version, "hash_key": hash.Hash})
+	}
+
 	sql, args, _ := a.Builder.
-		Select("id").
+		Select(apiKeyColumns...).
 		From("api_keys").
-		Where("hash_key = ?", token).
+		Where(match).
+		Limit(1).
 		ToSql()
 
-	var tokenID int
-	err := a.Pool.QueryRow(ctx, sql, args...).Scan(&tokenID)
+	key, err := scanAPIKey(a.Pool.QueryRow(ctx, sql, args...))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return entity.APIKey{}, repoerrs.ErrNotFound
+		}
+		return entity.APIKey{}, fmt.Errorf("AuthRepo.TokenExist - u.Pool.QueryRow: %v", err)
+	}
+	return key, nil
+}
+
+func (a *AuthRepo) GetToken(ctx context.Context, id int) (entity.APIKey, error) {
+	sql, args, _ := a.Builder.
+		Select(apiKeyColumns...).
+		From("api_keys").
+		Where("id = ?", id).
+		ToSql()
+
+	key, err := scanAPIKey(a.Pool.QueryRow(ctx, sql, args...))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return entity.APIKey{}, repoerrs.ErrNotFound
+		}
+		return entity.APIKey{}, fmt.Errorf("AuthRepo.GetToken - a.Pool.QueryRow: %v", err)
+	}
+	return key, nil
+}
+
+func (a *AuthRepo) ListTokens(ctx context.Context) ([]entity.APIKey, error) {
+	sql, args, _ := a.Builder.
+		Select(apiKeyColumns...).
+		From("api_keys").
+		OrderBy("id").
+		ToSql()
+
+	rows, err := a.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("AuthRepo.ListTokens - a.Pool.Query: %v", err)
+	}
+	defer rows.Close()
+
+	keys := make([]entity.APIKey, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("AuthRepo.ListTokens - rows.Scan: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RehashToken replaces the hash of the key with a hash of a newer version
+func (a *AuthRepo) RehashToken(ctx context.Context, id int, hash entity.KeyHash, keyPrefix string) error {
+	sql, args, _ := a.Builder.
+		Update("api_keys").
+		Set("hash_key", hash.Hash).
+		Set("hash_version", hash.Version).
+		Set("key_prefix", keyPrefix).
+		Where("id = ? AND hash_version < ?", id, hash.Version).
+		ToSql()
+
+	_, err := a.Pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("AuthRepo.RehashToken - a.Pool.Exec: %v", err)
+	}
+	return nil
+}
+
+// TouchToken records the use of the key
+func (a *AuthRepo) TouchToken(ctx context.Context, id int) error {
+	sql, args, _ := a.Builder.
+		Update("api_keys").
+		Set("last_used_at", squirrel.Expr("now()")).
+		Where("id = ?", id).
+		ToSql()
+
+	_, err := a.Pool.Exec(ctx, sql, args...)
 	if err != nil {
-		return 0, fmt.Errorf("AuthRepo.TokenExist - u.Pool.QueryRow: %v", err)
+		return fmt.Errorf("AuthRepo.TouchToken - a.Pool.Exec: %v", err)
+	}
+	return nil
+}
+
+// RevokeToken revokes the key, the time of the first revocation is kept
+func (a *AuthRepo) RevokeToken(ctx context.Context, id int) error {
+	sql, args, _ := a.Builder.
+		Update("api_keys").
+		Set("revoked_at", squirrel.Expr("COALESCE(revoked_at, now())")).
+		Where("id = ?", id).
+		ToSql()
+
+	tag, err := a.Pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("AuthRepo.RevokeToken - a.Pool.Exec: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return repoerrs.ErrNotFound
+	}
+	return nil
+}
+
+// RotateToken writes a new key with the tenant, label, scopes, namespaces and rate limits of the key id
+// and makes the old key expire at oldExpiresAt unless it expires earlier
+func (a *AuthRepo) RotateToken(ctx context.Context, id int, token string, newKey entity.APIKey, oldExpiresAt time.Time) (int, error) {
+	tx, err := a.Pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("AuthRepo.RotateToken - a.Pool.Begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	sql, args, _ := a.Builder.
+		Update("api_keys").
+		Set("expires_at", squirrel.Expr("LEAST(expires_at, ?::timestamp)", oldExpiresAt)).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Suffix("RETURNING tenant_id, label, scopes, read_namespaces, write_namespaces, rate_limit, rate_burst").
+		ToSql()
+
+	err = tx.QueryRow(ctx, sql, args...).Scan(&newKey.TenantID, &newKey.Label, &newKey.Scopes, &newKey.ReadNamespaces, &newKey.WriteNamespaces,
+		&newKey.RateLimit, &newKey.RateBurst)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, repoerrs.ErrNotFound
+		}
+		return 0, fmt.Errorf("AuthRepo.RotateToken - tx.QueryRow (update): %v", err)
+	}
+
+	sql, args, _ = a.Builder.
+		Insert("api_keys").
+		Columns("tenant_id", "hash_key", "hash_version", "key_prefix", "label", "scopes", "read_namespaces", "write_namespaces", "expires_at",
+			"rate_limit", "rate_burst").
+		Values(newKey.TenantID, token, newKey.HashVersion, newKey.KeyPrefix, newKey.Label, newKey.Scopes,
+			newKey.ReadNamespaces, newKey.WriteNamespaces, newKey.ExpiresAt, newKey.RateLimit, newKey.RateBurst).
+		Suffix("RETURNING id").
+		ToSql()
+
+	var tokenID int
+	if err = tx.QueryRow(ctx, sql, args...).Scan(&tokenID); err != nil {
+		return 0, fmt.Errorf("AuthRepo.RotateToken - tx.QueryRow (insert): %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("AuthRepo.RotateToken - tx.Commit: %v", err)
 	}
 	return tokenID, nil
 }
+
+// ListenTokenChanges calls notify with the id of every key that was changed or deleted until ctx is done
+func (a *AuthRepo) ListenTokenChanges(ctx context.Context, notify func(id int)) error {
+	conn, err := a.Pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("AuthRepo.ListenTokenChanges - a.Pool.Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "LISTEN "+apiKeysChannel)
+	if err != nil {
+		return fmt.Errorf("AuthRepo.ListenTokenChanges - conn.Exec (listen): %v", err)
+	}
+	defer func() { _, _ = conn.Exec(context.Background(), "UNLISTEN "+apiKeysChannel) }()
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("AuthRepo.ListenTokenChanges - conn.WaitForNotification: %v", err)
+		}
+		id, err := strconv.Atoi(notification.Payload)
+		if err != nil {
+			return fmt.Errorf("AuthRepo.ListenTokenChanges - strconv.Atoi: %v", err)
+		}
+		notify(id)
+	}
+}
+
+func scanAPIKey(row pgx.Row) (entity.APIKey, error) {
+	var key entity.APIKey
+	err := row.Scan(&key.ID, &key.TenantID, &key.HashVersion, &key.KeyPrefix, &key.Label, &key.Scopes,
+		&key.ReadNamespaces, &key.WriteNamespaces, &key.CreatedAt, &key.ExpiresAt, &key.RevokedAt, &key.LastUsedAt, &key.RateLimit, &key.RateBurst)
+	return key, err
+}
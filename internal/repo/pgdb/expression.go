@@ -0,0 +1,84 @@
+package pgdb
+
+import (
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"strings"
+)
+
+// leafSegmentSQL joins the operand segment, members of archived segments and of segments outside their
+// active window are not members of the expression, as in UserRepo.GetSegments
+const leafSegmentSQL = "JOIN segments s ON s.tenant_id = us.tenant_id AND s.slug = us.segment_slug AND s.archived_at IS NULL " +
+	"AND (s.active_from IS NULL OR s.active_from <= now()) AND (s.active_until IS NULL OR s.active_until > now()) "
+
+const leafUsersSQL = "SELECT us.user_id FROM user_segments us " + leafSegmentSQL +
+	"WHERE us.tenant_id = ? AND us.segment_slug = ?"
+
+const leafMemberSQL = "EXISTS (SELECT 1 FROM user_segments us " + leafSegmentSQL +
+	"WHERE us.tenant_id = ? AND us.segment_slug = ? AND us.user_id = ?)"
+
+// expressionUsersSQL compiles the expression into a query selecting user_id of its members of the tenant
+func expressionUsersSQL(expr entity.SegmentExpression, tenantID int) (string, []interface{}) {
+	if expr.Op == "" {
+		return leafUsersSQL, []interface{}{tenantID, expr.Segment}
+	}
+
+	operator := map[string]string{
+		entity.ExpressionUnion:        " UNION ",
+		entity.ExpressionIntersection: " INTERSECT ",
+		entity.ExpressionDifference:   " EXCEPT ",
+	}[expr.Op]
+
+	parts := make([]string, 0, len(expr.Args))
+	args := make([]interface{}, 0, len(expr.Args))
+	for _, arg := range expr.Args {
+		sql, argArgs := expressionUsersSQL(arg, tenantID)
+		parts = append(parts, "("+sql+")")
+		args = append(args, argArgs...)
+	}
+	return strings.Join(parts, operator), args
+}
+
+// expressionMemberSQL compiles the expression into a condition that is true when the user of the tenant is its member
+func expressionMemberSQL(expr entity.SegmentExpression, tenantID int, userID string) (string, []interface{}) {
+	if expr.Op == "" {
+		return leafMemberSQL, []interface{}{tenantID, expr.Segment, userID}
+	}
+
+	parts := make([]string, 0, len(expr.Args))
+	args := make([]interface{}, 0, 2*len(expr.Args))
+	for _, arg := range expr.Args {
+		sql, argArgs := expressionMemberSQL(arg, tenantID, userID)
+		parts = append(parts, sql)
+		args = append(args, argArgs...)
+	}
+
+	switch expr.Op {
+	case entity.ExpressionUnion:
+		return "(" + strings.Join(parts, " OR ") + ")", args
+	case entity.ExpressionIntersection:
+		return "(" + strings.Join(parts, " AND ") + ")", args
+	default:
+		if len(parts) == 1 {
+			return parts[0], args
+		}
+		return "(" + parts[0] + " AND NOT (" + strings.Join(parts[1:], " OR ") + "))", args
+	}
+}
+
+// renameExpressionSegment replaces the slug in the expression and reports whether it was used
+func renameExpressionSegment(expr *entity.SegmentExpression, slug, newSlug string) bool {
+	if expr.Op == "" {
+		if expr.Segment != slug {
+			return false
+		}
+		expr.Segment = newSlug
+		return true
+	}
+	renamed := false
+	for i := range expr.Args {
+		if renameExpressionSegment(&expr.Args[i], slug, newSlug) {
+			renamed = true
+		}
+	}
+	return renamed
+}
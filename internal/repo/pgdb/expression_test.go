@@ -0,0 +1,77 @@
+package pgdb
+
+import (
+	"context"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/pkg/postgres"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestExpressionActiveWindow(t *testing.T) {
+	_, app := testDB(t)
+	ctx := postgres.WithTenant(context.Background(), entity.DefaultTenantID)
+	segmentRepo, userRepo := NewSegmentRepo(app), NewUserRepo(app)
+
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	segments := []entity.Segment{
+		{Slug: "ACTIVE"},
+		{Slug: "NOT_YET", ActiveFrom: &future},
+		{Slug: "EXPIRED", ActiveUntil: &past},
+	}
+	for _, segment := range segments {
+		if err := segmentRepo.CreateSegment(ctx, entity.Segment{Slug: segment.Slug}); err != nil {
+			t.Fatalf("CreateSegment(%s): %v", segment.Slug, err)
+		}
+		if _, err := userRepo.SetSegments(ctx, "user_"+segment.Slug, []string{segment.Slug}, []string{}, nil); err != nil {
+			t.Fatalf("SetSegments(%s): %v", segment.Slug, err)
+		}
+		if err := segmentRepo.SetActiveWindow(ctx, segment); err != nil {
+			t.Fatalf("SetActiveWindow(%s): %v", segment.Slug, err)
+		}
+	}
+
+	union := &entity.SegmentExpression{Op: entity.ExpressionUnion, Args: []entity.SegmentExpression{
+		{Segment: "ACTIVE"}, {Segment: "NOT_YET"}, {Segment: "EXPIRED"},
+	}}
+	if _, err := segmentRepo.CreateDerivedSegment(ctx, entity.Segment{Slug: "LIVE", Expression: union}, false); err != nil {
+		t.Fatalf("CreateDerivedSegment(LIVE): %v", err)
+	}
+	materialized, err := segmentRepo.CreateDerivedSegment(ctx, entity.Segment{Slug: "SNAPSHOT", Expression: union}, true)
+	if err != nil {
+		t.Fatalf("CreateDerivedSegment(SNAPSHOT): %v", err)
+	}
+	if !reflect.DeepEqual(materialized, []string{"user_ACTIVE"}) {
+		t.Errorf("materialized users = %v, want [user_ACTIVE]", materialized)
+	}
+
+	users, err := segmentRepo.GetUsersInSegment(ctx, "LIVE")
+	if err != nil {
+		t.Fatalf("GetUsersInSegment(LIVE): %v", err)
+	}
+	if !reflect.DeepEqual(users, []string{"user_ACTIVE"}) {
+		t.Errorf("GetUsersInSegment(LIVE) = %v, want [user_ACTIVE]", users)
+	}
+
+	for _, segment := range segments {
+		active, err := userRepo.GetSegments(ctx, "user_"+segment.Slug)
+		if err != nil {
+			t.Fatalf("GetSegments(user_%s): %v", segment.Slug, err)
+		}
+		got := make([]string, 0, len(active))
+		for _, s := range active {
+			got = append(got, s.Slug)
+		}
+		sort.Strings(got)
+
+		want := []string{}
+		if segment.Slug == "ACTIVE" {
+			want = []string{"ACTIVE", "LIVE", "SNAPSHOT"}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GetSegments(user_%s) = %v, want %v", segment.Slug, got, want)
+		}
+	}
+}
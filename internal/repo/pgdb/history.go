@@ -2,9 +2,7 @@ package pgdb
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"github.com/jackc/pgx/v5"
 	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/pkg/postgres"
 )
@@ -17,19 +15,22 @@ func NewHistoryRepo(pg *postgres.Postgres) *HistoryRepo {
 	return &HistoryRepo{pg}
 }
 
+// AddNotes writes the history records and the webhook deliveries made of them in one statement,
+// so a rolled back change does not notify subscribers
 func (h *HistoryRepo) AddNotes(ctx context.Context, notes []entity.History) error {
-	b := h.Builder.Insert("history").Columns("user_id", "segment_slug", "type")
+	if len(notes) == 0 {
+		return nil
+	}
+
+	b := h.Builder.Insert("history").Columns("tenant_id", "user_id", "segment_slug", "type")
 	for _, note := range notes {
-		b = b.Values(note.UserID, note.SegmentSlug, note.Type)
+		b = b.Values(tenant(ctx), note.UserID, note.SegmentSlug, note.Type)
 	}
-	sql, args, _ := b.ToSql()
+	sql, args, _ := b.Suffix("RETURNING history_id, tenant_id, user_id, segment_slug, type, created_at").ToSql()
 
-	err := h.Pool.QueryRow(ctx, sql, args...).Scan()
+	_, err := h.Pool.Exec(ctx, "WITH notes AS ("+sql+") "+enqueueDeliveriesSQL, args...)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return nil
-		}
-		return fmt.Errorf("HistoryRepo.AddNote - s.Pool.QueryRow: %v", err)
+		return fmt.Errorf("HistoryRepo.AddNote - s.Pool.Exec: %v", err)
 	}
 	return nil
 }
@@ -38,6 +39,7 @@ func (h *HistoryRepo) GetNotes(ctx context.Context, userID string, month, year i
 	sql, args, _ := h.Builder.
 		Select("user_id", "segment_slug", "type", "created_at").
 		From("history").
+		Where("tenant_id = ?", tenant(ctx)).
 		Where("user_id = ? and extract(month from created_at) = ? and extract(year from created_at) = ?", userID, month, year).
 		ToSql()
 
@@ -58,3 +60,29 @@ func (h *HistoryRepo) GetNotes(ctx context.Context, userID string, month, year i
 	}
 	return notes, nil
 }
+
+func (h *HistoryRepo) GetUserNotes(ctx context.Context, userID string) ([]entity.History, error) {
+	sql, args, _ := h.Builder.
+		Select("user_id", "segment_slug", "type", "created_at").
+		From("history").
+		Where("tenant_id = ? AND user_id = ?", tenant(ctx), userID).
+		OrderBy("created_at", "history_id").
+		ToSql()
+
+	rows, err := h.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("HistoryRepo.GetUserNotes - r.Pool.Query: %v", err)
+	}
+	defer rows.Close()
+
+	notes := make([]entity.History, 0, 1)
+	for rows.Next() {
+		note := entity.History{}
+		err = rows.Scan(&note.UserID, &note.SegmentSlug, &note.Type, &note.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("HistoryRepo.GetUserNotes - rows.Scan: %v", err)
+		}
+		notes = append(notes, note)
+	}
+	return notes, nil
+}
@@ -0,0 +1,101 @@
+package pgdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
+	"github.com/passionde/user-segmentation-service/pkg/postgres"
+	"time"
+)
+
+type IdempotencyRepo struct {
+	*postgres.Postgres
+}
+
+func NewIdempotencyRepo(pg *postgres.Postgres) *IdempotencyRepo {
+	return &IdempotencyRepo{pg}
+}
+
+// Reserve claims the key for the request. An expired key or a key abandoned in progress for longer
+// than lockTimeout is claimed anew. When the key is taken, the stored request is returned.
+func (i *IdempotencyRepo) Reserve(ctx context.Context, request entity.IdempotentRequest, retention, lockTimeout time.Duration) (bool, entity.IdempotentRequest, error) {
+	sql, args, _ := i.Builder.
+		Insert("idempotency_keys").
+		Columns("tenant_id", "principal", "idempotency_key", "request_hash").
+		Values(tenant(ctx), request.Principal, request.IdempotencyKey, request.RequestHash).
+		Suffix("ON CONFLICT (tenant_id, principal, idempotency_key) DO UPDATE "+
+			"SET request_hash = EXCLUDED.request_hash, status = NULL, content_type = NULL, body = NULL, created_at = now() "+
+			"WHERE idempotency_keys.created_at <= now() - make_interval(secs => ?) "+
+			"OR (idempotency_keys.status IS NULL AND idempotency_keys.created_at <= now() - make_interval(secs => ?)) "+
+			"RETURNING principal", retention.Seconds(), lockTimeout.Seconds()).
+		ToSql()
+
+	err := i.Pool.QueryRow(ctx, sql, args...).Scan(&request.Principal)
+	if err == nil {
+		return true, request, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return false, request, fmt.Errorf("IdempotencyRepo.Reserve - i.Pool.QueryRow (insert): %v", err)
+	}
+
+	sql, args, _ = i.Builder.
+		Select("request_hash", "status", "COALESCE(content_type, '')", "body", "created_at").
+		From("idempotency_keys").
+		Where("tenant_id = ? AND principal = ? AND idempotency_key = ?", tenant(ctx), request.Principal, request.IdempotencyKey).
+		ToSql()
+
+	stored := entity.IdempotentRequest{Principal: request.Principal, IdempotencyKey: request.IdempotencyKey}
+	err = i.Pool.QueryRow(ctx, sql, args...).
+		Scan(&stored.RequestHash, &stored.Status, &stored.ContentType, &stored.Body, &stored.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, stored, repoerrs.ErrNotFound
+		}
+		return false, stored, fmt.Errorf("IdempotencyRepo.Reserve - i.Pool.QueryRow (select): %v", err)
+	}
+	return false, stored, nil
+}
+
+func (i *IdempotencyRepo) Complete(ctx context.Context, request entity.IdempotentRequest) error {
+	sql, args, _ := i.Builder.
+		Update("idempotency_keys").
+		Set("status", request.Status).
+		Set("content_type", request.ContentType).
+		Set("body", request.Body).
+		Where("tenant_id = ? AND principal = ? AND idempotency_key = ?", tenant(ctx), request.Principal, request.IdempotencyKey).
+		ToSql()
+
+	if _, err := i.Pool.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("IdempotencyRepo.Complete - i.Pool.Exec: %v", err)
+	}
+	return nil
+}
+
+// Release drops a reservation that has not been completed, so the request can be retried
+func (i *IdempotencyRepo) Release(ctx context.Context, principal, idempotencyKey string) error {
+	sql, args, _ := i.Builder.
+		Delete("idempotency_keys").
+		Where("tenant_id = ? AND principal = ? AND idempotency_key = ? AND status IS NULL", tenant(ctx), principal, idempotencyKey).
+		ToSql()
+
+	if _, err := i.Pool.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("IdempotencyRepo.Release - i.Pool.Exec: %v", err)
+	}
+	return nil
+}
+
+func (i *IdempotencyRepo) PurgeExpired(ctx context.Context, retention time.Duration) (int64, error) {
+	sql, args, _ := i.Builder.
+		Delete("idempotency_keys").
+		Where("created_at <= now() - make_interval(secs => ?)", retention.Seconds()).
+		ToSql()
+
+	tag, err := i.Pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return 0, fmt.Errorf("IdempotencyRepo.PurgeExpired - i.Pool.Exec: %v", err)
+	}
+	return tag.RowsAffected(), nil
+}
@@ -2,12 +2,16 @@ package pgdb
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/Masterminds/squirrel"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
 	"github.com/passionde/user-segmentation-service/pkg/postgres"
+	"time"
 )
 
 type SegmentRepo struct {
@@ -18,14 +22,22 @@ func NewSegmentRepo(pg *postgres.Postgres) *SegmentRepo {
 	return &SegmentRepo{pg}
 }
 
-func (s *SegmentRepo) CreateSegment(ctx context.Context, slug string) error {
+func (s *SegmentRepo) CreateSegment(ctx context.Context, segment entity.Segment) error {
+	aliases, err := s.ResolveAliases(ctx, []string{segment.Slug})
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.CreateSegment - s.ResolveAliases: %v", err)
+	}
+	if len(aliases) > 0 {
+		return repoerrs.ErrAlreadyExists
+	}
+
 	sql, args, _ := s.Builder.
 		Insert("segments").
-		Columns("slug").
-		Values(slug).
+		Columns("tenant_id", "slug", "active_from", "active_until", "max_members", "auto_enroll").
+		Values(tenant(ctx), segment.Slug, segment.ActiveFrom, segment.ActiveUntil, segment.MaxMembers, segment.AutoEnroll).
 		ToSql()
 
-	err := s.Pool.QueryRow(ctx, sql, args...).Scan()
+	err = s.Pool.QueryRow(ctx, sql, args...).Scan()
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil
@@ -45,8 +57,9 @@ func (s *SegmentRepo) CreateSegment(ctx context.Context, slug string) error {
 
 func (s *SegmentRepo) DeleteSegment(ctx context.Context, slug string) error {
 	sql, args, _ := s.Builder.
-		Delete("segments").
-		Where("slug = ?", slug).
+		Update("segments").
+		Set("archived_at", squirrel.Expr("now()")).
+		Where("tenant_id = ? AND slug = ? AND archived_at IS NULL", tenant(ctx), slug).
 		Suffix("RETURNING slug").
 		ToSql()
 
@@ -60,13 +73,575 @@ func (s *SegmentRepo) DeleteSegment(ctx context.Context, slug string) error {
 	return nil
 }
 
-func (s *SegmentRepo) GetUsersInSegment(ctx context.Context, slug string) ([]string, error) {
+func (s *SegmentRepo) RestoreSegment(ctx context.Context, slug string) error {
+	sql, args, _ := s.Builder.
+		Update("segments").
+		Set("archived_at", nil).
+		Where("tenant_id = ? AND slug = ? AND archived_at IS NOT NULL", tenant(ctx), slug).
+		Suffix("RETURNING slug").
+		ToSql()
+
+	err := s.Pool.QueryRow(ctx, sql, args...).Scan(&slug)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return repoerrs.ErrNotFound
+		}
+		return fmt.Errorf("SegmentRepo.RestoreSegment - s.Pool.QueryRow: %v", err)
+	}
+	return nil
+}
+
+func (s *SegmentRepo) PurgeArchived(ctx context.Context, retention time.Duration) (int64, error) {
+	sql, args, _ := s.Builder.
+		Delete("segments").
+		Where("tenant_id = ?", tenant(ctx)).
+		Where("archived_at < now()::timestamp - make_interval(secs => ?)", retention.Seconds()).
+		ToSql()
+
+	tag, err := s.Pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return 0, fmt.Errorf("SegmentRepo.PurgeArchived - s.Pool.Exec: %v", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *SegmentRepo) SetCapacity(ctx context.Context, slug string, maxMembers *int) error {
+	sql, args, _ := s.Builder.
+		Update("segments").
+		Set("max_members", maxMembers).
+		Where("tenant_id = ? AND slug = ? AND archived_at IS NULL AND expression IS NULL", tenant(ctx), slug).
+		Suffix("RETURNING slug").
+		ToSql()
+
+	err := s.Pool.QueryRow(ctx, sql, args...).Scan(&slug)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return repoerrs.ErrNotFound
+		}
+		return fmt.Errorf("SegmentRepo.SetCapacity - s.Pool.QueryRow: %v", err)
+	}
+	return nil
+}
+
+func (s *SegmentRepo) SetAutoEnroll(ctx context.Context, slug string, percent *int) error {
 	sql, args, _ := s.Builder.
-		Select("user_id").
-		From("user_segments").
-		Where("segment_slug = ?", slug).
+		Update("segments").
+		Set("auto_enroll", percent).
+		Where("tenant_id = ? AND slug = ? AND archived_at IS NULL AND expression IS NULL", tenant(ctx), slug).
+		Suffix("RETURNING slug").
+		ToSql()
+
+	err := s.Pool.QueryRow(ctx, sql, args...).Scan(&slug)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return repoerrs.ErrNotFound
+		}
+		return fmt.Errorf("SegmentRepo.SetAutoEnroll - s.Pool.QueryRow: %v", err)
+	}
+	return nil
+}
+
+func (s *SegmentRepo) ListSegments(ctx context.Context) ([]entity.SegmentWithMembers, error) {
+	sql, args, _ := s.Builder.
+		Select("s.slug", "s.created_at", "s.active_from", "s.active_until", "s.expression", "s.max_members",
+			"s.auto_enroll", "(SELECT COUNT(*) FROM user_segments us WHERE us.tenant_id = s.tenant_id AND us.segment_slug = s.slug)").
+		From("segments s").
+		Where("s.tenant_id = ? AND s.archived_at IS NULL", tenant(ctx)).
+		OrderBy("s.slug").
 		ToSql()
 
+	rows, err := s.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("SegmentRepo.ListSegments - s.Pool.Query: %v", err)
+	}
+	defer rows.Close()
+
+	segments := make([]entity.SegmentWithMembers, 0, 1)
+	for rows.Next() {
+		var (
+			segment entity.SegmentWithMembers
+			raw     []byte
+		)
+		err = rows.Scan(&segment.Slug, &segment.CreatedAt, &segment.ActiveFrom, &segment.ActiveUntil,
+			&raw, &segment.MaxMembers, &segment.AutoEnroll, &segment.Members)
+		if err != nil {
+			return nil, fmt.Errorf("SegmentRepo.ListSegments - rows.Scan: %v", err)
+		}
+		if raw != nil {
+			segment.Expression = &entity.SegmentExpression{}
+			if err = json.Unmarshal(raw, segment.Expression); err != nil {
+				return nil, fmt.Errorf("SegmentRepo.ListSegments - json.Unmarshal: %v", err)
+			}
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+func (s *SegmentRepo) SetActiveWindow(ctx context.Context, segment entity.Segment) error {
+	sql, args, _ := s.Builder.
+		Update("segments").
+		Set("active_from", segment.ActiveFrom).
+		Set("active_until", segment.ActiveUntil).
+		Where("tenant_id = ? AND slug = ? AND archived_at IS NULL", tenant(ctx), segment.Slug).
+		Suffix("RETURNING slug").
+		ToSql()
+
+	err := s.Pool.QueryRow(ctx, sql, args...).Scan(&segment.Slug)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return repoerrs.ErrNotFound
+		}
+		return fmt.Errorf("SegmentRepo.SetActiveWindow - s.Pool.QueryRow: %v", err)
+	}
+	return nil
+}
+
+func (s *SegmentRepo) RenameSegment(ctx context.Context, slug, newSlug string, aliasTTL time.Duration) error {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.RenameSegment - s.Pool.Begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// the old row is locked so that concurrent adds wait for the rename
+	sql, args, _ := s.Builder.
+		Select("slug").
+		From("segments").
+		Where("tenant_id = ? AND slug = ? AND archived_at IS NULL", tenant(ctx), slug).
+		Suffix("FOR UPDATE").
+		ToSql()
+	err = tx.QueryRow(ctx, sql, args...).Scan(&slug)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return repoerrs.ErrNotFound
+		}
+		return fmt.Errorf("SegmentRepo.RenameSegment - tx.QueryRow (lock): %v", err)
+	}
+
+	// renaming back to a former slug drops its alias, an alias of another segment keeps the slug busy
+	sql, args, _ = s.Builder.
+		Delete("segment_aliases").
+		Where("tenant_id = ? AND alias = ? AND (segment_slug = ? OR expires_at <= now())", tenant(ctx), newSlug, slug).
+		ToSql()
+	if _, err = tx.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("SegmentRepo.RenameSegment - tx.Exec (drop alias): %v", err)
+	}
+
+	var aliasBusy bool
+	sql, args, _ = s.Builder.
+		Select().
+		Column(squirrel.Expr("EXISTS (SELECT 1 FROM segment_aliases WHERE tenant_id = ? AND alias = ?)", tenant(ctx), newSlug)).
+		ToSql()
+	if err = tx.QueryRow(ctx, sql, args...).Scan(&aliasBusy); err != nil {
+		return fmt.Errorf("SegmentRepo.RenameSegment - tx.QueryRow (alias): %v", err)
+	}
+	if aliasBusy {
+		return repoerrs.ErrAlreadyExists
+	}
+
+	sql, args, _ = s.Builder.
+		Insert("segments").
+		Columns("tenant_id", "slug", "created_at", "active_from", "active_until", "expression", "max_members", "auto_enroll").
+		Select(squirrel.
+			Select().
+			Column("tenant_id").
+			Column(squirrel.Expr("?::varchar", newSlug)).
+			Columns("created_at", "active_from", "active_until", "expression", "max_members", "auto_enroll").
+			From("segments").
+			Where("tenant_id = ? AND slug = ?", tenant(ctx), slug)).
+		ToSql()
+	if _, err = tx.Exec(ctx, sql, args...); err != nil {
+		var pgErr *pgconn.PgError
+		if ok := errors.As(err, &pgErr); ok && pgErr.Code == "23505" {
+			return repoerrs.ErrAlreadyExists
+		}
+		return fmt.Errorf("SegmentRepo.RenameSegment - tx.Exec (segments): %v", err)
+	}
+
+	tenantID := tenant(ctx)
+	queries := []squirrel.Sqlizer{
+		s.Builder.Update("user_segments").Set("segment_slug", newSlug).Where(squirrel.Eq{"tenant_id": tenantID, "segment_slug": slug}),
+		s.Builder.Update("tasks_delete").Set("segment_slug", newSlug).
+			Where(squirrel.Eq{"tenant_id": tenantID, "segment_slug": slug, "done": false}),
+		s.Builder.Update("segment_aliases").Set("segment_slug", newSlug).Where(squirrel.Eq{"tenant_id": tenantID, "segment_slug": slug}),
+		s.Builder.Update("segment_hierarchy").Set("parent_slug", newSlug).Where(squirrel.Eq{"tenant_id": tenantID, "parent_slug": slug}),
+		s.Builder.Update("segment_hierarchy").Set("child_slug", newSlug).Where(squirrel.Eq{"tenant_id": tenantID, "child_slug": slug}),
+		s.Builder.Update("segment_prerequisites").Set("segment_slug", newSlug).
+			Where(squirrel.Eq{"tenant_id": tenantID, "segment_slug": slug}),
+		s.Builder.Update("segment_prerequisites").Set("prerequisite_slug", newSlug).
+			Where(squirrel.Eq{"tenant_id": tenantID, "prerequisite_slug": slug}),
+		// webhooks keep receiving the segment, namespace prefixes in their filters are not slugs and stay as they are
+		s.Builder.Update("webhooks").Set("segments", squirrel.Expr("array_replace(segments, ?::text, ?::text)", slug, newSlug)).
+			Where("tenant_id = ? AND ?::text = ANY(segments)", tenantID, slug),
+		s.Builder.Delete("segments").Where(squirrel.Eq{"tenant_id": tenantID, "slug": slug}),
+		s.Builder.Insert("segment_aliases").
+			Columns("tenant_id", "alias", "segment_slug", "expires_at").
+			Values(tenantID, slug, newSlug, squirrel.Expr("now()::timestamp + make_interval(secs => ?)", aliasTTL.Seconds())).
+			Suffix("ON CONFLICT (tenant_id, alias) DO UPDATE SET segment_slug = excluded.segment_slug, expires_at = excluded.expires_at"),
+	}
+	for _, query := range queries {
+		sql, args, _ = query.ToSql()
+		if _, err = tx.Exec(ctx, sql, args...); err != nil {
+			return fmt.Errorf("SegmentRepo.RenameSegment - tx.Exec: %v", err)
+		}
+	}
+
+	if err = s.renameInExpressions(ctx, tx, slug, newSlug); err != nil {
+		return fmt.Errorf("SegmentRepo.RenameSegment - s.renameInExpressions: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("SegmentRepo.RenameSegment - tx.Commit: %v", err)
+	}
+	return nil
+}
+
+// renameInExpressions points live derived segments to the new slug of their operand
+func (s *SegmentRepo) renameInExpressions(ctx context.Context, tx pgx.Tx, slug, newSlug string) error {
+	sql, args, _ := s.Builder.
+		Select("slug", "expression").
+		From("segments").
+		Where("tenant_id = ? AND expression IS NOT NULL", tenant(ctx)).
+		Suffix("FOR UPDATE").
+		ToSql()
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.renameInExpressions - tx.Query: %v", err)
+	}
+
+	renamed := make(map[string]string)
+	for rows.Next() {
+		var (
+			derived string
+			raw     []byte
+		)
+		if err = rows.Scan(&derived, &raw); err != nil {
+			rows.Close()
+			return fmt.Errorf("SegmentRepo.renameInExpressions - rows.Scan: %v", err)
+		}
+
+		expression := entity.SegmentExpression{}
+		if err = json.Unmarshal(raw, &expression); err != nil {
+			rows.Close()
+			return fmt.Errorf("SegmentRepo.renameInExpressions - json.Unmarshal: %v", err)
+		}
+		if renameExpressionSegment(&expression, slug, newSlug) {
+			raw, _ = json.Marshal(expression)
+			renamed[derived] = string(raw)
+		}
+	}
+	rows.Close()
+
+	for derived, expression := range renamed {
+		sql, args, _ = s.Builder.
+			Update("segments").
+			Set("expression", squirrel.Expr("?::jsonb", expression)).
+			Where("tenant_id = ? AND slug = ?", tenant(ctx), derived).
+			ToSql()
+		if _, err = tx.Exec(ctx, sql, args...); err != nil {
+			return fmt.Errorf("SegmentRepo.renameInExpressions - tx.Exec: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *SegmentRepo) LinkSegments(ctx context.Context, parent, child, inheritance string) error {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.LinkSegments - s.Pool.Begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// concurrent links are serialized, otherwise two of them could close a cycle together
+	if _, err = tx.Exec(ctx, "LOCK TABLE segment_hierarchy IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return fmt.Errorf("SegmentRepo.LinkSegments - tx.Exec (lock): %v", err)
+	}
+
+	sql, args, _ := s.Builder.
+		Select("COUNT(*)").
+		From("segments").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "slug": []string{parent, child}, "archived_at": nil, "expression": nil}).
+		ToSql()
+
+	var count int
+	if err = tx.QueryRow(ctx, sql, args...).Scan(&count); err != nil {
+		return fmt.Errorf("SegmentRepo.LinkSegments - tx.QueryRow (segments): %v", err)
+	}
+	if count != countUnique([]string{parent, child}) {
+		return repoerrs.ErrNotFound
+	}
+
+	// the parent must not be reachable from the child
+	var cycle bool
+	sql, args, _ = s.Builder.
+		Select().
+		Column(squirrel.Expr(`EXISTS (
+			WITH RECURSIVE descendants(slug) AS (
+				SELECT ?::varchar
+				UNION
+				SELECT h.child_slug FROM descendants d JOIN segment_hierarchy h ON h.tenant_id = ? AND h.parent_slug = d.slug
+			)
+			SELECT 1 FROM descendants WHERE slug = ?
+		)`, child, tenant(ctx), parent)).
+		ToSql()
+	if err = tx.QueryRow(ctx, sql, args...).Scan(&cycle); err != nil {
+		return fmt.Errorf("SegmentRepo.LinkSegments - tx.QueryRow (cycle): %v", err)
+	}
+	if cycle {
+		return repoerrs.ErrHierarchyCycle
+	}
+
+	sql, args, _ = s.Builder.
+		Insert("segment_hierarchy").
+		Columns("tenant_id", "parent_slug", "child_slug", "inheritance").
+		Values(tenant(ctx), parent, child, inheritance).
+		ToSql()
+	if _, err = tx.Exec(ctx, sql, args...); err != nil {
+		var pgErr *pgconn.PgError
+		if ok := errors.As(err, &pgErr); ok && pgErr.Code == "23505" {
+			return repoerrs.ErrAlreadyExists
+		}
+		return fmt.Errorf("SegmentRepo.LinkSegments - tx.Exec: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("SegmentRepo.LinkSegments - tx.Commit: %v", err)
+	}
+	return nil
+}
+
+func (s *SegmentRepo) UnlinkSegments(ctx context.Context, parent, child string) error {
+	sql, args, _ := s.Builder.
+		Delete("segment_hierarchy").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "parent_slug": parent, "child_slug": child}).
+		Suffix("RETURNING parent_slug").
+		ToSql()
+
+	err := s.Pool.QueryRow(ctx, sql, args...).Scan(&parent)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return repoerrs.ErrNotFound
+		}
+		return fmt.Errorf("SegmentRepo.UnlinkSegments - s.Pool.QueryRow: %v", err)
+	}
+	return nil
+}
+
+func (s *SegmentRepo) SetPrerequisites(ctx context.Context, slug string, prerequisites []string) error {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("SegmentRepo.SetPrerequisites - s.Pool.Begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// concurrent changes are serialized, otherwise two of them could close a cycle together
+	if _, err = tx.Exec(ctx, "LOCK TABLE segment_prerequisites IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return fmt.Errorf("SegmentRepo.SetPrerequisites - tx.Exec (lock): %v", err)
+	}
+
+	segments := append([]string{slug}, prerequisites...)
+	sql, args, _ := s.Builder.
+		Select("COUNT(*)").
+		From("segments").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "slug": segments, "archived_at": nil, "expression": nil}).
+		ToSql()
+
+	var count int
+	if err = tx.QueryRow(ctx, sql, args...).Scan(&count); err != nil {
+		return fmt.Errorf("SegmentRepo.SetPrerequisites - tx.QueryRow (segments): %v", err)
+	}
+	if count != countUnique(segments) {
+		return repoerrs.ErrNotFound
+	}
+
+	sql, args, _ = s.Builder.Delete("segment_prerequisites").
+		Where("tenant_id = ? AND segment_slug = ?", tenant(ctx), slug).
+		ToSql()
+	if _, err = tx.Exec(ctx, sql, args...); err != nil {
+		return fmt.Errorf("SegmentRepo.SetPrerequisites - tx.Exec (delete): %v", err)
+	}
+
+	// the segment must not be required by its new prerequisites
+	var cycle bool
+	sql, args, _ = s.Builder.
+		Select().
+		Column(squirrel.Expr(`EXISTS (
+			WITH RECURSIVE required(slug) AS (
+				SELECT unnest(?::varchar[])
+				UNION
+				SELECT p.prerequisite_slug FROM required r JOIN segment_prerequisites p ON p.tenant_id = ? AND p.segment_slug = r.slug
+			)
+			SELECT 1 FROM required WHERE slug = ?
+		)`, prerequisites, tenant(ctx), slug)).
+		ToSql()
+	if err = tx.QueryRow(ctx, sql, args...).Scan(&cycle); err != nil {
+		return fmt.Errorf("SegmentRepo.SetPrerequisites - tx.QueryRow (cycle): %v", err)
+	}
+	if cycle {
+		return repoerrs.ErrPrerequisiteCycle
+	}
+
+	if len(prerequisites) > 0 {
+		b := s.Builder.Insert("segment_prerequisites").Columns("tenant_id", "segment_slug", "prerequisite_slug")
+		for _, prerequisite := range prerequisites {
+			b = b.Values(tenant(ctx), slug, prerequisite)
+		}
+		sql, args, _ = b.Suffix("ON CONFLICT DO NOTHING").ToSql()
+		if _, err = tx.Exec(ctx, sql, args...); err != nil {
+			return fmt.Errorf("SegmentRepo.SetPrerequisites - tx.Exec (insert): %v", err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("SegmentRepo.SetPrerequisites - tx.Commit: %v", err)
+	}
+	return nil
+}
+
+func (s *SegmentRepo) GetPrerequisites(ctx context.Context) (map[string][]string, error) {
+	sql, args, _ := s.Builder.
+		Select("segment_slug", "prerequisite_slug").
+		From("segment_prerequisites").
+		Where("tenant_id = ?", tenant(ctx)).
+		ToSql()
+
+	rows, err := s.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("SegmentRepo.GetPrerequisites - s.Pool.Query: %v", err)
+	}
+	defer rows.Close()
+
+	prerequisites := make(map[string][]string)
+	for rows.Next() {
+		var segment, prerequisite string
+		if err = rows.Scan(&segment, &prerequisite); err != nil {
+			return nil, fmt.Errorf("SegmentRepo.GetPrerequisites - rows.Scan: %v", err)
+		}
+		prerequisites[segment] = append(prerequisites[segment], prerequisite)
+	}
+	return prerequisites, nil
+}
+
+func (s *SegmentRepo) ResolveAliases(ctx context.Context, slugs []string) (map[string]string, error) {
+	sql, args, _ := s.Builder.
+		Select("alias", "segment_slug").
+		From("segment_aliases").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "alias": slugs}).
+		Where("expires_at > now()").
+		ToSql()
+
+	rows, err := s.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("SegmentRepo.ResolveAliases - s.Pool.Query: %v", err)
+	}
+	defer rows.Close()
+
+	aliases := make(map[string]string)
+	for rows.Next() {
+		var alias, slug string
+		if err = rows.Scan(&alias, &slug); err != nil {
+			return nil, fmt.Errorf("SegmentRepo.ResolveAliases - rows.Scan: %v", err)
+		}
+		aliases[alias] = slug
+	}
+	return aliases, nil
+}
+
+func (s *SegmentRepo) CreateDerivedSegment(ctx context.Context, segment entity.Segment, materialize bool) ([]string, error) {
+	aliases, err := s.ResolveAliases(ctx, []string{segment.Slug})
+	if err != nil {
+		return nil, fmt.Errorf("SegmentRepo.CreateDerivedSegment - s.ResolveAliases: %v", err)
+	}
+	if len(aliases) > 0 {
+		return nil, repoerrs.ErrAlreadyExists
+	}
+
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("SegmentRepo.CreateDerivedSegment - s.Pool.Begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	operands := segment.Expression.Segments()
+	sql, args, _ := s.Builder.
+		Select("COUNT(*)").
+		From("segments").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "slug": operands, "archived_at": nil, "expression": nil}).
+		ToSql()
+
+	var count int
+	if err = tx.QueryRow(ctx, sql, args...).Scan(&count); err != nil {
+		return nil, fmt.Errorf("SegmentRepo.CreateDerivedSegment - tx.QueryRow (operands): %v", err)
+	}
+	if count != countUnique(operands) {
+		return nil, repoerrs.ErrSegmentsNotExist
+	}
+
+	var expression interface{}
+	if !materialize {
+		raw, _ := json.Marshal(segment.Expression)
+		expression = string(raw)
+	}
+	sql, args, _ = s.Builder.
+		Insert("segments").
+		Columns("tenant_id", "slug", "active_from", "active_until", "expression").
+		Values(tenant(ctx), segment.Slug, segment.ActiveFrom, segment.ActiveUntil, squirrel.Expr("?::jsonb", expression)).
+		ToSql()
+	if _, err = tx.Exec(ctx, sql, args...); err != nil {
+		var pgErr *pgconn.PgError
+		if ok := errors.As(err, &pgErr); ok && pgErr.Code == "23505" {
+			return nil, repoerrs.ErrAlreadyExists
+		}
+		return nil, fmt.Errorf("SegmentRepo.CreateDerivedSegment - tx.Exec (segments): %v", err)
+	}
+
+	usersID := make([]string, 0, 1)
+	if materialize {
+		usersSQL, usersArgs := expressionUsersSQL(*segment.Expression, tenant(ctx))
+		sql = "INSERT INTO user_segments (tenant_id, user_id, segment_slug) SELECT ?::int, user_id, ? FROM (" +
+			usersSQL + ") AS derived RETURNING user_id"
+		sql, _ = squirrel.Dollar.ReplacePlaceholders(sql)
+
+		rows, err := tx.Query(ctx, sql, append([]interface{}{tenant(ctx), segment.Slug}, usersArgs...)...)
+		if err != nil {
+			return nil, fmt.Errorf("SegmentRepo.CreateDerivedSegment - tx.Query (user_segments): %v", err)
+		}
+		usersID = scanSegments(rows)
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, fmt.Errorf("SegmentRepo.CreateDerivedSegment - rows.Err: %v", err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("SegmentRepo.CreateDerivedSegment - tx.Commit: %v", err)
+	}
+	return usersID, nil
+}
+
+func (s *SegmentRepo) GetUsersInSegment(ctx context.Context, slug string) ([]string, error) {
+	expression, err := s.getExpression(ctx, slug)
+	if err != nil {
+		return nil, fmt.Errorf("SegmentRepo.GetUsersInSegment - s.getExpression: %v", err)
+	}
+
+	var (
+		sql  string
+		args []interface{}
+	)
+	if expression != nil {
+		sql, args = expressionUsersSQL(*expression, tenant(ctx))
+		sql, _ = squirrel.Dollar.ReplacePlaceholders(sql)
+	} else {
+		sql, args, _ = s.Builder.
+			Select("user_id").
+			From("user_segments").
+			Where("tenant_id = ? AND segment_slug = ?", tenant(ctx), slug).
+			ToSql()
+	}
+
 	rows, err := s.Pool.Query(ctx, sql, args...)
 	if err != nil {
 		return nil, fmt.Errorf("SegmentRepo.GetUsersInSegment - u.Pool.Query: %v", err)
@@ -81,3 +656,29 @@ func (s *SegmentRepo) GetUsersInSegment(ctx context.Context, slug string) ([]str
 	}
 	return usersID, nil
 }
+
+func (s *SegmentRepo) getExpression(ctx context.Context, slug string) (*entity.SegmentExpression, error) {
+	sql, args, _ := s.Builder.
+		Select("expression").
+		From("segments").
+		Where("tenant_id = ? AND slug = ?", tenant(ctx), slug).
+		ToSql()
+
+	var raw []byte
+	err := s.Pool.QueryRow(ctx, sql, args...).Scan(&raw)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("SegmentRepo.getExpression - s.Pool.QueryRow: %v", err)
+	}
+	if raw == nil {
+		return nil, nil
+	}
+
+	expression := &entity.SegmentExpression{}
+	if err = json.Unmarshal(raw, expression); err != nil {
+		return nil, fmt.Errorf("SegmentRepo.getExpression - json.Unmarshal: %v", err)
+	}
+	return expression, nil
+}
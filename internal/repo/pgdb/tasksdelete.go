@@ -7,10 +7,13 @@ import (
 	"github.com/Masterminds/squirrel"
 	"github.com/jackc/pgx/v5"
 	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
 	"github.com/passionde/user-segmentation-service/pkg/postgres"
 	"time"
 )
 
+const tasksDeleteChannel = "tasks_delete"
+
 type TasksDeleteRepo struct {
 	*postgres.Postgres
 }
@@ -21,10 +24,11 @@ func NewTasksDeleteRepo(pg *postgres.Postgres) *TasksDeleteRepo {
 
 func (t *TasksDeleteRepo) GetExpiredTasks(ctx context.Context) ([]entity.Task, error) {
 	sql, args, _ := t.Builder.
-		Select("task_id", "user_id", "segment_slug").
+		Select("task_id", "user_id", "segment_slug", "operation", "deadline").
 		From("tasks_delete").
-		Where("deadline < now()").
+		Where("tenant_id = ? AND deadline <= now()", tenant(ctx)).
 		Where(squirrel.Eq{"done": false}).
+		OrderBy("deadline", "task_id").
 		ToSql()
 
 	rows, err := t.Pool.Query(ctx, sql, args...)
@@ -33,13 +37,80 @@ func (t *TasksDeleteRepo) GetExpiredTasks(ctx context.Context) ([]entity.Task, e
 	}
 	defer rows.Close()
 
-	expiredTasks := make([]entity.Task, 0, 1)
+	return scanTasks(rows)
+}
+
+func (t *TasksDeleteRepo) GetPendingTasks(ctx context.Context, userID string) ([]entity.Task, error) {
+	sql, args, _ := t.Builder.
+		Select("task_id", "user_id", "segment_slug", "operation", "deadline").
+		From("tasks_delete").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "user_id": userID, "done": false}).
+		OrderBy("deadline", "task_id").
+		ToSql()
+
+	rows, err := t.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("TasksDeleteRepo.GetPendingTasks - t.Pool.Query: %v", err)
+	}
+	defer rows.Close()
+
+	return scanTasks(rows)
+}
+
+func scanTasks(rows pgx.Rows) ([]entity.Task, error) {
+	tasks := make([]entity.Task, 0, 1)
 	for rows.Next() {
 		task := entity.Task{}
-		_ = rows.Scan(&task.TaskID, &task.UserID, &task.SegmentSlug)
-		expiredTasks = append(expiredTasks, task)
+		err := rows.Scan(&task.TaskID, &task.UserID, &task.SegmentSlug, &task.Operation, &task.Deadline)
+		if err != nil {
+			return nil, fmt.Errorf("scanTasks - rows.Scan: %v", err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+func (t *TasksDeleteRepo) GetNextDeadline(ctx context.Context) (time.Duration, error) {
+	sql, args, _ := t.Builder.
+		Select("EXTRACT(EPOCH FROM MIN(deadline) - now()::timestamp)").
+		From("tasks_delete").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "done": false}).
+		ToSql()
+
+	var seconds *float64
+	err := t.Pool.QueryRow(ctx, sql, args...).Scan(&seconds)
+	if err != nil {
+		return 0, fmt.Errorf("TasksDeleteRepo.GetNextDeadline - t.Pool.QueryRow: %v", err)
+	}
+	if seconds == nil {
+		return 0, repoerrs.ErrNotFound
+	}
+	if *seconds < 0 {
+		return 0, nil
+	}
+	return time.Duration(*seconds * float64(time.Second)), nil
+}
+
+func (t *TasksDeleteRepo) ListenNewTasks(ctx context.Context, notify func()) error {
+	conn, err := t.Pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("TasksDeleteRepo.ListenNewTasks - t.Pool.Acquire: %v", err)
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "LISTEN "+tasksDeleteChannel)
+	if err != nil {
+		return fmt.Errorf("TasksDeleteRepo.ListenNewTasks - conn.Exec (listen): %v", err)
+	}
+	defer func() { _, _ = conn.Exec(context.Background(), "UNLISTEN "+tasksDeleteChannel) }()
+
+	for {
+		_, err = conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("TasksDeleteRepo.ListenNewTasks - conn.WaitForNotification: %v", err)
+		}
+		notify()
 	}
-	return expiredTasks, nil
 }
 
 func (t *TasksDeleteRepo) ChangeStatusTasks(ctx context.Context, tasks []entity.Task) error {
@@ -51,7 +122,7 @@ func (t *TasksDeleteRepo) ChangeStatusTasks(ctx context.Context, tasks []entity.
 	sql, args, _ := t.Builder.
 		Update("tasks_delete").
 		Set("done", true).
-		Where(squirrel.Eq{"task_id": tasksID}).
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "task_id": tasksID}).
 		ToSql()
 
 	err := t.Pool.QueryRow(ctx, sql, args...).Scan()
@@ -65,6 +136,10 @@ func (t *TasksDeleteRepo) ChangeStatusTasks(ctx context.Context, tasks []entity.
 }
 
 func (t *TasksDeleteRepo) CreateTasks(ctx context.Context, tasks []entity.Task, ttl uint64) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+
 	var serverTime time.Time
 	err := t.Pool.QueryRow(ctx, "SELECT now()").Scan(&serverTime)
 	if err != nil {
@@ -72,18 +147,150 @@ func (t *TasksDeleteRepo) CreateTasks(ctx context.Context, tasks []entity.Task,
 	}
 	deadline := serverTime.Add(time.Duration(ttl) * time.Minute)
 
-	b := t.Builder.Insert("tasks_delete").Columns("user_id", "segment_slug", "deadline")
+	for i := range tasks {
+		tasks[i].Operation = entity.OperationTypeDelete
+		tasks[i].Deadline = deadline
+	}
+
+	tx, err := t.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("TasksDeleteRepo.CreateTasks - t.Pool.Begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err = t.insertTasks(ctx, tx, tasks); err != nil {
+		return fmt.Errorf("TasksDeleteRepo.CreateTasks - t.insertTasks: %v", err)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("TasksDeleteRepo.CreateTasks - tx.Commit: %v", err)
+	}
+	return nil
+}
+
+func (t *TasksDeleteRepo) ScheduleTasks(ctx context.Context, tasks []entity.Task) ([]entity.Task, error) {
+	if len(tasks) == 0 {
+		return tasks, nil
+	}
+
+	tx, err := t.Pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("TasksDeleteRepo.ScheduleTasks - t.Pool.Begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	segmentsAdd := make([]string, 0, 1)
+	usersID := make([]string, 0, len(tasks))
 	for _, task := range tasks {
-		b = b.Values(task.UserID, task.SegmentSlug, deadline)
+		if task.Operation == entity.OperationTypeAdd {
+			segmentsAdd = append(segmentsAdd, task.SegmentSlug)
+		}
+		usersID = append(usersID, task.UserID)
+	}
+
+	sql, args, _ := t.Builder.
+		Select("COUNT(DISTINCT slug)").
+		From("segments").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "slug": segmentsAdd, "archived_at": nil, "expression": nil}).
+		ToSql()
+
+	var count int
+	if err = tx.QueryRow(ctx, sql, args...).Scan(&count); err != nil {
+		return nil, fmt.Errorf("TasksDeleteRepo.ScheduleTasks - tx.QueryRow (segments): %v", err)
+	}
+	if count != countUnique(segmentsAdd) {
+		return nil, repoerrs.ErrSegmentsNotExist
+	}
+
+	b := t.Builder.Insert("users").Columns("tenant_id", "user_id")
+	for _, userID := range usersID {
+		b = b.Values(tenant(ctx), userID)
 	}
-	sql, args, _ := b.ToSql()
+	sql, args, _ = b.Suffix("ON CONFLICT (tenant_id, user_id) DO NOTHING").ToSql()
+	if _, err = tx.Exec(ctx, sql, args...); err != nil {
+		return nil, fmt.Errorf("TasksDeleteRepo.ScheduleTasks - tx.Exec (users): %v", err)
+	}
+
+	tasks, err = t.insertTasks(ctx, tx, tasks)
+	if err != nil {
+		return nil, fmt.Errorf("TasksDeleteRepo.ScheduleTasks - t.insertTasks: %v", err)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("TasksDeleteRepo.ScheduleTasks - tx.Commit: %v", err)
+	}
+	return tasks, nil
+}
 
-	err = t.Pool.QueryRow(ctx, sql, args...).Scan()
+// GetTask returns a pending task
+func (t *TasksDeleteRepo) GetTask(ctx context.Context, taskID int) (entity.Task, error) {
+	sql, args, _ := t.Builder.
+		Select("task_id", "user_id", "segment_slug", "operation", "deadline").
+		From("tasks_delete").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "task_id": taskID, "done": false}).
+		ToSql()
+
+	var task entity.Task
+	err := t.Pool.QueryRow(ctx, sql, args...).
+		Scan(&task.TaskID, &task.UserID, &task.SegmentSlug, &task.Operation, &task.Deadline)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return nil
+			return task, repoerrs.ErrNotFound
+		}
+		return task, fmt.Errorf("TasksDeleteRepo.GetTask - t.Pool.QueryRow: %v", err)
+	}
+	return task, nil
+}
+
+func (t *TasksDeleteRepo) CancelTask(ctx context.Context, taskID int) error {
+	sql, args, _ := t.Builder.
+		Delete("tasks_delete").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "task_id": taskID, "done": false}).
+		Suffix("RETURNING task_id").
+		ToSql()
+
+	err := t.Pool.QueryRow(ctx, sql, args...).Scan(&taskID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return repoerrs.ErrNotFound
 		}
-		return fmt.Errorf("TasksDeleteRepo.CreateTasks - u.Pool.QueryRow: %v", err)
+		return fmt.Errorf("TasksDeleteRepo.CancelTask - t.Pool.QueryRow: %v", err)
 	}
 	return nil
 }
+
+// insertTasks writes tasks in the transaction and wakes up the worker if it sleeps until a later deadline
+func (t *TasksDeleteRepo) insertTasks(ctx context.Context, tx pgx.Tx, tasks []entity.Task) ([]entity.Task, error) {
+	b := t.Builder.Insert("tasks_delete").Columns("tenant_id", "user_id", "segment_slug", "operation", "deadline")
+	for _, task := range tasks {
+		b = b.Values(tenant(ctx), task.UserID, task.SegmentSlug, task.Operation, task.Deadline)
+	}
+	sql, args, _ := b.Suffix("RETURNING task_id").ToSql()
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("TasksDeleteRepo.insertTasks - tx.Query: %v", err)
+	}
+	for i := 0; rows.Next(); i++ {
+		if err = rows.Scan(&tasks[i].TaskID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("TasksDeleteRepo.insertTasks - rows.Scan: %v", err)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("TasksDeleteRepo.insertTasks - rows.Err: %v", err)
+	}
+
+	_, err = tx.Exec(ctx, "SELECT pg_notify($1, $2)", tasksDeleteChannel, "")
+	if err != nil {
+		return nil, fmt.Errorf("TasksDeleteRepo.insertTasks - tx.Exec (notify): %v", err)
+	}
+	return tasks, nil
+}
+
+func countUnique(s []string) int {
+	unique := make(map[string]struct{}, len(s))
+	for _, e := range s {
+		unique[e] = struct{}{}
+	}
+	return len(unique)
+}
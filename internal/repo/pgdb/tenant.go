@@ -0,0 +1,71 @@
+package pgdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
+	"github.com/passionde/user-segmentation-service/pkg/postgres"
+)
+
+type TenantRepo struct {
+	*postgres.Postgres
+}
+
+func NewTenantRepo(pg *postgres.Postgres) *TenantRepo {
+	return &TenantRepo{pg}
+}
+
+func (t *TenantRepo) CreateTenant(ctx context.Context, name string) (int, error) {
+	sql, args, _ := t.Builder.
+		Insert("tenants").
+		Columns("name").
+		Values(name).
+		Suffix("RETURNING tenant_id").
+		ToSql()
+
+	var tenantID int
+	err := t.Pool.QueryRow(ctx, sql, args...).Scan(&tenantID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if ok := errors.As(err, &pgErr); ok && pgErr.Code == "23505" {
+			return 0, repoerrs.ErrAlreadyExists
+		}
+		return 0, fmt.Errorf("TenantRepo.CreateTenant - t.Pool.QueryRow: %v", err)
+	}
+	return tenantID, nil
+}
+
+func (t *TenantRepo) ListTenants(ctx context.Context) ([]entity.Tenant, error) {
+	sql, args, _ := t.Builder.
+		Select("tenant_id", "name", "created_at").
+		From("tenants").
+		OrderBy("tenant_id").
+		ToSql()
+
+	rows, err := t.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("TenantRepo.ListTenants - t.Pool.Query: %v", err)
+	}
+	defer rows.Close()
+
+	tenants := make([]entity.Tenant, 0, 1)
+	for rows.Next() {
+		var tenant entity.Tenant
+		if err = rows.Scan(&tenant.TenantID, &tenant.Name, &tenant.CreatedAt); err != nil {
+			return nil, fmt.Errorf("TenantRepo.ListTenants - rows.Scan: %v", err)
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, rows.Err()
+}
+
+// tenant returns the tenant of the request. Every query is scoped by it explicitly,
+// row-level security of the tables catches a query that misses the condition.
+// Without a tenant nothing matches, tenant ids start with 1.
+func tenant(ctx context.Context) int {
+	tenantID, _ := postgres.TenantFromContext(ctx)
+	return tenantID
+}
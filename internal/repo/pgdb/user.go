@@ -2,13 +2,16 @@ package pgdb
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/Masterminds/squirrel"
 	"github.com/jackc/pgx/v5"
+	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
 	"github.com/passionde/user-segmentation-service/pkg/postgres"
 	log "github.com/sirupsen/logrus"
+	"strings"
 )
 
 type UserRepo struct {
@@ -19,7 +22,7 @@ func NewUserRepo(pg *postgres.Postgres) *UserRepo {
 	return &UserRepo{pg}
 }
 
-func (u *UserRepo) GetSegments(ctx context.Context, userID string) ([]string, error) {
+func (u *UserRepo) GetSegments(ctx context.Context, userID string) ([]entity.ActiveSegment, error) {
 	ok, err := u.userExist(ctx, userID)
 	if err != nil {
 		return nil, fmt.Errorf("UserRepo.GetSegments - u.userExist: %v", err)
@@ -28,32 +31,188 @@ func (u *UserRepo) GetSegments(ctx context.Context, userID string) ([]string, er
 		return nil, repoerrs.ErrUserNotFound
 	}
 
+	// memberships are propagated along the hierarchy edges according to their inheritance type
+	sql, args, _ := u.Builder.
+		Select("e.slug", "bool_and(e.inherited)").
+		Prefix(`WITH RECURSIVE effective(slug, inherited) AS (
+			SELECT segment_slug, false FROM user_segments WHERE tenant_id = ? AND user_id = ?
+			UNION
+			SELECT CASE WHEN h.inheritance = ? THEN h.child_slug ELSE h.parent_slug END, true
+			FROM effective e
+			JOIN segment_hierarchy h ON h.tenant_id = ? AND ((h.inheritance = ? AND h.parent_slug = e.slug)
+				OR (h.inheritance = ? AND h.child_slug = e.slug))
+		)`, tenant(ctx), userID, entity.InheritanceDown, tenant(ctx), entity.InheritanceDown, entity.InheritanceUp).
+		From("effective e").
+		Join("segments s ON s.tenant_id = ? AND s.slug = e.slug", tenant(ctx)).
+		Where("s.archived_at IS NULL").
+		Where("(s.active_from IS NULL OR s.active_from <= now())").
+		Where("(s.active_until IS NULL OR s.active_until > now())").
+		GroupBy("e.slug").
+		ToSql()
+
+	rows, err := u.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.GetSegments - u.Pool.Query: %v", err)
+	}
+	userSegments := make([]entity.ActiveSegment, 0, 1)
+	for rows.Next() {
+		segment := entity.ActiveSegment{}
+		if err = rows.Scan(&segment.Slug, &segment.Inherited); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("UserRepo.GetSegments - rows.Scan: %v", err)
+		}
+		userSegments = append(userSegments, segment)
+	}
+	rows.Close()
+
+	derivedSegments, err := u.getDerivedSegments(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.GetSegments - u.getDerivedSegments: %v", err)
+	}
+	for _, slug := range derivedSegments {
+		userSegments = append(userSegments, entity.ActiveSegment{Slug: slug})
+	}
+	return userSegments, nil
+}
+
+// getDerivedSegments evaluates expressions of active live derived segments for the user.
+// A member of an expression is a member of one of its operands, so only expressions over segments of the user are evaluated.
+func (u *UserRepo) getDerivedSegments(ctx context.Context, userID string) ([]string, error) {
+	sql, args, _ := u.Builder.
+		Select("slug", "expression").
+		From("segments").
+		Where("tenant_id = ? AND expression IS NOT NULL AND archived_at IS NULL", tenant(ctx)).
+		Where("operands && ARRAY(SELECT segment_slug FROM user_segments WHERE tenant_id = ? AND user_id = ?)", tenant(ctx), userID).
+		Where("(active_from IS NULL OR active_from <= now())").
+		Where("(active_until IS NULL OR active_until > now())").
+		ToSql()
+
+	rows, err := u.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.getDerivedSegments - u.Pool.Query: %v", err)
+	}
+
+	checks := make([]string, 0, 1)
+	args = make([]interface{}, 0, 1)
+	for rows.Next() {
+		var (
+			slug string
+			raw  []byte
+		)
+		if err = rows.Scan(&slug, &raw); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("UserRepo.getDerivedSegments - rows.Scan: %v", err)
+		}
+
+		expression := entity.SegmentExpression{}
+		if err = json.Unmarshal(raw, &expression); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("UserRepo.getDerivedSegments - json.Unmarshal: %v", err)
+		}
+		condition, conditionArgs := expressionMemberSQL(expression, tenant(ctx), userID)
+		checks = append(checks, "SELECT ?::varchar WHERE "+condition)
+		args = append(append(args, slug), conditionArgs...)
+	}
+	rows.Close()
+
+	if len(checks) == 0 {
+		return []string{}, nil
+	}
+
+	sql, _ = squirrel.Dollar.ReplacePlaceholders(strings.Join(checks, " UNION ALL "))
+	rows, err = u.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.getDerivedSegments - u.Pool.Query (evaluate): %v", err)
+	}
+	defer rows.Close()
+
+	return scanSegments(rows), nil
+}
+
+func (u *UserRepo) GetMemberships(ctx context.Context, userID string) ([]string, error) {
+	ok, err := u.userExist(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.GetMemberships - u.userExist: %v", err)
+	}
+	if !ok {
+		return nil, repoerrs.ErrUserNotFound
+	}
+
 	sql, args, _ := u.Builder.
 		Select("segment_slug").
 		From("user_segments").
-		Where("user_id = ?", userID).
+		Where("tenant_id = ? AND user_id = ?", tenant(ctx), userID).
 		ToSql()
 
 	rows, err := u.Pool.Query(ctx, sql, args...)
 	if err != nil {
-		return nil, fmt.Errorf("UserRepo.GetSegments - u.Pool.Query: %v", err)
+		return nil, fmt.Errorf("UserRepo.GetMemberships - u.Pool.Query: %v", err)
 	}
 	defer rows.Close()
 
+	return scanSegments(rows), nil
+}
+
+// LockUser creates the user if it does not exist and locks it until the end of the transaction of the context,
+// so memberships read afterwards do not change under the caller. It reports whether the user was created.
+func (u *UserRepo) LockUser(ctx context.Context, userID string) (bool, error) {
+	sql, args, _ := u.Builder.
+		Insert("users").
+		Columns("tenant_id", "user_id").
+		Values(tenant(ctx), userID).
+		Suffix("ON CONFLICT (tenant_id, user_id) DO NOTHING").
+		ToSql()
+	tag, err := u.Pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return false, fmt.Errorf("UserRepo.LockUser - u.Pool.Exec: %v", err)
+	}
+
+	sql, args, _ = u.Builder.
+		Select("user_id").
+		From("users").
+		Where("tenant_id = ? AND user_id = ?", tenant(ctx), userID).
+		Suffix("FOR UPDATE").
+		ToSql()
+	if err = u.Pool.QueryRow(ctx, sql, args...).Scan(&userID); err != nil {
+		return false, fmt.Errorf("UserRepo.LockUser - u.Pool.QueryRow: %v", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// AutoEnroll adds a user created by LockUser to segments configured with auto_enroll, see autoEnroll
+func (u *UserRepo) AutoEnroll(ctx context.Context, userID string, exclude []string) ([]string, error) {
+	tx, err := u.Pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.AutoEnroll - u.Pool.Begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	enrolled, err := u.autoEnroll(ctx, tx, userID, exclude)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.AutoEnroll - u.autoEnroll: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("UserRepo.AutoEnroll - tx.Commit: %v", err)
+	}
+	return enrolled, nil
+}
+
+func scanSegments(rows pgx.Rows) []string {
 	userSegments := make([]string, 0, 1)
 	for rows.Next() {
 		var segment string
 		_ = rows.Scan(&segment)
 		userSegments = append(userSegments, segment)
 	}
-	return userSegments, nil
+	return userSegments
 }
 
 func (u *UserRepo) userExist(ctx context.Context, userID string) (bool, error) {
 	sql, args, _ := u.Builder.
 		Select("user_id").
 		From("users").
-		Where("user_id = ?", userID).
+		Where("tenant_id = ? AND user_id = ?", tenant(ctx), userID).
 		ToSql()
 	err := u.Pool.QueryRow(ctx, sql, args...).Scan(&userID)
 	if err != nil {
@@ -65,98 +224,670 @@ func (u *UserRepo) userExist(ctx context.Context, userID string) (bool, error) {
 	return true, nil
 }
 
-func (u *UserRepo) SetSegments(ctx context.Context, userID string, segmentsAdd, segmentsDel []string) error {
-	ok, err := u.checkExistSegmentsSlug(ctx, segmentsAdd)
+// SetSegments changes memberships of the user, creating it if needed.
+// When ifVersion is set, the user has to exist with this version.
+// It returns segments a newly created user was auto-enrolled into.
+func (u *UserRepo) SetSegments(ctx context.Context, userID string, segmentsAdd, segmentsDel []string, ifVersion *int64) ([]string, error) {
+	tx, err := u.Pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.SetSegments - u.Pool.Begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if ifVersion != nil {
+		if err := u.checkVersion(ctx, tx, userID, *ifVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	ok, err := u.checkExistSegmentsSlug(ctx, tx, segmentsAdd)
 	if err != nil {
-		return fmt.Errorf("UserRepo.SetSegments - u.checkExistSegmentsSlug: %v", err)
+		return nil, fmt.Errorf("UserRepo.SetSegments - u.checkExistSegmentsSlug: %v", err)
 	}
 	if !ok {
-		return repoerrs.ErrSegmentsNotExist
+		return nil, repoerrs.ErrSegmentsNotExist
 	}
 
-	userID, err = u.createUserIfNotExist(ctx, userID)
+	created, err := u.createUserIfNotExist(ctx, tx, userID)
 	if err != nil {
-		return fmt.Errorf("UserRepo.SetSegments - u.createUserIfNotExist: %v", err)
+		return nil, fmt.Errorf("UserRepo.SetSegments - u.createUserIfNotExist: %v", err)
+	}
+
+	if err := u.checkCapacity(ctx, tx, userID, segmentsAdd); err != nil {
+		return nil, err
+	}
+	if err := u.addSegmentsUser(ctx, tx, userID, segmentsAdd); err != nil {
+		return nil, fmt.Errorf("UserRepo.SetSegments - u.addSegmentsUser: %v", err)
+	}
+	if err := u.delSegmentsUser(ctx, tx, userID, segmentsDel); err != nil {
+		return nil, fmt.Errorf("UserRepo.SetSegments - u.addSegmentsUser: %v", err)
 	}
 
-	if err := u.addSegmentsUser(ctx, userID, segmentsAdd); err != nil {
-		return fmt.Errorf("UserRepo.SetSegments - u.addSegmentsUser: %v", err)
+	enrolled := make([]string, 0)
+	if created {
+		enrolled, err = u.autoEnroll(ctx, tx, userID, append(segmentsAdd, segmentsDel...))
+		if err != nil {
+			return nil, fmt.Errorf("UserRepo.SetSegments - u.autoEnroll: %v", err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("UserRepo.SetSegments - tx.Commit: %v", err)
+	}
+	return enrolled, nil
+}
+
+// checkVersion locks the user until the end of the transaction and compares its version, entity.AnyVersion
+// only requires the user to exist
+func (u *UserRepo) checkVersion(ctx context.Context, tx pgx.Tx, userID string, version int64) error {
+	sql, args, _ := u.Builder.
+		Select("version").
+		From("users").
+		Where("tenant_id = ? AND user_id = ?", tenant(ctx), userID).
+		Suffix("FOR UPDATE").
+		ToSql()
+
+	var current int64
+	err := tx.QueryRow(ctx, sql, args...).Scan(&current)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return repoerrs.ErrVersionMismatch
+		}
+		return fmt.Errorf("UserRepo.checkVersion - tx.QueryRow: %v", err)
 	}
-	if err := u.delSegmentsUser(ctx, userID, segmentsDel); err != nil {
-		return fmt.Errorf("UserRepo.SetSegments - u.addSegmentsUser: %v", err)
+	if version != entity.AnyVersion && current != version {
+		return repoerrs.ErrVersionMismatch
 	}
 	return nil
 }
 
-func (u *UserRepo) createUserIfNotExist(ctx context.Context, userID string) (string, error) {
+func (u *UserRepo) GetVersion(ctx context.Context, userID string) (int64, error) {
+	sql, args, _ := u.Builder.
+		Select("version").
+		From("users").
+		Where("tenant_id = ? AND user_id = ?", tenant(ctx), userID).
+		ToSql()
+
+	var version int64
+	err := u.Pool.QueryRow(ctx, sql, args...).Scan(&version)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, repoerrs.ErrUserNotFound
+		}
+		return 0, fmt.Errorf("UserRepo.GetVersion - u.Pool.QueryRow: %v", err)
+	}
+	return version, nil
+}
+
+func (u *UserRepo) createUserIfNotExist(ctx context.Context, tx pgx.Tx, userID string) (bool, error) {
 	sql, args, _ := u.Builder.
 		Insert("users").
-		Columns("user_id").
-		Values(userID).
-		Suffix("ON CONFLICT (user_id) DO NOTHING RETURNING user_id").
+		Columns("tenant_id", "user_id").
+		Values(tenant(ctx), userID).
+		Suffix("ON CONFLICT (tenant_id, user_id) DO NOTHING RETURNING user_id").
 		ToSql()
-	err := u.Pool.QueryRow(ctx, sql, args...).Scan(&userID)
+	err := tx.QueryRow(ctx, sql, args...).Scan(&userID)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return userID, nil
+			return false, nil
 		}
-		return "", fmt.Errorf("UserRepo.CreateUserIfNotExist - u.Pool.QueryRow: %v", err)
+		return false, fmt.Errorf("UserRepo.CreateUserIfNotExist - tx.QueryRow: %v", err)
 	}
-	return userID, nil
+	return true, nil
 }
 
-func (u *UserRepo) checkExistSegmentsSlug(ctx context.Context, segmentSlugs []string) (bool, error) {
+// autoEnroll adds a new user to segments configured with auto_enroll.
+// The user falls into the share by a hash of user_id and slug, so the choice does not change between attempts.
+// Segments touched by the request, full segments and segments with prerequisites are skipped.
+func (u *UserRepo) autoEnroll(ctx context.Context, tx pgx.Tx, userID string, exclude []string) ([]string, error) {
+	sql, args, _ := u.Builder.
+		Select("s.slug").
+		From("segments s").
+		Where("s.tenant_id = ?", tenant(ctx)).
+		Where("s.auto_enroll IS NOT NULL AND s.archived_at IS NULL AND s.expression IS NULL").
+		Where("(s.active_until IS NULL OR s.active_until > now())").
+		Where(squirrel.NotEq{"s.slug": exclude}).
+		Where("NOT EXISTS (SELECT 1 FROM segment_prerequisites p WHERE p.tenant_id = s.tenant_id AND p.segment_slug = s.slug)").
+		Where("('x' || substr(md5(?::text || ':' || s.slug), 1, 8))::bit(32)::bigint % 10000 < s.auto_enroll", userID).
+		OrderBy("s.slug").
+		Suffix("FOR UPDATE").
+		ToSql()
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.autoEnroll - tx.Query (lock): %v", err)
+	}
+	candidates := scanSegments(rows)
+	rows.Close()
+	if len(candidates) == 0 {
+		return candidates, nil
+	}
+
+	sql, args, _ = u.Builder.
+		Insert("user_segments").
+		Columns("tenant_id", "user_id", "segment_slug").
+		Select(squirrel.
+			Select().
+			Column("s.tenant_id").
+			Column("?", userID).
+			Column("s.slug").
+			From("segments s").
+			Where("s.tenant_id = ?", tenant(ctx)).
+			Where(squirrel.Eq{"s.slug": candidates}).
+			Where("(s.max_members IS NULL OR " +
+				"(SELECT COUNT(*) FROM user_segments WHERE tenant_id = s.tenant_id AND segment_slug = s.slug) < s.max_members)")).
+		Suffix("RETURNING segment_slug").
+		ToSql()
+
+	rows, err = tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.autoEnroll - tx.Query (insert): %v", err)
+	}
+	defer rows.Close()
+	return scanSegments(rows), nil
+}
+
+func (u *UserRepo) checkExistSegmentsSlug(ctx context.Context, tx pgx.Tx, segmentSlugs []string) (bool, error) {
 	sql, args, _ := u.Builder.
 		Select("COUNT(*) AS count_found_segments").
 		From("segments").
-		Where(squirrel.Eq{"slug": segmentSlugs}).
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "slug": segmentSlugs, "archived_at": nil, "expression": nil}).
 		ToSql()
 
 	var count int
-	err := u.Pool.QueryRow(ctx, sql, args...).Scan(&count)
+	err := tx.QueryRow(ctx, sql, args...).Scan(&count)
 	if err != nil {
-		return false, fmt.Errorf("UserRepo.CheckExistSegmentsSlug - u.Pool.QueryRow: %v", err)
+		return false, fmt.Errorf("UserRepo.CheckExistSegmentsSlug - tx.QueryRow: %v", err)
 	}
 
-	return count == len(segmentSlugs), nil
+	return count == countUnique(segmentSlugs), nil
 }
 
-func (u *UserRepo) addSegmentsUser(ctx context.Context, userID string, segmentSlugs []string) error {
-	b := u.Builder.Insert("user_segments").Columns("user_id", "segment_slug")
+// checkCapacity locks the limited segments until the end of the transaction,
+// so concurrent additions are counted one after another
+func (u *UserRepo) checkCapacity(ctx context.Context, tx pgx.Tx, userID string, segmentSlugs []string) error {
+	sql, args, _ := u.Builder.
+		Select("slug").
+		From("segments").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "slug": segmentSlugs}).
+		Where("max_members IS NOT NULL").
+		OrderBy("slug").
+		Suffix("FOR UPDATE").
+		ToSql()
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("UserRepo.checkCapacity - tx.Query (lock): %v", err)
+	}
+	limited := scanSegments(rows)
+	rows.Close()
+	if len(limited) == 0 {
+		return nil
+	}
+
+	var full string
+	sql, args, _ = u.Builder.
+		Select("s.slug").
+		From("segments s").
+		Where(squirrel.Eq{"s.tenant_id": tenant(ctx), "s.slug": limited}).
+		Where("NOT EXISTS (SELECT 1 FROM user_segments WHERE tenant_id = s.tenant_id AND segment_slug = s.slug AND user_id = ?)", userID).
+		Where("(SELECT COUNT(*) FROM user_segments WHERE tenant_id = s.tenant_id AND segment_slug = s.slug) >= s.max_members").
+		OrderBy("s.slug").
+		Limit(1).
+		ToSql()
+	err = tx.QueryRow(ctx, sql, args...).Scan(&full)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("UserRepo.checkCapacity - tx.QueryRow: %v", err)
+	}
+	return &repoerrs.SegmentFullError{Slug: full}
+}
+
+func (u *UserRepo) addSegmentsUser(ctx context.Context, tx pgx.Tx, userID string, segmentSlugs []string) error {
+	if len(segmentSlugs) == 0 {
+		return nil
+	}
+
+	b := u.Builder.Insert("user_segments").Columns("tenant_id", "user_id", "segment_slug")
 	for _, segment := range segmentSlugs {
-		b = b.Values(userID, segment)
+		b = b.Values(tenant(ctx), userID, segment)
 	}
-	sql, args, _ := b.Suffix("ON CONFLICT (user_id, segment_slug) DO NOTHING").ToSql()
-	err := u.Pool.QueryRow(ctx, sql, args...).Scan()
+	sql, args, _ := b.Suffix("ON CONFLICT (tenant_id, user_id, segment_slug) DO NOTHING").ToSql()
+	err := tx.QueryRow(ctx, sql, args...).Scan()
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil
 		}
-		return fmt.Errorf("UserRepo.addSegmentsUser - u.Pool.QueryRow: %v", err)
+		return fmt.Errorf("UserRepo.addSegmentsUser - tx.QueryRow: %v", err)
 	}
 	return nil
 }
 
-func (u *UserRepo) delSegmentsUser(ctx context.Context, userID string, segmentSlugs []string) error {
+func (u *UserRepo) delSegmentsUser(ctx context.Context, tx pgx.Tx, userID string, segmentSlugs []string) error {
+	if len(segmentSlugs) == 0 {
+		return nil
+	}
+
 	sql, args, _ := u.Builder.Delete("user_segments").Where(squirrel.And{
-		squirrel.Eq{"user_id": userID},
+		squirrel.Eq{"tenant_id": tenant(ctx), "user_id": userID},
 		squirrel.Eq{"segment_slug": segmentSlugs},
 	}).ToSql()
 
-	err := u.Pool.QueryRow(ctx, sql, args...).Scan()
+	err := tx.QueryRow(ctx, sql, args...).Scan()
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil
 		}
-		return fmt.Errorf("UserRepo.addSegmentsUser - u.Pool.QueryRow: %v", err)
+		return fmt.Errorf("UserRepo.addSegmentsUser - tx.QueryRow: %v", err)
 	}
 	return nil
 }
 
+// CreateUser creates the user and returns segments it was auto-enrolled into
+func (u *UserRepo) CreateUser(ctx context.Context, userID string) ([]string, error) {
+	tx, err := u.Pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.CreateUser - u.Pool.Begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	created, err := u.createUserIfNotExist(ctx, tx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.CreateUser - u.createUserIfNotExist: %v", err)
+	}
+	if !created {
+		return nil, repoerrs.ErrAlreadyExists
+	}
+
+	enrolled, err := u.autoEnroll(ctx, tx, userID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.CreateUser - u.autoEnroll: %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("UserRepo.CreateUser - tx.Commit: %v", err)
+	}
+	return enrolled, nil
+}
+
+func (u *UserRepo) ListUsers(ctx context.Context, filter entity.UserFilter) ([]entity.User, error) {
+	b := u.Builder.
+		Select("u.user_id", "u.created_at").
+		From("users u").
+		Where("u.tenant_id = ?", tenant(ctx)).
+		OrderBy("u.created_at", "u.user_id").
+		Limit(filter.Limit).
+		Offset(filter.Offset)
+	if filter.CreatedFrom != nil {
+		b = b.Where("u.created_at >= ?", *filter.CreatedFrom)
+	}
+	if filter.CreatedTo != nil {
+		b = b.Where("u.created_at < ?", *filter.CreatedTo)
+	}
+	if filter.Segment != "" {
+		b = b.Where("EXISTS (SELECT 1 FROM user_segments us "+
+			"WHERE us.tenant_id = u.tenant_id AND us.user_id = u.user_id AND us.segment_slug = ?)",
+			filter.Segment)
+	}
+	sql, args, _ := b.ToSql()
+
+	rows, err := u.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.ListUsers - u.Pool.Query: %v", err)
+	}
+	defer rows.Close()
+
+	users := make([]entity.User, 0, filter.Limit)
+	for rows.Next() {
+		var user entity.User
+		if err = rows.Scan(&user.UserID, &user.CreatedAt); err != nil {
+			return nil, fmt.Errorf("UserRepo.ListUsers - rows.Scan: %v", err)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// DeleteUser removes the user with its memberships and tasks.
+// History and the webhook deliveries made of it are kept unless purgeHistory is set.
+func (u *UserRepo) DeleteUser(ctx context.Context, userID string, purgeHistory bool) error {
+	tx, err := u.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.DeleteUser - u.Pool.Begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	tables := []string{"user_segments", "tasks_delete"}
+	if purgeHistory {
+		tables = append(tables, "history", "webhook_deliveries")
+	}
+	for _, table := range tables {
+		sql, args, _ := u.Builder.Delete(table).Where("tenant_id = ? AND user_id = ?", tenant(ctx), userID).ToSql()
+		if _, err = tx.Exec(ctx, sql, args...); err != nil {
+			return fmt.Errorf("UserRepo.DeleteUser - tx.Exec (%s): %v", table, err)
+		}
+	}
+
+	sql, args, _ := u.Builder.Delete("users").Where("tenant_id = ? AND user_id = ?", tenant(ctx), userID).ToSql()
+	tag, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("UserRepo.DeleteUser - tx.Exec (users): %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return repoerrs.ErrUserNotFound
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("UserRepo.DeleteUser - tx.Commit: %v", err)
+	}
+	return nil
+}
+
+func (u *UserRepo) GetUser(ctx context.Context, userID string) (entity.User, error) {
+	sql, args, _ := u.Builder.
+		Select("user_id", "created_at").
+		From("users").
+		Where("tenant_id = ? AND user_id = ?", tenant(ctx), userID).
+		ToSql()
+
+	var user entity.User
+	err := u.Pool.QueryRow(ctx, sql, args...).Scan(&user.UserID, &user.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return entity.User{}, repoerrs.ErrUserNotFound
+		}
+		return entity.User{}, fmt.Errorf("UserRepo.GetUser - u.Pool.QueryRow: %v", err)
+	}
+	return user, nil
+}
+
+// EraseUser moves all rows of the user to the pseudonym or removes them when the pseudonym is empty.
+// Rows written under the former ids of a merged user are erased along with it, and so are stored responses
+// of idempotent requests that mention any of the ids. The audit record keeps only the mode and the number of affected rows.
+func (u *UserRepo) EraseUser(ctx context.Context, userID, pseudonym string) (entity.ErasureAudit, error) {
+	audit := entity.ErasureAudit{Mode: entity.ErasureModeDelete}
+	if pseudonym != "" {
+		audit.Mode = entity.ErasureModePseudonymize
+	}
+
+	tx, err := u.Pool.Begin(ctx)
+	if err != nil {
+		return audit, fmt.Errorf("UserRepo.EraseUser - u.Pool.Begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	aliases, err := u.GetAliases(postgres.WithTx(ctx, tx), userID)
+	if err != nil {
+		return audit, fmt.Errorf("UserRepo.EraseUser - u.GetAliases: %v", err)
+	}
+	usersID := append([]string{userID}, aliases...)
+
+	if pseudonym != "" {
+		sql, args, _ := u.Builder.
+			Insert("users").
+			Columns("tenant_id", "user_id", "created_at").
+			Select(squirrel.
+				Select().
+				Column("tenant_id").
+				Column("?", pseudonym).
+				Column("created_at").
+				From("users").
+				Where("tenant_id = ? AND user_id = ?", tenant(ctx), userID)).
+			ToSql()
+		if _, err = tx.Exec(ctx, sql, args...); err != nil {
+			return audit, fmt.Errorf("UserRepo.EraseUser - tx.Exec (pseudonym): %v", err)
+		}
+	}
+
+	counters := map[string]*int{
+		"user_segments": &audit.Memberships,
+		"tasks_delete":  &audit.Tasks,
+		"history":       &audit.HistoryRecords,
+	}
+	for _, table := range []string{"user_segments", "tasks_delete", "history"} {
+		var sql string
+		var args []interface{}
+		if pseudonym != "" {
+			sql, args, _ = u.Builder.Update(table).Set("user_id", pseudonym).
+				Where(squirrel.Eq{"tenant_id": tenant(ctx), "user_id": usersID}).ToSql()
+		} else {
+			sql, args, _ = u.Builder.Delete(table).Where(squirrel.Eq{"tenant_id": tenant(ctx), "user_id": usersID}).ToSql()
+		}
+		tag, err := tx.Exec(ctx, sql, args...)
+		if err != nil {
+			return audit, fmt.Errorf("UserRepo.EraseUser - tx.Exec (%s): %v", table, err)
+		}
+		*counters[table] = int(tag.RowsAffected())
+	}
+
+	// the delivery log of webhooks repeats the history, it is not counted separately
+	var sql string
+	var args []interface{}
+	if pseudonym != "" {
+		sql, args, _ = u.Builder.Update("webhook_deliveries").Set("user_id", pseudonym).
+			Where(squirrel.Eq{"tenant_id": tenant(ctx), "user_id": usersID}).ToSql()
+	} else {
+		sql, args, _ = u.Builder.Delete("webhook_deliveries").Where(squirrel.Eq{"tenant_id": tenant(ctx), "user_id": usersID}).ToSql()
+	}
+	if _, err = tx.Exec(ctx, sql, args...); err != nil {
+		return audit, fmt.Errorf("UserRepo.EraseUser - tx.Exec (webhook_deliveries): %v", err)
+	}
+
+	// a stored response is dropped rather than replayed, a retry of its request is processed anew
+	mentions := make(squirrel.Or, 0, len(usersID))
+	for _, id := range usersID {
+		mentions = append(mentions, squirrel.Expr("position(?::bytea in body) > 0", jsonString(id)))
+	}
+	sql, args, _ = u.Builder.
+		Delete("idempotency_keys").
+		Where("tenant_id = ?", tenant(ctx)).
+		Where(mentions).
+		ToSql()
+	if _, err = tx.Exec(ctx, sql, args...); err != nil {
+		return audit, fmt.Errorf("UserRepo.EraseUser - tx.Exec (idempotency_keys): %v", err)
+	}
+
+	sql, args, _ = u.Builder.Delete("users").Where("tenant_id = ? AND user_id = ?", tenant(ctx), userID).ToSql()
+	tag, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return audit, fmt.Errorf("UserRepo.EraseUser - tx.Exec (users): %v", err)
+	}
+	// history of a deleted user may outlive the user itself
+	if tag.RowsAffected() == 0 && audit.HistoryRecords == 0 {
+		return audit, repoerrs.ErrUserNotFound
+	}
+
+	sql, args, _ = u.Builder.
+		Insert("erasure_audit").
+		Columns("tenant_id", "mode", "memberships", "tasks", "history_records").
+		Values(tenant(ctx), audit.Mode, audit.Memberships, audit.Tasks, audit.HistoryRecords).
+		Suffix("RETURNING audit_id, created_at").
+		ToSql()
+	if err = tx.QueryRow(ctx, sql, args...).Scan(&audit.AuditID, &audit.CreatedAt); err != nil {
+		return audit, fmt.Errorf("UserRepo.EraseUser - tx.QueryRow (audit): %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return audit, fmt.Errorf("UserRepo.EraseUser - tx.Commit: %v", err)
+	}
+	return audit, nil
+}
+
+// MergeUsers moves everything of the source user to the target one and leaves the source id as an alias.
+// Memberships are united, of two pending tasks for the same segment and operation the later one is kept,
+// and a pending removal is dropped when the other user holds the segment permanently.
+// A merge that would overfill a limited segment fails with repoerrs.SegmentFullError.
+func (u *UserRepo) MergeUsers(ctx context.Context, sourceID, targetID string) error {
+	tx, err := u.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("UserRepo.MergeUsers - u.Pool.Begin: %v", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err = u.createUserIfNotExist(ctx, tx, targetID); err != nil {
+		return fmt.Errorf("UserRepo.MergeUsers - u.createUserIfNotExist: %v", err)
+	}
+
+	sql, args, _ := u.Builder.
+		Select("user_id").
+		From("users").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "user_id": []string{sourceID, targetID}}).
+		OrderBy("user_id").
+		Suffix("FOR UPDATE").
+		ToSql()
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("UserRepo.MergeUsers - tx.Query (lock): %v", err)
+	}
+	locked := scanSegments(rows)
+	rows.Close()
+	if len(locked) != 2 {
+		return repoerrs.ErrUserNotFound
+	}
+
+	tenantID := tenant(ctx)
+	const pendingDelete = "tasks_delete t WHERE t.tenant_id = s.tenant_id AND t.user_id = ? AND NOT t.done AND t.operation = 'delete'"
+	const membership = "user_segments us WHERE us.tenant_id = s.tenant_id AND us.user_id = ?"
+	queries := []squirrel.Sqlizer{
+		// a permanent membership outlives any pending removal of the same segment
+		u.Builder.
+			Delete("tasks_delete s").
+			Where("s.tenant_id = ? AND s.user_id = ? AND NOT s.done AND s.operation = 'delete'", tenantID, sourceID).
+			Where("EXISTS (SELECT 1 FROM "+membership+" AND us.segment_slug = s.segment_slug)", targetID).
+			Where("NOT EXISTS (SELECT 1 FROM "+pendingDelete+" AND t.segment_slug = s.segment_slug)", targetID),
+		u.Builder.
+			Delete("tasks_delete s").
+			Where("s.tenant_id = ? AND s.user_id = ? AND NOT s.done AND s.operation = 'delete'", tenantID, targetID).
+			Where("EXISTS (SELECT 1 FROM "+membership+" AND us.segment_slug = s.segment_slug)", sourceID).
+			Where("NOT EXISTS (SELECT 1 FROM "+pendingDelete+" AND t.segment_slug = s.segment_slug)", sourceID),
+		// of two pending tasks for the same segment and operation the later deadline wins
+		u.Builder.
+			Update("tasks_delete t").
+			Set("deadline", squirrel.Expr("s.deadline")).
+			From("tasks_delete s").
+			Where("t.tenant_id = ? AND s.tenant_id = t.tenant_id", tenantID).
+			Where("t.user_id = ? AND s.user_id = ? AND NOT t.done AND NOT s.done", targetID, sourceID).
+			Where("t.segment_slug = s.segment_slug AND t.operation = s.operation AND s.deadline > t.deadline"),
+		u.Builder.
+			Delete("tasks_delete s").
+			Where("s.tenant_id = ? AND s.user_id = ? AND NOT s.done", tenantID, sourceID).
+			Where("EXISTS (SELECT 1 FROM tasks_delete t WHERE t.tenant_id = s.tenant_id AND t.user_id = ? AND NOT t.done "+
+				"AND t.segment_slug = s.segment_slug AND t.operation = s.operation)", targetID),
+		u.Builder.Update("tasks_delete").Set("user_id", targetID).Where("tenant_id = ? AND user_id = ?", tenantID, sourceID),
+	}
+	if err = u.execAll(ctx, tx, queries); err != nil {
+		return fmt.Errorf("UserRepo.MergeUsers - u.execAll (tasks): %v", err)
+	}
+
+	if err = u.moveMemberships(ctx, tx, sourceID, targetID); err != nil {
+		return err
+	}
+
+	queries = []squirrel.Sqlizer{
+		u.Builder.Update("history").Set("user_id", targetID).Where("tenant_id = ? AND user_id = ?", tenantID, sourceID),
+		u.Builder.Update("user_aliases").Set("user_id", targetID).Where("tenant_id = ? AND user_id = ?", tenantID, sourceID),
+		u.Builder.Delete("users").Where("tenant_id = ? AND user_id = ?", tenantID, sourceID),
+		u.Builder.Insert("user_aliases").Columns("tenant_id", "alias", "user_id").Values(tenantID, sourceID, targetID),
+	}
+	if err = u.execAll(ctx, tx, queries); err != nil {
+		return fmt.Errorf("UserRepo.MergeUsers - u.execAll (users): %v", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("UserRepo.MergeUsers - tx.Commit: %v", err)
+	}
+	return nil
+}
+
+// moveMemberships gives the target user the segments of the source one. The source user leaves its segments first,
+// so the target user is let into limited segments by the same capacity check as SetSegments.
+func (u *UserRepo) moveMemberships(ctx context.Context, tx pgx.Tx, sourceID, targetID string) error {
+	sql, args, _ := u.Builder.
+		Delete("user_segments").
+		Where("tenant_id = ? AND user_id = ?", tenant(ctx), sourceID).
+		Suffix("RETURNING segment_slug").
+		ToSql()
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("UserRepo.moveMemberships - tx.Query: %v", err)
+	}
+	segments := scanSegments(rows)
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("UserRepo.moveMemberships - rows.Err: %v", err)
+	}
+
+	if err = u.checkCapacity(ctx, tx, targetID, segments); err != nil {
+		return err
+	}
+	if err = u.addSegmentsUser(ctx, tx, targetID, segments); err != nil {
+		return fmt.Errorf("UserRepo.moveMemberships - u.addSegmentsUser: %v", err)
+	}
+	return nil
+}
+
+func (u *UserRepo) execAll(ctx context.Context, tx pgx.Tx, queries []squirrel.Sqlizer) error {
+	for _, query := range queries {
+		sql, args, err := query.ToSql()
+		if err != nil {
+			return fmt.Errorf("UserRepo.execAll - query.ToSql: %v", err)
+		}
+		if _, err = tx.Exec(ctx, sql, args...); err != nil {
+			return fmt.Errorf("UserRepo.execAll - tx.Exec: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetAliases returns the former ids of the users merged into the user
+func (u *UserRepo) GetAliases(ctx context.Context, userID string) ([]string, error) {
+	sql, args, _ := u.Builder.
+		Select("alias").
+		From("user_aliases").
+		Where("tenant_id = ? AND user_id = ?", tenant(ctx), userID).
+		OrderBy("alias").
+		ToSql()
+
+	rows, err := u.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.GetAliases - u.Pool.Query: %v", err)
+	}
+	defer rows.Close()
+	return scanSegments(rows), nil
+}
+
+// ResolveUsers maps ids of merged users to the users they were merged into
+func (u *UserRepo) ResolveUsers(ctx context.Context, usersID []string) (map[string]string, error) {
+	sql, args, _ := u.Builder.
+		Select("alias", "user_id").
+		From("user_aliases").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "alias": usersID}).
+		ToSql()
+
+	rows, err := u.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("UserRepo.ResolveUsers - u.Pool.Query: %v", err)
+	}
+	defer rows.Close()
+
+	aliases := make(map[string]string)
+	for rows.Next() {
+		var alias, userID string
+		if err = rows.Scan(&alias, &userID); err != nil {
+			return nil, fmt.Errorf("UserRepo.ResolveUsers - rows.Scan: %v", err)
+		}
+		aliases[alias] = userID
+	}
+	return aliases, nil
+}
+
 func (u *UserRepo) GetRandomUsers(ctx context.Context, percent int) ([]string, error) {
 	sql, args, _ := u.Builder.
 		Select("COUNT(user_id)").
 		From("users").
+		Where("tenant_id = ?", tenant(ctx)).
 		OrderBy("RANDOM()").
 		ToSql()
 
@@ -170,6 +901,7 @@ func (u *UserRepo) GetRandomUsers(ctx context.Context, percent int) ([]string, e
 	sql, args, _ = u.Builder.
 		Select("user_id").
 		From("users").
+		Where("tenant_id = ?", tenant(ctx)).
 		OrderBy("RANDOM()").
 		Limit(choiceCount).
 		ToSql()
@@ -189,3 +921,9 @@ func (u *UserRepo) GetRandomUsers(ctx context.Context, percent int) ([]string, e
 	}
 	return usersID, nil
 }
+
+// jsonString returns the id as it appears in JSON responses
+func jsonString(id string) []byte {
+	raw, _ := json.Marshal(id)
+	return raw
+}
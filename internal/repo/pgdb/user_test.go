@@ -0,0 +1,234 @@
+package pgdb
+
+import (
+	"context"
+	"errors"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
+	"github.com/passionde/user-segmentation-service/pkg/postgres"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMergeUsersCapacity(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxMembers int
+		// members of the segment before the merge, the source user is one of them
+		members []string
+		// lowered is the capacity set after the members joined
+		lowered     int
+		wantErr     error
+		wantMembers []string
+	}{
+		{
+			name:        "the target takes the place of the source",
+			maxMembers:  1,
+			members:     []string{"source"},
+			wantMembers: []string{"target"},
+		},
+		{
+			name:        "both users were members",
+			maxMembers:  2,
+			members:     []string{"source", "target"},
+			wantMembers: []string{"target"},
+		},
+		{
+			name:        "a segment over its capacity takes nobody",
+			maxMembers:  2,
+			members:     []string{"other", "source"},
+			lowered:     1,
+			wantErr:     &repoerrs.SegmentFullError{Slug: "LIMITED"},
+			wantMembers: []string{"other", "source"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, app := testDB(t)
+			ctx := postgres.WithTenant(context.Background(), entity.DefaultTenantID)
+			userRepo, segmentRepo := NewUserRepo(app), NewSegmentRepo(app)
+
+			maxMembers := tt.maxMembers
+			if err := segmentRepo.CreateSegment(ctx, entity.Segment{Slug: "LIMITED", MaxMembers: &maxMembers}); err != nil {
+				t.Fatalf("CreateSegment: %v", err)
+			}
+			for _, userID := range append([]string{"target"}, tt.members...) {
+				add := []string{}
+				for _, member := range tt.members {
+					if member == userID {
+						add = []string{"LIMITED"}
+					}
+				}
+				if _, err := userRepo.SetSegments(ctx, userID, add, []string{}, nil); err != nil {
+					t.Fatalf("SetSegments(%s): %v", userID, err)
+				}
+			}
+			if tt.lowered != 0 {
+				if err := segmentRepo.SetCapacity(ctx, "LIMITED", &tt.lowered); err != nil {
+					t.Fatalf("SetCapacity: %v", err)
+				}
+			}
+
+			err := userRepo.MergeUsers(ctx, "source", "target")
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Fatalf("MergeUsers() error = %v, want %v", err, tt.wantErr)
+			}
+
+			members, err := segmentRepo.GetUsersInSegment(ctx, "LIMITED")
+			if err != nil {
+				t.Fatalf("GetUsersInSegment: %v", err)
+			}
+			sort.Strings(members)
+			if !reflect.DeepEqual(members, tt.wantMembers) {
+				t.Errorf("members = %v, want %v", members, tt.wantMembers)
+			}
+
+			aliases, err := userRepo.ResolveUsers(ctx, []string{"source"})
+			if err != nil {
+				t.Fatalf("ResolveUsers: %v", err)
+			}
+			if merged := aliases["source"] == "target"; merged != (tt.wantErr == nil) {
+				t.Errorf("ResolveUsers(source) = %v, merged = %v, want %v", aliases, merged, tt.wantErr == nil)
+			}
+		})
+	}
+}
+
+func TestLockUser(t *testing.T) {
+	_, app := testDB(t)
+	ctx := postgres.WithTenant(context.Background(), entity.DefaultTenantID)
+	userRepo := NewUserRepo(app)
+
+	for _, want := range []bool{true, false} {
+		err := app.WithinTransaction(ctx, func(ctx context.Context) error {
+			created, err := userRepo.LockUser(ctx, "1000")
+			if err != nil {
+				return err
+			}
+			if created != want {
+				t.Errorf("LockUser() created = %v, want %v", created, want)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("LockUser() error = %v", err)
+		}
+	}
+
+	if _, err := userRepo.GetUser(ctx, "1000"); errors.Is(err, repoerrs.ErrUserNotFound) {
+		t.Errorf("LockUser() did not create the user")
+	}
+}
+
+func TestAutoEnroll(t *testing.T) {
+	_, app := testDB(t)
+	ctx := postgres.WithTenant(context.Background(), entity.DefaultTenantID)
+	userRepo, segmentRepo := NewUserRepo(app), NewSegmentRepo(app)
+
+	everyone := 10000
+	for _, slug := range []string{"AUTO", "SKIPPED"} {
+		if err := segmentRepo.CreateSegment(ctx, entity.Segment{Slug: slug}); err != nil {
+			t.Fatalf("CreateSegment(%s): %v", slug, err)
+		}
+		if err := segmentRepo.SetAutoEnroll(ctx, slug, &everyone); err != nil {
+			t.Fatalf("SetAutoEnroll(%s): %v", slug, err)
+		}
+	}
+
+	var enrolled []string
+	err := app.WithinTransaction(ctx, func(ctx context.Context) error {
+		if _, err := userRepo.LockUser(ctx, "1000"); err != nil {
+			return err
+		}
+		var err error
+		enrolled, err = userRepo.AutoEnroll(ctx, "1000", []string{"SKIPPED"})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("AutoEnroll() error = %v", err)
+	}
+	if !reflect.DeepEqual(enrolled, []string{"AUTO"}) {
+		t.Errorf("AutoEnroll() = %v, want [AUTO]", enrolled)
+	}
+
+	memberships, err := userRepo.GetMemberships(ctx, "1000")
+	if err != nil || !reflect.DeepEqual(memberships, []string{"AUTO"}) {
+		t.Errorf("GetMemberships() = %v, %v, want [AUTO]", memberships, err)
+	}
+}
+
+func TestEraseUser(t *testing.T) {
+	owner, app := testDB(t)
+	ctx := postgres.WithTenant(context.Background(), entity.DefaultTenantID)
+	userRepo, idempotencyRepo := NewUserRepo(app), NewIdempotencyRepo(app)
+
+	if err := NewSegmentRepo(app).CreateSegment(ctx, entity.Segment{Slug: "A"}); err != nil {
+		t.Fatalf("CreateSegment: %v", err)
+	}
+	for _, userID := range []string{"merged", "1000", "2000"} {
+		if _, err := userRepo.SetSegments(ctx, userID, []string{"A"}, []string{}, nil); err != nil {
+			t.Fatalf("SetSegments(%s): %v", userID, err)
+		}
+		err := NewHistoryRepo(app).AddNotes(ctx, []entity.History{{UserID: userID, SegmentSlug: "A", Type: entity.OperationTypeAdd}})
+		if err != nil {
+			t.Fatalf("AddNotes(%s): %v", userID, err)
+		}
+	}
+	if err := userRepo.MergeUsers(ctx, "merged", "1000"); err != nil {
+		t.Fatalf("MergeUsers: %v", err)
+	}
+
+	// the response of the second tenant mentions its own user 1000
+	secondTenant := postgres.WithTenant(context.Background(), 2)
+	responses := []struct {
+		ctx            context.Context
+		principal      string
+		idempotencyKey string
+		body           string
+	}{
+		{ctx, "key:1", "user", `{"user_id":"1000"}`},
+		{ctx, "jwt:billing", "alias", `[{"user_id":"merged","segment_slug":"A"}]`},
+		{ctx, "key:1", "other", `{"user_id":"2000"}`},
+		{ctx, "key:1", "prefix", `{"user_id":"10000"}`},
+		{secondTenant, "key:2", "tenant", `{"user_id":"1000"}`},
+	}
+	for _, response := range responses {
+		request := entity.IdempotentRequest{Principal: response.principal, IdempotencyKey: response.idempotencyKey, RequestHash: "hash"}
+		if _, _, err := idempotencyRepo.Reserve(response.ctx, request, time.Hour, time.Minute); err != nil {
+			t.Fatalf("Reserve(%s): %v", response.idempotencyKey, err)
+		}
+		status := 200
+		request.Status, request.ContentType, request.Body = &status, "application/json", []byte(response.body)
+		if err := idempotencyRepo.Complete(response.ctx, request); err != nil {
+			t.Fatalf("Complete(%s): %v", response.idempotencyKey, err)
+		}
+	}
+
+	audit, err := userRepo.EraseUser(ctx, "1000", "")
+	if err != nil {
+		t.Fatalf("EraseUser() error = %v", err)
+	}
+	if audit.Memberships != 1 || audit.HistoryRecords != 2 {
+		t.Errorf("EraseUser() = %+v, want 1 membership and 2 history records", audit)
+	}
+
+	for _, userID := range []string{"1000", "merged"} {
+		notes, err := NewHistoryRepo(app).GetUserNotes(ctx, userID)
+		if err != nil || len(notes) != 0 {
+			t.Errorf("GetUserNotes(%s) = %v, %v, want none", userID, notes, err)
+		}
+	}
+
+	rows, err := owner.Pool.Query(context.Background(), "SELECT idempotency_key FROM idempotency_keys ORDER BY idempotency_key")
+	if err != nil {
+		t.Fatalf("owner.Pool.Query: %v", err)
+	}
+	left := scanSegments(rows)
+	rows.Close()
+	if !reflect.DeepEqual(left, []string{"other", "prefix", "tenant"}) {
+		t.Errorf("stored responses = %v, want [other prefix tenant]", left)
+	}
+}
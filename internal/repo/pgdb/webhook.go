@@ -0,0 +1,227 @@
+package pgdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v5"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
+	"github.com/passionde/user-segmentation-service/pkg/postgres"
+	"strings"
+	"time"
+)
+
+// enqueueDeliveriesSQL writes a delivery for every webhook subscribed to the history records of the notes CTE,
+// see HistoryRepo.AddNotes. A segment filter ending with "/" matches every segment of the namespace.
+const enqueueDeliveriesSQL = `INSERT INTO webhook_deliveries (tenant_id, webhook_id, event, user_id, segment_slug, created_at)
+SELECT n.tenant_id, w.webhook_id, n.type, n.user_id, n.segment_slug, n.created_at
+FROM notes n
+JOIN webhooks w ON w.tenant_id = n.tenant_id
+WHERE (cardinality(w.events) = 0 OR n.type = ANY(w.events))
+AND (cardinality(w.segments) = 0 OR EXISTS (
+	SELECT 1 FROM unnest(w.segments) s
+	WHERE n.segment_slug = s OR (right(s, 1) = '/' AND starts_with(n.segment_slug, s))))
+ORDER BY n.history_id, w.webhook_id`
+
+var deliveryColumns = []string{"d.delivery_id", "d.webhook_id", "d.event", "d.user_id", "d.segment_slug", "d.created_at",
+	"d.status", "d.attempts", "d.next_attempt_at", "d.last_attempt_at", "d.response_status", "d.last_error"}
+
+type WebhookRepo struct {
+	*postgres.Postgres
+}
+
+func NewWebhookRepo(pg *postgres.Postgres) *WebhookRepo {
+	return &WebhookRepo{pg}
+}
+
+func (w *WebhookRepo) CreateWebhook(ctx context.Context, webhook entity.Webhook) (int, error) {
+	sql, args, _ := w.Builder.
+		Insert("webhooks").
+		Columns("tenant_id", "url", "secret", "segments", "events").
+		Values(tenant(ctx), webhook.URL, webhook.Secret, webhook.Segments, webhook.Events).
+		Suffix("RETURNING webhook_id").
+		ToSql()
+
+	var webhookID int
+	if err := w.Pool.QueryRow(ctx, sql, args...).Scan(&webhookID); err != nil {
+		return 0, fmt.Errorf("WebhookRepo.CreateWebhook - w.Pool.QueryRow: %v", err)
+	}
+	return webhookID, nil
+}
+
+func (w *WebhookRepo) GetWebhook(ctx context.Context, webhookID int) (entity.Webhook, error) {
+	sql, args, _ := w.Builder.
+		Select("webhook_id", "url", "secret", "segments", "events", "created_at").
+		From("webhooks").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "webhook_id": webhookID}).
+		ToSql()
+
+	var webhook entity.Webhook
+	err := w.Pool.QueryRow(ctx, sql, args...).
+		Scan(&webhook.WebhookID, &webhook.URL, &webhook.Secret, &webhook.Segments, &webhook.Events, &webhook.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return entity.Webhook{}, repoerrs.ErrNotFound
+		}
+		return entity.Webhook{}, fmt.Errorf("WebhookRepo.GetWebhook - w.Pool.QueryRow: %v", err)
+	}
+	return webhook, nil
+}
+
+func (w *WebhookRepo) ListWebhooks(ctx context.Context) ([]entity.Webhook, error) {
+	sql, args, _ := w.Builder.
+		Select("webhook_id", "url", "secret", "segments", "events", "created_at").
+		From("webhooks").
+		Where("tenant_id = ?", tenant(ctx)).
+		OrderBy("webhook_id").
+		ToSql()
+
+	rows, err := w.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("WebhookRepo.ListWebhooks - w.Pool.Query: %v", err)
+	}
+	defer rows.Close()
+
+	webhooks := make([]entity.Webhook, 0)
+	for rows.Next() {
+		var webhook entity.Webhook
+		err = rows.Scan(&webhook.WebhookID, &webhook.URL, &webhook.Secret, &webhook.Segments, &webhook.Events, &webhook.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("WebhookRepo.ListWebhooks - rows.Scan: %v", err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook removes the webhook with its delivery log, pending deliveries are not sent
+func (w *WebhookRepo) DeleteWebhook(ctx context.Context, webhookID int) error {
+	sql, args, _ := w.Builder.
+		Delete("webhooks").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "webhook_id": webhookID}).
+		ToSql()
+
+	tag, err := w.Pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("WebhookRepo.DeleteWebhook - w.Pool.Exec: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return repoerrs.ErrNotFound
+	}
+	return nil
+}
+
+// GetDeliveries returns the delivery log of the webhook, the latest deliveries first
+func (w *WebhookRepo) GetDeliveries(ctx context.Context, webhookID int, limit, offset uint64) ([]entity.WebhookDelivery, error) {
+	sql, args, _ := w.Builder.
+		Select(deliveryColumns...).
+		From("webhook_deliveries d").
+		Where(squirrel.Eq{"d.tenant_id": tenant(ctx), "d.webhook_id": webhookID}).
+		OrderBy("d.delivery_id DESC").
+		Limit(limit).
+		Offset(offset).
+		ToSql()
+
+	rows, err := w.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("WebhookRepo.GetDeliveries - w.Pool.Query: %v", err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]entity.WebhookDelivery, 0)
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("WebhookRepo.GetDeliveries - rows.Scan: %v", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// ClaimDeliveries returns pending deliveries that are due and postpones them by lease,
+// so other instances do not send them while they are being sent
+func (w *WebhookRepo) ClaimDeliveries(ctx context.Context, limit uint64, lease time.Duration) ([]entity.OutgoingDelivery, error) {
+	// the subquery keeps "?" placeholders, they are numbered once with the outer query
+	due := w.Builder.
+		PlaceholderFormat(squirrel.Question).
+		Select("delivery_id").
+		From("webhook_deliveries").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "status": entity.DeliveryStatusPending}).
+		Where("next_attempt_at <= now()").
+		OrderBy("next_attempt_at", "delivery_id").
+		Limit(limit).
+		Suffix("FOR UPDATE SKIP LOCKED")
+
+	sql, args, _ := w.Builder.
+		Update("webhook_deliveries d").
+		Set("next_attempt_at", squirrel.Expr("now() + make_interval(secs => ?)", lease.Seconds())).
+		From("webhooks w").
+		Where("w.webhook_id = d.webhook_id").
+		Where(squirrel.Expr("d.delivery_id IN (?)", due)).
+		Suffix("RETURNING " + strings.Join(deliveryColumns, ", ") + ", w.url, w.secret").
+		ToSql()
+
+	rows, err := w.Pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("WebhookRepo.ClaimDeliveries - w.Pool.Query: %v", err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]entity.OutgoingDelivery, 0)
+	for rows.Next() {
+		var d entity.OutgoingDelivery
+		err = rows.Scan(&d.DeliveryID, &d.WebhookID, &d.Event, &d.UserID, &d.SegmentSlug, &d.CreatedAt, &d.Status,
+			&d.Attempts, &d.NextAttemptAt, &d.LastAttemptAt, &d.ResponseStatus, &d.LastError, &d.URL, &d.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("WebhookRepo.ClaimDeliveries - rows.Scan: %v", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// UpdateDelivery records the result of an attempt made now, a pending delivery is retried after retryIn
+func (w *WebhookRepo) UpdateDelivery(ctx context.Context, delivery entity.WebhookDelivery, retryIn time.Duration) error {
+	sql, args, _ := w.Builder.
+		Update("webhook_deliveries").
+		Set("status", delivery.Status).
+		Set("attempts", delivery.Attempts).
+		Set("next_attempt_at", squirrel.Expr("now() + make_interval(secs => ?)", retryIn.Seconds())).
+		Set("last_attempt_at", squirrel.Expr("now()")).
+		Set("response_status", delivery.ResponseStatus).
+		Set("last_error", delivery.LastError).
+		Where(squirrel.Eq{"tenant_id": tenant(ctx), "delivery_id": delivery.DeliveryID}).
+		ToSql()
+
+	_, err := w.Pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("WebhookRepo.UpdateDelivery - w.Pool.Exec: %v", err)
+	}
+	return nil
+}
+
+// PurgeDeliveries removes delivered and failed deliveries whose last attempt is older than retention
+func (w *WebhookRepo) PurgeDeliveries(ctx context.Context, retention time.Duration) (int64, error) {
+	sql, args, _ := w.Builder.
+		Delete("webhook_deliveries").
+		Where(squirrel.Eq{"tenant_id": tenant(ctx)}).
+		Where(squirrel.NotEq{"status": entity.DeliveryStatusPending}).
+		Where("last_attempt_at <= now() - make_interval(secs => ?)", retention.Seconds()).
+		ToSql()
+
+	tag, err := w.Pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return 0, fmt.Errorf("WebhookRepo.PurgeDeliveries - w.Pool.Exec: %v", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func scanDelivery(row pgx.Row) (entity.WebhookDelivery, error) {
+	var d entity.WebhookDelivery
+	err := row.Scan(&d.DeliveryID, &d.WebhookID, &d.Event, &d.UserID, &d.SegmentSlug, &d.CreatedAt, &d.Status,
+		&d.Attempts, &d.NextAttemptAt, &d.LastAttemptAt, &d.ResponseStatus, &d.LastError)
+	return d, err
+}
@@ -0,0 +1,135 @@
+package pgdb
+
+import (
+	"context"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/pkg/postgres"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEnqueueDeliveries(t *testing.T) {
+	_, app := testDB(t)
+	webhooks := NewWebhookRepo(app)
+	first := postgres.WithTenant(context.Background(), 1)
+	second := postgres.WithTenant(context.Background(), 2)
+
+	// want lists the deliveries as "<event> <segment>" in the order of the notes
+	subscriptions := []struct {
+		ctx      context.Context
+		segments []string
+		events   []string
+		want     []string
+	}{
+		{first, []string{}, []string{}, []string{"add checkout/a", "delete checkout/b", "add checkouts/a", "add PLAIN"}},
+		{first, []string{"checkout/"}, []string{}, []string{"add checkout/a", "delete checkout/b"}},
+		{first, []string{"checkout/a"}, []string{entity.OperationTypeAdd}, []string{"add checkout/a"}},
+		{first, []string{"checkout"}, []string{}, []string{}},
+		{first, []string{}, []string{entity.OperationTypeDelete}, []string{"delete checkout/b"}},
+		{first, []string{"PLAIN", "checkout/b"}, []string{}, []string{"delete checkout/b", "add PLAIN"}},
+		{second, []string{}, []string{}, []string{}},
+	}
+	webhookIDs := make([]int, len(subscriptions))
+	for i, sub := range subscriptions {
+		var err error
+		webhookIDs[i], err = webhooks.CreateWebhook(sub.ctx, entity.Webhook{URL: "https://example.com/hook",
+			Secret: "secret", Segments: sub.segments, Events: sub.events})
+		if err != nil {
+			t.Fatalf("CreateWebhook(%v, %v): %v", sub.segments, sub.events, err)
+		}
+	}
+
+	err := NewHistoryRepo(app).AddNotes(first, []entity.History{
+		{UserID: "1000", SegmentSlug: "checkout/a", Type: entity.OperationTypeAdd},
+		{UserID: "1000", SegmentSlug: "checkout/b", Type: entity.OperationTypeDelete},
+		{UserID: "1000", SegmentSlug: "checkouts/a", Type: entity.OperationTypeAdd},
+		{UserID: "1000", SegmentSlug: "PLAIN", Type: entity.OperationTypeAdd},
+	})
+	if err != nil {
+		t.Fatalf("AddNotes: %v", err)
+	}
+
+	for i, sub := range subscriptions {
+		webhookID := webhookIDs[i]
+		deliveries, err := webhooks.GetDeliveries(sub.ctx, webhookID, 10, 0)
+		if err != nil {
+			t.Fatalf("GetDeliveries(%d): %v", webhookID, err)
+		}
+
+		got := make([]string, 0, len(deliveries))
+		// the log lists the latest deliveries first
+		for j := len(deliveries) - 1; j >= 0; j-- {
+			delivery := deliveries[j]
+			if delivery.Status != entity.DeliveryStatusPending || delivery.UserID != "1000" {
+				t.Errorf("webhook %d: delivery %+v, want a pending delivery of user 1000", webhookID, delivery)
+			}
+			got = append(got, delivery.Event+" "+delivery.SegmentSlug)
+		}
+		if !reflect.DeepEqual(got, sub.want) {
+			t.Errorf("webhook %d: deliveries %v, want %v", webhookID, got, sub.want)
+		}
+	}
+}
+
+func TestRenameSegmentWebhooks(t *testing.T) {
+	_, app := testDB(t)
+	webhooks := NewWebhookRepo(app)
+	first := postgres.WithTenant(context.Background(), 1)
+	second := postgres.WithTenant(context.Background(), 2)
+
+	subscriptions := []struct {
+		ctx      context.Context
+		segments []string
+		want     []string
+	}{
+		{first, []string{"checkout/a", "PLAIN"}, []string{"checkout/renamed", "PLAIN"}},
+		{first, []string{"checkout/"}, []string{"checkout/"}},
+		{first, []string{}, []string{}},
+		{second, []string{"checkout/a"}, []string{"checkout/a"}},
+	}
+	webhookIDs := make([]int, len(subscriptions))
+	for i, sub := range subscriptions {
+		var err error
+		webhookIDs[i], err = webhooks.CreateWebhook(sub.ctx, entity.Webhook{URL: "https://example.com/hook",
+			Secret: "secret", Segments: sub.segments, Events: []string{}})
+		if err != nil {
+			t.Fatalf("CreateWebhook(%v): %v", sub.segments, err)
+		}
+	}
+
+	segments := NewSegmentRepo(app)
+	for _, ctx := range []context.Context{first, second} {
+		if err := segments.CreateSegment(ctx, entity.Segment{Slug: "checkout/a"}); err != nil {
+			t.Fatalf("CreateSegment: %v", err)
+		}
+	}
+	if err := segments.RenameSegment(first, "checkout/a", "checkout/renamed", time.Hour); err != nil {
+		t.Fatalf("RenameSegment() error = %v", err)
+	}
+
+	for i, sub := range subscriptions {
+		webhook, err := webhooks.GetWebhook(sub.ctx, webhookIDs[i])
+		if err != nil {
+			t.Fatalf("GetWebhook(%d): %v", webhookIDs[i], err)
+		}
+		if !reflect.DeepEqual(webhook.Segments, sub.want) {
+			t.Errorf("webhook %d: segments %v, want %v", webhookIDs[i], webhook.Segments, sub.want)
+		}
+	}
+
+	// a note of the renamed segment reaches the webhook subscribed to its old slug
+	err := NewHistoryRepo(app).AddNotes(first, []entity.History{
+		{UserID: "1000", SegmentSlug: "checkout/renamed", Type: entity.OperationTypeAdd},
+	})
+	if err != nil {
+		t.Fatalf("AddNotes: %v", err)
+	}
+	deliveries, err := webhooks.GetDeliveries(first, webhookIDs[0], 10, 0)
+	if err != nil {
+		t.Fatalf("GetDeliveries: %v", err)
+	}
+	if len(deliveries) != 1 || deliveries[0].SegmentSlug != "checkout/renamed" {
+		t.Errorf("deliveries = %+v, want one of checkout/renamed", deliveries)
+	}
+}
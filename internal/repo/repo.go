@@ -5,34 +5,103 @@ import (
 	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/repo/pgdb"
 	"github.com/passionde/user-segmentation-service/pkg/postgres"
+	"time"
 )
 
 type User interface {
-	SetSegments(ctx context.Context, userID string, segmentsAdd, segmentsDel []string) error
-	GetSegments(ctx context.Context, userID string) ([]string, error)
+	SetSegments(ctx context.Context, userID string, segmentsAdd, segmentsDel []string, ifVersion *int64) ([]string, error)
+	GetVersion(ctx context.Context, userID string) (int64, error)
+	GetSegments(ctx context.Context, userID string) ([]entity.ActiveSegment, error)
+	GetMemberships(ctx context.Context, userID string) ([]string, error)
+	LockUser(ctx context.Context, userID string) (bool, error)
+	AutoEnroll(ctx context.Context, userID string, exclude []string) ([]string, error)
+	CreateUser(ctx context.Context, userID string) ([]string, error)
+	ListUsers(ctx context.Context, filter entity.UserFilter) ([]entity.User, error)
+	DeleteUser(ctx context.Context, userID string, purgeHistory bool) error
+	GetUser(ctx context.Context, userID string) (entity.User, error)
+	EraseUser(ctx context.Context, userID, pseudonym string) (entity.ErasureAudit, error)
+	MergeUsers(ctx context.Context, sourceID, targetID string) error
+	GetAliases(ctx context.Context, userID string) ([]string, error)
+	ResolveUsers(ctx context.Context, usersID []string) (map[string]string, error)
 	GetRandomUsers(ctx context.Context, percent int) ([]string, error)
 }
 
 type Segment interface {
-	CreateSegment(ctx context.Context, slug string) error
+	CreateSegment(ctx context.Context, segment entity.Segment) error
+	SetActiveWindow(ctx context.Context, segment entity.Segment) error
+	SetCapacity(ctx context.Context, slug string, maxMembers *int) error
+	SetAutoEnroll(ctx context.Context, slug string, percent *int) error
+	ListSegments(ctx context.Context) ([]entity.SegmentWithMembers, error)
 	DeleteSegment(ctx context.Context, slug string) error
+	RestoreSegment(ctx context.Context, slug string) error
+	PurgeArchived(ctx context.Context, retention time.Duration) (int64, error)
+	CreateDerivedSegment(ctx context.Context, segment entity.Segment, materialize bool) ([]string, error)
+	RenameSegment(ctx context.Context, slug, newSlug string, aliasTTL time.Duration) error
+	LinkSegments(ctx context.Context, parent, child, inheritance string) error
+	UnlinkSegments(ctx context.Context, parent, child string) error
+	SetPrerequisites(ctx context.Context, slug string, prerequisites []string) error
+	GetPrerequisites(ctx context.Context) (map[string][]string, error)
+	ResolveAliases(ctx context.Context, slugs []string) (map[string]string, error)
 	GetUsersInSegment(ctx context.Context, slug string) ([]string, error)
 }
 
 type History interface {
 	AddNotes(ctx context.Context, notes []entity.History) error
 	GetNotes(ctx context.Context, userID string, month, year int) ([]entity.History, error)
+	GetUserNotes(ctx context.Context, userID string) ([]entity.History, error)
 }
 
 type TaskDelete interface {
 	GetExpiredTasks(ctx context.Context) ([]entity.Task, error)
+	GetNextDeadline(ctx context.Context) (time.Duration, error)
+	ListenNewTasks(ctx context.Context, notify func()) error
 	ChangeStatusTasks(ctx context.Context, tasks []entity.Task) error
 	CreateTasks(ctx context.Context, tasks []entity.Task, ttl uint64) error
+	ScheduleTasks(ctx context.Context, tasks []entity.Task) ([]entity.Task, error)
+	GetPendingTasks(ctx context.Context, userID string) ([]entity.Task, error)
+	GetTask(ctx context.Context, taskID int) (entity.Task, error)
+	CancelTask(ctx context.Context, taskID int) error
 }
 
 type Auth interface {
-	WriteToken(ctx context.Context, token string) (int, error)
-	TokenExist(ctx context.Context, token string) (int, error)
+	WriteToken(ctx context.Context, token string, key entity.APIKey) (int, error)
+	TokenExist(ctx context.Context, hashes []entity.KeyHash) (entity.APIKey, error)
+	RehashToken(ctx context.Context, id int, hash entity.KeyHash, keyPrefix string) error
+	GetToken(ctx context.Context, id int) (entity.APIKey, error)
+	ListTokens(ctx context.Context) ([]entity.APIKey, error)
+	TouchToken(ctx context.Context, id int) error
+	RevokeToken(ctx context.Context, id int) error
+	RotateToken(ctx context.Context, id int, token string, newKey entity.APIKey, oldExpiresAt time.Time) (int, error)
+	ListenTokenChanges(ctx context.Context, notify func(id int)) error
+}
+
+type Tenant interface {
+	CreateTenant(ctx context.Context, name string) (int, error)
+	ListTenants(ctx context.Context) ([]entity.Tenant, error)
+}
+
+type Idempotency interface {
+	Reserve(ctx context.Context, request entity.IdempotentRequest, retention, lockTimeout time.Duration) (bool, entity.IdempotentRequest, error)
+	Complete(ctx context.Context, request entity.IdempotentRequest) error
+	Release(ctx context.Context, principal, idempotencyKey string) error
+	PurgeExpired(ctx context.Context, retention time.Duration) (int64, error)
+}
+
+type Webhook interface {
+	CreateWebhook(ctx context.Context, webhook entity.Webhook) (int, error)
+	GetWebhook(ctx context.Context, webhookID int) (entity.Webhook, error)
+	ListWebhooks(ctx context.Context) ([]entity.Webhook, error)
+	DeleteWebhook(ctx context.Context, webhookID int) error
+	GetDeliveries(ctx context.Context, webhookID int, limit, offset uint64) ([]entity.WebhookDelivery, error)
+	ClaimDeliveries(ctx context.Context, limit uint64, lease time.Duration) ([]entity.OutgoingDelivery, error)
+	UpdateDelivery(ctx context.Context, delivery entity.WebhookDelivery, retryIn time.Duration) error
+	PurgeDeliveries(ctx context.Context, retention time.Duration) (int64, error)
+}
+
+// Transactor runs a function in a transaction, repositories called with the context of the function take part in it
+type Transactor interface {
+	WithinTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+	RollbackAfter(ctx context.Context, fn func(ctx context.Context) error) error
 }
 
 type Repositories struct {
@@ -41,14 +110,22 @@ type Repositories struct {
 	History
 	TaskDelete
 	Auth
+	Tenant
+	Idempotency
+	Webhook
+	Transactor
 }
 
 func NewRepositories(pg *postgres.Postgres) *Repositories {
 	return &Repositories{
-		User:       pgdb.NewUserRepo(pg),
-		Segment:    pgdb.NewSegmentRepo(pg),
-		History:    pgdb.NewHistoryRepo(pg),
-		TaskDelete: pgdb.NewTasksDeleteRepo(pg),
-		Auth:       pgdb.NewAuthRepo(pg),
+		User:        pgdb.NewUserRepo(pg),
+		Segment:     pgdb.NewSegmentRepo(pg),
+		History:     pgdb.NewHistoryRepo(pg),
+		TaskDelete:  pgdb.NewTasksDeleteRepo(pg),
+		Auth:        pgdb.NewAuthRepo(pg),
+		Tenant:      pgdb.NewTenantRepo(pg),
+		Idempotency: pgdb.NewIdempotencyRepo(pg),
+		Webhook:     pgdb.NewWebhookRepo(pg),
+		Transactor:  pg,
 	}
 }
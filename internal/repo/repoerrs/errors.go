@@ -3,8 +3,25 @@ package repoerrs
 import "errors"
 
 var (
-	ErrNotFound         = errors.New("not found")
-	ErrAlreadyExists    = errors.New("already exists")
-	ErrSegmentsNotExist = errors.New("one of the segments does not exist")
-	ErrUserNotFound     = errors.New("user not found")
+	ErrNotFound          = errors.New("not found")
+	ErrAlreadyExists     = errors.New("already exists")
+	ErrSegmentsNotExist  = errors.New("one of the segments does not exist")
+	ErrUserNotFound      = errors.New("user not found")
+	ErrHierarchyCycle    = errors.New("hierarchy cycle")
+	ErrPrerequisiteCycle = errors.New("prerequisite cycle")
+	ErrSegmentFull       = errors.New("segment is full")
+	ErrVersionMismatch   = errors.New("version mismatch")
 )
+
+// SegmentFullError reports the segment that has reached max_members
+type SegmentFullError struct {
+	Slug string
+}
+
+func (e *SegmentFullError) Error() string {
+	return ErrSegmentFull.Error() + ": " + e.Slug
+}
+
+func (e *SegmentFullError) Is(target error) bool {
+	return target == ErrSegmentFull
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+)
+
+type accessKey struct{}
+
+// WithAccess returns a context whose calls are limited to the segment namespaces of the key.
+// Calls without a key in the context, such as the worker and the CLI, have access to every namespace.
+func WithAccess(ctx context.Context, key entity.APIKey) context.Context {
+	return context.WithValue(ctx, accessKey{}, key)
+}
+
+func accessFromContext(ctx context.Context) (entity.APIKey, bool) {
+	key, ok := ctx.Value(accessKey{}).(entity.APIKey)
+	return key, ok
+}
+
+func checkWrite(ctx context.Context, slugs ...string) error {
+	key, ok := accessFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	for _, slug := range slugs {
+		if !key.CanWrite(slug) {
+			return &NamespaceError{Namespace: entity.SegmentNamespace(slug), Write: true}
+		}
+	}
+	return nil
+}
+
+func checkRead(ctx context.Context, slugs ...string) error {
+	key, ok := accessFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	for _, slug := range slugs {
+		if !key.CanRead(slug) {
+			return &NamespaceError{Namespace: entity.SegmentNamespace(slug)}
+		}
+	}
+	return nil
+}
+
+// checkUnrestricted allows operations that change memberships in every namespace, such as user deletion
+func checkUnrestricted(ctx context.Context) error {
+	key, ok := accessFromContext(ctx)
+	if !ok || key.Unrestricted() {
+		return nil
+	}
+	return &NamespaceError{Namespace: entity.NamespaceAll, Write: true}
+}
+
+// checkReadAll allows reading memberships of every segment, such as a webhook without a segment filter
+func checkReadAll(ctx context.Context) error {
+	key, ok := accessFromContext(ctx)
+	if !ok || key.CanReadAll() {
+		return nil
+	}
+	return &NamespaceError{Namespace: entity.NamespaceAll}
+}
+
+func canRead(ctx context.Context, slug string) bool {
+	key, ok := accessFromContext(ctx)
+	return !ok || key.CanRead(slug)
+}
+
+func readableTasks(ctx context.Context, tasks []entity.Task) []entity.Task {
+	visible := make([]entity.Task, 0, len(tasks))
+	for _, task := range tasks {
+		if canRead(ctx, task.SegmentSlug) {
+			visible = append(visible, task)
+		}
+	}
+	return visible
+}
+
+func readableNotes(ctx context.Context, notes []entity.History) []entity.History {
+	visible := make([]entity.History, 0, len(notes))
+	for _, note := range notes {
+		if canRead(ctx, note.SegmentSlug) {
+			visible = append(visible, note)
+		}
+	}
+	return visible
+}
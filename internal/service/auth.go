@@ -2,28 +2,323 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/repo"
+	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
+	"github.com/passionde/user-segmentation-service/pkg/jwtauth"
 	"github.com/passionde/user-segmentation-service/pkg/secure"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// lastUsedPrecision limits how often last_used_at is written for a key in active use
+const lastUsedPrecision = time.Minute
+
 type AuthService struct {
-	authRepo repo.Auth
-	secure   secure.APISecure
+	authRepo    repo.Auth
+	secure      secure.APISecure
+	jwtVerifier jwtauth.Verifier
+	jwtClaims   JWTClaims
+	// verified holds keys found by the hash of the current version, rejected holds hashes of unknown keys.
+	// They are separate, so rejected hashes never evict verified keys. Every distinct unknown key still
+	// reaches the database, the rejected cache only spares repeats of the same one.
+	verified *keyCache
+	rejected *keyCache
 }
 
-func NewAuthService(authRepo repo.Auth, secure secure.APISecure) *AuthService {
+// NewAuthService accepts a nil jwtVerifier when JWT authentication is not configured
+func NewAuthService(authRepo repo.Auth, secure secure.APISecure, jwtVerifier jwtauth.Verifier, jwtClaims JWTClaims,
+	cache KeyCache) *AuthService {
 	return &AuthService{
-		authRepo: authRepo,
-		secure:   secure,
+		authRepo:    authRepo,
+		secure:      secure,
+		jwtVerifier: jwtVerifier,
+		jwtClaims:   jwtClaims,
+		verified:    newKeyCache(cache.Size, cache.TTL),
+		rejected:    newKeyCache(cache.RejectedSize, cache.RejectedTTL),
 	}
 }
 
-func (a *AuthService) TokenExist(ctx context.Context, token string) (int, error) {
-	return a.authRepo.TokenExist(ctx, a.secure.Hash(token))
+// TokenExist returns the key if it exists, is not revoked and has not expired.
+// A key hashed with an older version is rehashed with the current one.
+func (a *AuthService) TokenExist(ctx context.Context, token string) (entity.APIKey, error) {
+	hash := a.secure.Hash(token)
+	generation := a.verified.generation()
+	key, err := a.findToken(ctx, token, hash, generation)
+	if err != nil {
+		return entity.APIKey{}, err
+	}
+
+	// cached keys are checked on every use, so they stop working as soon as they expire
+	now := time.Now().UTC()
+	if key.RevokedAt != nil {
+		return entity.APIKey{}, ErrKeyRevoked
+	}
+	if key.ExpiresAt != nil && !now.Before(*key.ExpiresAt) {
+		return entity.APIKey{}, ErrKeyExpired
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= lastUsedPrecision {
+		if err := a.authRepo.TouchToken(ctx, key.ID); err != nil {
+			return entity.APIKey{}, err
+		}
+		key.LastUsedAt = &now
+		a.verified.set(hash, key, true, generation)
+	}
+	return key, nil
 }
 
-func (a *AuthService) GenerateToken(ctx context.Context) (int, string, error) {
+// findToken looks the key up in the caches and then in the database by the hashes of every version,
+// the found key is cached unless keys were removed from the cache after the generation was taken
+func (a *AuthService) findToken(ctx context.Context, token, hash string, generation uint64) (entity.APIKey, error) {
+	if key, ok := a.verified.get(hash); ok {
+		return key, nil
+	}
+	if _, ok := a.rejected.get(hash); ok {
+		return entity.APIKey{}, ErrKeyNotFound
+	}
+
+	hashes := make([]entity.KeyHash, 0, len(a.secure.Versions()))
+	for _, version := range a.secure.Versions() {
+		versionHash, err := a.secure.HashVersion(token, version)
+		if err != nil {
+			return entity.APIKey{}, err
+		}
+		hashes = append(hashes, entity.KeyHash{Version: version, Hash: versionHash})
+	}
+
+	rejectedGeneration := a.rejected.generation()
+	key, err := a.authRepo.TokenExist(ctx, hashes)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			a.rejected.set(hash, entity.APIKey{}, false, rejectedGeneration)
+			return entity.APIKey{}, ErrKeyNotFound
+		}
+		return entity.APIKey{}, err
+	}
+
+	// revoked and expired keys are not rehashed, they are rejected anyway
+	usable := key.RevokedAt == nil && (key.ExpiresAt == nil || time.Now().UTC().Before(*key.ExpiresAt))
+	if key.HashVersion != a.secure.CurrentVersion() && usable {
+		current := entity.KeyHash{Version: a.secure.CurrentVersion(), Hash: hash}
+		if err := a.authRepo.RehashToken(ctx, key.ID, current, a.secure.PublicPart(token)); err != nil {
+			return entity.APIKey{}, err
+		}
+		key.HashVersion, key.KeyPrefix = current.Version, a.secure.PublicPart(token)
+	}
+
+	a.verified.set(hash, key, false, generation)
+	return key, nil
+}
+
+// ListenKeyChanges drops cached keys that were revoked, rotated or changed by this or another process.
+// The cache is cleared when listening stops, changes made until it is restarted could be missed.
+func (a *AuthService) ListenKeyChanges(ctx context.Context) error {
+	defer a.verified.clear()
+	return a.authRepo.ListenTokenChanges(ctx, a.verified.deleteKey)
+}
+
+// VerifyJWT returns the caller described by the claims of a JWT of the identity provider.
+// Only scopes known to the service are granted, the token has access to every namespace of its tenant.
+func (a *AuthService) VerifyJWT(ctx context.Context, token string) (entity.APIKey, error) {
+	if a.jwtVerifier == nil {
+		return entity.APIKey{}, ErrJWTDisabled
+	}
+
+	claims, err := a.jwtVerifier.Verify(token)
+	if err != nil {
+		if errors.Is(err, jwtauth.ErrTokenExpired) {
+			return entity.APIKey{}, ErrTokenExpired
+		}
+		return entity.APIKey{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	actor, _ := claims[a.jwtClaims.ActorClaim].(string)
+	if actor == "" {
+		return entity.APIKey{}, fmt.Errorf("%w: missing %s claim", ErrInvalidToken, a.jwtClaims.ActorClaim)
+	}
+
+	tenantID := a.jwtClaims.Tenant
+	if a.jwtClaims.TenantClaim != "" {
+		tenantID, err = intClaim(claims[a.jwtClaims.TenantClaim])
+		if err != nil {
+			return entity.APIKey{}, fmt.Errorf("%w: invalid %s claim", ErrInvalidToken, a.jwtClaims.TenantClaim)
+		}
+	}
+
+	return entity.APIKey{
+		TenantID:        tenantID,
+		Actor:           actor,
+		Scopes:          a.jwtScopes(claims[a.jwtClaims.ScopesClaim]),
+		ReadNamespaces:  []string{entity.NamespaceAll},
+		WriteNamespaces: []string{entity.NamespaceAll},
+	}, nil
+}
+
+// jwtScopes accepts a space separated string, as in OAuth 2.0, or a list of scopes
+func (a *AuthService) jwtScopes(claim interface{}) []string {
+	var values []string
+	switch claim := claim.(type) {
+	case string:
+		values = strings.Fields(claim)
+	case []interface{}:
+		for _, value := range claim {
+			if value, ok := value.(string); ok {
+				values = append(values, value)
+			}
+		}
+	}
+
+	scopes := make([]string, 0, len(values))
+	for _, value := range values {
+		if !strings.HasPrefix(value, a.jwtClaims.ScopePrefix) {
+			continue
+		}
+		scope := strings.TrimPrefix(value, a.jwtClaims.ScopePrefix)
+		if validScopes([]string{scope}) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+func intClaim(claim interface{}) (int, error) {
+	switch claim := claim.(type) {
+	case json.Number:
+		id, err := claim.Int64()
+		return int(id), err
+	case string:
+		return strconv.Atoi(claim)
+	}
+	return 0, fmt.Errorf("unexpected claim type %T", claim)
+}
+
+func (a *AuthService) GenerateToken(ctx context.Context, input GenerateTokenInput) (int, string, error) {
+	if len(input.Scopes) == 0 || !validScopes(input.Scopes) {
+		return 0, "", ErrInvalidScope
+	}
+	readNamespaces, ok := normalizeNamespaces(input.ReadNamespaces)
+	if !ok {
+		return 0, "", ErrInvalidNamespace
+	}
+	writeNamespaces, ok := normalizeNamespaces(input.WriteNamespaces)
+	if !ok {
+		return 0, "", ErrInvalidNamespace
+	}
+	if input.RateLimit != nil && *input.RateLimit <= 0 || input.RateBurst != nil && *input.RateBurst <= 0 {
+		return 0, "", ErrInvalidRateLimit
+	}
+
+	token := a.secure.GenerateKey()
+	id, err := a.authRepo.WriteToken(ctx, a.secure.Hash(token), entity.APIKey{
+		TenantID:        input.TenantID,
+		HashVersion:     a.secure.CurrentVersion(),
+		KeyPrefix:       a.secure.PublicPart(token),
+		Label:           input.Label,
+		Scopes:          input.Scopes,
+		ReadNamespaces:  readNamespaces,
+		WriteNamespaces: writeNamespaces,
+		ExpiresAt:       expiresAt(input.ExpiresIn),
+		RateLimit:       input.RateLimit,
+		RateBurst:       input.RateBurst,
+	})
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return 0, "", ErrTenantNotFound
+		}
+		return 0, "", err
+	}
+	return id, token, nil
+}
+
+func (a *AuthService) GetToken(ctx context.Context, input TokenInput) (entity.APIKey, error) {
+	key, err := a.authRepo.GetToken(ctx, input.ID)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return entity.APIKey{}, ErrKeyNotFound
+		}
+		return entity.APIKey{}, err
+	}
+	return key, nil
+}
+
+func (a *AuthService) ListTokens(ctx context.Context) ([]entity.APIKey, error) {
+	return a.authRepo.ListTokens(ctx)
+}
+
+func (a *AuthService) RevokeToken(ctx context.Context, input TokenInput) error {
+	err := a.authRepo.RevokeToken(ctx, input.ID)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return ErrKeyNotFound
+		}
+		return err
+	}
+	a.verified.deleteKey(input.ID)
+	return nil
+}
+
+// RotateToken issues a new key with the tenant, label, scopes, namespaces and rate limits of the key being replaced.
+// The old key keeps working for the grace period unless it expires earlier.
+func (a *AuthService) RotateToken(ctx context.Context, input RotateTokenInput) (int, string, error) {
 	token := a.secure.GenerateKey()
-	id, err := a.authRepo.WriteToken(ctx, a.secure.Hash(token))
-	return id, token, err
+	id, err := a.authRepo.RotateToken(ctx, input.ID, a.secure.Hash(token), entity.APIKey{
+		HashVersion: a.secure.CurrentVersion(),
+		KeyPrefix:   a.secure.PublicPart(token),
+		ExpiresAt:   expiresAt(input.ExpiresIn),
+	}, time.Now().UTC().Add(input.Grace))
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return 0, "", ErrKeyNotFound
+		}
+		return 0, "", err
+	}
+	a.verified.deleteKey(input.ID)
+	return id, token, nil
+}
+
+// expiresAt returns nil for keys that do not expire
+func expiresAt(expiresIn time.Duration) *time.Time {
+	if expiresIn <= 0 {
+		return nil
+	}
+	t := time.Now().UTC().Add(expiresIn)
+	return &t
+}
+
+// normalizeNamespaces appends the "/" separator to namespaces given without it
+func normalizeNamespaces(namespaces []string) ([]string, bool) {
+	normalized := make([]string, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		if namespace == entity.NamespaceAll {
+			normalized = append(normalized, namespace)
+			continue
+		}
+		namespace = strings.TrimSuffix(namespace, "/")
+		if namespace == "" || strings.ContainsAny(namespace, "/*") {
+			return nil, false
+		}
+		normalized = append(normalized, namespace+"/")
+	}
+	return normalized, true
+}
+
+func validScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		known := false
+		for _, s := range entity.Scopes {
+			if scope == s {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return false
+		}
+	}
+	return true
 }
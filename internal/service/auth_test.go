@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/pkg/jwtauth"
+	"reflect"
+	"testing"
+)
+
+// fakeVerifier returns the claims or the error regardless of the token
+type fakeVerifier struct {
+	claims map[string]interface{}
+	err    error
+}
+
+func (f fakeVerifier) Verify(string) (map[string]interface{}, error) {
+	return f.claims, f.err
+}
+
+func TestVerifyJWT(t *testing.T) {
+	claimsConfig := JWTClaims{ActorClaim: "sub", ScopesClaim: "scope", ScopePrefix: "uss:", TenantClaim: "tenant"}
+	namespaces := []string{entity.NamespaceAll}
+
+	tests := []struct {
+		name    string
+		config  JWTClaims
+		claims  map[string]interface{}
+		err     error
+		want    entity.APIKey
+		wantErr error
+	}{
+		{
+			name:   "space separated scopes",
+			config: claimsConfig,
+			claims: map[string]interface{}{"sub": "payments", "tenant": json.Number("2"),
+				"scope": "openid uss:segments:read uss:unknown other:admin uss:users:write"},
+			want: entity.APIKey{TenantID: 2, Actor: "payments", Scopes: []string{"segments:read", "users:write"},
+				ReadNamespaces: namespaces, WriteNamespaces: namespaces},
+		},
+		{
+			name:   "list of scopes and tenant as a string",
+			config: claimsConfig,
+			claims: map[string]interface{}{"sub": "reports", "tenant": "3",
+				"scope": []interface{}{"uss:history:read", json.Number("1"), "history:read"}},
+			want: entity.APIKey{TenantID: 3, Actor: "reports", Scopes: []string{"history:read"},
+				ReadNamespaces: namespaces, WriteNamespaces: namespaces},
+		},
+		{
+			name:   "default tenant and no scopes",
+			config: JWTClaims{ActorClaim: "client_id", ScopesClaim: "scope", Tenant: 1},
+			claims: map[string]interface{}{"client_id": "cli", "tenant": json.Number("2")},
+			want: entity.APIKey{TenantID: 1, Actor: "cli", Scopes: []string{},
+				ReadNamespaces: namespaces, WriteNamespaces: namespaces},
+		},
+		{
+			name:    "no actor",
+			config:  claimsConfig,
+			claims:  map[string]interface{}{"tenant": json.Number("2"), "scope": "uss:admin"},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "no tenant",
+			config:  claimsConfig,
+			claims:  map[string]interface{}{"sub": "payments", "scope": "uss:admin"},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "invalid tenant",
+			config:  claimsConfig,
+			claims:  map[string]interface{}{"sub": "payments", "tenant": "marketplace"},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "expired",
+			config:  claimsConfig,
+			err:     jwtauth.ErrTokenExpired,
+			wantErr: ErrTokenExpired,
+		},
+		{
+			name:    "rejected by the verifier",
+			config:  claimsConfig,
+			err:     jwtauth.ErrInvalidAudience,
+			wantErr: ErrInvalidToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authService := NewAuthService(nil, nil, fakeVerifier{claims: tt.claims, err: tt.err}, tt.config, KeyCache{})
+
+			got, err := authService.VerifyJWT(context.Background(), "token")
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("VerifyJWT() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("VerifyJWT() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyJWTDisabled(t *testing.T) {
+	authService := NewAuthService(nil, nil, nil, JWTClaims{}, KeyCache{})
+
+	if _, err := authService.VerifyJWT(context.Background(), "token"); !errors.Is(err, ErrJWTDisabled) {
+		t.Fatalf("VerifyJWT() error = %v, want %v", err, ErrJWTDisabled)
+	}
+}
@@ -3,9 +3,105 @@ package service
 import "fmt"
 
 var (
-	ErrSegmentAlreadyExists = fmt.Errorf("segment already exists")
-	ErrCannotCreateSegment  = fmt.Errorf("cannot create segment")
-	ErrSegmentNotFound      = fmt.Errorf("segment not found")
-	ErrUserNotFound         = fmt.Errorf("user not found")
-	ErrUserNoData           = fmt.Errorf("this user has no data")
+	ErrSegmentAlreadyExists  = fmt.Errorf("segment already exists")
+	ErrCannotCreateSegment   = fmt.Errorf("cannot create segment")
+	ErrSegmentNotFound       = fmt.Errorf("segment not found")
+	ErrArchivedNotFound      = fmt.Errorf("archived segment not found")
+	ErrUserNotFound          = fmt.Errorf("user not found")
+	ErrUserAlreadyExists     = fmt.Errorf("user already exists")
+	ErrMergeSameUser         = fmt.Errorf("cannot merge a user into itself")
+	ErrVersionMismatch       = fmt.Errorf("user segments were changed by another request")
+	ErrUserNoData            = fmt.Errorf("this user has no data")
+	ErrReportNotFound        = fmt.Errorf("report not found")
+	ErrNoPendingTasks        = fmt.Errorf("no pending tasks")
+	ErrTaskNotFound          = fmt.Errorf("task not found")
+	ErrScheduleInPast        = fmt.Errorf("scheduled time must be in the future")
+	ErrInvalidActiveWindow   = fmt.Errorf("active_until must be later than active_from")
+	ErrInvalidExpression     = fmt.Errorf("invalid segment expression")
+	ErrHierarchyCycle        = fmt.Errorf("link would create a cycle in the segment hierarchy")
+	ErrLinkAlreadyExists     = fmt.Errorf("segments are already linked")
+	ErrLinkNotFound          = fmt.Errorf("segments are not linked")
+	ErrSegmentCapacity       = fmt.Errorf("segment capacity reached")
+	ErrPrerequisiteMissing   = fmt.Errorf("prerequisite segment missing")
+	ErrPrerequisiteRequired  = fmt.Errorf("segment is a prerequisite of another segment")
+	ErrPrerequisiteCycle     = fmt.Errorf("prerequisites would create a cycle")
+	ErrIdempotencyKeyReused  = fmt.Errorf("idempotency key was used with a different request")
+	ErrIdempotencyInProgress = fmt.Errorf("request with this idempotency key is in progress")
+	ErrInvalidScope          = fmt.Errorf("unknown API key scope")
+	ErrKeyNotFound           = fmt.Errorf("API key not found")
+	ErrKeyExpired            = fmt.Errorf("API key has expired")
+	ErrKeyRevoked            = fmt.Errorf("API key has been revoked")
+	ErrInvalidNamespace      = fmt.Errorf("invalid namespace")
+	ErrNamespaceForbidden    = fmt.Errorf("API key has no access to the namespace")
+	ErrTenantNotFound        = fmt.Errorf("tenant not found")
+	ErrTenantAlreadyExists   = fmt.Errorf("tenant already exists")
+	ErrJWTDisabled           = fmt.Errorf("JWT authentication is not configured")
+	ErrInvalidToken          = fmt.Errorf("invalid token")
+	ErrTokenExpired          = fmt.Errorf("token has expired")
+	ErrInvalidRateLimit      = fmt.Errorf("rate limit must be positive")
+	ErrWebhookNotFound       = fmt.Errorf("webhook not found")
+	ErrInvalidWebhookEvent   = fmt.Errorf("unknown webhook event")
 )
+
+// SegmentCapacityError is returned when an addition would exceed max_members of the segment
+type SegmentCapacityError struct {
+	Slug string
+}
+
+func (e *SegmentCapacityError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrSegmentCapacity, e.Slug)
+}
+
+func (e *SegmentCapacityError) Is(target error) bool {
+	return target == ErrSegmentCapacity
+}
+
+// PrerequisiteError is returned when a segment is added without one of its prerequisites
+type PrerequisiteError struct {
+	Slug         string
+	Prerequisite string
+}
+
+func (e *PrerequisiteError) Error() string {
+	return fmt.Sprintf("%s: %s requires %s", ErrPrerequisiteMissing, e.Slug, e.Prerequisite)
+}
+
+func (e *PrerequisiteError) Is(target error) bool {
+	return target == ErrPrerequisiteMissing
+}
+
+// DependentError is returned when a prerequisite is removed without cascading to its dependents
+type DependentError struct {
+	Slug      string
+	Dependent string
+}
+
+func (e *DependentError) Error() string {
+	return fmt.Sprintf("%s: %s is required by %s", ErrPrerequisiteRequired, e.Slug, e.Dependent)
+}
+
+func (e *DependentError) Is(target error) bool {
+	return target == ErrPrerequisiteRequired
+}
+
+// NamespaceError is returned when the API key has no access to the namespace of a segment
+type NamespaceError struct {
+	Namespace string
+	Write     bool
+}
+
+func (e *NamespaceError) Error() string {
+	access := "read"
+	if e.Write {
+		access = "write"
+	}
+	namespace := e.Namespace
+	if namespace == "" {
+		namespace = "segments without a namespace"
+	}
+	return fmt.Sprintf("%s: %s access to %s", ErrNamespaceForbidden, access, namespace)
+}
+
+func (e *NamespaceError) Is(target error) bool {
+	return target == ErrNamespaceForbidden
+}
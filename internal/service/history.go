@@ -2,22 +2,35 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/repo"
 	"github.com/passionde/user-segmentation-service/pkg/csvwriter"
-	"path"
-	"time"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	// reportIDBytes is the length of the random id of a report, the id is the only secret of its link
+	reportIDBytes = 16
+	// reportUserColumn is the header of the column with user_id in reports, the name of the field of entity.History
+	reportUserColumn = "UserID"
 )
 
 type HistoryService struct {
 	historyRepo repo.History
+	userRepo    repo.User
 	csvWriter   csvwriter.CSVWriter
 }
 
-func NewHistoryService(historyRepo repo.History, csvWriter csvwriter.CSVWriter) *HistoryService {
+func NewHistoryService(historyRepo repo.History, userRepo repo.User, csvWriter csvwriter.CSVWriter) *HistoryService {
 	return &HistoryService{
 		historyRepo: historyRepo,
+		userRepo:    userRepo,
 		csvWriter:   csvWriter,
 	}
 }
@@ -27,14 +40,64 @@ func (h *HistoryService) AddNotes(ctx context.Context, notes []entity.History) e
 }
 
 func (h *HistoryService) GetNotes(ctx context.Context, input GetHistoryInput) (string, error) {
-	notes, err := h.historyRepo.GetNotes(ctx, input.UserID, input.Month, input.Year)
+	userID, err := resolveUser(ctx, h.userRepo, input.UserID)
 	if err != nil {
 		return "", err
 	}
+
+	notes, err := h.historyRepo.GetNotes(ctx, userID, input.Month, input.Year)
+	if err != nil {
+		return "", err
+	}
+	notes = readableNotes(ctx, notes)
 	if len(notes) == 0 {
 		return "", ErrUserNoData
 	}
 
-	fileName := path.Clean(fmt.Sprintf("%s-%d-%d-%d.csv", input.UserID, input.Year, input.Month, time.Now().Unix()))
-	return h.csvWriter.CreateCSVFile(fileName, notes)
+	// the report is read by its random id, the notes depend on the namespaces of the caller
+	reportID, err := newReportID()
+	if err != nil {
+		return "", err
+	}
+	if _, err = h.csvWriter.CreateCSVFile(reportFileName(ctx, reportID), notes); err != nil {
+		return "", err
+	}
+	return reportID, nil
+}
+
+// GetReport opens a report of the tenant of the caller
+func (h *HistoryService) GetReport(ctx context.Context, reportID string) (io.ReadCloser, error) {
+	if !validReportID(reportID) {
+		return nil, ErrReportNotFound
+	}
+	file, err := h.csvWriter.OpenCSVFile(reportFileName(ctx, reportID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrReportNotFound
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// reportFileName keeps reports of every tenant in its own directory, a report id of another tenant is not found
+func reportFileName(ctx context.Context, reportID string) string {
+	return fmt.Sprintf("%s/%s.csv", reportDir(ctx), reportID)
+}
+
+func reportDir(ctx context.Context) string {
+	return strconv.Itoa(tenantFromContext(ctx))
+}
+
+func newReportID() (string, error) {
+	id := make([]byte, reportIDBytes)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func validReportID(reportID string) bool {
+	id, err := hex.DecodeString(reportID)
+	return err == nil && len(id) == reportIDBytes
 }
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/pkg/csvwriter"
+	"io"
+	"strings"
+	"testing"
+)
+
+func (f *fakeHistoryRepo) GetNotes(context.Context, string, int, int) ([]entity.History, error) {
+	return f.notes, nil
+}
+
+func TestReports(t *testing.T) {
+	historyRepo := &fakeHistoryRepo{notes: []entity.History{
+		{UserID: "1000", SegmentSlug: "AVITO_VOICE_MESSAGES", Type: entity.OperationTypeAdd},
+	}}
+	historyService := NewHistoryService(historyRepo, &fakeUserRepo{}, csvwriter.NewCsvWriter(t.TempDir()))
+	tenant1 := WithTenant(context.Background(), 1)
+	tenant2 := WithTenant(context.Background(), 2)
+	input := GetHistoryInput{UserID: "1000", Year: 2023, Month: 8}
+
+	reportID, err := historyService.GetNotes(tenant1, input)
+	if err != nil {
+		t.Fatalf("GetNotes() error = %v", err)
+	}
+	if !validReportID(reportID) || strings.Contains(reportID, "1000") {
+		t.Fatalf("GetNotes() = %q, want a random id", reportID)
+	}
+	if other, _ := historyService.GetNotes(tenant1, input); other == reportID {
+		t.Errorf("the same request in the same second returned the same report %q", reportID)
+	}
+
+	file, err := historyService.GetReport(tenant1, reportID)
+	if err != nil {
+		t.Fatalf("GetReport() error = %v", err)
+	}
+	content, _ := io.ReadAll(file)
+	_ = file.Close()
+	if !strings.Contains(string(content), "AVITO_VOICE_MESSAGES") {
+		t.Errorf("report = %q, want the history of the user", content)
+	}
+
+	if _, err = historyService.GetReport(tenant2, reportID); !errors.Is(err, ErrReportNotFound) {
+		t.Errorf("GetReport() of another tenant error = %v, want %v", err, ErrReportNotFound)
+	}
+	for _, id := range []string{"", "../1/" + reportID, reportID + ".csv", strings.ToUpper(reportID[:8])} {
+		if _, err = historyService.GetReport(tenant1, id); !errors.Is(err, ErrReportNotFound) {
+			t.Errorf("GetReport(%q) error = %v, want %v", id, err, ErrReportNotFound)
+		}
+	}
+}
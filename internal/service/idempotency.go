@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/repo"
+	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
+	"time"
+)
+
+// IdempotencyService.lockTimeout is how long a key stays locked by a request that never completed, e.g. after a crash
+type IdempotencyService struct {
+	idempotencyRepo repo.Idempotency
+	retention       time.Duration
+	lockTimeout     time.Duration
+}
+
+func NewIdempotencyService(idempotencyRepo repo.Idempotency, retention, lockTimeout time.Duration) *IdempotencyService {
+	return &IdempotencyService{
+		idempotencyRepo: idempotencyRepo,
+		retention:       retention,
+		lockTimeout:     lockTimeout,
+	}
+}
+
+// Begin claims the key for the request. It returns nil when the request has to be processed
+// and the stored request when its response has to be replayed.
+// A key is never claimed anew while the request holding it may still run until its deadline.
+func (i *IdempotencyService) Begin(ctx context.Context, input BeginIdempotentInput) (*entity.IdempotentRequest, error) {
+	lockTimeout := i.lockTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		lockTimeout = max(lockTimeout, time.Until(deadline))
+	}
+
+	reserved, stored, err := i.idempotencyRepo.Reserve(ctx, entity.IdempotentRequest{
+		Principal:      input.Principal,
+		IdempotencyKey: input.IdempotencyKey,
+		RequestHash:    input.RequestHash,
+	}, i.retention, lockTimeout)
+	if err != nil {
+		// the key was released by the first request right after the reservation attempt
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return nil, ErrIdempotencyInProgress
+		}
+		return nil, err
+	}
+	if reserved {
+		return nil, nil
+	}
+
+	if stored.RequestHash != input.RequestHash {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if stored.Status == nil {
+		return nil, ErrIdempotencyInProgress
+	}
+	return &stored, nil
+}
+
+func (i *IdempotencyService) Complete(ctx context.Context, request entity.IdempotentRequest) error {
+	return i.idempotencyRepo.Complete(ctx, request)
+}
+
+func (i *IdempotencyService) Release(ctx context.Context, input BeginIdempotentInput) error {
+	return i.idempotencyRepo.Release(ctx, input.Principal, input.IdempotencyKey)
+}
+
+func (i *IdempotencyService) PurgeExpired(ctx context.Context) (int64, error) {
+	return i.idempotencyRepo.PurgeExpired(ctx, i.retention)
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/repo"
+	"testing"
+	"time"
+)
+
+// fakeIdempotencyRepo reserves every key and records the lock timeout
+type fakeIdempotencyRepo struct {
+	repo.Idempotency
+	lockTimeout time.Duration
+}
+
+func (f *fakeIdempotencyRepo) Reserve(_ context.Context, request entity.IdempotentRequest, _, lockTimeout time.Duration) (bool, entity.IdempotentRequest, error) {
+	f.lockTimeout = lockTimeout
+	return true, request, nil
+}
+
+func TestIdempotencyLockTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		wantMin  time.Duration
+		wantMax  time.Duration
+	}{
+		{
+			name:    "no deadline",
+			wantMin: time.Minute,
+			wantMax: time.Minute,
+		},
+		{
+			name:     "deadline before the timeout",
+			deadline: time.Second,
+			wantMin:  time.Minute,
+			wantMax:  time.Minute,
+		},
+		{
+			name:     "deadline after the timeout",
+			deadline: time.Hour,
+			wantMin:  time.Hour - time.Minute,
+			wantMax:  time.Hour,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.deadline != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+
+			idempotencyRepo := &fakeIdempotencyRepo{}
+			idempotencyService := NewIdempotencyService(idempotencyRepo, 24*time.Hour, time.Minute)
+			stored, err := idempotencyService.Begin(ctx, BeginIdempotentInput{Principal: "key:1", IdempotencyKey: "key", RequestHash: "hash"})
+			if err != nil || stored != nil {
+				t.Fatalf("Begin() = %v, %v, want a reservation", stored, err)
+			}
+			if idempotencyRepo.lockTimeout < tt.wantMin || idempotencyRepo.lockTimeout > tt.wantMax {
+				t.Errorf("lock timeout = %v, want between %v and %v", idempotencyRepo.lockTimeout, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"container/list"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"sync"
+	"time"
+)
+
+// keyCache is a bounded LRU cache of key hashes with a TTL, the least recently used hash is evicted when it is full.
+// A nil cache is disabled: it finds nothing and stores nothing.
+type keyCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+	now     func() time.Time
+	// gen changes whenever keys are removed, see set
+	gen uint64
+}
+
+type keyCacheEntry struct {
+	hash    string
+	key     entity.APIKey
+	expires time.Time
+}
+
+// newKeyCache returns nil when size or ttl is not positive
+func newKeyCache(size int, ttl time.Duration) *keyCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &keyCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element, size),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+func (c *keyCache) get(hash string) (entity.APIKey, bool) {
+	if c == nil {
+		return entity.APIKey{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[hash]
+	if !ok {
+		return entity.APIKey{}, false
+	}
+	entry := element.Value.(*keyCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(element)
+		return entity.APIKey{}, false
+	}
+	c.order.MoveToFront(element)
+	return entry.key, true
+}
+
+// generation is taken before the key is read from the database and passed to set
+func (c *keyCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// set stores the key, keepTTL leaves the expiration of an already cached hash unchanged.
+// Nothing is stored when keys were removed after the generation was taken: the key could have been read
+// before it was revoked, and storing it would bring the revoked key back.
+func (c *keyCache) set(hash string, key entity.APIKey, keepTTL bool, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.gen {
+		return
+	}
+
+	if element, ok := c.entries[hash]; ok {
+		entry := element.Value.(*keyCacheEntry)
+		entry.key = key
+		if !keepTTL {
+			entry.expires = c.now().Add(c.ttl)
+		}
+		c.order.MoveToFront(element)
+		return
+	}
+	if keepTTL {
+		return
+	}
+
+	for c.order.Len() >= c.size {
+		c.remove(c.order.Back())
+	}
+	c.entries[hash] = c.order.PushFront(&keyCacheEntry{hash: hash, key: key, expires: c.now().Add(c.ttl)})
+}
+
+// deleteKey removes the hashes of the key with the id
+func (c *keyCache) deleteKey(id int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, element := range c.entries {
+		if element.Value.(*keyCacheEntry).key.ID == id {
+			c.remove(element)
+		}
+	}
+}
+
+func (c *keyCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.entries = make(map[string]*list.Element, c.size)
+	c.order.Init()
+}
+
+func (c *keyCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*keyCacheEntry).hash)
+}
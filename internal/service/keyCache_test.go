@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/repo"
+	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
+	"github.com/passionde/user-segmentation-service/pkg/secure"
+	"testing"
+	"time"
+)
+
+// newTestKeyCache returns a cache whose clock moves only when advance is called
+func newTestKeyCache(size int, ttl time.Duration) (*keyCache, func(time.Duration)) {
+	now := time.Date(2026, 10, 20, 12, 0, 0, 0, time.UTC)
+	c := newKeyCache(size, ttl)
+	c.now = func() time.Time { return now }
+	return c, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestKeyCache(t *testing.T) {
+	// lookup is made in order, a found hash becomes the most recently used one
+	type lookup struct {
+		hash  string
+		found bool
+	}
+	type op struct {
+		advance time.Duration
+		// set stores the hash with the key id, get lists the lookups made afterwards
+		set       string
+		keyID     int
+		keepTTL   bool
+		deleteKey int
+		get       []lookup
+	}
+
+	tests := []struct {
+		name string
+		ops  []op
+	}{
+		{
+			name: "least recently used hash is evicted",
+			ops: []op{
+				{set: "a", keyID: 1},
+				{set: "b", keyID: 2},
+				{get: []lookup{{"a", true}}},
+				{set: "c", keyID: 3, get: []lookup{{"a", true}, {"b", false}, {"c", true}}},
+				{set: "d", keyID: 4, get: []lookup{{"a", false}, {"c", true}, {"d", true}}},
+			},
+		},
+		{
+			name: "hashes expire after ttl",
+			ops: []op{
+				{set: "a", keyID: 1},
+				{advance: time.Minute - time.Nanosecond, get: []lookup{{"a", true}}},
+				{advance: time.Nanosecond, get: []lookup{{"a", false}}},
+			},
+		},
+		{
+			name: "set without keepTTL extends the ttl",
+			ops: []op{
+				{set: "a", keyID: 1},
+				{advance: 30 * time.Second, set: "a", keyID: 1},
+				{advance: 45 * time.Second, get: []lookup{{"a", true}}},
+			},
+		},
+		{
+			name: "keepTTL updates the key but not the ttl",
+			ops: []op{
+				{set: "a", keyID: 1},
+				{advance: 30 * time.Second, set: "a", keyID: 1, keepTTL: true},
+				{advance: 30 * time.Second, get: []lookup{{"a", false}}},
+			},
+		},
+		{
+			name: "keepTTL does not add a hash",
+			ops: []op{
+				{set: "a", keyID: 1, keepTTL: true, get: []lookup{{"a", false}}},
+			},
+		},
+		{
+			name: "deleteKey removes every hash of the key",
+			ops: []op{
+				{set: "old", keyID: 1},
+				{set: "rehashed", keyID: 1},
+				{set: "other", keyID: 2},
+				{deleteKey: 1, get: []lookup{{"old", false}, {"rehashed", false}, {"other", true}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, advance := newTestKeyCache(2, time.Minute)
+			for i, o := range tt.ops {
+				advance(o.advance)
+				if o.set != "" {
+					c.set(o.set, entity.APIKey{ID: o.keyID}, o.keepTTL, c.generation())
+				}
+				if o.deleteKey != 0 {
+					c.deleteKey(o.deleteKey)
+				}
+				for _, l := range o.get {
+					if _, ok := c.get(l.hash); ok != l.found {
+						t.Fatalf("op %d: get(%s) = %v, want %v", i, l.hash, ok, l.found)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestKeyCacheGeneration(t *testing.T) {
+	for _, remove := range []func(c *keyCache){
+		func(c *keyCache) { c.deleteKey(1) },
+		func(c *keyCache) { c.clear() },
+	} {
+		c, _ := newTestKeyCache(2, time.Minute)
+		c.set("a", entity.APIKey{ID: 1}, false, c.generation())
+
+		// the key was read before it was removed, e.g. before a revoke
+		generation := c.generation()
+		remove(c)
+		c.set("a", entity.APIKey{ID: 1}, false, generation)
+		c.set("b", entity.APIKey{ID: 2}, false, generation)
+		if _, ok := c.get("a"); ok {
+			t.Errorf("a key read before the removal was stored")
+		}
+
+		c.set("b", entity.APIKey{ID: 2}, false, c.generation())
+		if _, ok := c.get("b"); !ok {
+			t.Errorf("a key read after the removal was not stored")
+		}
+	}
+}
+
+func TestDisabledKeyCache(t *testing.T) {
+	for _, c := range []*keyCache{newKeyCache(0, time.Minute), newKeyCache(10, 0)} {
+		c.set("a", entity.APIKey{ID: 1}, false, c.generation())
+		if _, ok := c.get("a"); ok {
+			t.Fatalf("disabled cache returned a key")
+		}
+		c.deleteKey(1)
+		c.clear()
+	}
+}
+
+// fakeAuthRepo stores keys by the hash of the current version and counts lookups
+type fakeAuthRepo struct {
+	repo.Auth
+	keys    map[string]entity.APIKey
+	lookups int
+	// afterLookup runs once the key was read, as a change made by another request at that moment
+	afterLookup func()
+}
+
+func (f *fakeAuthRepo) TokenExist(_ context.Context, hashes []entity.KeyHash) (entity.APIKey, error) {
+	f.lookups++
+	for _, hash := range hashes {
+		if key, ok := f.keys[hash.Hash]; ok {
+			if f.afterLookup != nil {
+				f.afterLookup()
+			}
+			return key, nil
+		}
+	}
+	return entity.APIKey{}, repoerrs.ErrNotFound
+}
+
+func (f *fakeAuthRepo) TouchToken(context.Context, int) error {
+	return nil
+}
+
+func (f *fakeAuthRepo) RevokeToken(_ context.Context, id int) error {
+	now := time.Now().UTC()
+	return f.update(id, func(key *entity.APIKey) { key.RevokedAt = &now })
+}
+
+func (f *fakeAuthRepo) RotateToken(_ context.Context, id int, _ string, _ entity.APIKey, oldExpiresAt time.Time) (int, error) {
+	return id + 1, f.update(id, func(key *entity.APIKey) { key.ExpiresAt = &oldExpiresAt })
+}
+
+func (f *fakeAuthRepo) update(id int, change func(key *entity.APIKey)) error {
+	for hash, key := range f.keys {
+		if key.ID == id {
+			change(&key)
+			f.keys[hash] = key
+			return nil
+		}
+	}
+	return repoerrs.ErrNotFound
+}
+
+func newCachedAuthService(t *testing.T) (*AuthService, *fakeAuthRepo, string) {
+	t.Helper()
+	apiSecure := secure.NewSecure("salt", "0123456789abcdef0123456789abcdef")
+	token := apiSecure.GenerateKey()
+	authRepo := &fakeAuthRepo{keys: map[string]entity.APIKey{
+		apiSecure.Hash(token): {ID: 1, HashVersion: apiSecure.CurrentVersion(), Scopes: []string{entity.ScopeAdmin}},
+	}}
+	cache := KeyCache{Size: 2, TTL: time.Minute, RejectedSize: 2, RejectedTTL: time.Minute}
+	return NewAuthService(authRepo, apiSecure, nil, JWTClaims{}, cache), authRepo, token
+}
+
+func TestTokenExistCache(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("verified and rejected keys are looked up once", func(t *testing.T) {
+		authService, authRepo, token := newCachedAuthService(t)
+		for i := 0; i < 3; i++ {
+			if _, err := authService.TokenExist(ctx, token); err != nil {
+				t.Fatalf("TokenExist() error = %v", err)
+			}
+			if _, err := authService.TokenExist(ctx, "uss_unknown"); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("TokenExist(unknown) error = %v, want %v", err, ErrKeyNotFound)
+			}
+		}
+		if authRepo.lookups != 2 {
+			t.Errorf("lookups = %d, want 2", authRepo.lookups)
+		}
+	})
+
+	t.Run("a key revoked during the lookup is not cached", func(t *testing.T) {
+		authService, authRepo, token := newCachedAuthService(t)
+		authRepo.afterLookup = func() {
+			authRepo.afterLookup = nil
+			if err := authService.RevokeToken(ctx, TokenInput{ID: 1}); err != nil {
+				t.Fatalf("RevokeToken() error = %v", err)
+			}
+		}
+		if _, err := authService.TokenExist(ctx, token); err != nil {
+			t.Fatalf("TokenExist() during the revoke error = %v", err)
+		}
+		if _, err := authService.TokenExist(ctx, token); !errors.Is(err, ErrKeyRevoked) {
+			t.Errorf("TokenExist() after the revoke error = %v, want %v", err, ErrKeyRevoked)
+		}
+	})
+
+	t.Run("unknown keys do not evict verified keys", func(t *testing.T) {
+		authService, authRepo, token := newCachedAuthService(t)
+		if _, err := authService.TokenExist(ctx, token); err != nil {
+			t.Fatalf("TokenExist() error = %v", err)
+		}
+		for i := 0; i < 100; i++ {
+			_, _ = authService.TokenExist(ctx, fmt.Sprintf("%sflood%d", secure.KeyPrefix, i))
+		}
+		lookups := authRepo.lookups
+		if _, err := authService.TokenExist(ctx, token); err != nil {
+			t.Fatalf("TokenExist() after the flood error = %v", err)
+		}
+		if authRepo.lookups != lookups {
+			t.Errorf("the verified key was evicted by unknown keys")
+		}
+	})
+
+	tests := []struct {
+		name    string
+		change  func(authService *AuthService) error
+		wantErr error
+	}{
+		{
+			name: "revoke",
+			change: func(authService *AuthService) error {
+				return authService.RevokeToken(ctx, TokenInput{ID: 1})
+			},
+			wantErr: ErrKeyRevoked,
+		},
+		{
+			name: "rotate",
+			change: func(authService *AuthService) error {
+				_, _, err := authService.RotateToken(ctx, RotateTokenInput{ID: 1, Grace: -time.Second})
+				return err
+			},
+			wantErr: ErrKeyExpired,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+" drops the cached key", func(t *testing.T) {
+			authService, _, token := newCachedAuthService(t)
+			if _, err := authService.TokenExist(ctx, token); err != nil {
+				t.Fatalf("TokenExist() error = %v", err)
+			}
+			if err := tt.change(authService); err != nil {
+				t.Fatalf("change error = %v", err)
+			}
+			if _, err := authService.TokenExist(ctx, token); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("TokenExist() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
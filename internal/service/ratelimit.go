@@ -0,0 +1,55 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/pkg/ratelimit"
+)
+
+type RateLimitService struct {
+	limiter ratelimit.Limiter
+	limits  RateLimits
+}
+
+func NewRateLimitService(limiter ratelimit.Limiter, limits RateLimits) *RateLimitService {
+	return &RateLimitService{
+		limiter: limiter,
+		limits:  limits,
+	}
+}
+
+// Allow takes a request from the bucket of the key. Callers with a JWT share a bucket per tenant and actor.
+func (r *RateLimitService) Allow(ctx context.Context, key entity.APIKey) (ratelimit.Result, error) {
+	bucket := fmt.Sprintf("key:%d", key.ID)
+	if key.ID == 0 {
+		bucket = fmt.Sprintf("jwt:%d:%s", key.TenantID, key.Actor)
+	}
+	return r.limiter.Allow(ctx, bucket, r.limit(key))
+}
+
+// limit returns the limit of the key itself or the most generous limit of its scopes,
+// a scope without a limit of its own has the default limit
+func (r *RateLimitService) limit(key entity.APIKey) ratelimit.Limit {
+	limit := r.limits.Default
+	if len(key.Scopes) > 0 {
+		limit = ratelimit.Limit{}
+		for _, scope := range key.Scopes {
+			scopeLimit, ok := r.limits.Scopes[scope]
+			if !ok {
+				scopeLimit = r.limits.Default
+			}
+			if scopeLimit.Rate > limit.Rate || scopeLimit.Rate == limit.Rate && scopeLimit.Burst > limit.Burst {
+				limit = scopeLimit
+			}
+		}
+	}
+
+	if key.RateLimit != nil {
+		limit.Rate, limit.Burst = *key.RateLimit, *key.RateLimit
+	}
+	if key.RateBurst != nil {
+		limit.Burst = *key.RateBurst
+	}
+	return limit
+}
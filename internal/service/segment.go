@@ -3,65 +3,399 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/repo"
 	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
+	"time"
+)
+
+// maxExpressionDepth and maxExpressionSize bound the nesting and the number of nodes of a derived segment expression
+const (
+	maxExpressionDepth = 8
+	maxExpressionSize  = 64
 )
 
 type SegmentService struct {
 	segmentRepo repo.Segment
 	historyRepo repo.History
 	userRepo    repo.User
+	transactor  repo.Transactor
+	aliasTTL    time.Duration
 }
 
-func NewSegmentService(segmentRepo repo.Segment, historyRepo repo.History, userRepo repo.User) *SegmentService {
+func NewSegmentService(segmentRepo repo.Segment, historyRepo repo.History, userRepo repo.User, transactor repo.Transactor, aliasTTL time.Duration) *SegmentService {
 	return &SegmentService{
 		segmentRepo: segmentRepo,
 		historyRepo: historyRepo,
 		userRepo:    userRepo,
+		transactor:  transactor,
+		aliasTTL:    aliasTTL,
 	}
 }
 
 func (s *SegmentService) CreateSegment(ctx context.Context, input CreateSegmentInput) error {
-	err := s.segmentRepo.CreateSegment(ctx, input.Slug)
+	_, _, err := s.createSegment(ctx, input)
+	return err
+}
+
+// PreviewCreateSegment runs CreateSegment in a rolled-back transaction.
+// The percentage rollout picks random users, so the actual run selects a different sample.
+func (s *SegmentService) PreviewCreateSegment(ctx context.Context, input CreateSegmentInput) (entity.ChangePreview, error) {
+	preview := entity.ChangePreview{Conflicts: make([]string, 0)}
+	err := s.transactor.RollbackAfter(ctx, func(ctx context.Context) error {
+		notes, skipped, err := s.createSegment(ctx, input)
+		preview.History = notes
+		if skipped > 0 {
+			preview.Conflicts = append(preview.Conflicts,
+				fmt.Sprintf("%s: %d sampled users would not be added", ErrSegmentCapacity, skipped))
+		}
+		return err
+	})
+	return preview, err
+}
+
+// createSegment returns the written history and the number of sampled users left out because of max_members
+func (s *SegmentService) createSegment(ctx context.Context, input CreateSegmentInput) ([]entity.History, int, error) {
+	if err := checkWrite(ctx, input.Slug); err != nil {
+		return nil, 0, err
+	}
+	if !validActiveWindow(input.ActiveFrom, input.ActiveUntil) {
+		return nil, 0, ErrInvalidActiveWindow
+	}
+
+	err := s.segmentRepo.CreateSegment(ctx, entity.Segment{
+		Slug:        input.Slug,
+		ActiveFrom:  toUTC(input.ActiveFrom),
+		ActiveUntil: toUTC(input.ActiveUntil),
+		MaxMembers:  input.MaxMembers,
+		AutoEnroll:  input.AutoEnroll,
+	})
 	if err != nil {
 		if errors.Is(err, repoerrs.ErrAlreadyExists) {
-			return ErrSegmentAlreadyExists
+			return nil, 0, ErrSegmentAlreadyExists
 		}
-		return ErrCannotCreateSegment
+		return nil, 0, ErrCannotCreateSegment
 	}
 	if input.PercentageUsers <= 0 {
-		return nil
+		return make([]entity.History, 0), 0, nil
 	}
 
 	// todo вынести в фоновый процесс с использование RabbitMQ
 	usersID, err := s.userRepo.GetRandomUsers(ctx, input.PercentageUsers)
 	if err != nil {
-		return err
+		return nil, 0, err
+	}
+	sampled := len(usersID)
+	if input.MaxMembers != nil && len(usersID) > *input.MaxMembers {
+		usersID = usersID[:*input.MaxMembers]
 	}
+
+	addedUsersID := make([]string, 0, len(usersID))
 	for _, userID := range usersID {
-		err := s.userRepo.SetSegments(ctx, userID, []string{input.Slug}, []string{})
+		_, err := s.userRepo.SetSegments(ctx, userID, []string{input.Slug}, []string{}, nil)
 		if err != nil {
-			return err
+			// the capacity could have been taken by concurrent requests
+			if errors.Is(err, repoerrs.ErrSegmentFull) {
+				break
+			}
+			return nil, 0, err
 		}
+		addedUsersID = append(addedUsersID, userID)
+	}
+	notes := cookNotesSegmentAdd(addedUsersID, input.Slug)
+	return notes, sampled - len(addedUsersID), s.historyRepo.AddNotes(ctx, notes)
+}
+
+func (s *SegmentService) CreateDerivedSegment(ctx context.Context, input CreateDerivedSegmentInput) error {
+	if !validExpression(input.Expression) {
+		return ErrInvalidExpression
+	}
+	if err := checkWrite(ctx, input.Slug); err != nil {
+		return err
+	}
+	if err := checkRead(ctx, input.Expression.Segments()...); err != nil {
+		return err
+	}
+	if !validActiveWindow(input.ActiveFrom, input.ActiveUntil) {
+		return ErrInvalidActiveWindow
+	}
+
+	usersID, err := s.segmentRepo.CreateDerivedSegment(ctx, entity.Segment{
+		Slug:        input.Slug,
+		ActiveFrom:  toUTC(input.ActiveFrom),
+		ActiveUntil: toUTC(input.ActiveUntil),
+		Expression:  &input.Expression,
+	}, input.Materialize)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrAlreadyExists) {
+			return ErrSegmentAlreadyExists
+		}
+		if errors.Is(err, repoerrs.ErrSegmentsNotExist) {
+			return ErrSegmentNotFound
+		}
+		return err
+	}
+	if len(usersID) == 0 {
+		return nil
 	}
 	return s.historyRepo.AddNotes(ctx, cookNotesSegmentAdd(usersID, input.Slug))
 }
 
 func (s *SegmentService) DeleteSegment(ctx context.Context, input SegmentInput) error {
+	_, err := s.deleteSegment(ctx, input)
+	return err
+}
+
+func (s *SegmentService) PreviewDeleteSegment(ctx context.Context, input SegmentInput) (entity.ChangePreview, error) {
+	preview := entity.ChangePreview{Conflicts: make([]string, 0)}
+	err := s.transactor.RollbackAfter(ctx, func(ctx context.Context) error {
+		notes, err := s.deleteSegment(ctx, input)
+		preview.History = notes
+		return err
+	})
+	return preview, err
+}
+
+func (s *SegmentService) deleteSegment(ctx context.Context, input SegmentInput) ([]entity.History, error) {
+	if err := checkWrite(ctx, input.Slug); err != nil {
+		return nil, err
+	}
+
 	usersID, err := s.segmentRepo.GetUsersInSegment(ctx, input.Slug)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = s.segmentRepo.DeleteSegment(ctx, input.Slug)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return nil, ErrSegmentNotFound
+		}
+		return nil, err
+	}
+	notes := cookNotesSegmentDel(usersID, input.Slug)
+	return notes, s.historyRepo.AddNotes(ctx, notes)
+}
+
+func (s *SegmentService) RestoreSegment(ctx context.Context, input SegmentInput) error {
+	if err := checkWrite(ctx, input.Slug); err != nil {
+		return err
+	}
+
+	err := s.segmentRepo.RestoreSegment(ctx, input.Slug)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return ErrArchivedNotFound
+		}
+		return err
+	}
+
+	usersID, err := s.segmentRepo.GetUsersInSegment(ctx, input.Slug)
+	if err != nil {
+		return err
+	}
+	return s.historyRepo.AddNotes(ctx, cookNotesSegmentRestore(usersID, input.Slug))
+}
+
+func (s *SegmentService) RenameSegment(ctx context.Context, input RenameSegmentInput) error {
+	if err := checkWrite(ctx, input.Slug, input.NewSlug); err != nil {
+		return err
+	}
+	if input.Slug == input.NewSlug {
+		return nil
+	}
+
+	err := s.segmentRepo.RenameSegment(ctx, input.Slug, input.NewSlug, s.aliasTTL)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return ErrSegmentNotFound
+		}
+		if errors.Is(err, repoerrs.ErrAlreadyExists) {
+			return ErrSegmentAlreadyExists
+		}
+		return err
+	}
+
+	usersID, err := s.segmentRepo.GetUsersInSegment(ctx, input.NewSlug)
+	if err != nil {
+		return err
+	}
+	return s.historyRepo.AddNotes(ctx, cookNotesSegmentRename(usersID, input.Slug, input.NewSlug))
+}
+
+func (s *SegmentService) LinkSegments(ctx context.Context, input LinkSegmentsInput) error {
+	if err := checkWrite(ctx, input.Parent, input.Child); err != nil {
+		return err
+	}
+	if input.Parent == input.Child {
+		return ErrHierarchyCycle
+	}
+
+	err := s.segmentRepo.LinkSegments(ctx, input.Parent, input.Child, input.Inheritance)
 	if err != nil {
 		if errors.Is(err, repoerrs.ErrNotFound) {
 			return ErrSegmentNotFound
 		}
+		if errors.Is(err, repoerrs.ErrHierarchyCycle) {
+			return ErrHierarchyCycle
+		}
+		if errors.Is(err, repoerrs.ErrAlreadyExists) {
+			return ErrLinkAlreadyExists
+		}
 		return err
 	}
-	return s.historyRepo.AddNotes(ctx, cookNotesSegmentDel(usersID, input.Slug))
+	return nil
+}
+
+func (s *SegmentService) UnlinkSegments(ctx context.Context, input LinkSegmentsInput) error {
+	if err := checkWrite(ctx, input.Parent, input.Child); err != nil {
+		return err
+	}
+
+	err := s.segmentRepo.UnlinkSegments(ctx, input.Parent, input.Child)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return ErrLinkNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *SegmentService) PurgeArchived(ctx context.Context, retention time.Duration) (int64, error) {
+	return s.segmentRepo.PurgeArchived(ctx, retention)
+}
+
+func (s *SegmentService) SetCapacity(ctx context.Context, input SetCapacityInput) error {
+	if err := checkWrite(ctx, input.Slug); err != nil {
+		return err
+	}
+
+	err := s.segmentRepo.SetCapacity(ctx, input.Slug, input.MaxMembers)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return ErrSegmentNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *SegmentService) SetAutoEnroll(ctx context.Context, input SetAutoEnrollInput) error {
+	if err := checkWrite(ctx, input.Slug); err != nil {
+		return err
+	}
+
+	err := s.segmentRepo.SetAutoEnroll(ctx, input.Slug, input.Percent)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return ErrSegmentNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *SegmentService) SetPrerequisites(ctx context.Context, input SetPrerequisitesInput) error {
+	if err := checkWrite(ctx, input.Slug); err != nil {
+		return err
+	}
+	if err := checkRead(ctx, input.Prerequisites...); err != nil {
+		return err
+	}
+
+	err := s.segmentRepo.SetPrerequisites(ctx, input.Slug, input.Prerequisites)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return ErrSegmentNotFound
+		}
+		if errors.Is(err, repoerrs.ErrPrerequisiteCycle) {
+			return ErrPrerequisiteCycle
+		}
+		return err
+	}
+	return nil
+}
+
+// ListSegments returns the segments the caller may read
+func (s *SegmentService) ListSegments(ctx context.Context) ([]entity.SegmentWithMembers, error) {
+	segments, err := s.segmentRepo.ListSegments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make([]entity.SegmentWithMembers, 0, len(segments))
+	for _, segment := range segments {
+		if canRead(ctx, segment.Slug) {
+			visible = append(visible, segment)
+		}
+	}
+	return visible, nil
+}
+
+func (s *SegmentService) SetActiveWindow(ctx context.Context, input SetActiveWindowInput) error {
+	if err := checkWrite(ctx, input.Slug); err != nil {
+		return err
+	}
+	if !validActiveWindow(input.ActiveFrom, input.ActiveUntil) {
+		return ErrInvalidActiveWindow
+	}
+
+	err := s.segmentRepo.SetActiveWindow(ctx, entity.Segment{
+		Slug:        input.Slug,
+		ActiveFrom:  toUTC(input.ActiveFrom),
+		ActiveUntil: toUTC(input.ActiveUntil),
+	})
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return ErrSegmentNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// validExpression checks the operations of the expression and bounds the query it is compiled into
+func validExpression(expr entity.SegmentExpression) bool {
+	size := 0
+	return validExpressionNode(expr, 1, &size)
+}
+
+func validExpressionNode(expr entity.SegmentExpression, depth int, size *int) bool {
+	*size++
+	if depth > maxExpressionDepth || *size > maxExpressionSize {
+		return false
+	}
+
+	switch expr.Op {
+	case "":
+		return expr.Segment != "" && len(expr.Args) == 0
+	case entity.ExpressionUnion, entity.ExpressionIntersection, entity.ExpressionDifference:
+		if expr.Segment != "" || len(expr.Args) == 0 {
+			return false
+		}
+		for _, arg := range expr.Args {
+			if !validExpressionNode(arg, depth+1, size) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+func validActiveWindow(activeFrom, activeUntil *time.Time) bool {
+	return activeFrom == nil || activeUntil == nil || activeUntil.After(*activeFrom)
+}
+
+func toUTC(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
 }
 
 func cookNotesSegmentDel(usersID []string, segment string) []entity.History {
@@ -76,6 +410,34 @@ func cookNotesSegmentDel(usersID []string, segment string) []entity.History {
 	return notes
 }
 
+func cookNotesSegmentRestore(usersID []string, segment string) []entity.History {
+	notes := make([]entity.History, 0, len(usersID))
+	for _, userID := range usersID {
+		notes = append(notes, entity.History{
+			UserID:      userID,
+			SegmentSlug: segment,
+			Type:        entity.OperationTypeSegmentRestore,
+		})
+	}
+	return notes
+}
+
+func cookNotesSegmentRename(usersID []string, segment, newSegment string) []entity.History {
+	notes := make([]entity.History, 0, 2*len(usersID))
+	for _, userID := range usersID {
+		notes = append(notes, entity.History{
+			UserID:      userID,
+			SegmentSlug: segment,
+			Type:        entity.OperationTypeRenameFrom,
+		}, entity.History{
+			UserID:      userID,
+			SegmentSlug: newSegment,
+			Type:        entity.OperationTypeRenameTo,
+		})
+	}
+	return notes
+}
+
 func cookNotesSegmentAdd(usersID []string, segment string) []entity.History {
 	notes := make([]entity.History, 0, len(usersID))
 	for _, userID := range usersID {
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"testing"
+)
+
+func leaf(slug string) entity.SegmentExpression {
+	return entity.SegmentExpression{Segment: slug}
+}
+
+// nested returns an expression of the given depth
+func nested(depth int) entity.SegmentExpression {
+	expr := leaf("A")
+	for i := 1; i < depth; i++ {
+		expr = entity.SegmentExpression{Op: entity.ExpressionUnion, Args: []entity.SegmentExpression{expr}}
+	}
+	return expr
+}
+
+// wide returns a union of the given number of segments
+func wide(operands int) entity.SegmentExpression {
+	expr := entity.SegmentExpression{Op: entity.ExpressionUnion}
+	for i := 0; i < operands; i++ {
+		expr.Args = append(expr.Args, leaf("A"))
+	}
+	return expr
+}
+
+func TestValidExpression(t *testing.T) {
+	tests := []struct {
+		name string
+		expr entity.SegmentExpression
+		want bool
+	}{
+		{"segment", leaf("A"), true},
+		{"empty segment", leaf(""), false},
+		{"segment with args", entity.SegmentExpression{Segment: "A", Args: []entity.SegmentExpression{leaf("B")}}, false},
+		{"difference", entity.SegmentExpression{Op: entity.ExpressionDifference, Args: []entity.SegmentExpression{leaf("A"), leaf("B")}}, true},
+		{"operation without args", entity.SegmentExpression{Op: entity.ExpressionIntersection}, false},
+		{"unknown operation", entity.SegmentExpression{Op: "xor", Args: []entity.SegmentExpression{leaf("A")}}, false},
+		{"invalid nested", entity.SegmentExpression{Op: entity.ExpressionUnion, Args: []entity.SegmentExpression{leaf("A"), leaf("")}}, false},
+		{"max depth", nested(maxExpressionDepth), true},
+		{"too deep", nested(maxExpressionDepth + 1), false},
+		{"max size", wide(maxExpressionSize - 1), true},
+		{"too large", wide(maxExpressionSize), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validExpression(tt.expr); got != tt.want {
+				t.Errorf("validExpression() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -5,21 +5,83 @@ import (
 	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/repo"
 	"github.com/passionde/user-segmentation-service/pkg/csvwriter"
+	"github.com/passionde/user-segmentation-service/pkg/jwtauth"
+	"github.com/passionde/user-segmentation-service/pkg/ratelimit"
 	"github.com/passionde/user-segmentation-service/pkg/secure"
+	"github.com/passionde/user-segmentation-service/pkg/webhook"
+	"io"
+	"time"
 )
 
 type CreateSegmentInput struct {
 	Slug            string
 	PercentageUsers int
+	ActiveFrom      *time.Time
+	ActiveUntil     *time.Time
+	MaxMembers      *int
+	AutoEnroll      *int
 }
 
 type SegmentInput struct {
 	Slug string
 }
 
+type CreateDerivedSegmentInput struct {
+	Slug        string
+	Expression  entity.SegmentExpression
+	Materialize bool
+	ActiveFrom  *time.Time
+	ActiveUntil *time.Time
+}
+
+type RenameSegmentInput struct {
+	Slug    string
+	NewSlug string
+}
+
+type LinkSegmentsInput struct {
+	Parent      string
+	Child       string
+	Inheritance string
+}
+
+type SetCapacityInput struct {
+	Slug       string
+	MaxMembers *int
+}
+
+type SetAutoEnrollInput struct {
+	Slug    string
+	Percent *int
+}
+
+type SetPrerequisitesInput struct {
+	Slug          string
+	Prerequisites []string
+}
+
+type SetActiveWindowInput struct {
+	Slug        string
+	ActiveFrom  *time.Time
+	ActiveUntil *time.Time
+}
+
 type Segment interface {
 	CreateSegment(ctx context.Context, input CreateSegmentInput) error
+	PreviewCreateSegment(ctx context.Context, input CreateSegmentInput) (entity.ChangePreview, error)
+	CreateDerivedSegment(ctx context.Context, input CreateDerivedSegmentInput) error
 	DeleteSegment(ctx context.Context, input SegmentInput) error
+	PreviewDeleteSegment(ctx context.Context, input SegmentInput) (entity.ChangePreview, error)
+	SetActiveWindow(ctx context.Context, input SetActiveWindowInput) error
+	SetCapacity(ctx context.Context, input SetCapacityInput) error
+	SetAutoEnroll(ctx context.Context, input SetAutoEnrollInput) error
+	SetPrerequisites(ctx context.Context, input SetPrerequisitesInput) error
+	ListSegments(ctx context.Context) ([]entity.SegmentWithMembers, error)
+	RestoreSegment(ctx context.Context, input SegmentInput) error
+	RenameSegment(ctx context.Context, input RenameSegmentInput) error
+	LinkSegments(ctx context.Context, input LinkSegmentsInput) error
+	UnlinkSegments(ctx context.Context, input LinkSegmentsInput) error
+	PurgeArchived(ctx context.Context, retention time.Duration) (int64, error)
 }
 
 type SetSegmentsUserInput struct {
@@ -27,15 +89,48 @@ type SetSegmentsUserInput struct {
 	SegmentsAdd []string
 	SegmentsDel []string
 	TTL         uint64
+	// Cascade removes segments whose prerequisites are deleted instead of rejecting the change
+	Cascade bool
+	// IfVersion applies the change only if memberships of the user have this version
+	IfVersion *int64
 }
 
 type GetSegmentsUserInput struct {
 	UserID string
 }
 
+type UserInput struct {
+	UserID string
+}
+
+type EraseUserInput struct {
+	UserID string
+	Mode   string
+}
+
+type MergeUsersInput struct {
+	SourceID string
+	TargetID string
+}
+
+type ListUsersInput struct {
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	Segment     string
+	Limit       uint64
+	Offset      uint64
+}
+
 type User interface {
 	SetSegments(ctx context.Context, input SetSegmentsUserInput) error
-	GetSegments(ctx context.Context, input GetSegmentsUserInput) ([]string, error)
+	PreviewSetSegments(ctx context.Context, input SetSegmentsUserInput) (entity.ChangePreview, error)
+	GetSegments(ctx context.Context, input GetSegmentsUserInput) ([]entity.ActiveSegment, int64, error)
+	CreateUser(ctx context.Context, input UserInput) error
+	ListUsers(ctx context.Context, input ListUsersInput) ([]entity.User, error)
+	DeleteUser(ctx context.Context, input UserInput) error
+	ExportUser(ctx context.Context, input UserInput) (entity.UserExport, error)
+	EraseUser(ctx context.Context, input EraseUserInput) (entity.ErasureAudit, error)
+	MergeUsers(ctx context.Context, input MergeUsersInput) error
 }
 
 type GetHistoryInput struct {
@@ -46,40 +141,194 @@ type GetHistoryInput struct {
 
 type History interface {
 	AddNotes(ctx context.Context, notes []entity.History) error
+	// GetNotes writes the report and returns its id
 	GetNotes(ctx context.Context, input GetHistoryInput) (string, error)
+	GetReport(ctx context.Context, reportID string) (io.ReadCloser, error)
+}
+
+type ScheduleTasksInput struct {
+	UsersID   []string
+	Segments  []string
+	Operation string
+	RunAt     time.Time
+}
+
+type GetTasksUserInput struct {
+	UserID string
+}
+
+type CancelTaskInput struct {
+	TaskID int
 }
 
 type TaskDelete interface {
 	GetExpiredTasks(ctx context.Context) ([]entity.Task, error)
+	GetNextDeadline(ctx context.Context) (time.Duration, error)
+	ListenNewTasks(ctx context.Context, notify func()) error
 	CompleteTasks(ctx context.Context, tasks []entity.Task, callback func([]entity.Task) error) error
 	CreateTasks(ctx context.Context, tasks []entity.Task, ttl uint64) error
+	ScheduleTasks(ctx context.Context, input ScheduleTasksInput) ([]entity.Task, error)
+	GetPendingTasks(ctx context.Context, input GetTasksUserInput) ([]entity.Task, error)
+	CancelTask(ctx context.Context, input CancelTaskInput) error
+}
+
+type GenerateTokenInput struct {
+	TenantID        int
+	Label           string
+	Scopes          []string
+	ReadNamespaces  []string
+	WriteNamespaces []string
+	ExpiresIn       time.Duration
+	RateLimit       *int
+	RateBurst       *int
+}
+
+type TokenInput struct {
+	ID int
+}
+
+type RotateTokenInput struct {
+	ID        int
+	Grace     time.Duration
+	ExpiresIn time.Duration
+}
+
+// JWTClaims describes how claims of a JWT map to the caller
+type JWTClaims struct {
+	ActorClaim  string
+	ScopesClaim string
+	// ScopePrefix marks the scopes of this service among the scopes of the identity provider
+	ScopePrefix string
+	// TenantClaim holds the tenant id, without it every token belongs to Tenant
+	TenantClaim string
+	Tenant      int
+}
+
+// KeyCache limits the number of cached hashes of verified and rejected keys and the time they are kept,
+// a cache with zero size is disabled
+type KeyCache struct {
+	Size         int
+	TTL          time.Duration
+	RejectedSize int
+	RejectedTTL  time.Duration
 }
 
 type Auth interface {
-	TokenExist(ctx context.Context, token string) (int, error)
-	GenerateToken(ctx context.Context) (int, string, error)
+	TokenExist(ctx context.Context, token string) (entity.APIKey, error)
+	ListenKeyChanges(ctx context.Context) error
+	VerifyJWT(ctx context.Context, token string) (entity.APIKey, error)
+	GenerateToken(ctx context.Context, input GenerateTokenInput) (int, string, error)
+	GetToken(ctx context.Context, input TokenInput) (entity.APIKey, error)
+	ListTokens(ctx context.Context) ([]entity.APIKey, error)
+	RevokeToken(ctx context.Context, input TokenInput) error
+	RotateToken(ctx context.Context, input RotateTokenInput) (int, string, error)
+}
+
+type CreateTenantInput struct {
+	Name string
+}
+
+type Tenant interface {
+	CreateTenant(ctx context.Context, input CreateTenantInput) (int, error)
+	ListTenants(ctx context.Context) ([]entity.Tenant, error)
+}
+
+// RateLimits holds the limit of keys without a limit of their own and the limits of scopes
+type RateLimits struct {
+	Default ratelimit.Limit
+	Scopes  map[string]ratelimit.Limit
+}
+
+type RateLimit interface {
+	Allow(ctx context.Context, key entity.APIKey) (ratelimit.Result, error)
+}
+
+type BeginIdempotentInput struct {
+	Principal      string
+	IdempotencyKey string
+	RequestHash    string
+}
+
+type Idempotency interface {
+	Begin(ctx context.Context, input BeginIdempotentInput) (*entity.IdempotentRequest, error)
+	Complete(ctx context.Context, request entity.IdempotentRequest) error
+	Release(ctx context.Context, input BeginIdempotentInput) error
+	PurgeExpired(ctx context.Context) (int64, error)
+}
+
+type CreateWebhookInput struct {
+	URL      string
+	Secret   string
+	Segments []string
+	Events   []string
+}
+
+type WebhookInput struct {
+	WebhookID int
+}
+
+type GetDeliveriesInput struct {
+	WebhookID int
+	Limit     uint64
+	Offset    uint64
+}
+
+// WebhookOptions limit a delivery attempt to Timeout. A failed delivery is retried after Backoff,
+// doubled with every attempt, until it has been attempted MaxAttempts times.
+type WebhookOptions struct {
+	Timeout     time.Duration
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+type Webhook interface {
+	CreateWebhook(ctx context.Context, input CreateWebhookInput) (int, error)
+	ListWebhooks(ctx context.Context) ([]entity.Webhook, error)
+	DeleteWebhook(ctx context.Context, input WebhookInput) error
+	GetDeliveries(ctx context.Context, input GetDeliveriesInput) ([]entity.WebhookDelivery, error)
+	SendDeliveries(ctx context.Context) (int, error)
+	PurgeDeliveries(ctx context.Context, retention time.Duration) (int64, error)
 }
 
 type Services struct {
-	User       User
-	Segment    Segment
-	History    History
-	TaskDelete TaskDelete
-	Auth       Auth
+	User        User
+	Segment     Segment
+	History     History
+	TaskDelete  TaskDelete
+	Auth        Auth
+	Tenant      Tenant
+	Idempotency Idempotency
+	RateLimit   RateLimit
+	Webhook     Webhook
 }
 
 type ServicesDependencies struct {
-	Repos     *repo.Repositories
-	APISecure secure.APISecure
-	CSVWrite  csvwriter.CSVWriter
+	Repos             *repo.Repositories
+	APISecure         secure.APISecure
+	JWTVerifier       jwtauth.Verifier
+	JWTClaims         JWTClaims
+	KeyCache          KeyCache
+	CSVWrite          csvwriter.CSVWriter
+	SegmentAliasTTL   time.Duration
+	UserHistoryPolicy string
+	IdempotencyTTL    time.Duration
+	IdempotencyLock   time.Duration
+	RateLimiter       ratelimit.Limiter
+	RateLimits        RateLimits
+	WebhookSender     webhook.Sender
+	WebhookOptions    WebhookOptions
 }
 
 func NewServices(deps ServicesDependencies) *Services {
 	return &Services{
-		User:       NewUserService(deps.Repos.User, deps.Repos.History, deps.Repos.TaskDelete),
-		Segment:    NewSegmentService(deps.Repos.Segment, deps.Repos.History, deps.Repos.User),
-		History:    NewHistoryService(deps.Repos.History, deps.CSVWrite),
-		TaskDelete: NewTasksDeleteService(deps.Repos.TaskDelete),
-		Auth:       NewAuthService(deps.Repos.Auth, deps.APISecure),
+		User:        NewUserService(deps.Repos.User, deps.Repos.Segment, deps.Repos.History, deps.Repos.TaskDelete, deps.Repos.Transactor, deps.CSVWrite, deps.UserHistoryPolicy),
+		Segment:     NewSegmentService(deps.Repos.Segment, deps.Repos.History, deps.Repos.User, deps.Repos.Transactor, deps.SegmentAliasTTL),
+		History:     NewHistoryService(deps.Repos.History, deps.Repos.User, deps.CSVWrite),
+		TaskDelete:  NewTasksDeleteService(deps.Repos.TaskDelete, deps.Repos.User),
+		Auth:        NewAuthService(deps.Repos.Auth, deps.APISecure, deps.JWTVerifier, deps.JWTClaims, deps.KeyCache),
+		Tenant:      NewTenantService(deps.Repos.Tenant),
+		Idempotency: NewIdempotencyService(deps.Repos.Idempotency, deps.IdempotencyTTL, deps.IdempotencyLock),
+		RateLimit:   NewRateLimitService(deps.RateLimiter, deps.RateLimits),
+		Webhook:     NewWebhookService(deps.Repos.Webhook, deps.WebhookSender, deps.WebhookOptions),
 	}
 }
@@ -2,17 +2,22 @@ package service
 
 import (
 	"context"
+	"errors"
 	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/repo"
+	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
+	"time"
 )
 
 type TasksDeleteService struct {
 	tasksDeleteRepo repo.TaskDelete
+	userRepo        repo.User
 }
 
-func NewTasksDeleteService(tasksDeleteRepo repo.TaskDelete) *TasksDeleteService {
+func NewTasksDeleteService(tasksDeleteRepo repo.TaskDelete, userRepo repo.User) *TasksDeleteService {
 	return &TasksDeleteService{
 		tasksDeleteRepo: tasksDeleteRepo,
+		userRepo:        userRepo,
 	}
 }
 
@@ -20,6 +25,21 @@ func (t *TasksDeleteService) GetExpiredTasks(ctx context.Context) ([]entity.Task
 	return t.tasksDeleteRepo.GetExpiredTasks(ctx)
 }
 
+func (t *TasksDeleteService) GetNextDeadline(ctx context.Context) (time.Duration, error) {
+	wait, err := t.tasksDeleteRepo.GetNextDeadline(ctx)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return 0, ErrNoPendingTasks
+		}
+		return 0, err
+	}
+	return wait, nil
+}
+
+func (t *TasksDeleteService) ListenNewTasks(ctx context.Context, notify func()) error {
+	return t.tasksDeleteRepo.ListenNewTasks(ctx, notify)
+}
+
 func (t *TasksDeleteService) CompleteTasks(ctx context.Context, tasks []entity.Task, callback func([]entity.Task) error) error {
 	if err := callback(tasks); err != nil {
 		return err
@@ -30,3 +50,76 @@ func (t *TasksDeleteService) CompleteTasks(ctx context.Context, tasks []entity.T
 func (t *TasksDeleteService) CreateTasks(ctx context.Context, tasks []entity.Task, ttl uint64) error {
 	return t.tasksDeleteRepo.CreateTasks(ctx, tasks, ttl)
 }
+
+func (t *TasksDeleteService) ScheduleTasks(ctx context.Context, input ScheduleTasksInput) ([]entity.Task, error) {
+	if !input.RunAt.After(time.Now()) {
+		return nil, ErrScheduleInPast
+	}
+	if err := checkWrite(ctx, input.Segments...); err != nil {
+		return nil, err
+	}
+
+	aliases, err := t.userRepo.ResolveUsers(ctx, input.UsersID)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make([]entity.Task, 0, len(input.UsersID)*len(input.Segments))
+	for _, userID := range input.UsersID {
+		if resolved, ok := aliases[userID]; ok {
+			userID = resolved
+		}
+		for _, segment := range input.Segments {
+			tasks = append(tasks, entity.Task{
+				UserID:      userID,
+				SegmentSlug: segment,
+				Operation:   input.Operation,
+				Deadline:    input.RunAt.UTC(),
+			})
+		}
+	}
+
+	tasks, err = t.tasksDeleteRepo.ScheduleTasks(ctx, tasks)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrSegmentsNotExist) {
+			return nil, ErrSegmentNotFound
+		}
+		return nil, err
+	}
+	return tasks, nil
+}
+
+func (t *TasksDeleteService) GetPendingTasks(ctx context.Context, input GetTasksUserInput) ([]entity.Task, error) {
+	userID, err := resolveUser(ctx, t.userRepo, input.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks, err := t.tasksDeleteRepo.GetPendingTasks(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return readableTasks(ctx, tasks), nil
+}
+
+func (t *TasksDeleteService) CancelTask(ctx context.Context, input CancelTaskInput) error {
+	task, err := t.tasksDeleteRepo.GetTask(ctx, input.TaskID)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return ErrTaskNotFound
+		}
+		return err
+	}
+	if err := checkWrite(ctx, task.SegmentSlug); err != nil {
+		return err
+	}
+
+	err = t.tasksDeleteRepo.CancelTask(ctx, input.TaskID)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return ErrTaskNotFound
+		}
+		return err
+	}
+	return nil
+}
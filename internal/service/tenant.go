@@ -0,0 +1,44 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/repo"
+	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
+	"github.com/passionde/user-segmentation-service/pkg/postgres"
+)
+
+// WithTenant returns a context whose calls read and change only the data of the tenant.
+// Calls without a tenant in the context see no data at all.
+func WithTenant(ctx context.Context, tenantID int) context.Context {
+	return postgres.WithTenant(ctx, tenantID)
+}
+
+func tenantFromContext(ctx context.Context) int {
+	tenantID, _ := postgres.TenantFromContext(ctx)
+	return tenantID
+}
+
+type TenantService struct {
+	tenantRepo repo.Tenant
+}
+
+func NewTenantService(tenantRepo repo.Tenant) *TenantService {
+	return &TenantService{tenantRepo: tenantRepo}
+}
+
+func (t *TenantService) CreateTenant(ctx context.Context, input CreateTenantInput) (int, error) {
+	id, err := t.tenantRepo.CreateTenant(ctx, input.Name)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrAlreadyExists) {
+			return 0, ErrTenantAlreadyExists
+		}
+		return 0, err
+	}
+	return id, nil
+}
+
+func (t *TenantService) ListTenants(ctx context.Context) ([]entity.Tenant, error) {
+	return t.tenantRepo.ListTenants(ctx)
+}
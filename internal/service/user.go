@@ -2,65 +2,539 @@ package service
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"github.com/passionde/user-segmentation-service/internal/entity"
 	"github.com/passionde/user-segmentation-service/internal/repo"
 	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
+	"github.com/passionde/user-segmentation-service/pkg/csvwriter"
+	"sort"
+)
+
+// History policies applied when a user is deleted
+const (
+	HistoryPolicyKeep   = "keep"
+	HistoryPolicyDelete = "delete"
 )
 
 type UserService struct {
-	userRepo    repo.User
-	taskDelete  repo.TaskDelete
-	historyRepo repo.History
+	userRepo      repo.User
+	segmentRepo   repo.Segment
+	taskDelete    repo.TaskDelete
+	historyRepo   repo.History
+	transactor    repo.Transactor
+	csvWriter     csvwriter.CSVWriter
+	historyPolicy string
 }
 
-func NewUserService(userRepo repo.User, historyRepo repo.History, taskDelete repo.TaskDelete) *UserService {
+func NewUserService(userRepo repo.User, segmentRepo repo.Segment, historyRepo repo.History, taskDelete repo.TaskDelete, transactor repo.Transactor, csvWriter csvwriter.CSVWriter, historyPolicy string) *UserService {
 	return &UserService{
-		userRepo:    userRepo,
-		taskDelete:  taskDelete,
-		historyRepo: historyRepo,
+		userRepo:      userRepo,
+		segmentRepo:   segmentRepo,
+		taskDelete:    taskDelete,
+		historyRepo:   historyRepo,
+		transactor:    transactor,
+		csvWriter:     csvWriter,
+		historyPolicy: historyPolicy,
 	}
 }
 
 func (u *UserService) SetSegments(ctx context.Context, input SetSegmentsUserInput) error {
-	activeSegments, err := u.GetSegments(ctx, GetSegmentsUserInput{UserID: input.UserID})
-	if err != nil {
-		if !errors.Is(err, ErrUserNotFound) {
-			return err
+	_, err := u.setSegments(ctx, input)
+	return err
+}
+
+// PreviewSetSegments runs SetSegments in a rolled-back transaction.
+// Errors that reject the change because of the current state are reported as conflicts.
+func (u *UserService) PreviewSetSegments(ctx context.Context, input SetSegmentsUserInput) (entity.ChangePreview, error) {
+	preview := entity.ChangePreview{History: make([]entity.History, 0), Conflicts: make([]string, 0)}
+	err := u.transactor.RollbackAfter(ctx, func(ctx context.Context) error {
+		notes, err := u.setSegments(ctx, input)
+		if err == nil {
+			preview.History = notes
 		}
-		activeSegments = make([]string, 0)
+		return err
+	})
+	if errors.Is(err, ErrSegmentCapacity) || errors.Is(err, ErrPrerequisiteMissing) ||
+		errors.Is(err, ErrPrerequisiteRequired) || errors.Is(err, ErrVersionMismatch) {
+		preview.Conflicts = append(preview.Conflicts, err.Error())
+		return preview, nil
+	}
+	return preview, err
+}
+
+// setSegments changes memberships of the user and returns the written history
+func (u *UserService) setSegments(ctx context.Context, input SetSegmentsUserInput) ([]entity.History, error) {
+	input, err := u.resolveAliases(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWrite(ctx, append(append([]string{}, input.SegmentsAdd...), input.SegmentsDel...)...); err != nil {
+		return nil, err
+	}
+	if input.UserID, err = resolveUser(ctx, u.userRepo, input.UserID); err != nil {
+		return nil, err
+	}
+
+	var notes []entity.History
+	err = u.transactor.WithinTransaction(ctx, func(ctx context.Context) error {
+		notes, err = u.setSegmentsLocked(ctx, input)
+		return err
+	})
+	return notes, err
+}
+
+// setSegmentsLocked locks the user first, so the memberships the change is computed from
+// stay current until the history is written.
+func (u *UserService) setSegmentsLocked(ctx context.Context, input SetSegmentsUserInput) ([]entity.History, error) {
+	created, err := u.userRepo.LockUser(ctx, input.UserID)
+	if err != nil {
+		return nil, err
+	}
+	// the version of a user that did not exist can not match
+	if created && input.IfVersion != nil {
+		return nil, ErrVersionMismatch
+	}
+
+	// memberships of segments outside their activation window are counted too
+	activeSegments, err := u.userRepo.GetMemberships(ctx, input.UserID)
+	if err != nil {
+		return nil, err
 	}
 
-	err = u.userRepo.SetSegments(
-		ctx,
-		input.UserID,
-		input.SegmentsAdd,
-		input.SegmentsDel,
-	)
+	cascaded, err := u.checkPrerequisites(ctx, input, activeSegments)
 	if err != nil {
+		return nil, err
+	}
+	if err := checkWrite(ctx, cascaded...); err != nil {
+		return nil, err
+	}
+
+	// copied, appending to SegmentsDel could write into the array of the caller
+	segmentsDel := make([]string, 0, len(input.SegmentsDel)+len(cascaded))
+	segmentsDel = append(append(segmentsDel, input.SegmentsDel...), cascaded...)
+	if _, err = u.userRepo.SetSegments(ctx, input.UserID, input.SegmentsAdd, segmentsDel, input.IfVersion); err != nil {
 		if errors.Is(err, repoerrs.ErrSegmentsNotExist) {
-			return ErrSegmentNotFound
+			return nil, ErrSegmentNotFound
+		}
+		if errors.Is(err, repoerrs.ErrVersionMismatch) {
+			return nil, ErrVersionMismatch
+		}
+		var fullErr *repoerrs.SegmentFullError
+		if errors.As(err, &fullErr) {
+			return nil, &SegmentCapacityError{Slug: fullErr.Slug}
+		}
+		return nil, err
+	}
+	enrolled := make([]string, 0)
+	if created {
+		if enrolled, err = u.userRepo.AutoEnroll(ctx, input.UserID, append(segmentsDel, input.SegmentsAdd...)); err != nil {
+			return nil, err
 		}
-		return err
 	}
 	if input.TTL > 0 {
 		if err := u.taskDelete.CreateTasks(ctx, cookTasks(input, activeSegments), input.TTL); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return u.historyRepo.AddNotes(ctx, cookNotesUser(input, activeSegments))
+	notes := cookNotesUser(input, activeSegments)
+	for _, segment := range cascaded {
+		notes = append(notes, entity.History{
+			UserID:      input.UserID,
+			SegmentSlug: segment,
+			Type:        entity.OperationTypeDeleteCascade,
+		})
+	}
+	for _, segment := range enrolled {
+		notes = append(notes, entity.History{
+			UserID:      input.UserID,
+			SegmentSlug: segment,
+			Type:        entity.OperationTypeAutoAdd,
+		})
+	}
+	return notes, u.historyRepo.AddNotes(ctx, notes)
+}
 
+// GetSegments returns active segments of the user with the version of its memberships.
+// The version is read first, so it never claims changes the segments do not reflect.
+func (u *UserService) GetSegments(ctx context.Context, input GetSegmentsUserInput) ([]entity.ActiveSegment, int64, error) {
+	userID, err := resolveUser(ctx, u.userRepo, input.UserID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	version, err := u.userRepo.GetVersion(ctx, userID)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrUserNotFound) {
+			return nil, 0, ErrUserNotFound
+		}
+		return nil, 0, err
+	}
+
+	segments, err := u.userRepo.GetSegments(ctx, userID)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrUserNotFound) {
+			return nil, 0, ErrUserNotFound
+		}
+		return nil, 0, err
+	}
+
+	visible := make([]entity.ActiveSegment, 0, len(segments))
+	for _, segment := range segments {
+		if canRead(ctx, segment.Slug) {
+			visible = append(visible, segment)
+		}
+	}
+	return visible, version, nil
 }
 
-func (u *UserService) GetSegments(ctx context.Context, input GetSegmentsUserInput) ([]string, error) {
-	segments, err := u.userRepo.GetSegments(ctx, input.UserID)
+func (u *UserService) CreateUser(ctx context.Context, input UserInput) error {
+	userID, err := resolveUser(ctx, u.userRepo, input.UserID)
+	if err != nil {
+		return err
+	}
+	// the id of a merged user stays taken by its alias
+	if userID != input.UserID {
+		return ErrUserAlreadyExists
+	}
+
+	enrolled, err := u.userRepo.CreateUser(ctx, input.UserID)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrAlreadyExists) {
+			return ErrUserAlreadyExists
+		}
+		return err
+	}
+
+	notes := make([]entity.History, 0, len(enrolled))
+	for _, segment := range enrolled {
+		notes = append(notes, entity.History{
+			UserID:      input.UserID,
+			SegmentSlug: segment,
+			Type:        entity.OperationTypeAutoAdd,
+		})
+	}
+	return u.historyRepo.AddNotes(ctx, notes)
+}
+
+func (u *UserService) ListUsers(ctx context.Context, input ListUsersInput) ([]entity.User, error) {
+	if input.Segment != "" {
+		if err := checkRead(ctx, input.Segment); err != nil {
+			return nil, err
+		}
+	}
+
+	return u.userRepo.ListUsers(ctx, entity.UserFilter{
+		CreatedFrom: toUTC(input.CreatedFrom),
+		CreatedTo:   toUTC(input.CreatedTo),
+		Segment:     input.Segment,
+		Limit:       input.Limit,
+		Offset:      input.Offset,
+	})
+}
+
+// DeleteUser removes memberships in every namespace, so it needs access to all of them
+func (u *UserService) DeleteUser(ctx context.Context, input UserInput) error {
+	if err := checkUnrestricted(ctx); err != nil {
+		return err
+	}
+
+	userID, err := resolveUser(ctx, u.userRepo, input.UserID)
+	if err != nil {
+		return err
+	}
+
+	err = u.userRepo.DeleteUser(ctx, userID, u.historyPolicy == HistoryPolicyDelete)
 	if err != nil {
 		if errors.Is(err, repoerrs.ErrUserNotFound) {
-			return nil, ErrUserNotFound
+			return ErrUserNotFound
 		}
+		return err
+	}
+	return nil
+}
+
+func (u *UserService) ExportUser(ctx context.Context, input UserInput) (entity.UserExport, error) {
+	var err error
+	if input.UserID, err = resolveUser(ctx, u.userRepo, input.UserID); err != nil {
+		return entity.UserExport{}, err
+	}
+	export := entity.UserExport{UserID: input.UserID}
+
+	user, err := u.userRepo.GetUser(ctx, input.UserID)
+	if err != nil && !errors.Is(err, repoerrs.ErrUserNotFound) {
+		return export, err
+	}
+	if err == nil {
+		export.CreatedAt = &user.CreatedAt
+	}
+
+	if export.Segments, err = u.userRepo.GetMemberships(ctx, input.UserID); err != nil {
+		if !errors.Is(err, repoerrs.ErrUserNotFound) {
+			return export, err
+		}
+		export.Segments = make([]string, 0)
+	}
+	if export.PendingTasks, err = u.taskDelete.GetPendingTasks(ctx, input.UserID); err != nil {
+		return export, err
+	}
+	if export.History, err = u.historyRepo.GetUserNotes(ctx, input.UserID); err != nil {
+		return export, err
+	}
+
+	segments := make([]string, 0, len(export.Segments))
+	for _, segment := range export.Segments {
+		if canRead(ctx, segment) {
+			segments = append(segments, segment)
+		}
+	}
+	export.Segments = segments
+	export.PendingTasks = readableTasks(ctx, export.PendingTasks)
+	export.History = readableNotes(ctx, export.History)
+
+	// history of a deleted user is still exported
+	if export.CreatedAt == nil && len(export.History) == 0 {
+		return export, ErrUserNotFound
+	}
+	return export, nil
+}
+
+func (u *UserService) EraseUser(ctx context.Context, input EraseUserInput) (entity.ErasureAudit, error) {
+	if err := checkUnrestricted(ctx); err != nil {
+		return entity.ErasureAudit{}, err
+	}
+
+	var err error
+	if input.UserID, err = resolveUser(ctx, u.userRepo, input.UserID); err != nil {
+		return entity.ErasureAudit{}, err
+	}
+
+	var pseudonym string
+	if input.Mode == entity.ErasureModePseudonymize {
+		if pseudonym, err = newPseudonym(input.UserID); err != nil {
+			return entity.ErasureAudit{}, err
+		}
+	}
+
+	// reports are removed first, a failed erasure can be retried while the user still exists
+	if err = u.deleteReports(ctx, input.UserID); err != nil {
+		return entity.ErasureAudit{}, err
+	}
+
+	audit, err := u.userRepo.EraseUser(ctx, input.UserID, pseudonym)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrUserNotFound) {
+			return audit, ErrUserNotFound
+		}
+		return audit, err
+	}
+	return audit, nil
+}
+
+func (u *UserService) MergeUsers(ctx context.Context, input MergeUsersInput) error {
+	if err := checkUnrestricted(ctx); err != nil {
+		return err
+	}
+
+	aliases, err := u.userRepo.ResolveUsers(ctx, []string{input.SourceID, input.TargetID})
+	if err != nil {
+		return err
+	}
+	sourceID, targetID := input.SourceID, input.TargetID
+	if userID, ok := aliases[sourceID]; ok {
+		sourceID = userID
+	}
+	if userID, ok := aliases[targetID]; ok {
+		targetID = userID
+	}
+	if sourceID == targetID {
+		return ErrMergeSameUser
+	}
+
+	return u.transactor.WithinTransaction(ctx, func(ctx context.Context) error {
+		return u.mergeUsers(ctx, sourceID, targetID)
+	})
+}
+
+// mergeUsers locks both users in the order of their ids, so concurrent merges of the same users do not deadlock.
+// The target user gets the segments of the source one, so the united memberships are checked against prerequisites
+// and capacity as any other addition. The history records the source user leaving its segments and the target
+// user joining the new ones, which notifies webhook subscribers of both ids.
+func (u *UserService) mergeUsers(ctx context.Context, sourceID, targetID string) error {
+	usersID := []string{sourceID, targetID}
+	sort.Strings(usersID)
+	for _, userID := range usersID {
+		created, err := u.userRepo.LockUser(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if created && userID == sourceID {
+			return ErrUserNotFound
+		}
+	}
+
+	sourceSegments, err := u.userRepo.GetMemberships(ctx, sourceID)
+	if err != nil {
+		return err
+	}
+	targetSegments, err := u.userRepo.GetMemberships(ctx, targetID)
+	if err != nil {
+		return err
+	}
+	moved := getSegmentsAdd(sourceSegments, targetSegments)
+	_, err = u.checkPrerequisites(ctx, SetSegmentsUserInput{UserID: targetID, SegmentsAdd: moved}, targetSegments)
+	if err != nil {
+		return err
+	}
+
+	err = u.userRepo.MergeUsers(ctx, sourceID, targetID)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrUserNotFound) {
+			return ErrUserNotFound
+		}
+		var fullErr *repoerrs.SegmentFullError
+		if errors.As(err, &fullErr) {
+			return &SegmentCapacityError{Slug: fullErr.Slug}
+		}
+		return err
+	}
+
+	notes := cookNotesUser(SetSegmentsUserInput{UserID: sourceID, SegmentsDel: sourceSegments}, sourceSegments)
+	notes = append(notes, cookNotesUser(SetSegmentsUserInput{UserID: targetID, SegmentsAdd: moved}, targetSegments)...)
+	return u.historyRepo.AddNotes(ctx, notes)
+}
+
+// deleteReports removes reports of the tenant with records of the user or of the users merged into it.
+// Reports are written from the history, so they are removed in both erasure modes.
+func (u *UserService) deleteReports(ctx context.Context, userID string) error {
+	aliases, err := u.userRepo.GetAliases(ctx, userID)
+	if err != nil {
+		return err
+	}
+	usersID := append([]string{userID}, aliases...)
+
+	_, err = u.csvWriter.DeleteCSVFiles(reportDir(ctx), func(header, record []string) bool {
+		for i, column := range header {
+			if column == reportUserColumn && i < len(record) && contains(usersID, record[i]) {
+				return true
+			}
+		}
+		return false
+	})
+	return err
+}
+
+// resolveUser returns the id of the user the given id was merged into, or the id itself
+func resolveUser(ctx context.Context, userRepo repo.User, userID string) (string, error) {
+	aliases, err := userRepo.ResolveUsers(ctx, []string{userID})
+	if err != nil {
+		return "", err
+	}
+	if resolved, ok := aliases[userID]; ok {
+		return resolved, nil
+	}
+	return userID, nil
+}
+
+// newPseudonym hashes user_id with a random key that is discarded right away, so it cannot be reversed or recomputed
+func newPseudonym(userID string) (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(userID))
+	return "erased_" + hex.EncodeToString(mac.Sum(nil))[:32], nil
+}
+
+// checkPrerequisites validates the resulting memberships of the user against segment prerequisites.
+// It returns dependent segments that have to be removed along with their prerequisites.
+func (u *UserService) checkPrerequisites(ctx context.Context, input SetSegmentsUserInput, activeSegments []string) ([]string, error) {
+	prerequisites, err := u.segmentRepo.GetPrerequisites(ctx)
+	if err != nil {
 		return nil, err
 	}
-	return segments, nil
+	if len(prerequisites) == 0 {
+		return nil, nil
+	}
+
+	memberships := make(map[string]bool, len(activeSegments)+len(input.SegmentsAdd))
+	for _, segment := range activeSegments {
+		memberships[segment] = true
+	}
+	for _, segment := range input.SegmentsAdd {
+		memberships[segment] = true
+	}
+	for _, segment := range input.SegmentsDel {
+		delete(memberships, segment)
+	}
+
+	for _, segment := range input.SegmentsAdd {
+		for _, prerequisite := range prerequisites[segment] {
+			if !memberships[prerequisite] {
+				return nil, &PrerequisiteError{Slug: segment, Prerequisite: prerequisite}
+			}
+		}
+	}
+
+	// removing a dependent may in turn orphan its own dependents
+	cascaded := make([]string, 0)
+	for changed := true; changed; {
+		changed = false
+		for _, segment := range activeSegments {
+			if !memberships[segment] {
+				continue
+			}
+			for _, prerequisite := range prerequisites[segment] {
+				if memberships[prerequisite] {
+					continue
+				}
+				if !input.Cascade {
+					return nil, &DependentError{Slug: prerequisite, Dependent: segment}
+				}
+				delete(memberships, segment)
+				cascaded = append(cascaded, segment)
+				changed = true
+				break
+			}
+		}
+	}
+	return cascaded, nil
+}
+
+// resolveAliases replaces former slugs of renamed segments with the current ones
+func (u *UserService) resolveAliases(ctx context.Context, input SetSegmentsUserInput) (SetSegmentsUserInput, error) {
+	slugs := make([]string, 0, len(input.SegmentsAdd)+len(input.SegmentsDel))
+	slugs = append(append(slugs, input.SegmentsAdd...), input.SegmentsDel...)
+	if len(slugs) == 0 {
+		return input, nil
+	}
+
+	aliases, err := u.segmentRepo.ResolveAliases(ctx, slugs)
+	if err != nil {
+		return input, err
+	}
+	if len(aliases) == 0 {
+		return input, nil
+	}
+
+	input.SegmentsAdd = replaceAliases(input.SegmentsAdd, aliases)
+	input.SegmentsDel = replaceAliases(input.SegmentsDel, aliases)
+	return input, nil
+}
+
+func replaceAliases(segments []string, aliases map[string]string) []string {
+	resolved := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		if slug, ok := aliases[segment]; ok {
+			segment = slug
+		}
+		resolved = append(resolved, segment)
+	}
+	return resolved
 }
 
 func cookNotesUser(input SetSegmentsUserInput, activeSegments []string) []entity.History {
@@ -0,0 +1,328 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/repo"
+	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
+	"github.com/passionde/user-segmentation-service/pkg/csvwriter"
+	"reflect"
+	"testing"
+)
+
+type fakeUserRepo struct {
+	repo.User
+	memberships []string
+	segmentsDel []string
+	// created makes LockUser report a new user, which gets the enrolled segments
+	created  bool
+	enrolled []string
+}
+
+func (f *fakeUserRepo) ResolveUsers(context.Context, []string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (f *fakeUserRepo) LockUser(context.Context, string) (bool, error) {
+	return f.created, nil
+}
+
+func (f *fakeUserRepo) AutoEnroll(context.Context, string, []string) ([]string, error) {
+	return f.enrolled, nil
+}
+
+func (f *fakeUserRepo) GetMemberships(context.Context, string) ([]string, error) {
+	return f.memberships, nil
+}
+
+func (f *fakeUserRepo) SetSegments(_ context.Context, _ string, _, segmentsDel []string, _ *int64) ([]string, error) {
+	f.segmentsDel = segmentsDel
+	return nil, nil
+}
+
+// fakeTransactor runs functions without a transaction
+type fakeTransactor struct{}
+
+func (fakeTransactor) WithinTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+func (fakeTransactor) RollbackAfter(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+type fakeSegmentRepo struct {
+	repo.Segment
+	prerequisites map[string][]string
+}
+
+func (f *fakeSegmentRepo) ResolveAliases(context.Context, []string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (f *fakeSegmentRepo) GetPrerequisites(context.Context) (map[string][]string, error) {
+	return f.prerequisites, nil
+}
+
+type fakeHistoryRepo struct {
+	repo.History
+	notes []entity.History
+}
+
+func (f *fakeHistoryRepo) AddNotes(_ context.Context, notes []entity.History) error {
+	f.notes = append(f.notes, notes...)
+	return nil
+}
+
+func TestSetSegmentsCascadeKeepsInput(t *testing.T) {
+	userRepo := &fakeUserRepo{memberships: []string{"BASE", "PREMIUM"}}
+	segmentRepo := &fakeSegmentRepo{prerequisites: map[string][]string{"PREMIUM": {"BASE"}}}
+	historyRepo := &fakeHistoryRepo{}
+	userService := NewUserService(userRepo, segmentRepo, historyRepo, nil, fakeTransactor{}, nil, HistoryPolicyKeep)
+
+	// spare capacity of the caller's array must not receive cascaded segments
+	segmentsDel := make([]string, 1, 4)
+	segmentsDel[0] = "BASE"
+	err := userService.SetSegments(context.Background(), SetSegmentsUserInput{
+		UserID:      "1000",
+		SegmentsAdd: []string{},
+		SegmentsDel: segmentsDel,
+		Cascade:     true,
+	})
+	if err != nil {
+		t.Fatalf("SetSegments() error = %v", err)
+	}
+
+	if got := segmentsDel[:2]; !reflect.DeepEqual(got, []string{"BASE", ""}) {
+		t.Errorf("caller's segments = %v, want [BASE ]", got)
+	}
+	if !reflect.DeepEqual(userRepo.segmentsDel, []string{"BASE", "PREMIUM"}) {
+		t.Errorf("removed segments = %v, want [BASE PREMIUM]", userRepo.segmentsDel)
+	}
+	want := []entity.History{
+		{UserID: "1000", SegmentSlug: "BASE", Type: entity.OperationTypeDelete},
+		{UserID: "1000", SegmentSlug: "PREMIUM", Type: entity.OperationTypeDeleteCascade},
+	}
+	if !reflect.DeepEqual(historyRepo.notes, want) {
+		t.Errorf("history = %+v, want %+v", historyRepo.notes, want)
+	}
+}
+
+func TestSetSegmentsNewUser(t *testing.T) {
+	anyVersion := entity.AnyVersion
+
+	tests := []struct {
+		name      string
+		ifVersion *int64
+		wantErr   error
+		wantNotes []entity.History
+	}{
+		{
+			name: "auto-enrolled",
+			wantNotes: []entity.History{
+				{UserID: "1000", SegmentSlug: "BASE", Type: entity.OperationTypeAdd},
+				{UserID: "1000", SegmentSlug: "AUTO", Type: entity.OperationTypeAutoAdd},
+			},
+		},
+		{
+			name:      "version of a missing user",
+			ifVersion: &anyVersion,
+			wantErr:   ErrVersionMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userRepo := &fakeUserRepo{memberships: []string{}, created: true, enrolled: []string{"AUTO"}}
+			historyRepo := &fakeHistoryRepo{}
+			userService := NewUserService(userRepo, &fakeSegmentRepo{}, historyRepo, nil, fakeTransactor{}, nil, HistoryPolicyKeep)
+
+			err := userService.SetSegments(context.Background(), SetSegmentsUserInput{
+				UserID:      "1000",
+				SegmentsAdd: []string{"BASE"},
+				SegmentsDel: []string{},
+				IfVersion:   tt.ifVersion,
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SetSegments() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(historyRepo.notes, tt.wantNotes) {
+				t.Errorf("history = %+v, want %+v", historyRepo.notes, tt.wantNotes)
+			}
+		})
+	}
+}
+
+// fakeMergeUserRepo keeps memberships of existing users and fails the merge with mergeErr
+type fakeMergeUserRepo struct {
+	repo.User
+	memberships map[string][]string
+	mergeErr    error
+	locked      []string
+	merged      bool
+}
+
+func (f *fakeMergeUserRepo) ResolveUsers(context.Context, []string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (f *fakeMergeUserRepo) LockUser(_ context.Context, userID string) (bool, error) {
+	f.locked = append(f.locked, userID)
+	_, ok := f.memberships[userID]
+	return !ok, nil
+}
+
+func (f *fakeMergeUserRepo) GetMemberships(_ context.Context, userID string) ([]string, error) {
+	return f.memberships[userID], nil
+}
+
+func (f *fakeMergeUserRepo) MergeUsers(context.Context, string, string) error {
+	if f.mergeErr != nil {
+		return f.mergeErr
+	}
+	f.merged = true
+	return nil
+}
+
+func TestMergeUsers(t *testing.T) {
+	prerequisites := map[string][]string{"PREMIUM": {"BASE"}}
+
+	tests := []struct {
+		name        string
+		memberships map[string][]string
+		mergeErr    error
+		wantErr     error
+		wantNotes   []entity.History
+	}{
+		{
+			name:        "memberships are united",
+			memberships: map[string][]string{"b_source": {"BASE", "PREMIUM"}, "a_target": {}},
+			wantNotes: []entity.History{
+				{UserID: "b_source", SegmentSlug: "BASE", Type: entity.OperationTypeDelete},
+				{UserID: "b_source", SegmentSlug: "PREMIUM", Type: entity.OperationTypeDelete},
+				{UserID: "a_target", SegmentSlug: "BASE", Type: entity.OperationTypeAdd},
+				{UserID: "a_target", SegmentSlug: "PREMIUM", Type: entity.OperationTypeAdd},
+			},
+		},
+		{
+			name:        "prerequisite held by the target",
+			memberships: map[string][]string{"b_source": {"PREMIUM", "BASE"}, "a_target": {"BASE"}},
+			wantNotes: []entity.History{
+				{UserID: "b_source", SegmentSlug: "PREMIUM", Type: entity.OperationTypeDelete},
+				{UserID: "b_source", SegmentSlug: "BASE", Type: entity.OperationTypeDelete},
+				{UserID: "a_target", SegmentSlug: "PREMIUM", Type: entity.OperationTypeAdd},
+			},
+		},
+		{
+			name:        "prerequisite of a moved segment is missing",
+			memberships: map[string][]string{"b_source": {"PREMIUM"}, "a_target": {"OTHER"}},
+			wantErr:     ErrPrerequisiteMissing,
+		},
+		{
+			name:        "moved segment is full",
+			memberships: map[string][]string{"b_source": {"LIMITED"}, "a_target": {}},
+			mergeErr:    &repoerrs.SegmentFullError{Slug: "LIMITED"},
+			wantErr:     ErrSegmentCapacity,
+		},
+		{
+			name:        "source user does not exist",
+			memberships: map[string][]string{"a_target": {}},
+			wantErr:     ErrUserNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userRepo := &fakeMergeUserRepo{memberships: tt.memberships, mergeErr: tt.mergeErr}
+			segmentRepo := &fakeSegmentRepo{prerequisites: prerequisites}
+			historyRepo := &fakeHistoryRepo{}
+			userService := NewUserService(userRepo, segmentRepo, historyRepo, nil, fakeTransactor{}, nil, HistoryPolicyKeep)
+
+			err := userService.MergeUsers(context.Background(), MergeUsersInput{SourceID: "b_source", TargetID: "a_target"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("MergeUsers() error = %v, want %v", err, tt.wantErr)
+			}
+			if userRepo.merged != (tt.wantErr == nil) {
+				t.Errorf("merged = %v, want %v", userRepo.merged, tt.wantErr == nil)
+			}
+			if !reflect.DeepEqual(userRepo.locked, []string{"a_target", "b_source"}) {
+				t.Errorf("locked = %v, want the users in the order of their ids", userRepo.locked)
+			}
+			if !reflect.DeepEqual(historyRepo.notes, tt.wantNotes) {
+				t.Errorf("history = %+v, want %+v", historyRepo.notes, tt.wantNotes)
+			}
+		})
+	}
+}
+
+// fakeEraseUserRepo knows the aliases of the user and records the erased one
+type fakeEraseUserRepo struct {
+	repo.User
+	aliases []string
+	erased  string
+}
+
+func (f *fakeEraseUserRepo) ResolveUsers(context.Context, []string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (f *fakeEraseUserRepo) GetAliases(context.Context, string) ([]string, error) {
+	return f.aliases, nil
+}
+
+func (f *fakeEraseUserRepo) EraseUser(_ context.Context, userID, _ string) (entity.ErasureAudit, error) {
+	f.erased = userID
+	return entity.ErasureAudit{Mode: entity.ErasureModeDelete}, nil
+}
+
+func TestEraseUserReports(t *testing.T) {
+	reports := csvwriter.NewCsvWriter(t.TempDir())
+	tenant1 := WithTenant(context.Background(), 1)
+	tenant2 := WithTenant(context.Background(), 2)
+
+	report := func(ctx context.Context, notes ...entity.History) string {
+		reportID, err := NewHistoryService(&fakeHistoryRepo{notes: notes}, &fakeUserRepo{}, reports).
+			GetNotes(ctx, GetHistoryInput{UserID: notes[0].UserID, Year: 2023, Month: 8})
+		if err != nil {
+			t.Fatalf("GetNotes() error = %v", err)
+		}
+		return reportID
+	}
+	note := func(userID string) entity.History {
+		return entity.History{UserID: userID, SegmentSlug: "1000", Type: entity.OperationTypeAdd}
+	}
+
+	erased := []string{
+		report(tenant1, note("1000")),
+		report(tenant1, note("merged"), note("1000")),
+	}
+	kept := map[context.Context]string{
+		tenant1: report(tenant1, note("2000")),
+		tenant2: report(tenant2, note("1000")),
+	}
+
+	userRepo := &fakeEraseUserRepo{aliases: []string{"merged"}}
+	userService := NewUserService(userRepo, nil, nil, nil, nil, reports, HistoryPolicyKeep)
+	if _, err := userService.EraseUser(tenant1, EraseUserInput{UserID: "1000", Mode: entity.ErasureModeDelete}); err != nil {
+		t.Fatalf("EraseUser() error = %v", err)
+	}
+	if userRepo.erased != "1000" {
+		t.Errorf("erased = %q, want 1000", userRepo.erased)
+	}
+
+	historyService := NewHistoryService(nil, nil, reports)
+	for _, reportID := range erased {
+		if _, err := historyService.GetReport(tenant1, reportID); !errors.Is(err, ErrReportNotFound) {
+			t.Errorf("GetReport() of an erased user error = %v, want %v", err, ErrReportNotFound)
+		}
+	}
+	for ctx, reportID := range kept {
+		file, err := historyService.GetReport(ctx, reportID)
+		if err != nil {
+			t.Errorf("GetReport() of another user or tenant error = %v", err)
+			continue
+		}
+		_ = file.Close()
+	}
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/repo"
+	"github.com/passionde/user-segmentation-service/internal/repo/repoerrs"
+	"github.com/passionde/user-segmentation-service/pkg/webhook"
+	"strconv"
+	"time"
+)
+
+const (
+	// deliveryBatch is the number of deliveries claimed at once, they are sent one by one
+	deliveryBatch = 20
+	// maxDeliveryBackoff caps the doubling of the retry delay
+	maxDeliveryBackoff = time.Hour
+)
+
+type WebhookService struct {
+	webhookRepo repo.Webhook
+	sender      webhook.Sender
+	options     WebhookOptions
+}
+
+func NewWebhookService(webhookRepo repo.Webhook, sender webhook.Sender, options WebhookOptions) *WebhookService {
+	return &WebhookService{
+		webhookRepo: webhookRepo,
+		sender:      sender,
+		options:     options,
+	}
+}
+
+// webhookPayload is the body of a delivery, Event is the history operation type
+type webhookPayload struct {
+	DeliveryID int64     `json:"delivery_id"`
+	WebhookID  int       `json:"webhook_id"`
+	Event      string    `json:"event"`
+	UserID     string    `json:"user_id"`
+	Segment    string    `json:"segment"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (w *WebhookService) CreateWebhook(ctx context.Context, input CreateWebhookInput) (int, error) {
+	if !validWebhookEvents(input.Events) {
+		return 0, ErrInvalidWebhookEvent
+	}
+	if err := checkWebhookAccess(ctx, input.Segments); err != nil {
+		return 0, err
+	}
+
+	if input.Segments == nil {
+		input.Segments = make([]string, 0)
+	}
+	if input.Events == nil {
+		input.Events = make([]string, 0)
+	}
+
+	return w.webhookRepo.CreateWebhook(ctx, entity.Webhook{
+		URL:      input.URL,
+		Secret:   input.Secret,
+		Segments: input.Segments,
+		Events:   input.Events,
+	})
+}
+
+// ListWebhooks returns the webhooks whose events the key may see
+func (w *WebhookService) ListWebhooks(ctx context.Context) ([]entity.Webhook, error) {
+	webhooks, err := w.webhookRepo.ListWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make([]entity.Webhook, 0, len(webhooks))
+	for _, hook := range webhooks {
+		if checkWebhookAccess(ctx, hook.Segments) == nil {
+			visible = append(visible, hook)
+		}
+	}
+	return visible, nil
+}
+
+func (w *WebhookService) DeleteWebhook(ctx context.Context, input WebhookInput) error {
+	if _, err := w.getWebhook(ctx, input.WebhookID); err != nil {
+		return err
+	}
+
+	err := w.webhookRepo.DeleteWebhook(ctx, input.WebhookID)
+	if errors.Is(err, repoerrs.ErrNotFound) {
+		return ErrWebhookNotFound
+	}
+	return err
+}
+
+func (w *WebhookService) GetDeliveries(ctx context.Context, input GetDeliveriesInput) ([]entity.WebhookDelivery, error) {
+	if _, err := w.getWebhook(ctx, input.WebhookID); err != nil {
+		return nil, err
+	}
+	return w.webhookRepo.GetDeliveries(ctx, input.WebhookID, input.Limit, input.Offset)
+}
+
+// getWebhook returns the webhook if the key may see its events
+func (w *WebhookService) getWebhook(ctx context.Context, webhookID int) (entity.Webhook, error) {
+	hook, err := w.webhookRepo.GetWebhook(ctx, webhookID)
+	if err != nil {
+		if errors.Is(err, repoerrs.ErrNotFound) {
+			return entity.Webhook{}, ErrWebhookNotFound
+		}
+		return entity.Webhook{}, err
+	}
+	if err = checkWebhookAccess(ctx, hook.Segments); err != nil {
+		return entity.Webhook{}, err
+	}
+	return hook, nil
+}
+
+// SendDeliveries sends a batch of due deliveries and returns their number.
+// Deliveries are sent at least once: a delivery is sent again if its result could not be recorded.
+func (w *WebhookService) SendDeliveries(ctx context.Context) (int, error) {
+	lease := w.options.Timeout * (deliveryBatch + 1)
+	deliveries, err := w.webhookRepo.ClaimDeliveries(ctx, deliveryBatch, lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, outgoing := range deliveries {
+		delivery, retryIn := w.send(ctx, outgoing)
+		if err = w.webhookRepo.UpdateDelivery(ctx, delivery, retryIn); err != nil {
+			return 0, err
+		}
+	}
+	return len(deliveries), nil
+}
+
+// send makes an attempt and returns the delivery with its result and the delay before the next attempt
+func (w *WebhookService) send(ctx context.Context, outgoing entity.OutgoingDelivery) (entity.WebhookDelivery, time.Duration) {
+	delivery := outgoing.WebhookDelivery
+	delivery.Attempts++
+	delivery.ResponseStatus, delivery.LastError = nil, nil
+
+	body, _ := json.Marshal(webhookPayload{
+		DeliveryID: delivery.DeliveryID,
+		WebhookID:  delivery.WebhookID,
+		Event:      delivery.Event,
+		UserID:     delivery.UserID,
+		Segment:    delivery.SegmentSlug,
+		CreatedAt:  delivery.CreatedAt,
+	})
+
+	sendCtx, cancel := context.WithTimeout(ctx, w.options.Timeout)
+	defer cancel()
+	status, err := w.sender.Send(sendCtx, outgoing.URL, outgoing.Secret, strconv.FormatInt(delivery.DeliveryID, 10), body)
+	if status != 0 {
+		delivery.ResponseStatus = &status
+	}
+
+	if err == nil {
+		delivery.Status = entity.DeliveryStatusDelivered
+		return delivery, 0
+	}
+	message := err.Error()
+	delivery.LastError = &message
+	if delivery.Attempts >= w.options.MaxAttempts {
+		delivery.Status = entity.DeliveryStatusFailed
+		return delivery, 0
+	}
+	delivery.Status = entity.DeliveryStatusPending
+	return delivery, deliveryBackoff(w.options.Backoff, delivery.Attempts)
+}
+
+func (w *WebhookService) PurgeDeliveries(ctx context.Context, retention time.Duration) (int64, error) {
+	return w.webhookRepo.PurgeDeliveries(ctx, retention)
+}
+
+// deliveryBackoff doubles the delay with every attempt made
+func deliveryBackoff(backoff time.Duration, attempts int) time.Duration {
+	delay := backoff
+	for i := 1; i < attempts && delay < maxDeliveryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxDeliveryBackoff {
+		return maxDeliveryBackoff
+	}
+	return delay
+}
+
+// checkWebhookAccess requires read access to the segments of the filter, a webhook without a filter receives
+// events of every segment
+func checkWebhookAccess(ctx context.Context, segments []string) error {
+	if len(segments) == 0 {
+		return checkReadAll(ctx)
+	}
+	return checkRead(ctx, segments...)
+}
+
+func validWebhookEvents(events []string) bool {
+	for _, event := range events {
+		known := false
+		for _, e := range entity.WebhookEvents {
+			if event == e {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return false
+		}
+	}
+	return true
+}
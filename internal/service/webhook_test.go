@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/passionde/user-segmentation-service/internal/entity"
+	"github.com/passionde/user-segmentation-service/internal/repo"
+	"testing"
+	"time"
+)
+
+// fakeWebhookRepo hands out the deliveries once and records their results
+type fakeWebhookRepo struct {
+	repo.Webhook
+	deliveries []entity.OutgoingDelivery
+	updated    []entity.WebhookDelivery
+	retryIn    []time.Duration
+}
+
+func (f *fakeWebhookRepo) ClaimDeliveries(context.Context, uint64, time.Duration) ([]entity.OutgoingDelivery, error) {
+	deliveries := f.deliveries
+	f.deliveries = nil
+	return deliveries, nil
+}
+
+func (f *fakeWebhookRepo) UpdateDelivery(_ context.Context, delivery entity.WebhookDelivery, retryIn time.Duration) error {
+	f.updated = append(f.updated, delivery)
+	f.retryIn = append(f.retryIn, retryIn)
+	return nil
+}
+
+// fakeSender replies with the status, statuses other than 2xx fail as in webhook.HTTPSender
+type fakeSender struct {
+	status int
+	err    error
+	id     string
+	body   []byte
+}
+
+func (f *fakeSender) Send(_ context.Context, _, _, id string, body []byte) (int, error) {
+	f.id, f.body = id, body
+	if f.err == nil && (f.status < 200 || f.status > 299) {
+		return f.status, errors.New("unexpected status")
+	}
+	return f.status, f.err
+}
+
+func TestSendDeliveries(t *testing.T) {
+	options := WebhookOptions{Timeout: time.Second, MaxAttempts: 3, Backoff: 10 * time.Second}
+
+	tests := []struct {
+		name        string
+		attempts    int
+		sender      *fakeSender
+		wantStatus  string
+		wantRetryIn time.Duration
+		wantCode    int
+		wantError   bool
+	}{
+		{name: "delivered", sender: &fakeSender{status: 204},
+			wantStatus: entity.DeliveryStatusDelivered, wantCode: 204},
+		{name: "server error is retried", sender: &fakeSender{status: 503},
+			wantStatus: entity.DeliveryStatusPending, wantRetryIn: 10 * time.Second, wantCode: 503, wantError: true},
+		{name: "backoff doubles", attempts: 1, sender: &fakeSender{status: 500},
+			wantStatus: entity.DeliveryStatusPending, wantRetryIn: 20 * time.Second, wantCode: 500, wantError: true},
+		{name: "connection error is retried", attempts: 1, sender: &fakeSender{err: errors.New("connection refused")},
+			wantStatus: entity.DeliveryStatusPending, wantRetryIn: 20 * time.Second, wantError: true},
+		{name: "failed after max attempts", attempts: 2, sender: &fakeSender{status: 500},
+			wantStatus: entity.DeliveryStatusFailed, wantCode: 500, wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previousError := "timeout"
+			webhookRepo := &fakeWebhookRepo{deliveries: []entity.OutgoingDelivery{{
+				WebhookDelivery: entity.WebhookDelivery{DeliveryID: 42, WebhookID: 1, Event: entity.OperationTypeAdd,
+					UserID: "1000", SegmentSlug: "checkout/AVITO_VOICE_MESSAGES", Status: entity.DeliveryStatusPending,
+					Attempts: tt.attempts, LastError: &previousError},
+				URL:    "https://example.com/hooks",
+				Secret: "0123456789abcdef",
+			}}}
+			webhookService := NewWebhookService(webhookRepo, tt.sender, options)
+
+			count, err := webhookService.SendDeliveries(context.Background())
+			if err != nil || count != 1 {
+				t.Fatalf("SendDeliveries() = %d, %v, want 1", count, err)
+			}
+
+			got := webhookRepo.updated[0]
+			if got.Status != tt.wantStatus || got.Attempts != tt.attempts+1 || webhookRepo.retryIn[0] != tt.wantRetryIn {
+				t.Errorf("delivery = %s after %d attempts retried in %v, want %s after %d retried in %v",
+					got.Status, got.Attempts, webhookRepo.retryIn[0], tt.wantStatus, tt.attempts+1, tt.wantRetryIn)
+			}
+			if code := got.ResponseStatus; (code == nil) != (tt.wantCode == 0) || (code != nil && *code != tt.wantCode) {
+				t.Errorf("response status = %v, want %d", code, tt.wantCode)
+			}
+			if (got.LastError != nil) != tt.wantError {
+				t.Errorf("last error = %v, want error %v", got.LastError, tt.wantError)
+			}
+
+			var payload webhookPayload
+			if err = json.Unmarshal(tt.sender.body, &payload); err != nil || tt.sender.id != "42" ||
+				payload.DeliveryID != 42 || payload.Segment != "checkout/AVITO_VOICE_MESSAGES" {
+				t.Errorf("sent %s with id %q, %v", tt.sender.body, tt.sender.id, err)
+			}
+		})
+	}
+}
+
+func TestDeliveryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{4, 80 * time.Second},
+		{9, 2560 * time.Second},
+		{10, maxDeliveryBackoff},
+		{1000, maxDeliveryBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := deliveryBackoff(10*time.Second, tt.attempts); got != tt.want {
+			t.Errorf("deliveryBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
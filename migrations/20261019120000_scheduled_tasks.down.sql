@@ -0,0 +1,3 @@
+drop index if exists tasks_delete_pending_idx;
+
+alter table tasks_delete drop column if exists operation;
@@ -0,0 +1,3 @@
+ALTER TABLE tasks_delete ADD COLUMN operation VARCHAR(15) NOT NULL DEFAULT 'delete';
+
+CREATE INDEX tasks_delete_pending_idx ON tasks_delete (deadline) WHERE done = false;
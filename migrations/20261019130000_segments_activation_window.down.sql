@@ -0,0 +1,3 @@
+alter table segments drop column if exists active_from;
+
+alter table segments drop column if exists active_until;
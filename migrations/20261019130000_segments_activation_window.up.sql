@@ -0,0 +1,3 @@
+ALTER TABLE segments ADD COLUMN active_from TIMESTAMP;
+
+ALTER TABLE segments ADD COLUMN active_until TIMESTAMP;
@@ -0,0 +1 @@
+ALTER TABLE segments ADD COLUMN archived_at TIMESTAMP;
@@ -0,0 +1,5 @@
+CREATE TABLE segment_aliases (
+    alias VARCHAR PRIMARY KEY,
+    segment_slug VARCHAR REFERENCES segments(slug) ON DELETE CASCADE,
+    expires_at TIMESTAMP not null
+);
@@ -0,0 +1 @@
+ALTER TABLE segments ADD COLUMN expression JSONB;
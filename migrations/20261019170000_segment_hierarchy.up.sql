@@ -0,0 +1,6 @@
+CREATE TABLE segment_hierarchy (
+    parent_slug VARCHAR REFERENCES segments(slug) ON DELETE CASCADE,
+    child_slug VARCHAR REFERENCES segments(slug) ON DELETE CASCADE,
+    inheritance VARCHAR(10) not null,
+    PRIMARY KEY (parent_slug, child_slug)
+);
@@ -0,0 +1 @@
+alter table segments drop column if exists max_members;
@@ -0,0 +1 @@
+ALTER TABLE segments ADD COLUMN max_members INT CHECK (max_members >= 0);
@@ -0,0 +1,5 @@
+CREATE TABLE segment_prerequisites (
+    segment_slug VARCHAR REFERENCES segments(slug) ON DELETE CASCADE,
+    prerequisite_slug VARCHAR REFERENCES segments(slug) ON DELETE CASCADE,
+    PRIMARY KEY (segment_slug, prerequisite_slug)
+);
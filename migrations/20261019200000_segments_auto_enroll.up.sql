@@ -0,0 +1 @@
+ALTER TABLE segments ADD COLUMN auto_enroll INT CHECK (auto_enroll BETWEEN 1 AND 10000);
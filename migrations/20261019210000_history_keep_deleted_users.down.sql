@@ -0,0 +1,2 @@
+delete from history where user_id not in (select user_id from users);
+alter table history add constraint history_user_id_fkey foreign key (user_id) references users(user_id);
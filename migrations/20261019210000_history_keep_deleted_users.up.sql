@@ -0,0 +1 @@
+ALTER TABLE history DROP CONSTRAINT IF EXISTS history_user_id_fkey;
@@ -0,0 +1,8 @@
+CREATE TABLE erasure_audit (
+    audit_id SERIAL PRIMARY KEY,
+    mode VARCHAR(15) not null,
+    memberships INT not null,
+    tasks INT not null,
+    history_records INT not null,
+    created_at TIMESTAMP not null default now()
+);
@@ -0,0 +1,7 @@
+CREATE TABLE user_aliases (
+    alias VARCHAR(40) PRIMARY KEY,
+    user_id VARCHAR(40) not null REFERENCES users(user_id) ON DELETE CASCADE,
+    created_at TIMESTAMP not null default now()
+);
+
+CREATE INDEX user_aliases_user_id_idx ON user_aliases (user_id);
@@ -0,0 +1,12 @@
+CREATE TABLE idempotency_keys (
+    key_id INT REFERENCES api_keys(id) ON DELETE CASCADE,
+    idempotency_key VARCHAR(255),
+    request_hash VARCHAR(64) not null,
+    status INT,
+    content_type VARCHAR,
+    body BYTEA,
+    created_at TIMESTAMP not null default now(),
+    PRIMARY KEY (key_id, idempotency_key)
+);
+
+CREATE INDEX idempotency_keys_created_at_idx ON idempotency_keys (created_at);
@@ -0,0 +1,3 @@
+drop trigger if exists user_segments_bump_version on user_segments;
+drop function if exists bump_user_version();
+alter table users drop column if exists version;
@@ -0,0 +1,17 @@
+ALTER TABLE users ADD COLUMN version BIGINT not null default 0;
+
+CREATE FUNCTION bump_user_version() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        UPDATE users SET version = version + 1 WHERE user_id = NEW.user_id;
+    END IF;
+    IF TG_OP = 'DELETE' OR (TG_OP = 'UPDATE' AND OLD.user_id <> NEW.user_id) THEN
+        UPDATE users SET version = version + 1 WHERE user_id = OLD.user_id;
+    END IF;
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER user_segments_bump_version
+    AFTER INSERT OR UPDATE OR DELETE ON user_segments
+    FOR EACH ROW EXECUTE FUNCTION bump_user_version();
@@ -0,0 +1,4 @@
+ALTER TABLE api_keys ADD COLUMN scopes TEXT[] not null default '{}';
+
+-- keys issued before scopes existed had full access
+UPDATE api_keys SET scopes = '{admin}';
@@ -0,0 +1,6 @@
+alter table api_keys
+    drop column if exists label,
+    drop column if exists created_at,
+    drop column if exists expires_at,
+    drop column if exists revoked_at,
+    drop column if exists last_used_at;
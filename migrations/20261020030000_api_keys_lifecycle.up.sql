@@ -0,0 +1,6 @@
+ALTER TABLE api_keys
+    ADD COLUMN label VARCHAR(255) not null default '',
+    ADD COLUMN created_at TIMESTAMP not null default now(),
+    ADD COLUMN expires_at TIMESTAMP,
+    ADD COLUMN revoked_at TIMESTAMP,
+    ADD COLUMN last_used_at TIMESTAMP;
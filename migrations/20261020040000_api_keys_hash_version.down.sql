@@ -0,0 +1,4 @@
+drop index if exists api_keys_hash_key_idx;
+alter table api_keys
+    drop column if exists hash_version,
+    drop column if exists key_prefix;
@@ -0,0 +1,6 @@
+-- existing keys are hashed with the legacy sha1 scheme and are rehashed on their next use
+ALTER TABLE api_keys
+    ADD COLUMN hash_version INT not null default 1,
+    ADD COLUMN key_prefix VARCHAR(16) not null default '';
+
+CREATE INDEX api_keys_hash_key_idx ON api_keys (hash_key);
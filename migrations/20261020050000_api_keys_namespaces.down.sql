@@ -0,0 +1,3 @@
+alter table api_keys
+    drop column if exists read_namespaces,
+    drop column if exists write_namespaces;
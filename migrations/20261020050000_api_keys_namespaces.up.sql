@@ -0,0 +1,4 @@
+-- keys issued before namespaces existed have access to every namespace
+ALTER TABLE api_keys
+    ADD COLUMN read_namespaces TEXT[] not null default '{*}',
+    ADD COLUMN write_namespaces TEXT[] not null default '{*}';
@@ -0,0 +1,55 @@
+CREATE OR REPLACE FUNCTION bump_user_version() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        UPDATE users SET version = version + 1 WHERE user_id = NEW.user_id;
+    END IF;
+    IF TG_OP = 'DELETE' OR (TG_OP = 'UPDATE' AND OLD.user_id <> NEW.user_id) THEN
+        UPDATE users SET version = version + 1 WHERE user_id = OLD.user_id;
+    END IF;
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+-- only the default tenant can be kept, data of the other tenants would collide on the old keys
+DO $$
+DECLARE
+    t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['user_aliases', 'segment_prerequisites', 'segment_hierarchy', 'segment_aliases',
+        'tasks_delete', 'history', 'user_segments', 'erasure_audit', 'segments', 'users']
+    LOOP
+        EXECUTE format('DROP POLICY tenant_isolation ON %I', t);
+        EXECUTE format('ALTER TABLE %I NO FORCE ROW LEVEL SECURITY', t);
+        EXECUTE format('ALTER TABLE %I DISABLE ROW LEVEL SECURITY', t);
+        EXECUTE format('DELETE FROM %I WHERE tenant_id <> 1', t);
+        EXECUTE format('ALTER TABLE %I DROP COLUMN tenant_id CASCADE', t);
+    END LOOP;
+END
+$$;
+
+ALTER TABLE users ADD PRIMARY KEY (user_id);
+ALTER TABLE segments ADD PRIMARY KEY (slug);
+ALTER TABLE user_segments ADD PRIMARY KEY (user_id, segment_slug);
+ALTER TABLE segment_aliases ADD PRIMARY KEY (alias);
+ALTER TABLE segment_hierarchy ADD PRIMARY KEY (parent_slug, child_slug);
+ALTER TABLE segment_prerequisites ADD PRIMARY KEY (segment_slug, prerequisite_slug);
+ALTER TABLE user_aliases ADD PRIMARY KEY (alias);
+
+ALTER TABLE user_segments
+    ADD FOREIGN KEY (user_id) REFERENCES users(user_id),
+    ADD FOREIGN KEY (segment_slug) REFERENCES segments(slug) ON DELETE CASCADE;
+ALTER TABLE tasks_delete ADD FOREIGN KEY (user_id) REFERENCES users(user_id);
+ALTER TABLE segment_aliases ADD FOREIGN KEY (segment_slug) REFERENCES segments(slug) ON DELETE CASCADE;
+ALTER TABLE segment_hierarchy
+    ADD FOREIGN KEY (parent_slug) REFERENCES segments(slug) ON DELETE CASCADE,
+    ADD FOREIGN KEY (child_slug) REFERENCES segments(slug) ON DELETE CASCADE;
+ALTER TABLE segment_prerequisites
+    ADD FOREIGN KEY (segment_slug) REFERENCES segments(slug) ON DELETE CASCADE,
+    ADD FOREIGN KEY (prerequisite_slug) REFERENCES segments(slug) ON DELETE CASCADE;
+ALTER TABLE user_aliases ADD FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE;
+
+CREATE INDEX user_aliases_user_id_idx ON user_aliases (user_id);
+
+ALTER TABLE api_keys DROP COLUMN tenant_id;
+
+DROP TABLE tenants;
@@ -0,0 +1,80 @@
+CREATE TABLE tenants (
+    tenant_id SERIAL PRIMARY KEY,
+    name VARCHAR(255) not null UNIQUE,
+    created_at TIMESTAMP not null default now()
+);
+
+-- data and keys created before tenants existed belong to the default tenant
+INSERT INTO tenants (name) VALUES ('default');
+
+ALTER TABLE api_keys ADD COLUMN tenant_id INT not null default 1 REFERENCES tenants(tenant_id);
+ALTER TABLE api_keys ALTER COLUMN tenant_id DROP DEFAULT;
+
+ALTER TABLE user_segments
+    DROP CONSTRAINT user_segments_user_id_fkey,
+    DROP CONSTRAINT user_segments_segment_slug_fkey;
+ALTER TABLE tasks_delete DROP CONSTRAINT tasks_delete_user_id_fkey;
+ALTER TABLE segment_aliases DROP CONSTRAINT segment_aliases_segment_slug_fkey;
+ALTER TABLE segment_hierarchy
+    DROP CONSTRAINT segment_hierarchy_parent_slug_fkey,
+    DROP CONSTRAINT segment_hierarchy_child_slug_fkey;
+ALTER TABLE segment_prerequisites
+    DROP CONSTRAINT segment_prerequisites_segment_slug_fkey,
+    DROP CONSTRAINT segment_prerequisites_prerequisite_slug_fkey;
+ALTER TABLE user_aliases DROP CONSTRAINT user_aliases_user_id_fkey;
+
+DO $$
+DECLARE
+    t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['users', 'segments', 'user_segments', 'history', 'tasks_delete', 'segment_aliases',
+        'segment_hierarchy', 'segment_prerequisites', 'erasure_audit', 'user_aliases']
+    LOOP
+        EXECUTE format('ALTER TABLE %I ADD COLUMN tenant_id INT not null default 1 REFERENCES tenants(tenant_id)', t);
+        -- new rows take the tenant of the connection, see app.tenant_id
+        EXECUTE format('ALTER TABLE %I ALTER COLUMN tenant_id SET DEFAULT NULLIF(current_setting(''app.tenant_id'', true), '''')::int', t);
+        EXECUTE format('ALTER TABLE %I ENABLE ROW LEVEL SECURITY', t);
+        EXECUTE format('ALTER TABLE %I FORCE ROW LEVEL SECURITY', t);
+        EXECUTE format('CREATE POLICY tenant_isolation ON %I '
+            'USING (tenant_id = NULLIF(current_setting(''app.tenant_id'', true), '''')::int) '
+            'WITH CHECK (tenant_id = NULLIF(current_setting(''app.tenant_id'', true), '''')::int)', t);
+    END LOOP;
+END
+$$;
+
+ALTER TABLE users DROP CONSTRAINT users_pkey, ADD PRIMARY KEY (tenant_id, user_id);
+ALTER TABLE segments DROP CONSTRAINT segments_pkey, ADD PRIMARY KEY (tenant_id, slug);
+ALTER TABLE user_segments DROP CONSTRAINT user_segments_pkey, ADD PRIMARY KEY (tenant_id, user_id, segment_slug);
+ALTER TABLE segment_aliases DROP CONSTRAINT segment_aliases_pkey, ADD PRIMARY KEY (tenant_id, alias);
+ALTER TABLE segment_hierarchy DROP CONSTRAINT segment_hierarchy_pkey, ADD PRIMARY KEY (tenant_id, parent_slug, child_slug);
+ALTER TABLE segment_prerequisites DROP CONSTRAINT segment_prerequisites_pkey,
+    ADD PRIMARY KEY (tenant_id, segment_slug, prerequisite_slug);
+ALTER TABLE user_aliases DROP CONSTRAINT user_aliases_pkey, ADD PRIMARY KEY (tenant_id, alias);
+
+ALTER TABLE user_segments
+    ADD FOREIGN KEY (tenant_id, user_id) REFERENCES users(tenant_id, user_id),
+    ADD FOREIGN KEY (tenant_id, segment_slug) REFERENCES segments(tenant_id, slug) ON DELETE CASCADE;
+ALTER TABLE tasks_delete ADD FOREIGN KEY (tenant_id, user_id) REFERENCES users(tenant_id, user_id);
+ALTER TABLE segment_aliases ADD FOREIGN KEY (tenant_id, segment_slug) REFERENCES segments(tenant_id, slug) ON DELETE CASCADE;
+ALTER TABLE segment_hierarchy
+    ADD FOREIGN KEY (tenant_id, parent_slug) REFERENCES segments(tenant_id, slug) ON DELETE CASCADE,
+    ADD FOREIGN KEY (tenant_id, child_slug) REFERENCES segments(tenant_id, slug) ON DELETE CASCADE;
+ALTER TABLE segment_prerequisites
+    ADD FOREIGN KEY (tenant_id, segment_slug) REFERENCES segments(tenant_id, slug) ON DELETE CASCADE,
+    ADD FOREIGN KEY (tenant_id, prerequisite_slug) REFERENCES segments(tenant_id, slug) ON DELETE CASCADE;
+ALTER TABLE user_aliases ADD FOREIGN KEY (tenant_id, user_id) REFERENCES users(tenant_id, user_id) ON DELETE CASCADE;
+
+DROP INDEX user_aliases_user_id_idx;
+CREATE INDEX user_aliases_user_id_idx ON user_aliases (tenant_id, user_id);
+
+CREATE OR REPLACE FUNCTION bump_user_version() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        UPDATE users SET version = version + 1 WHERE tenant_id = NEW.tenant_id AND user_id = NEW.user_id;
+    END IF;
+    IF TG_OP = 'DELETE' OR (TG_OP = 'UPDATE' AND OLD.user_id <> NEW.user_id) THEN
+        UPDATE users SET version = version + 1 WHERE tenant_id = OLD.tenant_id AND user_id = OLD.user_id;
+    END IF;
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,3 @@
+alter table api_keys
+    drop column if exists rate_limit,
+    drop column if exists rate_burst;
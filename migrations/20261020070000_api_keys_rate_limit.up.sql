@@ -0,0 +1,4 @@
+-- keys without their own limit use the limit of their scopes or the default one
+ALTER TABLE api_keys
+    ADD COLUMN rate_limit INT check (rate_limit > 0),
+    ADD COLUMN rate_burst INT check (rate_burst > 0);
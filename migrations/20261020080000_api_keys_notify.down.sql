@@ -0,0 +1,2 @@
+drop trigger if exists api_keys_notify_changed on api_keys;
+drop function if exists notify_api_key_changed();
@@ -0,0 +1,12 @@
+-- servers drop cached verification results of a key when its access changes
+CREATE FUNCTION notify_api_key_changed() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('api_keys_changed', OLD.id::text);
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER api_keys_notify_changed
+    AFTER UPDATE OF tenant_id, scopes, read_namespaces, write_namespaces, expires_at, revoked_at, rate_limit, rate_burst
+        OR DELETE ON api_keys
+    FOR EACH ROW EXECUTE FUNCTION notify_api_key_changed();
@@ -0,0 +1,45 @@
+CREATE TABLE webhooks (
+    webhook_id SERIAL PRIMARY KEY,
+    tenant_id INT not null default NULLIF(current_setting('app.tenant_id', true), '')::int REFERENCES tenants(tenant_id),
+    url VARCHAR(2048) not null,
+    secret VARCHAR(255) not null,
+    -- empty lists subscribe to every segment and every event
+    segments TEXT[] not null default '{}',
+    events TEXT[] not null default '{}',
+    created_at TIMESTAMP not null default now()
+);
+
+-- deliveries are written together with the history records they are made of and are kept as the delivery log
+CREATE TABLE webhook_deliveries (
+    delivery_id BIGSERIAL PRIMARY KEY,
+    tenant_id INT not null default NULLIF(current_setting('app.tenant_id', true), '')::int REFERENCES tenants(tenant_id),
+    webhook_id INT not null REFERENCES webhooks(webhook_id) ON DELETE CASCADE,
+    event VARCHAR(15) not null,
+    user_id VARCHAR(40) not null,
+    segment_slug VARCHAR not null,
+    created_at TIMESTAMP not null,
+    status VARCHAR(15) not null default 'pending',
+    attempts INT not null default 0,
+    next_attempt_at TIMESTAMP not null default now(),
+    last_attempt_at TIMESTAMP,
+    response_status INT,
+    last_error TEXT
+);
+
+CREATE INDEX webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX webhook_deliveries_webhook_idx ON webhook_deliveries (webhook_id, delivery_id);
+
+DO $$
+DECLARE
+    t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['webhooks', 'webhook_deliveries']
+    LOOP
+        EXECUTE format('ALTER TABLE %I ENABLE ROW LEVEL SECURITY', t);
+        EXECUTE format('ALTER TABLE %I FORCE ROW LEVEL SECURITY', t);
+        EXECUTE format('CREATE POLICY tenant_isolation ON %I '
+            'USING (tenant_id = NULLIF(current_setting(''app.tenant_id'', true), '''')::int) '
+            'WITH CHECK (tenant_id = NULLIF(current_setting(''app.tenant_id'', true), '''')::int)', t);
+    END LOOP;
+END
+$$;
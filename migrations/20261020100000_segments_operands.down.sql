@@ -0,0 +1,3 @@
+drop index if exists segments_operands_idx;
+alter table segments drop column if exists operands;
+drop function if exists segment_expression_operands(jsonb);
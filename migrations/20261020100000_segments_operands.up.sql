@@ -0,0 +1,12 @@
+-- segments used in the expression of a derived segment, users are checked only against derived segments
+-- that have one of their segments as an operand
+CREATE FUNCTION segment_expression_operands(expression JSONB) RETURNS VARCHAR[]
+    LANGUAGE SQL IMMUTABLE AS
+$$
+SELECT ARRAY(SELECT jsonb_path_query(expression, 'strict $.**.segment', '{}', true) #>> '{}')::VARCHAR[]
+$$;
+
+ALTER TABLE segments
+    ADD COLUMN operands VARCHAR[] GENERATED ALWAYS AS (segment_expression_operands(expression)) STORED;
+
+CREATE INDEX segments_operands_idx ON segments USING GIN (operands) WHERE expression IS NOT NULL;
@@ -0,0 +1 @@
+-- cleared prefixes of legacy keys cannot be restored
@@ -0,0 +1,2 @@
+-- the start of a key without the uss_ prefix is part of its secret and must not be stored in plain text
+UPDATE api_keys SET key_prefix = '' WHERE key_prefix NOT LIKE 'uss\_%';
@@ -0,0 +1,7 @@
+-- the role itself is kept, its login is created outside of migrations, see deploy/postgres
+ALTER DEFAULT PRIVILEGES IN SCHEMA public REVOKE ALL ON SEQUENCES FROM uss_app;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public REVOKE ALL ON TABLES FROM uss_app;
+
+REVOKE ALL ON ALL SEQUENCES IN SCHEMA public FROM uss_app;
+REVOKE ALL ON ALL TABLES IN SCHEMA public FROM uss_app;
+REVOKE USAGE ON SCHEMA public FROM uss_app;
@@ -0,0 +1,20 @@
+-- the service connects as uss_app: it neither owns the tables nor bypasses row-level security,
+-- so tenant_isolation policies apply to every query. Migrations keep running as the owner.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'uss_app') THEN
+        CREATE ROLE uss_app NOLOGIN;
+    END IF;
+END
+$$;
+
+ALTER ROLE uss_app NOSUPERUSER NOBYPASSRLS NOCREATEDB NOCREATEROLE;
+
+GRANT USAGE ON SCHEMA public TO uss_app;
+GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO uss_app;
+GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO uss_app;
+REVOKE ALL ON schema_migrations FROM uss_app;
+
+-- tables of later migrations are created by the owner and are available to the service as well
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO uss_app;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT USAGE, SELECT ON SEQUENCES TO uss_app;
@@ -0,0 +1,11 @@
+-- responses stored for JWT callers have no key to belong to
+DELETE FROM idempotency_keys WHERE principal NOT LIKE 'key:%';
+
+ALTER TABLE idempotency_keys ADD COLUMN key_id INT REFERENCES api_keys(id) ON DELETE CASCADE;
+UPDATE idempotency_keys SET key_id = substr(principal, 5)::int;
+
+ALTER TABLE idempotency_keys
+    DROP CONSTRAINT idempotency_keys_pkey,
+    DROP COLUMN tenant_id,
+    DROP COLUMN principal,
+    ADD PRIMARY KEY (key_id, idempotency_key);
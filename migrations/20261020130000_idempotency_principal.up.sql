@@ -0,0 +1,14 @@
+-- stored responses belong to the caller within its tenant: an API key or the subject of a JWT, see APIKey.Principal
+ALTER TABLE idempotency_keys
+    ADD COLUMN tenant_id INT REFERENCES tenants(tenant_id),
+    ADD COLUMN principal VARCHAR(255);
+
+UPDATE idempotency_keys i SET tenant_id = k.tenant_id, principal = 'key:' || i.key_id
+FROM api_keys k WHERE k.id = i.key_id;
+
+ALTER TABLE idempotency_keys
+    DROP CONSTRAINT idempotency_keys_pkey,
+    DROP COLUMN key_id,
+    ALTER COLUMN tenant_id SET NOT NULL,
+    ALTER COLUMN principal SET NOT NULL,
+    ADD PRIMARY KEY (tenant_id, principal, idempotency_key);
@@ -2,7 +2,9 @@ package csvwriter
 
 import (
 	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"reflect"
@@ -10,6 +12,8 @@ import (
 
 type CSVWriter interface {
 	CreateCSVFile(filename string, data interface{}) (string, error)
+	OpenCSVFile(filename string) (io.ReadCloser, error)
+	DeleteCSVFiles(dir string, match func(header, record []string) bool) (int, error)
 }
 
 type CsvWriter struct {
@@ -21,7 +25,11 @@ func NewCsvWriter(basicPath string) *CsvWriter {
 }
 
 func (w *CsvWriter) CreateCSVFile(filename string, data interface{}) (string, error) {
-	file, err := os.Create(path.Join(w.basicPath, filename))
+	filePath := path.Join(w.basicPath, filename)
+	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		return "", err
+	}
+	file, err := os.Create(filePath)
 	if err != nil {
 		return "", err
 	}
@@ -51,6 +59,70 @@ func (w *CsvWriter) CreateCSVFile(filename string, data interface{}) (string, er
 	return filename, nil
 }
 
+// OpenCSVFile opens a file created by CreateCSVFile, the error wraps os.ErrNotExist for a missing file
+func (w *CsvWriter) OpenCSVFile(filename string) (io.ReadCloser, error) {
+	return os.Open(path.Join(w.basicPath, path.Clean("/"+filename)))
+}
+
+// DeleteCSVFiles removes files of the directory with a record accepted by match and returns their number.
+// A file that cannot be read as CSV, e.g. one being written, is removed as well, since it may hold such a record.
+func (w *CsvWriter) DeleteCSVFiles(dir string, match func(header, record []string) bool) (int, error) {
+	dirPath := path.Join(w.basicPath, path.Clean("/"+dir))
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	deleted := 0
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".csv" {
+			continue
+		}
+		filePath := path.Join(dirPath, entry.Name())
+		matched, err := w.fileMatches(filePath, match)
+		if err != nil {
+			return deleted, err
+		}
+		if !matched {
+			continue
+		}
+		if err = os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (w *CsvWriter) fileMatches(filePath string, match func(header, record []string) bool) (bool, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		return !errors.Is(err, io.EOF), nil
+	}
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			return !errors.Is(err, io.EOF), nil
+		}
+		if match(header, record) {
+			return true, nil
+		}
+	}
+}
+
 func (w *CsvWriter) getHeaders(data interface{}) []string {
 	var headers []string
 	value := reflect.ValueOf(data)
@@ -0,0 +1,74 @@
+package csvwriter
+
+import (
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type row struct {
+	UserID  string
+	Segment string
+}
+
+func TestDeleteCSVFiles(t *testing.T) {
+	dir := t.TempDir()
+	w := NewCsvWriter(dir)
+
+	files := map[string][]row{
+		"1/first.csv":  {{UserID: "1000", Segment: "A"}, {UserID: "1000", Segment: "B"}},
+		"1/second.csv": {{UserID: "2000", Segment: "1000"}},
+		"1/merged.csv": {{UserID: "2000", Segment: "A"}, {UserID: "1000", Segment: "A"}},
+		"2/other.csv":  {{UserID: "1000", Segment: "A"}},
+	}
+	for name, rows := range files {
+		if _, err := w.CreateCSVFile(name, rows); err != nil {
+			t.Fatalf("CreateCSVFile(%s): %v", name, err)
+		}
+	}
+	if err := os.WriteFile(path.Join(dir, "1", "broken.csv"), []byte("UserID,Segment\n\"2000"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if err := os.WriteFile(path.Join(dir, "1", "notes.txt"), []byte("UserID\n1000\n"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+
+	userID := func(header, record []string) bool {
+		for i, column := range header {
+			if column == "UserID" && record[i] == "1000" {
+				return true
+			}
+		}
+		return false
+	}
+	deleted, err := w.DeleteCSVFiles("1", userID)
+	if err != nil {
+		t.Fatalf("DeleteCSVFiles() error = %v", err)
+	}
+	if deleted != 3 {
+		t.Errorf("DeleteCSVFiles() = %d, want 3", deleted)
+	}
+
+	entries, _ := os.ReadDir(path.Join(dir, "1"))
+	left := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	sort.Strings(left)
+	if !reflect.DeepEqual(left, []string{"notes.txt", "second.csv"}) {
+		t.Errorf("files left = %v, want [notes.txt second.csv]", left)
+	}
+	if _, err = os.Stat(path.Join(dir, "2", "other.csv")); err != nil {
+		t.Errorf("a file of another directory was removed: %v", err)
+	}
+
+	if deleted, err = w.DeleteCSVFiles("3", userID); deleted != 0 || err != nil {
+		t.Errorf("DeleteCSVFiles(missing) = %d, %v, want 0, nil", deleted, err)
+	}
+	if _, err = w.OpenCSVFile("1/first.csv"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("OpenCSVFile(deleted) error = %v, want %v", err, os.ErrNotExist)
+	}
+}
@@ -0,0 +1,270 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// refreshInterval limits how often an unknown kid triggers a reload of the key set
+	refreshInterval = time.Minute
+	// maxAge of a key set loaded from a URL, keys rotated by the identity provider are picked up after it
+	maxAge        = time.Hour
+	fetchTimeout  = 10 * time.Second
+	maxJWKSLength = 1 << 20
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// JWK is a public key of a JSON Web Key Set, RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type publicKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// KeySet holds the keys of a JWKS file or URL. The set is reloaded when a token refers to an unknown kid
+// and, for a URL, when it gets older than maxAge.
+// Lookups read a snapshot of the keys and never wait for a reload of a stale set, only one reload runs at a time.
+type KeySet struct {
+	source string
+	client *http.Client
+
+	current atomic.Pointer[keySnapshot]
+
+	mu          sync.Mutex
+	attemptedAt time.Time
+	// refreshing is closed when the running reload finishes, it is nil when no reload runs
+	refreshing chan struct{}
+}
+
+type keySnapshot struct {
+	keys     map[string]publicKey
+	loadedAt time.Time
+}
+
+// NewKeySet loads the keys from an http(s) URL or a file path
+func NewKeySet(source string) (*KeySet, error) {
+	s := &KeySet{source: source, client: &http.Client{Timeout: fetchTimeout}, attemptedAt: time.Now()}
+	snapshot, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.current.Store(snapshot)
+	return s, nil
+}
+
+// Key returns the key with the kid. A key set with a single key matches tokens without a kid.
+// A stale set keeps serving its keys while it is reloaded in the background, an unknown kid waits for the reload.
+func (s *KeySet) Key(kid string) (crypto.PublicKey, string, error) {
+	key, ok := s.current.Load().lookup(kid)
+	if !ok {
+		s.refresh(true)
+		key, ok = s.current.Load().lookup(kid)
+	} else if s.isURL() && time.Since(s.current.Load().loadedAt) > maxAge {
+		s.refresh(false)
+	}
+	if !ok {
+		return nil, "", ErrUnknownKey
+	}
+	return key.key, key.alg, nil
+}
+
+// refresh reloads the set unless it was attempted within refreshInterval. A caller that waits for the result
+// joins the reload in progress instead of starting another one. The old keys keep working when the source is unavailable.
+func (s *KeySet) refresh(wait bool) {
+	s.mu.Lock()
+	if done := s.refreshing; done != nil {
+		s.mu.Unlock()
+		if wait {
+			<-done
+		}
+		return
+	}
+	if time.Since(s.attemptedAt) <= refreshInterval {
+		s.mu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	s.refreshing, s.attemptedAt = done, time.Now()
+	s.mu.Unlock()
+
+	reload := func() {
+		if snapshot, err := s.load(); err == nil {
+			s.current.Store(snapshot)
+		}
+		s.mu.Lock()
+		s.refreshing = nil
+		s.mu.Unlock()
+		close(done)
+	}
+	if wait {
+		reload()
+	} else {
+		go reload()
+	}
+}
+
+func (k *keySnapshot) lookup(kid string) (publicKey, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+func (s *KeySet) isURL() bool {
+	return strings.HasPrefix(s.source, "http://") || strings.HasPrefix(s.source, "https://")
+}
+
+func (s *KeySet) load() (*keySnapshot, error) {
+	raw, err := s.read()
+	if err != nil {
+		return nil, fmt.Errorf("jwtauth - KeySet.load - s.read: %w", err)
+	}
+	var set JWKS
+	if err = json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("jwtauth - KeySet.load - json.Unmarshal: %w", err)
+	}
+
+	keys := make(map[string]publicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		// encryption keys and unsupported key types are skipped
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = publicKey{alg: jwk.Alg, key: key}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("jwtauth - KeySet.load: no signing keys in %s", s.source)
+	}
+	return &keySnapshot{keys: keys, loadedAt: time.Now()}, nil
+}
+
+func (s *KeySet) read() ([]byte, error) {
+	if !s.isURL() {
+		return os.ReadFile(s.source)
+	}
+
+	resp, err := s.client.Get(s.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSLength))
+}
+
+// PublicKey decodes the RSA, EC or Ed25519 public key
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(),
+			"P-384": elliptic.P384(),
+			"P-521": elliptic.P521(),
+		}[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// NewJWK encodes the public key, it is used to publish a locally generated key pair
+func NewJWK(key crypto.PublicKey, kid string) (JWK, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", Kid: kid, Use: "sig", N: encode(key.N.Bytes()), E: encode(big.NewInt(int64(key.E)).Bytes())}, nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return JWK{Kty: "EC", Kid: kid, Use: "sig", Crv: key.Curve.Params().Name,
+			X: encode(key.X.FillBytes(make([]byte, size))), Y: encode(key.Y.FillBytes(make([]byte, size)))}, nil
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Kid: kid, Use: "sig", Crv: "Ed25519", X: encode(key)}, nil
+	}
+	return JWK{}, fmt.Errorf("unsupported key type %T", key)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(raw) == 0 {
+		return nil, errors.New("invalid base64url integer")
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
@@ -0,0 +1,136 @@
+package jwtauth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwksServer serves Ed25519 keys under the kids, requests wait until gate is closed when it is set
+type jwksServer struct {
+	*httptest.Server
+	requests atomic.Int32
+
+	mu   sync.Mutex
+	kids []string
+	gate chan struct{}
+}
+
+func newJWKSServer(t *testing.T, kids ...string) *jwksServer {
+	t.Helper()
+	s := &jwksServer{kids: kids}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		s.mu.Lock()
+		gate, kids := s.gate, s.kids
+		s.mu.Unlock()
+		if gate != nil {
+			<-gate
+		}
+
+		var set JWKS
+		for _, kid := range kids {
+			public, _, _ := ed25519.GenerateKey(rand.Reader)
+			jwk, _ := NewJWK(public, kid)
+			set.Keys = append(set.Keys, jwk)
+		}
+		_ = json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// hold makes the following requests wait and serve the kids, the returned function lets them through
+func (s *jwksServer) hold(kids ...string) func() {
+	gate := make(chan struct{})
+	s.mu.Lock()
+	s.gate, s.kids = gate, kids
+	s.mu.Unlock()
+	return func() { close(gate) }
+}
+
+// expire makes the set stale and allows a reload
+func expire(s *KeySet) {
+	snapshot := *s.current.Load()
+	snapshot.loadedAt = time.Now().Add(-2 * maxAge)
+	s.current.Store(&snapshot)
+	s.mu.Lock()
+	s.attemptedAt = time.Time{}
+	s.mu.Unlock()
+}
+
+func TestKeySetServesStaleKeysDuringReload(t *testing.T) {
+	server := newJWKSServer(t, "old")
+	keys, err := NewKeySet(server.URL)
+	if err != nil {
+		t.Fatalf("NewKeySet: %v", err)
+	}
+	expire(keys)
+	release := server.hold("old", "new")
+
+	// the reload is blocked, lookups of known keys still return at once
+	for i := 0; i < 3; i++ {
+		if _, _, err = keys.Key("old"); err != nil {
+			t.Fatalf("Key(old) during reload error = %v", err)
+		}
+	}
+	release()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Since(keys.current.Load().loadedAt) > maxAge {
+		if time.Now().After(deadline) {
+			t.Fatal("the stale set was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, _, err = keys.Key("new"); err != nil {
+		t.Errorf("Key(new) after reload error = %v", err)
+	}
+	if got := server.requests.Load(); got != 2 {
+		t.Errorf("requests = %d, want 2: the initial load and one reload", got)
+	}
+}
+
+func TestKeySetUnknownKidReloadsOnce(t *testing.T) {
+	server := newJWKSServer(t, "old")
+	keys, err := NewKeySet(server.URL)
+	if err != nil {
+		t.Fatalf("NewKeySet: %v", err)
+	}
+
+	// a reload was attempted less than refreshInterval ago
+	if _, _, err = keys.Key("new"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Key(new) right after loading error = %v, want %v", err, ErrUnknownKey)
+	}
+
+	expire(keys)
+	release := server.hold("old", "new")
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, _, err := keys.Key("new")
+			errs <- err
+		}()
+	}
+	// callers of the unknown kid wait for the reload, a known key does not
+	if _, _, err = keys.Key("old"); err != nil {
+		t.Errorf("Key(old) during reload error = %v", err)
+	}
+	release()
+
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Key(new) error = %v", err)
+		}
+	}
+	if got := server.requests.Load(); got != 2 {
+		t.Errorf("requests = %d, want 2: the initial load and one reload", got)
+	}
+}
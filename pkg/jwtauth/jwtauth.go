@@ -0,0 +1,111 @@
+package jwtauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken    = errors.New("invalid token")
+	ErrInvalidIssuer   = errors.New("invalid token issuer")
+	ErrInvalidAudience = errors.New("invalid token audience")
+	ErrTokenExpired    = errors.New("token has expired")
+	ErrTokenNotYet     = errors.New("token is not valid yet")
+)
+
+// signingMethods are the asymmetric algorithms accepted from the identity provider,
+// "none" and HMAC are never accepted since the keys are public
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+type Verifier interface {
+	// Verify checks the signature, issuer, audience and lifetime of the token and returns its claims
+	Verify(token string) (map[string]interface{}, error)
+}
+
+type JWTVerifier struct {
+	keys   *KeySet
+	parser *jwt.Parser
+}
+
+// NewVerifier loads the keys from a JWKS file or URL, tokens must carry the issuer and the audience
+func NewVerifier(jwks, issuer, audience string, clockSkew time.Duration) (*JWTVerifier, error) {
+	if issuer == "" || audience == "" {
+		return nil, errors.New("jwtauth - NewVerifier: issuer and audience are required")
+	}
+	keys, err := NewKeySet(jwks)
+	if err != nil {
+		return nil, err
+	}
+	return &JWTVerifier{
+		keys: keys,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods(signingMethods),
+			jwt.WithJSONNumber(),
+			jwt.WithIssuer(issuer),
+			jwt.WithAudience(audience),
+			jwt.WithExpirationRequired(),
+			jwt.WithIssuedAt(),
+			jwt.WithLeeway(clockSkew),
+		),
+	}, nil
+}
+
+func (v *JWTVerifier) Verify(token string) (map[string]interface{}, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, v.keyFunc)
+	// claims are validated after the signature, a token may fail several checks at once
+	switch {
+	case err == nil:
+		return claims, nil
+	case errors.Is(err, ErrUnknownKey):
+		return nil, ErrUnknownKey
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return nil, ErrTokenExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return nil, ErrTokenNotYet
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return nil, ErrInvalidIssuer
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return nil, ErrInvalidAudience
+	}
+	return nil, ErrInvalidToken
+}
+
+// keyFunc returns the key of the token kid if its type matches the algorithm of the token
+func (v *JWTVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, keyAlg, err := v.keys.Key(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	alg := token.Method.Alg()
+	if keyAlg != "" && keyAlg != alg {
+		return nil, fmt.Errorf("key %s is for %s, not %s", kid, keyAlg, alg)
+	}
+
+	var ok bool
+	switch {
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		_, ok = key.(*rsa.PublicKey)
+	case strings.HasPrefix(alg, "ES"):
+		_, ok = key.(*ecdsa.PublicKey)
+	case alg == "EdDSA":
+		_, ok = key.(ed25519.PublicKey)
+	}
+	if !ok {
+		return nil, fmt.Errorf("key %s does not match %s", kid, alg)
+	}
+	return key, nil
+}
+
+// IsJWT reports whether the bearer token looks like a compact JWS rather than an API key
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
@@ -0,0 +1,177 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer    = "https://id.example.com"
+	testAudience  = "user-segmentation-service"
+	testClockSkew = time.Minute
+)
+
+type testKeys struct {
+	rsa     *rsa.PrivateKey
+	ec      *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}
+
+// newTestVerifier writes a JWKS file with the public keys under the kids "rsa", "ec" and "ed25519"
+func newTestVerifier(t *testing.T) (*JWTVerifier, testKeys) {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %v", err)
+	}
+
+	var set JWKS
+	for kid, key := range map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey, "ed25519": edKey.Public()} {
+		jwk, err := NewJWK(key, kid)
+		if err != nil {
+			t.Fatalf("NewJWK(%s): %v", kid, err)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	raw, _ := json.Marshal(set)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err = os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+
+	verifier, err := NewVerifier(path, testIssuer, testAudience, testClockSkew)
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	return verifier, testKeys{rsa: rsaKey, ec: ecKey, ed25519: edKey}
+}
+
+func validClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss": testIssuer,
+		"aud": testAudience,
+		"sub": "payments-backend",
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString(%s): %v", method.Alg(), err)
+	}
+	return signed
+}
+
+func TestVerify(t *testing.T) {
+	verifier, keys := newTestVerifier(t)
+	now := time.Now()
+
+	with := func(claim string, value interface{}) jwt.MapClaims {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, claim)
+		} else {
+			claims[claim] = value
+		}
+		return claims
+	}
+
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKIXPublicKey: %v", err)
+	}
+	noneToken := sign(t, jwt.SigningMethodNone, "rsa", jwt.UnsafeAllowNoneSignatureType, validClaims())
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"RS256", sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, validClaims()), nil},
+		{"PS384", sign(t, jwt.SigningMethodPS384, "rsa", keys.rsa, validClaims()), nil},
+		{"ES256", sign(t, jwt.SigningMethodES256, "ec", keys.ec, validClaims()), nil},
+		{"EdDSA", sign(t, jwt.SigningMethodEdDSA, "ed25519", keys.ed25519, validClaims()), nil},
+		{"audience in a list", sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, with("aud", []string{"other", testAudience})), nil},
+		{"wrong issuer", sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, with("iss", "https://evil.example.com")), ErrInvalidIssuer},
+		{"no issuer", sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, with("iss", nil)), ErrInvalidToken},
+		{"wrong audience", sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, with("aud", "other")), ErrInvalidAudience},
+		{"no audience", sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, with("aud", nil)), ErrInvalidToken},
+		{"no exp", sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, with("exp", nil)), ErrInvalidToken},
+		{"expired within skew", sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, with("exp", now.Add(-testClockSkew/2).Unix())), nil},
+		{"expired beyond skew", sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, with("exp", now.Add(-2*testClockSkew).Unix())), ErrTokenExpired},
+		{"nbf within skew", sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, with("nbf", now.Add(testClockSkew/2).Unix())), nil},
+		{"nbf beyond skew", sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, with("nbf", now.Add(2*testClockSkew).Unix())), ErrTokenNotYet},
+		{"iat beyond skew", sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, with("iat", now.Add(2*testClockSkew).Unix())), ErrTokenNotYet},
+		{"unknown kid", sign(t, jwt.SigningMethodRS256, "rotated", keys.rsa, validClaims()), ErrUnknownKey},
+		{"no kid with several keys", sign(t, jwt.SigningMethodRS256, "", keys.rsa, validClaims()), ErrUnknownKey},
+		{"key of another type", sign(t, jwt.SigningMethodRS256, "ec", keys.rsa, validClaims()), ErrInvalidToken},
+		{"signed by another key", sign(t, jwt.SigningMethodES256, "ec", mustECKey(t), validClaims()), ErrInvalidToken},
+		{"alg none", noneToken, ErrInvalidToken},
+		{"HS256 with the public key", sign(t, jwt.SigningMethodHS256, "rsa", rsaPublic, validClaims()), ErrInvalidToken},
+		{"not a token", "a.b.c", ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifier.Verify(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && claims["sub"] != "payments-backend" {
+				t.Errorf("Verify() claims = %v, want the claims of the token", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyNumbers(t *testing.T) {
+	verifier, keys := newTestVerifier(t)
+	claims := validClaims()
+	claims["tenant"] = 2
+
+	got, err := verifier.Verify(sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, claims))
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if got["tenant"] != json.Number("2") {
+		t.Errorf("tenant claim = %#v, want json.Number", got["tenant"])
+	}
+}
+
+func mustECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	return key
+}
@@ -58,10 +58,13 @@ func New(url string, opts ...Option) (*Postgres, error) {
 	}
 
 	poolConfig.MaxConns = int32(pg.maxPoolSize)
+	poolConfig.BeforeAcquire = setTenant
 
 	for pg.connAttempts > 0 {
-		pg.Pool, err = pgxpool.NewWithConfig(context.Background(), poolConfig)
+		var pool *pgxpool.Pool
+		pool, err = pgxpool.NewWithConfig(context.Background(), poolConfig)
 		if err == nil {
+			pg.Pool = &txPool{pool}
 			break
 		}
 
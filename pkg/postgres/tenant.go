@@ -0,0 +1,32 @@
+package postgres
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"strconv"
+)
+
+type tenantKey struct{}
+
+// WithTenant returns a context whose queries run on behalf of the tenant.
+// The tenant is written to the app.tenant_id setting of the connection, which row-level security policies compare with.
+func WithTenant(ctx context.Context, tenantID int) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+// TenantFromContext returns the tenant set with WithTenant
+func TenantFromContext(ctx context.Context) (int, bool) {
+	tenantID, ok := ctx.Value(tenantKey{}).(int)
+	return tenantID, ok
+}
+
+// setTenant runs before a connection is acquired from the pool. A context without a tenant clears the setting,
+// so a connection never keeps the tenant of its previous user and row-level security hides every row.
+func setTenant(ctx context.Context, conn *pgx.Conn) bool {
+	tenant := ""
+	if tenantID, ok := TenantFromContext(ctx); ok {
+		tenant = strconv.Itoa(tenantID)
+	}
+	_, err := conn.Exec(ctx, "SELECT set_config('app.tenant_id', $1, false)", tenant)
+	return err == nil
+}
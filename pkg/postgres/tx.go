@@ -0,0 +1,102 @@
+package postgres
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type txKey struct{}
+
+// WithTx returns a context whose queries through Postgres.Pool run inside tx.
+// Transactions begun with such a context become savepoints of tx.
+func WithTx(ctx context.Context, tx pgx.Tx) context.Context {
+	return context.WithValue(ctx, txKey{}, tx)
+}
+
+func txFromContext(ctx context.Context) (pgx.Tx, bool) {
+	tx, ok := ctx.Value(txKey{}).(pgx.Tx)
+	return tx, ok
+}
+
+// txPool sends queries to the transaction carried by the context, if any, and to the pool otherwise
+type txPool struct {
+	PgxPool
+}
+
+func (p *txPool) Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error) {
+	if tx, ok := txFromContext(ctx); ok {
+		return tx.Exec(ctx, sql, arguments...)
+	}
+	return p.PgxPool.Exec(ctx, sql, arguments...)
+}
+
+func (p *txPool) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	if tx, ok := txFromContext(ctx); ok {
+		return tx.Query(ctx, sql, args...)
+	}
+	return p.PgxPool.Query(ctx, sql, args...)
+}
+
+func (p *txPool) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	if tx, ok := txFromContext(ctx); ok {
+		return tx.QueryRow(ctx, sql, args...)
+	}
+	return p.PgxPool.QueryRow(ctx, sql, args...)
+}
+
+func (p *txPool) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	if tx, ok := txFromContext(ctx); ok {
+		return tx.SendBatch(ctx, b)
+	}
+	return p.PgxPool.SendBatch(ctx, b)
+}
+
+func (p *txPool) Begin(ctx context.Context) (pgx.Tx, error) {
+	if tx, ok := txFromContext(ctx); ok {
+		return tx.Begin(ctx)
+	}
+	return p.PgxPool.Begin(ctx)
+}
+
+// BeginTx ignores txOptions inside a transaction, a savepoint inherits the options of its transaction
+func (p *txPool) BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error) {
+	if tx, ok := txFromContext(ctx); ok {
+		return tx.Begin(ctx)
+	}
+	return p.PgxPool.BeginTx(ctx, txOptions)
+}
+
+func (p *txPool) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error) {
+	if tx, ok := txFromContext(ctx); ok {
+		return tx.CopyFrom(ctx, tableName, columnNames, rowSrc)
+	}
+	return p.PgxPool.CopyFrom(ctx, tableName, columnNames, rowSrc)
+}
+
+// RollbackAfter runs fn inside a transaction that is always rolled back, so fn sees its own changes
+// while nothing is persisted
+func (p *Postgres) RollbackAfter(ctx context.Context, fn func(ctx context.Context) error) error {
+	tx, err := p.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	return fn(WithTx(ctx, tx))
+}
+
+// WithinTransaction runs fn inside a transaction that is committed when fn succeeds and rolled back otherwise.
+// Inside another transaction it becomes a savepoint.
+func (p *Postgres) WithinTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	tx, err := p.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if err = fn(WithTx(ctx, tx)); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
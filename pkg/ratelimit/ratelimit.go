@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the memory limiter forgets buckets that have refilled completely
+const sweepInterval = time.Minute
+
+// Limit is a token bucket: Burst requests at once, refilled at Rate requests per minute
+type Limit struct {
+	Rate  int
+	Burst int
+}
+
+// Result describes the bucket after the request, Remaining and Reset are used for the RateLimit headers
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, it is set for rejected requests
+	RetryAfter time.Duration
+}
+
+// Limiter takes a token from the bucket of the key. Implementations with a shared backend let
+// several instances of the service count requests together.
+type Limiter interface {
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+type bucket struct {
+	tokens    float64
+	updated   time.Time
+	perSecond float64
+	capacity  float64
+}
+
+// full reports whether the bucket has refilled completely by now
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.updated).Seconds()*b.perSecond >= b.capacity
+}
+
+// MemoryLimiter keeps buckets in the memory of one instance
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{buckets: make(map[string]*bucket), lastSweep: time.Now(), now: time.Now}
+}
+
+func (l *MemoryLimiter) Allow(_ context.Context, key string, limit Limit) (Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	perSecond := float64(limit.Rate) / 60
+	capacity := float64(limit.Burst)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		l.buckets[key] = b
+	}
+	// the limit of a key may change between requests, the bucket never holds more than the current burst
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated, b.perSecond, b.capacity = now, perSecond, capacity
+
+	result := Result{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsDuration((1 - b.tokens) / perSecond)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = secondsDuration((capacity - b.tokens) / perSecond)
+	return result, nil
+}
+
+// sweep removes buckets that would be full by now, they are recreated full on the next request
+func (l *MemoryLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	if math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return 0
+	}
+	return time.Duration(math.Ceil(seconds)) * time.Second
+}
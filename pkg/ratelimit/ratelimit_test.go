@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newTestLimiter returns a limiter whose clock moves only when advance is called
+func newTestLimiter() (*MemoryLimiter, func(time.Duration)) {
+	now := time.Date(2026, 10, 20, 12, 0, 0, 0, time.UTC)
+	l := NewMemoryLimiter()
+	l.lastSweep = now
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+type step struct {
+	advance time.Duration
+	key     string
+	limit   Limit
+	want    Result
+}
+
+func TestMemoryLimiterAllow(t *testing.T) {
+	perSecond := Limit{Rate: 60, Burst: 3}
+	slow := Limit{Rate: 6, Burst: 1}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "burst then refill",
+			steps: []step{
+				{limit: perSecond, want: Result{Allowed: true, Limit: 3, Remaining: 2, Reset: time.Second}},
+				{limit: perSecond, want: Result{Allowed: true, Limit: 3, Remaining: 1, Reset: 2 * time.Second}},
+				{limit: perSecond, want: Result{Allowed: true, Limit: 3, Remaining: 0, Reset: 3 * time.Second}},
+				{limit: perSecond, want: Result{Limit: 3, Reset: 3 * time.Second, RetryAfter: time.Second}},
+				{advance: 500 * time.Millisecond, limit: perSecond,
+					want: Result{Limit: 3, Reset: 3 * time.Second, RetryAfter: time.Second}},
+				{advance: 500 * time.Millisecond, limit: perSecond,
+					want: Result{Allowed: true, Limit: 3, Remaining: 0, Reset: 3 * time.Second}},
+				{advance: time.Hour, limit: perSecond, want: Result{Allowed: true, Limit: 3, Remaining: 2, Reset: time.Second}},
+			},
+		},
+		{
+			name: "retry after counts the missing part of a token",
+			steps: []step{
+				{limit: slow, want: Result{Allowed: true, Limit: 1, Remaining: 0, Reset: 10 * time.Second}},
+				{limit: slow, want: Result{Limit: 1, Reset: 10 * time.Second, RetryAfter: 10 * time.Second}},
+				{advance: 4 * time.Second, limit: slow, want: Result{Limit: 1, Reset: 6 * time.Second, RetryAfter: 6 * time.Second}},
+				{advance: 5500 * time.Millisecond, limit: slow,
+					want: Result{Limit: 1, Reset: time.Second, RetryAfter: time.Second}},
+				{advance: 500 * time.Millisecond, limit: slow, want: Result{Allowed: true, Limit: 1, Remaining: 0, Reset: 10 * time.Second}},
+			},
+		},
+		{
+			name: "keys have separate buckets",
+			steps: []step{
+				{key: "a", limit: slow, want: Result{Allowed: true, Limit: 1, Remaining: 0, Reset: 10 * time.Second}},
+				{key: "b", limit: slow, want: Result{Allowed: true, Limit: 1, Remaining: 0, Reset: 10 * time.Second}},
+				{key: "a", limit: slow, want: Result{Limit: 1, Reset: 10 * time.Second, RetryAfter: 10 * time.Second}},
+			},
+		},
+		{
+			name: "lowered burst caps the bucket",
+			steps: []step{
+				{limit: perSecond, want: Result{Allowed: true, Limit: 3, Remaining: 2, Reset: time.Second}},
+				{limit: Limit{Rate: 60, Burst: 1}, want: Result{Allowed: true, Limit: 1, Remaining: 0, Reset: time.Second}},
+				{limit: Limit{Rate: 60, Burst: 1}, want: Result{Limit: 1, Reset: time.Second, RetryAfter: time.Second}},
+			},
+		},
+		{
+			name: "zero rate never refills",
+			steps: []step{
+				{limit: Limit{Rate: 0, Burst: 1}, want: Result{Allowed: true, Limit: 1, Remaining: 0}},
+				{advance: time.Hour, limit: Limit{Rate: 0, Burst: 1}, want: Result{Limit: 1}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, advance := newTestLimiter()
+			for i, s := range tt.steps {
+				advance(s.advance)
+				got, err := l.Allow(context.Background(), "key"+s.key, s.limit)
+				if err != nil {
+					t.Fatalf("step %d: Allow() error = %v", i, err)
+				}
+				if got != s.want {
+					t.Fatalf("step %d: Allow() = %+v, want %+v", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryLimiterSweep(t *testing.T) {
+	l, advance := newTestLimiter()
+	ctx := context.Background()
+
+	_, _ = l.Allow(ctx, "refilled", Limit{Rate: 60, Burst: 1})
+	_, _ = l.Allow(ctx, "empty", Limit{Rate: 0, Burst: 1})
+
+	advance(sweepInterval)
+	_, _ = l.Allow(ctx, "new", Limit{Rate: 60, Burst: 1})
+
+	if _, ok := l.buckets["refilled"]; ok {
+		t.Errorf("a full bucket was kept after the sweep")
+	}
+	if _, ok := l.buckets["empty"]; !ok {
+		t.Errorf("a bucket that is not full was swept")
+	}
+
+	got, _ := l.Allow(ctx, "empty", Limit{Rate: 0, Burst: 1})
+	if got.Allowed {
+		t.Errorf("the swept limiter reset a bucket that is not full: %+v", got)
+	}
+}
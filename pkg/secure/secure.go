@@ -1,33 +1,91 @@
 package secure
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
 )
 
+// Versions of the key hashing algorithm stored with every key
+const (
+	// VersionSHA1 is the legacy sha1 digest of the key with the salt prepended to the output
+	VersionSHA1 = 1
+	// VersionHMACSHA256 is HMAC-SHA256 of the key with the server secret
+	VersionHMACSHA256 = 2
+)
+
+// KeyPrefix marks keys generated by the service, so a leaked key can be recognized
+const KeyPrefix = "uss_"
+
+// publicPartLength is the length of the start of a key that is stored in plain text to identify it
+const publicPartLength = len(KeyPrefix) + 8
+
+var ErrUnknownVersion = errors.New("unknown hash version")
+
 type APISecure interface {
+	// Hash returns the hash of the key with the current version
 	Hash(key string) string
+	// HashVersion returns the hash of the key with the given version
+	HashVersion(key string, version int) (string, error)
+	// Versions returns the supported versions, the current one first
+	Versions() []int
+	CurrentVersion() int
+	// PublicPart returns the start of the key that identifies it without revealing it
+	PublicPart(key string) string
 	GenerateKey() string
 }
 
-func NewSecure(salt string) *Secure {
-	return &Secure{salt: salt}
+func NewSecure(salt, secret string) *Secure {
+	return &Secure{salt: salt, secret: []byte(secret)}
 }
 
 type Secure struct {
-	salt string
+	salt   string
+	secret []byte
+}
+
+func (s *Secure) Hash(key string) string {
+	hash, _ := s.HashVersion(key, s.CurrentVersion())
+	return hash
+}
+
+func (s *Secure) HashVersion(key string, version int) (string, error) {
+	switch version {
+	case VersionSHA1:
+		hash := sha1.New()
+		hash.Write([]byte(key))
+		return fmt.Sprintf("%x", hash.Sum([]byte(s.salt))), nil
+	case VersionHMACSHA256:
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write([]byte(key))
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	}
+	return "", ErrUnknownVersion
+}
+
+func (s *Secure) Versions() []int {
+	return []int{VersionHMACSHA256, VersionSHA1}
+}
+
+func (s *Secure) CurrentVersion() int {
+	return VersionHMACSHA256
 }
 
-func (s *Secure) Hash(password string) string {
-	hash := sha1.New()
-	hash.Write([]byte(password))
-	return fmt.Sprintf("%x", hash.Sum([]byte(s.salt)))
+// PublicPart is empty for keys generated before the prefix existed, the start of such a key is part of its secret
+func (s *Secure) PublicPart(key string) string {
+	if len(key) <= publicPartLength || !strings.HasPrefix(key, KeyPrefix) {
+		return ""
+	}
+	return key[:publicPartLength]
 }
 
 func (s *Secure) GenerateKey() string {
 	keyBytes := make([]byte, 32)
 	_, _ = rand.Read(keyBytes)
-	return hex.EncodeToString(keyBytes)
+	return KeyPrefix + hex.EncodeToString(keyBytes)
 }
@@ -0,0 +1,68 @@
+package secure
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPublicPart(t *testing.T) {
+	s := NewSecure("salt", "0123456789abcdef0123456789abcdef")
+
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{"prefixed", "uss_0123456789abcdef", "uss_01234567"},
+		{"legacy", "0123456789abcdef0123456789abcdef", ""},
+		{"legacy starting with u", "us0123456789abcdef", ""},
+		{"too short", "uss_01234567", ""},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.PublicPart(tt.key); got != tt.want {
+				t.Errorf("PublicPart(%q) = %q, want %q", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	s := NewSecure("salt", "0123456789abcdef0123456789abcdef")
+
+	key := s.GenerateKey()
+	if !strings.HasPrefix(key, KeyPrefix) || len(key) != len(KeyPrefix)+64 {
+		t.Fatalf("GenerateKey() = %q, want %s and 64 hex characters", key, KeyPrefix)
+	}
+	if s.PublicPart(key) != key[:publicPartLength] {
+		t.Errorf("PublicPart() of a generated key = %q", s.PublicPart(key))
+	}
+	if other := s.GenerateKey(); other == key {
+		t.Errorf("GenerateKey() returned the same key twice")
+	}
+}
+
+func TestHashVersion(t *testing.T) {
+	s := NewSecure("salt", "0123456789abcdef0123456789abcdef")
+	other := NewSecure("salt", "fedcba9876543210fedcba9876543210")
+
+	current, err := s.HashVersion("uss_key", VersionHMACSHA256)
+	if err != nil || current != s.Hash("uss_key") {
+		t.Fatalf("HashVersion(current) = %q, %v, want Hash()", current, err)
+	}
+	if otherHash, _ := other.HashVersion("uss_key", VersionHMACSHA256); otherHash == current {
+		t.Errorf("HMAC does not depend on the secret")
+	}
+
+	// the legacy digest is sha1 of the key appended to the salt bytes, as stored by earlier versions
+	legacy, err := s.HashVersion("key", VersionSHA1)
+	if err != nil || legacy != "73616c74a62f2225bf70bfaccbc7f1ef2a397836717377de" {
+		t.Errorf("HashVersion(legacy) = %q, %v", legacy, err)
+	}
+
+	if _, err = s.HashVersion("key", 0); err != ErrUnknownVersion {
+		t.Errorf("HashVersion(0) error = %v, want %v", err, ErrUnknownVersion)
+	}
+}
@@ -0,0 +1,121 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Headers of a delivery. The receiver computes Sign of the raw body with the timestamp from TimestampHeader
+// and compares it with SignatureHeader, old timestamps should be rejected to prevent replays.
+const (
+	IDHeader        = "Webhook-Id"
+	TimestampHeader = "Webhook-Timestamp"
+	SignatureHeader = "Webhook-Signature"
+
+	signaturePrefix = "sha256="
+)
+
+// maxResponseBody is how much of the response is read, so the connection can be reused
+const maxResponseBody = 64 << 10
+
+var ErrForbiddenAddress = errors.New("webhook address is not public")
+
+// sharedAddressSpace is the carrier-grade NAT range, RFC 6598, it is not routed on the internet
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// Sender posts a JSON payload signed with the secret of the webhook and returns the response status
+type Sender interface {
+	Send(ctx context.Context, url, secret, id string, body []byte) (int, error)
+}
+
+type HTTPSender struct {
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewHTTPSender refuses to connect to private, loopback and link-local addresses, so a webhook cannot reach
+// the internal network of the service. Redirects are not followed, a 3xx response fails the attempt.
+func NewHTTPSender(timeout time.Duration) *HTTPSender {
+	return newHTTPSender(timeout, denyInternal)
+}
+
+func newHTTPSender(timeout time.Duration, control func(network, address string, c syscall.RawConn) error) *HTTPSender {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// the address is checked when connecting, a proxy would be checked instead of the webhook
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: timeout, Control: control}).DialContext
+
+	return &HTTPSender{
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		now: time.Now,
+	}
+}
+
+// denyInternal runs after the host name is resolved, so names resolving to internal addresses are refused as well
+func denyInternal(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, address)
+	}
+	if !publicAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, addrPort.Addr())
+	}
+	return nil
+}
+
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// Send fails for responses other than 2xx, the status is returned with the error when there was a response
+func (s *HTTPSender) Send(ctx context.Context, url, secret, id string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("webhook - HTTPSender.Send - http.NewRequest: %w", err)
+	}
+
+	timestamp := s.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IDHeader, id)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, signaturePrefix+Sign(secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("webhook - HTTPSender.Send - client.Do: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseBody))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook - HTTPSender.Send: unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" with the secret
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,142 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+// newTestServer replies with the status and records the requests, /redirect redirects to /
+func newTestServer(t *testing.T, status int) (*httptest.Server, *[]received) {
+	t.Helper()
+	requests := make([]received, 0, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, received{header: r.Header.Clone(), body: body})
+		w.WriteHeader(status)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestSend(t *testing.T) {
+	const secret = "0123456789abcdef"
+	body := []byte(`{"delivery_id":42,"event":"add"}`)
+	timestamp := time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		status     int
+		path       string
+		wantStatus int
+		wantErr    bool
+		wantSent   int
+	}{
+		{name: "delivered", status: http.StatusNoContent, path: "/", wantStatus: http.StatusNoContent, wantSent: 1},
+		{name: "server error", status: http.StatusInternalServerError, path: "/", wantStatus: http.StatusInternalServerError,
+			wantErr: true, wantSent: 1},
+		{name: "redirect is not followed", status: http.StatusOK, path: "/redirect", wantStatus: http.StatusFound,
+			wantErr: true, wantSent: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newTestServer(t, tt.status)
+			sender := newHTTPSender(time.Second, nil)
+			sender.now = func() time.Time { return timestamp }
+
+			status, err := sender.Send(context.Background(), server.URL+tt.path, secret, "42", body)
+
+			if status != tt.wantStatus || (err != nil) != tt.wantErr {
+				t.Fatalf("Send() = %d, %v, want %d, error %v", status, err, tt.wantStatus, tt.wantErr)
+			}
+			if len(*requests) != tt.wantSent {
+				t.Fatalf("requests = %d, want %d", len(*requests), tt.wantSent)
+			}
+			if tt.wantSent == 0 {
+				return
+			}
+
+			request := (*requests)[0]
+			if string(request.body) != string(body) {
+				t.Errorf("body = %s, want %s", request.body, body)
+			}
+			wantHeaders := map[string]string{
+				"Content-Type":  "application/json",
+				IDHeader:        "42",
+				TimestampHeader: strconv.FormatInt(timestamp.Unix(), 10),
+				SignatureHeader: "sha256=" + Sign(secret, timestamp.Unix(), body),
+			}
+			for header, want := range wantHeaders {
+				if got := request.header.Get(header); got != want {
+					t.Errorf("%s = %q, want %q", header, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSendRefusesInternalAddresses(t *testing.T) {
+	server, requests := newTestServer(t, http.StatusNoContent)
+
+	_, err := NewHTTPSender(time.Second).Send(context.Background(), server.URL, "secret", "1", []byte("{}"))
+
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("Send() error = %v, want %v", err, ErrForbiddenAddress)
+	}
+	if len(*requests) != 0 {
+		t.Fatalf("the request reached a loopback address")
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.216.34":        true,
+		"2606:2800:220:1::248": true,
+		"10.0.0.1":             false,
+		"172.16.5.4":           false,
+		"192.168.1.1":          false,
+		"100.64.0.1":           false,
+		"127.0.0.1":            false,
+		"::1":                  false,
+		"169.254.169.254":      false,
+		"fe80::1":              false,
+		"fd00::1":              false,
+		"0.0.0.0":              false,
+		"::":                   false,
+		"224.0.0.1":            false,
+		"255.255.255.255":      false,
+		"::ffff:127.0.0.1":     false,
+		"::ffff:10.0.0.1":      false,
+	}
+
+	for addr, want := range tests {
+		if got := publicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("publicAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '1760950800.{}' | openssl dgst -sha256 -hmac secret
+	const want = "dbc284bf4758c44406536eedefae41a42d3bf2003384b978c41b0b959bc756db"
+	if got := Sign("secret", 1760950800, []byte("{}")); got != want {
+		t.Fatalf("Sign() = %q, want %q", got, want)
+	}
+}